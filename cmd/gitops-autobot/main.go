@@ -3,12 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"time"
+	// schedule timezones are looked up in a scratch image, which has no zoneinfo
+	_ "time/tzdata"
 
 	"github.com/cresta/gitops-autobot/internal/changemaker/shellchangemaker"
 
@@ -16,22 +20,38 @@ import (
 	"github.com/cresta/gitops-autobot/internal/awssetup"
 
 	"github.com/cresta/gitops-autobot/internal/changemaker/filecontentchangemaker/helmchangemaker"
+	"github.com/cresta/gitops-autobot/internal/changemaker/filecontentchangemaker/imagechangemaker"
 	"github.com/cresta/gitops-autobot/internal/versionfetch/helm"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/image"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/registry"
 
 	"github.com/go-git/go-git/v5/plumbing/transport/client"
 
+	"github.com/cresta/gitops-autobot/internal/adminapi"
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
 	"github.com/cresta/gitops-autobot/internal/cache"
 	"github.com/cresta/gitops-autobot/internal/changemaker"
 	"github.com/cresta/gitops-autobot/internal/changemaker/filecontentchangemaker/timechangemaker"
 	"github.com/cresta/gitops-autobot/internal/checkout"
+	"github.com/cresta/gitops-autobot/internal/declined"
+	"github.com/cresta/gitops-autobot/internal/discovery"
+	"github.com/cresta/gitops-autobot/internal/forge"
+	"github.com/cresta/gitops-autobot/internal/forge/gitlab"
+	"github.com/cresta/gitops-autobot/internal/forgebot"
+	"github.com/cresta/gitops-autobot/internal/gatereport"
 	"github.com/cresta/gitops-autobot/internal/ghapp"
 	"github.com/cresta/gitops-autobot/internal/ghapp/cachedgithub"
 	"github.com/cresta/gitops-autobot/internal/ghapp/githubdirect"
+	"github.com/cresta/gitops-autobot/internal/ghapp/instrumentedgithub"
 	"github.com/cresta/gitops-autobot/internal/gitopsbot"
+	"github.com/cresta/gitops-autobot/internal/janitor"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/metrics"
 	"github.com/cresta/gitops-autobot/internal/prcreator"
 	"github.com/cresta/gitops-autobot/internal/prmerger"
 	"github.com/cresta/gitops-autobot/internal/prreviewer"
+	"github.com/cresta/gitops-autobot/internal/slashcmd"
+	"github.com/cresta/gitops-autobot/internal/webhook"
 	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
 
 	"github.com/cresta/gotracing"
@@ -102,6 +122,10 @@ func fromDuration(envKey string) time.Duration {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		instance.Plan(os.Args[2:])
+		return
+	}
 	instance.Main()
 }
 
@@ -113,6 +137,16 @@ type Service struct {
 	server    *http.Server
 	tracers   *gotracing.Registry
 	gitopsBot *gitopsbot.GitopsBot
+	// webhookSecret is nil if webhooks are not configured
+	webhookSecret []byte
+	adminAPI      *adminapi.API
+	// plan is set when running the plan subcommand
+	plan *planOptions
+}
+
+type planOptions struct {
+	out                io.Writer
+	repoConfigOverride *autobotcfg.AutobotPerRepoConfig
 }
 
 var instance = Service{
@@ -189,6 +223,54 @@ func (m *Service) Main() {
 	}
 }
 
+// Plan runs every change maker, reviewer and merger once, printing what they would do without pushing, approving or
+// merging anything
+func (m *Service) Plan(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	repoConfigFile := fs.String("repo-config", "", "use this .gitops-autobot file for every repository instead of the committed one")
+	if err := fs.Parse(args); err != nil {
+		m.osExit(2)
+		return
+	}
+	if m.log == nil {
+		var err error
+		m.log, err = setupLogging(m.config.LogLevel)
+		if err != nil {
+			fmt.Printf("Unable to setup logging: %v", err)
+			m.osExit(1)
+			return
+		}
+	}
+	ctx := context.Background()
+	m.plan = &planOptions{
+		out: os.Stdout,
+	}
+	if *repoConfigFile != "" {
+		b, err := ioutil.ReadFile(*repoConfigFile)
+		if err != nil {
+			m.log.IfErr(err).Error(ctx, "unable to read repo config")
+			m.osExit(1)
+			return
+		}
+		m.plan.repoConfigOverride, err = autobotcfg.LoadPerRepoConfig(bytes.NewReader(b))
+		if err != nil {
+			m.log.IfErr(err).Error(ctx, "unable to load repo config")
+			m.osExit(1)
+			return
+		}
+	}
+	if err := m.injection(ctx, gotracing.Noop{}); err != nil {
+		m.log.IfErr(err).Error(ctx, "unable to inject starting variables")
+		m.osExit(1)
+		return
+	}
+	if err := m.gitopsBot.RunOnce(ctx); err != nil {
+		m.log.IfErr(err).Error(ctx, "unable to plan")
+		m.osExit(1)
+		return
+	}
+}
+
 func (m *Service) injection(ctx context.Context, tracer gotracing.Tracing) error {
 	m.log.Info(ctx, "<-injection")
 	defer m.log.Info(ctx, "->injection")
@@ -217,16 +299,17 @@ func (m *Service) injection(ctx context.Context, tracer gotracing.Tracing) error
 		return fmt.Errorf("unable to load committer from config: %w", err)
 	}
 	memoryCache := []cache.ClearableCache{
-		&cache.InMemoryCache{},
-		&cache.InMemoryCache{},
-		&cache.InMemoryCache{},
+		&cache.InMemoryCache{Name: "github_pr_creator"},
+		&cache.InMemoryCache{Name: "github_pr_reviewer"},
+		&cache.InMemoryCache{Name: "helm_index"},
+		&cache.InMemoryCache{Name: "registry"},
 	}
 	directPRCreatorClient, err := githubdirect.NewFromConfig(ctx, cfg.PRCreator, tracer.WrapRoundTrip(http.DefaultTransport), m.log)
 	if err != nil {
 		return fmt.Errorf("unable to make direct github client: %w", err)
 	}
 	cachedPRCreatorClient := &cachedgithub.CachedGithub{
-		Into:  directPRCreatorClient,
+		Into:  &instrumentedgithub.InstrumentedGithub{Into: directPRCreatorClient, Client: "pr_creator"},
 		Cache: memoryCache[0],
 	}
 	prMaker, err := cachedPRCreatorClient.Self(ctx)
@@ -238,16 +321,51 @@ func (m *Service) injection(ctx context.Context, tracer gotracing.Tracing) error
 		return fmt.Errorf("unable to make direct github client: %w", err)
 	}
 	cachedPRReviewerClient := &cachedgithub.CachedGithub{
-		Into:  directPRReviewerClient,
+		Into:  &instrumentedgithub.InstrumentedGithub{Into: directPRReviewerClient, Client: "pr_reviewer"},
 		Cache: memoryCache[1],
 	}
 	cfg, err = ghapp.PopulateRepoDefaultBranches(ctx, cfg, cachedPRCreatorClient)
 	if err != nil {
 		return fmt.Errorf("unable to populate default branches: %w", err)
 	}
+	// forges are where repositories not on GitHub are hosted
+	forges := make(map[string]forge.Forge)
+	if cfg.GitLab != nil {
+		token, err := cfg.GitLab.Token()
+		if err != nil {
+			return fmt.Errorf("unable to load gitlab token: %w", err)
+		}
+		approverToken, err := cfg.GitLab.ApproverToken()
+		if err != nil {
+			return fmt.Errorf("unable to load gitlab approver token: %w", err)
+		}
+		if approverToken == nil {
+			m.log.Warn(ctx, "no gitlab approverTokenLoc: merge requests are approved by their author, which projects must allow")
+		}
+		forges[autobotcfg.ForgeGitLab] = &gitlab.Client{
+			BaseURL:       cfg.GitLab.BaseURL(),
+			Token:         string(token),
+			ApproverToken: string(approverToken),
+			HTTP:          tracedClient,
+			Logger:        m.log,
+		}
+	}
+	if err := forge.PopulateDefaultBranches(ctx, cfg, forges); err != nil {
+		return fmt.Errorf("unable to populate default branches: %w", err)
+	}
+	newCheckout := func(ctx context.Context, repo autobotcfg.RepoConfig) (*checkout.Checkout, error) {
+		auth := cachedPRCreatorClient.GoGetAuthMethod()
+		if f, exists := forges[repo.ForgeName()]; exists {
+			auth = f.GoGetAuthMethod()
+		}
+		return checkout.NewCheckout(ctx, m.log, repo, cfg.CloneDataDir, auth)
+	}
 	allCheckouts := make([]*checkout.Checkout, 0, len(cfg.Repos))
 	for _, repo := range cfg.Repos {
-		co, err := checkout.NewCheckout(ctx, m.log, repo, cfg.CloneDataDir, cachedPRCreatorClient.GoGetAuthMethod())
+		if repo.ForgeName() != autobotcfg.ForgeGitHub {
+			m.log.Warn(ctx, "some features are only done on github", zap.Stringer("repo", repo), zap.String("forge", repo.ForgeName()), zap.Strings("github_only", autobotcfg.GitHubOnlyFeatures))
+		}
+		co, err := newCheckout(ctx, repo)
 		if err != nil {
 			return fmt.Errorf("unable to setup checkout: %w", err)
 		}
@@ -257,6 +375,31 @@ func (m *Service) injection(ctx context.Context, tracer gotracing.Tracing) error
 	if err != nil {
 		return fmt.Errorf("unable to make AWS/S3 client: %w", err)
 	}
+	registryCredentials := make(map[string]registry.BasicCredentials, len(cfg.Registries))
+	registryPlainHTTP := make(map[string]bool)
+	for idx := range cfg.Registries {
+		if cfg.Registries[idx].PlainHTTP {
+			registryPlainHTTP[cfg.Registries[idx].Host] = true
+		}
+		if !cfg.Registries[idx].HasCredentials() {
+			continue
+		}
+		password, err := cfg.Registries[idx].Password()
+		if err != nil {
+			return fmt.Errorf("unable to load registry password: %w", err)
+		}
+		registryCredentials[cfg.Registries[idx].Host] = registry.BasicCredentials{
+			Username: cfg.Registries[idx].Username,
+			Password: password,
+		}
+	}
+	registryClient := &registry.Client{
+		Client:      tracedClient,
+		Logger:      m.log,
+		Cache:       memoryCache[3],
+		Credentials: registryCredentials,
+		PlainHTTP:   registryPlainHTTP,
+	}
 	factory := changemaker.Factory{
 		Factories: []changemaker.WorkingTreeChangerFactory{
 			shellchangemaker.MakeFactory(m.log),
@@ -277,43 +420,163 @@ func (m *Service) injection(ctx context.Context, tracer gotracing.Tracing) error
 						Logger: m.log,
 						Client: s3.New(session),
 					},
+					"oci": &helm.OCILoader{
+						Logger:   m.log,
+						Registry: registryClient,
+					},
 				},
 			}, &helm.ChangeParser{
 				Logger: m.log,
 			}, m.log),
+			imagechangemaker.MakeFactory(&image.ChangeParser{
+				Tags: registryClient,
+			}, m.log),
 		},
 	}
+	var markerSigner *marker.Signer
+	signingKey, err := cfg.MarkerSigningKey()
+	if err != nil {
+		return fmt.Errorf("unable to load marker signing key: %w", err)
+	}
+	if signingKey != nil {
+		markerSigner = &marker.Signer{Key: signingKey}
+	}
+	declinedChanges, err := declined.Load(cfg.DeclinedChangesPath())
+	if err != nil {
+		return fmt.Errorf("unable to load declined changes: %w", err)
+	}
 	prCreator := &prcreator.PrCreator{
 		F:             &factory,
 		AutobotConfig: cfg,
 		Logger:        m.log,
 		GitCommitter:  committer,
 		Client:        cachedPRCreatorClient,
+		MarkerSigner:  markerSigner,
+		PRMaker:       prMaker,
+		Declined:      declinedChanges,
+		Forges:        forges,
 	}
 	prMerger := &prmerger.PRMerger{
 		AutobotConfig: cfg,
 		Client:        cachedPRReviewerClient,
 		Logger:        m.log,
+		MarkerSigner:  markerSigner,
 	}
 	prReviewer := &prreviewer.PrReviewer{
 		AutobotConfig: cfg,
 		Logger:        m.log,
 		Client:        cachedPRReviewerClient,
 		PRMaker:       prMaker,
+		MarkerSigner:  markerSigner,
+	}
+	branchJanitor := &janitor.Janitor{
+		Client:        cachedPRCreatorClient,
+		AutobotConfig: cfg,
+		PRMaker:       prMaker,
+		Logger:        m.log,
+	}
+	forgeBot := &forgebot.ForgeBot{
+		Forges:        forges,
+		AutobotConfig: cfg,
+		MarkerSigner:  markerSigner,
+		Logger:        m.log,
+	}
+	m.webhookSecret, err = cfg.WebhookSecret()
+	if err != nil {
+		return fmt.Errorf("unable to load webhook secret: %w", err)
+	}
+	adminToken, err := cfg.AdminToken()
+	if err != nil {
+		return fmt.Errorf("unable to load admin token: %w", err)
+	}
+	if m.plan != nil {
+		prCreator.Plan = m.plan.out
+		prCreator.RepoConfigOverride = m.plan.repoConfigOverride
+		prReviewer.Plan = m.plan.out
+		prMerger.Plan = m.plan.out
+		branchJanitor.Plan = m.plan.out
+		forgeBot.Plan = m.plan.out
+		// Planning must not change what later runs remember
+		declinedChanges.Path = ""
+		// Keep the plan of one repository together
+		cfg.Concurrency = 1
+	}
+	commandRunner := &slashcmd.Runner{
+		Client:        cachedPRReviewerClient,
+		AutobotConfig: cfg,
+		PRMaker:       prMaker,
+		Logger:        m.log,
+		Declined:      declinedChanges,
+	}
+	var gateReporter *gatereport.Reporter
+	if m.plan == nil {
+		gateReporter = &gatereport.Reporter{
+			Client:        cachedPRReviewerClient,
+			Reviewer:      prReviewer,
+			Merger:        prMerger,
+			AutobotConfig: cfg,
+			Logger:        m.log,
+		}
 	}
 	m.gitopsBot = &gitopsbot.GitopsBot{
-		PRCreator:    prCreator,
-		PrReviewer:   prReviewer,
-		PRMerger:     prMerger,
-		Checkouts:    allCheckouts,
-		Tracer:       tracer,
-		Logger:       m.log.With(zap.String("class", "gitopsbot")),
-		CronInterval: m.config.CronInterval,
+		PRCreator:     prCreator,
+		PrReviewer:    prReviewer,
+		PRMerger:      prMerger,
+		CommandRunner: commandRunner,
+		Janitor:       branchJanitor,
+		GateReporter:  gateReporter,
+		ForgeBot:      forgeBot,
+		Checkouts:     allCheckouts,
+		Tracer:        tracer,
+		Logger:        m.log.With(zap.String("class", "gitopsbot")),
+		CronInterval:  m.config.CronInterval,
+		Concurrency:   cfg.Concurrency,
 		OnCron: func(ctx context.Context, logger *zapctx.Logger) {
 			for idx := range memoryCache {
 				logger.IfErr(memoryCache[idx].Clear(ctx)).Warn(ctx, "unable to clear cache")
 			}
 		},
+		OnRepoEvent: func(ctx context.Context, logger *zapctx.Logger, owner string, name string) {
+			logger.IfErr(cachedPRCreatorClient.InvalidatePullRequests(ctx, owner, name)).Warn(ctx, "unable to invalidate cached prs")
+			logger.IfErr(cachedPRReviewerClient.InvalidatePullRequests(ctx, owner, name)).Warn(ctx, "unable to invalidate cached prs")
+		},
+	}
+	commandRunner.TriggerRepo = m.gitopsBot.TriggerRepo
+	m.adminAPI = &adminapi.API{
+		Bot:           m.gitopsBot,
+		AutobotConfig: cfg,
+		Reviewer:      prReviewer,
+		Merger:        prMerger,
+		Token:         adminToken,
+		Logger:        m.log.With(zap.String("class", "adminapi")),
+	}
+	if cfg.Discovery != nil && m.plan != nil {
+		m.log.Info(ctx, "not planning discovered repositories: planning does not clone or remove repositories beyond the configured ones")
+	}
+	if cfg.Discovery != nil && m.plan == nil {
+		m.gitopsBot.Discoverer = &discovery.Discoverer{
+			Client:        cachedPRCreatorClient,
+			AutobotConfig: cfg,
+			Logger:        m.log,
+		}
+		m.gitopsBot.DiscoveryInterval = cfg.Discovery.RefreshInterval()
+		m.gitopsBot.NewCheckout = newCheckout
+		m.gitopsBot.AutobotConfig = cfg
+		if err := m.gitopsBot.RefreshRepos(ctx); err != nil {
+			return fmt.Errorf("unable to discover repositories: %w", err)
+		}
+	}
+	if m.plan != nil {
+		// Planning leaves every other clone alone
+		return nil
+	}
+	// Only now are the checkouts of discovered repositories known, so they are not removed
+	keepCheckouts := make([]checkout.RepoConfig, 0, len(cfg.Repos))
+	for _, repo := range cfg.AllRepos() {
+		keepCheckouts = append(keepCheckouts, repo)
+	}
+	if err := checkout.GarbageCollect(ctx, m.log, cfg.CloneDataDir, keepCheckouts); err != nil {
+		return fmt.Errorf("unable to remove stale checkouts: %w", err)
 	}
 	return nil
 }
@@ -321,12 +584,19 @@ func (m *Service) injection(ctx context.Context, tracer gotracing.Tracing) error
 func (m *Service) setupServer(cfg config, log *zapctx.Logger, tracer gotracing.Tracing) *http.Server {
 	rootHandler := mux.NewRouter()
 	rootHandler.Handle("/health", httpsimple.HealthHandler(log, tracer))
-	rootHandler.Methods(http.MethodPost).Path("/trigger").HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		m.gitopsBot.TriggerNow()
-		writer.WriteHeader(http.StatusAccepted)
-		_, err := io.WriteString(writer, "triggered async")
-		m.log.IfErr(err).Warn(request.Context(), "unable to write out status")
-	})
+	m.adminAPI.Register(rootHandler)
+	if m.adminAPI.Token == nil {
+		log.Info(context.Background(), "no admin token configured: targeted triggers are disabled")
+	}
+	if m.webhookSecret != nil {
+		rootHandler.Methods(http.MethodPost).Path("/webhook").Handler(&webhook.Handler{
+			Secret:    m.webhookSecret,
+			Scheduler: m.gitopsBot,
+			Logger:    log.With(zap.String("class", "webhook")),
+		})
+	} else {
+		log.Info(context.Background(), "no webhook secret configured: only running on cron")
+	}
 	return &http.Server{
 		Addr:    cfg.ListenAddr,
 		Handler: rootHandler,
@@ -342,6 +612,7 @@ func setupDebugServer(l *zapctx.Logger, listenAddr string, obj interface{}) (fun
 		Logger:        &zapctx.FieldLogger{Logger: l},
 		ExplorableObj: obj,
 	})
+	ret.Mux.Handle("/metrics", metrics.Handler())
 	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return nil, fmt.Errorf("unable to listen to %s: %w", listenAddr, err)
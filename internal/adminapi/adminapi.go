@@ -0,0 +1,342 @@
+// Package adminapi serves what the bot knows about each repository as JSON, and lets operators trigger work for one
+// repository or change maker
+package adminapi
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/gitopsbot"
+	"github.com/cresta/gitops-autobot/internal/prmerger"
+	"github.com/cresta/gitops-autobot/internal/prreviewer"
+	"github.com/cresta/zapctx"
+	"github.com/gorilla/mux"
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Bot is what the API reports on and triggers.  GitopsBot implements it.
+type Bot interface {
+	LastResult() *gitopsbot.CycleResult
+	TriggerNow()
+	TriggerRepoNow(owner string, name string, changeMaker string)
+}
+
+// API is the admin HTTP API.  Every route needs Token, if it is set.
+type API struct {
+	Bot           Bot
+	AutobotConfig *autobotcfg.AutobotConfig
+	// Reviewer and Merger decide what would happen to each open pull request.  The pull requests are listed with the
+	// reviewer's client.
+	Reviewer *prreviewer.PrReviewer
+	Merger   *prmerger.PRMerger
+	// Token is the bearer token every route requires.  If nil, only the routes reporting what the bot already knows and
+	// the full iteration trigger are served, without a token, as they always were.  Listing pull requests, which calls
+	// GitHub on every request, and targeted triggers need a token.
+	Token  []byte
+	Logger *zapctx.Logger
+}
+
+// Register adds every route of the API to r
+func (a *API) Register(r *mux.Router) {
+	if a.Token == nil {
+		r.Methods(http.MethodGet).Path("/api/repos").HandlerFunc(a.listRepos)
+		r.Methods(http.MethodGet).Path("/api/repos/{owner}/{repo}").HandlerFunc(a.getRepo)
+		r.Methods(http.MethodGet).Path("/api/cycle").HandlerFunc(a.lastCycle)
+		r.Methods(http.MethodPost).Path("/trigger").HandlerFunc(a.triggerAll)
+		return
+	}
+	r.Methods(http.MethodGet).Path("/api/repos").Handler(a.requireToken(a.listRepos))
+	r.Methods(http.MethodGet).Path("/api/repos/{owner}/{repo}").Handler(a.requireToken(a.getRepo))
+	r.Methods(http.MethodGet).Path("/api/repos/{owner}/{repo}/pulls").Handler(a.requireToken(a.listPullRequests))
+	r.Methods(http.MethodGet).Path("/api/cycle").Handler(a.requireToken(a.lastCycle))
+	r.Methods(http.MethodPost).Path("/trigger").Handler(a.requireToken(a.triggerAll))
+	r.Methods(http.MethodPost).Path("/trigger/{owner}/{repo}").Handler(a.requireToken(a.triggerRepo))
+	r.Methods(http.MethodPost).Path("/trigger/{owner}/{repo}/{changeMaker}").Handler(a.requireToken(a.triggerRepo))
+}
+
+func (a *API) requireToken(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), a.Token) != 1 {
+			http.Error(writer, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(writer, request)
+	})
+}
+
+// Repo is a managed checkout and how it did in the last full iteration
+type Repo struct {
+	Owner  string `json:"owner"`
+	Name   string `json:"name"`
+	Branch string `json:"branch"`
+	Forge  string `json:"forge"`
+	// Config is the .gitops-autobot file change makers last ran with, as in the file
+	Config    interface{} `json:"config"`
+	LastCycle *RepoCycle  `json:"lastCycle,omitempty"`
+}
+
+// RepoCycle is what happened to one checkout during a full iteration.  Each phase has an error if it failed.
+type RepoCycle struct {
+	Repo         string        `json:"repo"`
+	CreateError  string        `json:"createError,omitempty"`
+	ChangeMakers []ChangeMaker `json:"changeMakers"`
+	ReviewError  string        `json:"reviewError,omitempty"`
+	MergeError   string        `json:"mergeError,omitempty"`
+	CleanupError string        `json:"cleanupError,omitempty"`
+	ReportError  string        `json:"reportError,omitempty"`
+}
+
+// ChangeMaker is how one change maker did
+type ChangeMaker struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// Cycle is the last full iteration
+type Cycle struct {
+	Start time.Time   `json:"start"`
+	End   time.Time   `json:"end"`
+	Error string      `json:"error,omitempty"`
+	Repos []RepoCycle `json:"repos"`
+}
+
+// PullRequest is an open autobot pull request, and what the reviewer and merger would do with it.  In repositories
+// that leave merging to GitHub, Merge is whether GitHub is going to merge it.
+type PullRequest struct {
+	Number      int      `json:"number"`
+	Title       string   `json:"title"`
+	HeadRefName string   `json:"headRefName"`
+	HeadOid     string   `json:"headOid"`
+	Approve     Decision `json:"approve"`
+	Merge       Decision `json:"merge"`
+}
+
+// Decision is whether something would be done.  If not, Reason is the first condition that failed.
+type Decision struct {
+	Will   bool   `json:"will"`
+	Reason string `json:"reason"`
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func toRepoCycle(r *gitopsbot.RepoResult) RepoCycle {
+	ret := RepoCycle{
+		Repo:         r.Repo,
+		ChangeMakers: []ChangeMaker{},
+		ReviewError:  errString(r.ReviewErr),
+		MergeError:   errString(r.MergeErr),
+		CleanupError: errString(r.CleanupErr),
+		ReportError:  errString(r.ReportErr),
+	}
+	if r.Creator != nil {
+		ret.CreateError = errString(r.Creator.Err)
+		for _, cm := range r.Creator.ChangeMakers {
+			ret.ChangeMakers = append(ret.ChangeMakers, ChangeMaker{Name: cm.Name, Error: errString(cm.Err)})
+		}
+	}
+	return ret
+}
+
+// configJSON is cfg with the field names of the .gitops-autobot file.  Change maker data is decoded as YAML maps with
+// any type of key, which JSON cannot encode, so it goes through YAML again.
+func configJSON(cfg *autobotcfg.AutobotPerRepoConfig) (interface{}, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	b, err := yamlv2.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode config: %w", err)
+	}
+	var ret interface{}
+	if err := yaml.Unmarshal(b, &ret); err != nil {
+		return nil, fmt.Errorf("unable to decode config: %w", err)
+	}
+	return ret, nil
+}
+
+// repos are the managed checkouts of owner/name, or every one if owner is empty
+func (a *API) repos(owner string, name string) ([]Repo, error) {
+	last := make(map[string]*gitopsbot.RepoResult)
+	if cycle := a.Bot.LastResult(); cycle != nil {
+		for _, r := range cycle.Repos {
+			last[r.Repo] = r
+		}
+	}
+	ret := []Repo{}
+	for _, r := range a.AutobotConfig.AllRepos() {
+		if owner != "" && (!strings.EqualFold(r.Owner, owner) || !strings.EqualFold(r.Name, name)) {
+			continue
+		}
+		repo := Repo{
+			Owner:  r.Owner,
+			Name:   r.Name,
+			Branch: r.Branch,
+			Forge:  r.ForgeName(),
+		}
+		if result, exists := last[r.String()]; exists {
+			cycle := toRepoCycle(result)
+			repo.LastCycle = &cycle
+			if result.Creator != nil {
+				cfg, err := configJSON(result.Creator.Config)
+				if err != nil {
+					return nil, err
+				}
+				repo.Config = cfg
+			}
+		}
+		ret = append(ret, repo)
+	}
+	return ret, nil
+}
+
+func (a *API) listRepos(writer http.ResponseWriter, request *http.Request) {
+	repos, err := a.repos("", "")
+	if err != nil {
+		a.writeError(writer, request, err)
+		return
+	}
+	a.writeJSON(writer, request, repos)
+}
+
+func (a *API) getRepo(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	repos, err := a.repos(vars["owner"], vars["repo"])
+	if err != nil {
+		a.writeError(writer, request, err)
+		return
+	}
+	if len(repos) == 0 {
+		http.Error(writer, "unknown repository", http.StatusNotFound)
+		return
+	}
+	a.writeJSON(writer, request, repos)
+}
+
+func (a *API) lastCycle(writer http.ResponseWriter, request *http.Request) {
+	cycle := a.Bot.LastResult()
+	if cycle == nil {
+		http.Error(writer, "no full iteration has finished yet", http.StatusNotFound)
+		return
+	}
+	ret := Cycle{
+		Start: cycle.Start,
+		End:   cycle.End,
+		Error: errString(cycle.Error()),
+		Repos: make([]RepoCycle, 0, len(cycle.Repos)),
+	}
+	for _, r := range cycle.Repos {
+		ret.Repos = append(ret.Repos, toRepoCycle(r))
+	}
+	a.writeJSON(writer, request, ret)
+}
+
+func (a *API) listPullRequests(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	vars := mux.Vars(request)
+	r := a.AutobotConfig.FindRepo(vars["owner"], vars["repo"])
+	if r == nil {
+		http.Error(writer, "unknown repository", http.StatusNotFound)
+		return
+	}
+	if r.ForgeName() != autobotcfg.ForgeGitHub {
+		http.Error(writer, "pull requests are only listed for repositories on GitHub", http.StatusNotImplemented)
+		return
+	}
+	client := a.Reviewer.Client
+	cfg, err := ghapp.FetchMasterConfigFile(ctx, client, *r)
+	if err != nil {
+		a.writeError(writer, request, fmt.Errorf("unable to fetch repo config: %w", err))
+		return
+	}
+	prs, err := client.EveryOpenPullRequest(ctx, r.Owner, r.Name, ghapp.PRFilterFromConfig(a.AutobotConfig))
+	if err != nil {
+		a.writeError(writer, request, fmt.Errorf("unable to list pull requests: %w", err))
+		return
+	}
+	ret := []PullRequest{}
+	for _, pr := range prs.Repository.PullRequests.Nodes {
+		if maker := a.Reviewer.PRMaker; maker != nil && maker.ID != pr.Author.Bot.ID && maker.ID != pr.Author.User.ID {
+			continue
+		}
+		approve, approveReason := a.Reviewer.ApprovalDecision(pr, cfg)
+		merge, mergeReason := a.Merger.MergeDecision(pr, cfg)
+		if cfg.NativeMerge() {
+			if merge, mergeReason, err = a.Merger.NativeMergeDecision(ctx, pr, cfg); err != nil {
+				a.writeError(writer, request, fmt.Errorf("unable to decide merge of #%d: %w", pr.Number, err))
+				return
+			}
+		}
+		ret = append(ret, PullRequest{
+			Number:      int(pr.Number),
+			Title:       string(pr.Title),
+			HeadRefName: string(pr.HeadRefName),
+			HeadOid:     string(pr.HeadRef.Target.Oid),
+			Approve:     Decision{Will: approve, Reason: approveReason},
+			Merge:       Decision{Will: merge, Reason: mergeReason},
+		})
+	}
+	a.writeJSON(writer, request, ret)
+}
+
+func (a *API) triggerAll(writer http.ResponseWriter, request *http.Request) {
+	a.Bot.TriggerNow()
+	writer.WriteHeader(http.StatusAccepted)
+	_, err := io.WriteString(writer, "triggered async")
+	a.Logger.IfErr(err).Warn(request.Context(), "unable to write out status")
+}
+
+// triggerRepo schedules work for one repository, and only one of its change makers if the route names one
+func (a *API) triggerRepo(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	r := a.AutobotConfig.FindRepo(vars["owner"], vars["repo"])
+	if r == nil {
+		http.Error(writer, "unknown repository", http.StatusNotFound)
+		return
+	}
+	changeMaker := vars["changeMaker"]
+	if changeMaker != "" && !a.hasChangeMaker(changeMaker) {
+		http.Error(writer, "unknown change maker", http.StatusNotFound)
+		return
+	}
+	a.Bot.TriggerRepoNow(r.Owner, r.Name, changeMaker)
+	writer.WriteHeader(http.StatusAccepted)
+	_, err := io.WriteString(writer, "triggered async")
+	a.Logger.IfErr(err).Warn(request.Context(), "unable to write out status")
+}
+
+func (a *API) hasChangeMaker(name string) bool {
+	for _, cm := range a.AutobotConfig.ChangeMakers {
+		if cm.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *API) writeJSON(writer http.ResponseWriter, request *http.Request, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(writer)
+	enc.SetIndent("", "  ")
+	a.Logger.IfErr(enc.Encode(v)).Warn(request.Context(), "unable to write out response")
+}
+
+func (a *API) writeError(writer http.ResponseWriter, request *http.Request, err error) {
+	a.Logger.IfErr(err).Warn(request.Context(), "admin api request failed")
+	http.Error(writer, err.Error(), http.StatusInternalServerError)
+}
+
+var _ Bot = &gitopsbot.GitopsBot{}
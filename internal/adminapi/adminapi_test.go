@@ -0,0 +1,210 @@
+package adminapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/ghapp/fakegithub"
+	"github.com/cresta/gitops-autobot/internal/gitopsbot"
+	"github.com/cresta/gitops-autobot/internal/prcreator"
+	"github.com/cresta/gitops-autobot/internal/prmerger"
+	"github.com/cresta/gitops-autobot/internal/prreviewer"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/gorilla/mux"
+	"github.com/shurcooL/githubv4"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBot struct {
+	last      *gitopsbot.CycleResult
+	triggered []string
+}
+
+func (f *fakeBot) LastResult() *gitopsbot.CycleResult {
+	return f.last
+}
+
+func (f *fakeBot) TriggerNow() {
+	f.triggered = append(f.triggered, "all")
+}
+
+func (f *fakeBot) TriggerRepoNow(owner string, name string, changeMaker string) {
+	f.triggered = append(f.triggered, owner+"/"+name+":"+changeMaker)
+}
+
+const repoConfig = `allowAutoReview: true
+allowAutoMerge: false
+changeMakers:
+  - name: helm
+    autoApprove: true
+`
+
+func newAPI(t *testing.T, token []byte) (*fakeBot, *mux.Router) {
+	bot, r, _ := newAPIWithConfig(t, token, repoConfig)
+	return bot, r
+}
+
+func newAPIWithConfig(t *testing.T, token []byte, config string) (*fakeBot, *mux.Router, *fakegithub.GitHub) {
+	ctx := context.Background()
+	logger := testhelp.ZapTestingLogger(t)
+	gh := fakegithub.New(t.TempDir())
+	require.NoError(t, gh.AddRepository(fakegithub.Repository{
+		Owner: "cresta",
+		Name:  "gitops",
+		Files: map[string]string{".gitops-autobot": config},
+	}))
+	_, err := gh.Commit("cresta", "gitops", "autobot-change", map[string]string{"a.txt": "a\n"}, "Change")
+	require.NoError(t, err)
+	creator := gh.Client("autobot")
+	prMaker, err := creator.Self(ctx)
+	require.NoError(t, err)
+	_, err = creator.CreatePullRequest(ctx, "cresta", "gitops", githubv4.CreatePullRequestInput{
+		BaseRefName: "master",
+		HeadRefName: "autobot-change",
+		Title:       "Change",
+		Body:        githubv4.NewString("gitops-autobot: auto-approve=true\ngitops-autobot: auto-merge=true"),
+	})
+	require.NoError(t, err)
+
+	cfg := &autobotcfg.AutobotConfig{
+		ChangeMakers: []autobotcfg.ChangeMakerConfig{{Name: "helm"}},
+		Repos:        []autobotcfg.RepoConfig{{Owner: "cresta", Name: "gitops", Branch: "master"}},
+	}
+	repoCfg, err := autobotcfg.LoadPerRepoConfig(strings.NewReader(config + "    data:\n      charts: [a]\n"))
+	require.NoError(t, err)
+	bot := &fakeBot{
+		last: &gitopsbot.CycleResult{
+			Start: time.Now(),
+			End:   time.Now(),
+			Repos: []*gitopsbot.RepoResult{{
+				Repo: "cresta/gitops:master",
+				Creator: &prcreator.RepoResult{
+					Repo:         "cresta/gitops:master",
+					Config:       repoCfg,
+					ChangeMakers: []prcreator.ChangeMakerResult{{Name: "helm", Err: errors.New("no chart")}},
+				},
+			}},
+		},
+	}
+	reviewer := gh.Client("reviewer")
+	api := &API{
+		Bot:           bot,
+		AutobotConfig: cfg,
+		Reviewer: &prreviewer.PrReviewer{
+			Client:        reviewer,
+			Logger:        logger,
+			AutobotConfig: cfg,
+			PRMaker:       prMaker,
+		},
+		Merger: &prmerger.PRMerger{
+			Client:        reviewer,
+			Logger:        logger,
+			AutobotConfig: cfg,
+		},
+		Token:  token,
+		Logger: logger,
+	}
+	r := mux.NewRouter()
+	api.Register(r)
+	return bot, r, gh
+}
+
+func do(r http.Handler, method string, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPI_Repos(t *testing.T) {
+	_, r := newAPI(t, nil)
+	rec := do(r, http.MethodGet, "/api/repos/cresta/gitops", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var repos []Repo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &repos))
+	require.Len(t, repos, 1)
+	require.Equal(t, "master", repos[0].Branch)
+	require.Equal(t, "no chart", repos[0].LastCycle.ChangeMakers[0].Error)
+	cfg := repos[0].Config.(map[string]interface{})
+	require.Equal(t, true, cfg["allowAutoReview"])
+	require.Equal(t, "helm", cfg["changeMakers"].([]interface{})[0].(map[string]interface{})["name"])
+
+	require.Equal(t, http.StatusNotFound, do(r, http.MethodGet, "/api/repos/cresta/missing", "").Code)
+	require.Equal(t, http.StatusOK, do(r, http.MethodGet, "/api/cycle", "").Code)
+}
+
+func TestAPI_ReadNeedsToken(t *testing.T) {
+	_, r := newAPI(t, []byte("secret"))
+	for _, path := range []string{"/api/repos", "/api/repos/cresta/gitops", "/api/repos/cresta/gitops/pulls", "/api/cycle"} {
+		require.Equal(t, http.StatusUnauthorized, do(r, http.MethodGet, path, "").Code, path)
+		require.Equal(t, http.StatusOK, do(r, http.MethodGet, path, "secret").Code, path)
+	}
+
+	_, r = newAPI(t, nil)
+	require.NotEqual(t, http.StatusOK, do(r, http.MethodGet, "/api/repos/cresta/gitops/pulls", "").Code, "listing pull requests calls GitHub, so it needs a token")
+}
+
+func TestAPI_PullRequests(t *testing.T) {
+	_, r := newAPI(t, []byte("secret"))
+	rec := do(r, http.MethodGet, "/api/repos/cresta/gitops/pulls", "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var prs []PullRequest
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &prs))
+	require.Len(t, prs, 1)
+	require.Equal(t, "autobot-change", prs[0].HeadRefName)
+	require.Equal(t, Decision{Will: true, Reason: "asking for approval and all checks passed"}, prs[0].Approve)
+	require.Equal(t, Decision{Will: false, Reason: "auto merge is not allowed"}, prs[0].Merge)
+}
+
+func TestAPI_PullRequestsNativeMerge(t *testing.T) {
+	ctx := context.Background()
+	native := strings.Replace(repoConfig, "allowAutoMerge: false", "allowAutoMerge: true\nmergeMode: native", 1)
+	_, r, gh := newAPIWithConfig(t, []byte("secret"), native)
+	prs := gh.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	list := func() PullRequest {
+		rec := do(r, http.MethodGet, "/api/repos/cresta/gitops/pulls", "secret")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var ret []PullRequest
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ret))
+		require.Len(t, ret, 1)
+		return ret[0]
+	}
+	require.NoError(t, gh.SetCheckState("cresta", "gitops", list().HeadOid, githubv4.StatusStatePending))
+	require.Equal(t, Decision{Will: true, Reason: "enabling auto merge: waiting for status state not success (PENDING)"}, list().Merge)
+
+	method := githubv4.PullRequestMergeMethodSquash
+	_, err := gh.Client("reviewer").EnablePullRequestAutoMerge(ctx, "cresta", "gitops", githubv4.EnablePullRequestAutoMergeInput{
+		PullRequestID: githubv4.ID(prs[0].ID),
+		MergeMethod:   &method,
+	})
+	require.NoError(t, err)
+	require.Equal(t, Decision{Will: true, Reason: "auto merge enabled: waiting for GitHub to merge it"}, list().Merge)
+}
+
+func TestAPI_Trigger(t *testing.T) {
+	bot, r := newAPI(t, []byte("secret"))
+	require.Equal(t, http.StatusUnauthorized, do(r, http.MethodPost, "/trigger", "").Code)
+	require.Equal(t, http.StatusUnauthorized, do(r, http.MethodPost, "/trigger/cresta/gitops", "wrong").Code)
+	require.Equal(t, http.StatusAccepted, do(r, http.MethodPost, "/trigger", "secret").Code)
+	require.Equal(t, http.StatusAccepted, do(r, http.MethodPost, "/trigger/cresta/gitops", "secret").Code)
+	require.Equal(t, http.StatusAccepted, do(r, http.MethodPost, "/trigger/Cresta/gitops/helm", "secret").Code)
+	require.Equal(t, http.StatusNotFound, do(r, http.MethodPost, "/trigger/cresta/gitops/missing", "secret").Code)
+	require.Equal(t, http.StatusNotFound, do(r, http.MethodPost, "/trigger/cresta/missing", "secret").Code)
+	require.Equal(t, []string{"all", "cresta/gitops:", "cresta/gitops:helm"}, bot.triggered)
+
+	bot, r = newAPI(t, nil)
+	require.Equal(t, http.StatusAccepted, do(r, http.MethodPost, "/trigger", "").Code)
+	require.NotEqual(t, http.StatusAccepted, do(r, http.MethodPost, "/trigger/cresta/gitops", "").Code, "targeted triggers need a token")
+	require.Equal(t, []string{"all"}, bot.triggered)
+}
@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -16,6 +21,127 @@ type AutobotPerRepoConfig struct {
 	AllowAutoReview           bool                       `yaml:"allowAutoReview"`
 	AllowUsersToTriggerAccept bool                       `yaml:"allowUsersToTriggerAccept"`
 	AllowAutoMerge            bool                       `yaml:"allowAutoMerge"`
+	// UpgradePolicy is the default policy of every change maker that does not set its own
+	UpgradePolicy *UpgradePolicy `yaml:"upgradePolicy"`
+	// SlashCommands enables "/autobot <verb>" comments on autobot pull requests
+	SlashCommands *SlashCommandConfig `yaml:"slashCommands"`
+	// HoldLabel is the label that stops the reviewer and merger from touching a PR.  Defaults to "autobot-hold".
+	HoldLabel string `yaml:"holdLabel"`
+	// GateReport publishes the review and merge gates of every autobot PR: "checkRun", "comment", or empty for neither
+	GateReport string `yaml:"gateReport"`
+	// MergeMode is "direct" (the default), where the merger merges PRs itself once every gate passes, or "native",
+	// where it enables GitHub auto merge, or enqueues into the merge queue if the base branch requires one
+	MergeMode string `yaml:"mergeMode"`
+	// MergeMethod is "squash" (the default), "merge" or "rebase".  Change makers can set their own.
+	MergeMethod string `yaml:"mergeMethod"`
+	// Schedule limits when PRs of this repository are approved and merged, on top of the global schedule
+	Schedule *Schedule `yaml:"schedule"`
+	// Freeze stops every approval and merge of this repository, for emergencies
+	Freeze bool `yaml:"freeze"`
+	// FreezeLabel on any open PR of this repository that the bot looks at (see pullRequestFilter) freezes the
+	// repository like Freeze does.  Defaults to "autobot-freeze".
+	FreezeLabel string `yaml:"freezeLabel"`
+}
+
+const (
+	GateReportCheckRun = "checkRun"
+	GateReportComment  = "comment"
+)
+
+const (
+	MergeModeDirect = "direct"
+	MergeModeNative = "native"
+)
+
+const (
+	MergeMethodSquash = "squash"
+	MergeMethodMerge  = "merge"
+	MergeMethodRebase = "rebase"
+)
+
+// NativeMerge is true if GitHub, rather than the merger, merges PRs
+func (a *AutobotPerRepoConfig) NativeMerge() bool {
+	return a.MergeMode == MergeModeNative
+}
+
+// MergeMethodFor is the merge method of PRs made by changeMaker
+func (a *AutobotPerRepoConfig) MergeMethodFor(changeMaker string) string {
+	for _, cm := range a.ChangeMakers {
+		if cm.Name == changeMaker && cm.MergeMethod != "" {
+			return cm.MergeMethod
+		}
+	}
+	if a.MergeMethod != "" {
+		return a.MergeMethod
+	}
+	return MergeMethodSquash
+}
+
+func validMergeMethod(m string) bool {
+	switch m {
+	case "", MergeMethodSquash, MergeMethodMerge, MergeMethodRebase:
+		return true
+	}
+	return false
+}
+
+const defaultHoldLabel = "autobot-hold"
+
+const defaultFreezeLabel = "autobot-freeze"
+
+func (a *AutobotPerRepoConfig) HoldLabelName() string {
+	if a.HoldLabel == "" {
+		return defaultHoldLabel
+	}
+	return a.HoldLabel
+}
+
+func (a *AutobotPerRepoConfig) FreezeLabelName() string {
+	if a.FreezeLabel == "" {
+		return defaultFreezeLabel
+	}
+	return a.FreezeLabel
+}
+
+// Closed returns why PRs of the repository may not be approved or merged at now, given the global schedule, or empty
+// if they may
+func (a *AutobotPerRepoConfig) Closed(global *Schedule, now time.Time) string {
+	if a.Freeze {
+		return "repository is frozen"
+	}
+	if reason := global.Closed(now); reason != "" {
+		return reason
+	}
+	return a.Schedule.Closed(now)
+}
+
+type SlashCommandConfig struct {
+	// Commands are the verbs that are allowed.  If empty, every verb is allowed.
+	Commands []string `yaml:"commands"`
+	// MinimumPermission a commenter needs on the repository: read, write or admin.  Defaults to write.
+	MinimumPermission string `yaml:"minimumPermission"`
+}
+
+func (s *SlashCommandConfig) Allows(verb string) bool {
+	if s == nil {
+		return false
+	}
+	if len(s.Commands) == 0 {
+		return true
+	}
+	for _, c := range s.Commands {
+		if strings.EqualFold(c, verb) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SlashCommandConfig) RequiredPermission() string {
+	if s == nil || s.MinimumPermission == "" {
+		return "write"
+	}
+	return s.MinimumPermission
 }
 
 type AutobotConfig struct {
@@ -26,6 +152,266 @@ type AutobotConfig struct {
 	Repos                []RepoConfig        `yaml:"repos"`
 	CommitterConfig      CommitterConfig     `yaml:"committerConfig"`
 	DelayForAutoApproval time.Duration       `yaml:"delayForAutoApproval"`
+	Registries           []RegistryConfig    `yaml:"registries"`
+	// MarkerSigningKeyLoc is a file with the HMAC key used to sign auto-approve/auto-merge markers.  If unset, markers
+	// are not signed and any PR body asking for auto approval or merge is trusted.
+	MarkerSigningKeyLoc string `yaml:"markerSigningKeyLoc"`
+	// WebhookSecretLoc is a file with the secret GitHub signs webhook deliveries with.  The /webhook endpoint is only
+	// enabled if this is set.
+	WebhookSecretLoc string `yaml:"webhookSecretLoc"`
+	// AdminTokenLoc is a file with the bearer token every admin API route requires.  Targeted triggers and the pull
+	// request listing are only enabled if this is set.
+	AdminTokenLoc string `yaml:"adminTokenLoc"`
+	// PullRequestFilter limits which open pull requests are downloaded for review and merge
+	PullRequestFilter PullRequestFilter `yaml:"pullRequestFilter"`
+	// Concurrency is how many repositories are processed at once.  Defaults to 4.
+	Concurrency int `yaml:"concurrency"`
+	// BranchCleanup, if set, deletes autobot branches once their pull requests are merged or closed
+	BranchCleanup *BranchCleanupConfig `yaml:"branchCleanup"`
+	// DeclinedChangesFile is where changes of autobot pull requests that were closed without merge are remembered, so
+	// they are not proposed again.  Defaults to declined-changes.json in CloneDataDir.
+	DeclinedChangesFile string `yaml:"declinedChangesFile"`
+	// GitLab is how to reach GitLab.  It must be set if any repository is on GitLab.
+	GitLab *GitLabConfig `yaml:"gitlab"`
+	// Discovery, if set, also manages every repository the PR creator can access that matches it
+	Discovery *DiscoveryConfig `yaml:"discovery"`
+	// Schedule limits when PRs of every repository are approved and merged.  Repositories can limit it further.
+	Schedule *Schedule `yaml:"schedule"`
+
+	discoveredMu sync.RWMutex
+	discovered   []RepoConfig
+}
+
+// DiscoveryConfig picks which of the repositories the PR creator can access are managed.  With no filters set, every
+// repository is.
+type DiscoveryConfig struct {
+	// Topics, if set, only discovers repositories with at least one of these topics
+	Topics []string `yaml:"topics"`
+	// Names, if set, only discovers repositories whose owner/name matches one of these globs, such as cresta/*-gitops
+	Names []string `yaml:"names"`
+	// RequireConfigFile only discovers repositories with a .gitops-autobot file on their default branch
+	RequireConfigFile bool `yaml:"requireConfigFile"`
+	// Interval is how often the list of repositories is refreshed.  Defaults to 10 minutes.
+	Interval time.Duration `yaml:"interval"`
+	// Depth limits how many commits of history are cloned for discovered repositories
+	Depth int `yaml:"depth"`
+}
+
+func (d *DiscoveryConfig) RefreshInterval() time.Duration {
+	if d.Interval <= 0 {
+		return time.Minute * 10
+	}
+	return d.Interval
+}
+
+// Matches is true if a repository with this owner, name and topics passes the topic and name filters
+func (d *DiscoveryConfig) Matches(owner string, name string, topics []string) bool {
+	if len(d.Topics) > 0 && !anyEqualFold(d.Topics, topics) {
+		return false
+	}
+	if len(d.Names) == 0 {
+		return true
+	}
+	fullName := strings.ToLower(owner + "/" + name)
+	for _, glob := range d.Names {
+		// Patterns are checked when the config is loaded
+		if matched, _ := path.Match(strings.ToLower(glob), fullName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func anyEqualFold(want []string, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if strings.EqualFold(w, h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AllRepos is every managed repository: the configured ones, then the discovered ones
+func (a *AutobotConfig) AllRepos() []RepoConfig {
+	a.discoveredMu.RLock()
+	defer a.discoveredMu.RUnlock()
+	ret := make([]RepoConfig, 0, len(a.Repos)+len(a.discovered))
+	ret = append(ret, a.Repos...)
+	return append(ret, a.discovered...)
+}
+
+// SetDiscoveredRepos replaces the repositories found by discovery
+func (a *AutobotConfig) SetDiscoveredRepos(repos []RepoConfig) {
+	a.discoveredMu.Lock()
+	defer a.discoveredMu.Unlock()
+	a.discovered = append([]RepoConfig(nil), repos...)
+}
+
+type GitLabConfig struct {
+	// URL of the GitLab instance.  Defaults to https://gitlab.com.
+	URL string `yaml:"url"`
+	// TokenLoc is a file with an access token that has the api and write_repository scopes
+	TokenLoc string `yaml:"tokenLoc"`
+	// ApproverTokenLoc is a file with the access token, with the api scope, of a second user that approves merge
+	// requests.  Without it the user of TokenLoc approves the merge requests it authored, which GitLab only allows if
+	// "Prevent approval by merge request author" is turned off for the project.
+	ApproverTokenLoc string `yaml:"approverTokenLoc"`
+}
+
+const defaultGitLabURL = "https://gitlab.com"
+
+func (g *GitLabConfig) BaseURL() string {
+	if g == nil || g.URL == "" {
+		return defaultGitLabURL
+	}
+	return strings.TrimSuffix(g.URL, "/")
+}
+
+func (g *GitLabConfig) Token() ([]byte, error) {
+	return readSecretFile(g.TokenLoc, "gitlab token")
+}
+
+// ApproverToken is the token of ApproverTokenLoc, or nil if it is not set
+func (g *GitLabConfig) ApproverToken() ([]byte, error) {
+	return readSecretFile(g.ApproverTokenLoc, "gitlab approver token")
+}
+
+func (a *AutobotConfig) DeclinedChangesPath() string {
+	if a.DeclinedChangesFile != "" {
+		return a.DeclinedChangesFile
+	}
+	dir := a.CloneDataDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "declined-changes.json")
+}
+
+type BranchCleanupConfig struct {
+	// Prefixes of the branches that may be deleted.  Defaults to the branches change makers create.
+	Prefixes []string `yaml:"prefixes"`
+	// GracePeriod is how long after its pull request closes a branch is kept.  Defaults to a day.
+	GracePeriod time.Duration `yaml:"gracePeriod"`
+}
+
+var defaultBranchCleanupPrefixes = []string{"filechange_", "shellchange"}
+
+func (b *BranchCleanupConfig) BranchPrefixes() []string {
+	if len(b.Prefixes) == 0 {
+		return defaultBranchCleanupPrefixes
+	}
+	return b.Prefixes
+}
+
+func (b *BranchCleanupConfig) Grace() time.Duration {
+	if b.GracePeriod == 0 {
+		return time.Hour * 24
+	}
+	return b.GracePeriod
+}
+
+// PullRequestFilter keeps busy repositories from downloading every pull request's details.  Only set this if every
+// pull request autobot should review or merge matches it.
+type PullRequestFilter struct {
+	// HeadRefPrefixes only lists pull requests whose branch starts with one of these.  Autobot makes both
+	// "filechange_" and "shellchange" branches.
+	HeadRefPrefixes []string `yaml:"headRefPrefixes"`
+	// HeadRefPrefix is the same as a single entry of HeadRefPrefixes
+	HeadRefPrefix string `yaml:"headRefPrefix"`
+	// Author only lists pull requests made by this login.  GitHub apps are written as "app/<app-name>".
+	Author string `yaml:"author"`
+}
+
+// Prefixes are every head ref prefix pull requests are filtered by
+func (p PullRequestFilter) Prefixes() []string {
+	if p.HeadRefPrefix == "" {
+		return p.HeadRefPrefixes
+	}
+	return append(append([]string(nil), p.HeadRefPrefixes...), p.HeadRefPrefix)
+}
+
+func (a *AutobotConfig) MarkerSigningKey() ([]byte, error) {
+	return readSecretFile(a.MarkerSigningKeyLoc, "marker signing key")
+}
+
+func (a *AutobotConfig) WebhookSecret() ([]byte, error) {
+	return readSecretFile(a.WebhookSecretLoc, "webhook secret")
+}
+
+func (a *AutobotConfig) AdminToken() ([]byte, error) {
+	return readSecretFile(a.AdminTokenLoc, "admin token")
+}
+
+// FindRepo returns the configured repository with this owner and name, or nil if we do not manage it
+func (a *AutobotConfig) FindRepo(owner string, name string) *RepoConfig {
+	for idx := range a.Repos {
+		if strings.EqualFold(a.Repos[idx].Owner, owner) && strings.EqualFold(a.Repos[idx].Name, name) {
+			return &a.Repos[idx]
+		}
+	}
+	a.discoveredMu.RLock()
+	defer a.discoveredMu.RUnlock()
+	for idx := range a.discovered {
+		if strings.EqualFold(a.discovered[idx].Owner, owner) && strings.EqualFold(a.discovered[idx].Name, name) {
+			ret := a.discovered[idx]
+			return &ret
+		}
+	}
+	return nil
+}
+
+// readSecretFile returns the trimmed content of loc, or nil if loc is not set
+func readSecretFile(loc string, what string) ([]byte, error) {
+	if loc == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(loc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s %s: %w", what, loc, err)
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s %s is empty", what, loc)
+	}
+	return key, nil
+}
+
+// RegistryConfig is how to reach a container (or OCI helm chart) registry: its credentials, if it needs any, and
+// whether it is served over plain HTTP
+type RegistryConfig struct {
+	Host        string `yaml:"host"`
+	Username    string `yaml:"username"`
+	PasswordLoc string `yaml:"passwordLoc"`
+	// PlainHTTP reaches the registry over http:// rather than https://, such as a local registry on localhost:5000
+	PlainHTTP bool `yaml:"plainHTTP"`
+}
+
+// HasCredentials is true if the registry has a login
+func (r *RegistryConfig) HasCredentials() bool {
+	return r.Username != "" || r.PasswordLoc != ""
+}
+
+func (r *RegistryConfig) Validate() error {
+	if r.Host == "" {
+		return fmt.Errorf("registry host must be set")
+	}
+	if !r.HasCredentials() {
+		return nil
+	}
+	if _, err := os.Stat(r.PasswordLoc); os.IsNotExist(err) {
+		return fmt.Errorf("unable to find password file %s", r.PasswordLoc)
+	}
+	return nil
+}
+
+func (r *RegistryConfig) Password() (string, error) {
+	b, err := ioutil.ReadFile(r.PasswordLoc)
+	if err != nil {
+		return "", fmt.Errorf("unable to read password file %s: %w", r.PasswordLoc, err)
+	}
+	return strings.TrimSpace(string(b)), nil
 }
 
 type CommitterConfig struct {
@@ -37,22 +423,124 @@ type GithubAppConfig struct {
 	AppID          int64  `yaml:"appID"`
 	InstallationID int64  `yaml:"installationID"`
 	PEMKeyLoc      string `yaml:"PEMKeyLoc"`
+	// TokenLoc is a file with a personal access token.  If set, it is used instead of GitHub App installation auth.
+	TokenLoc string `yaml:"tokenLoc"`
+	// BaseURL is the web address of GitHub Enterprise Server, such as https://github.example.com.  Defaults to
+	// https://github.com.
+	BaseURL string `yaml:"baseURL"`
+	// APIURL is the REST API address.  Defaults to https://api.github.com/, or BaseURL/api/v3/ on GitHub Enterprise.
+	APIURL string `yaml:"apiURL"`
+	// GraphQLURL is the GraphQL API address.  Defaults to https://api.github.com/graphql, or BaseURL/api/graphql on
+	// GitHub Enterprise.
+	GraphQLURL string `yaml:"graphqlURL"`
 }
 
+const defaultGitHubURL = "https://github.com"
+
 func (g *GithubAppConfig) Validate() error {
 	if g == nil {
 		return nil
 	}
+	if g.TokenLoc != "" {
+		if _, err := g.Token(); err != nil {
+			return fmt.Errorf("unable to validate token: %w", err)
+		}
+		return nil
+	}
 	if _, err := os.Stat(g.PEMKeyLoc); os.IsNotExist(err) {
 		return fmt.Errorf("unable to find PEM key %s", g.PEMKeyLoc)
 	}
 	return nil
 }
 
+// Token is the personal access token kept in TokenLoc
+func (g *GithubAppConfig) Token() ([]byte, error) {
+	return readSecretFile(g.TokenLoc, "github token")
+}
+
+// IsEnterprise is true if the config points at GitHub Enterprise Server rather than github.com
+func (g *GithubAppConfig) IsEnterprise() bool {
+	return g.BaseURL != "" || g.APIURL != "" || g.GraphQLURL != ""
+}
+
+// WebURL is the address repositories are cloned from
+func (g *GithubAppConfig) WebURL() string {
+	if g.BaseURL == "" {
+		return defaultGitHubURL
+	}
+	return strings.TrimSuffix(g.BaseURL, "/")
+}
+
+// RESTURL is the address of the REST API, always ending in a slash
+func (g *GithubAppConfig) RESTURL() string {
+	if g.APIURL != "" {
+		return strings.TrimSuffix(g.APIURL, "/") + "/"
+	}
+	if g.BaseURL == "" {
+		return "https://api.github.com/"
+	}
+	return g.WebURL() + "/api/v3/"
+}
+
+// GraphQLEndpoint is the address of the GraphQL API
+func (g *GithubAppConfig) GraphQLEndpoint() string {
+	if g.GraphQLURL != "" {
+		return g.GraphQLURL
+	}
+	if g.BaseURL == "" {
+		return "https://api.github.com/graphql"
+	}
+	return g.WebURL() + "/api/graphql"
+}
+
+const (
+	ForgeGitHub = "github"
+	ForgeGitLab = "gitlab"
+)
+
+// GitHubOnlyFeatures are what autobot only does for repositories on GitHub.  Merge requests on other forges are still
+// made, approved and merged by the same rules, but none of these happen to them.
+var GitHubOnlyFeatures = []string{
+	"updating branches a change maker makes differently or a human edited",
+	"updating pull requests behind their base and closing conflicting or obsolete ones",
+	"deleting stale branches",
+	"remembering declined changes",
+	"slash commands",
+	"gate reports",
+	"native auto merge and merge queues",
+}
+
 type RepoConfig struct {
 	Branch string `yaml:"branch"`
-	Owner  string `yaml:"owner"`
-	Name   string `yaml:"name"`
+	// Owner is the user or organization of the repository, or its group (which may be nested) on GitLab
+	Owner string `yaml:"owner"`
+	Name  string `yaml:"name"`
+	// Depth limits how many commits of history are cloned and fetched.  Zero clones the full history.
+	Depth int `yaml:"depth"`
+	// Forge hosts the repository: github or gitlab.  Defaults to github.  See GitHubOnlyFeatures for what is not done on
+	// gitlab.
+	Forge string `yaml:"forge"`
+	// ForgeURL is the web address of the forge.  Defaults to the base URL of the PR creator on GitHub, or the GitLab URL
+	// on GitLab.
+	ForgeURL string `yaml:"forgeURL"`
+}
+
+// ForgeName is the forge hosting the repository, which is github unless configured otherwise
+func (r RepoConfig) ForgeName() string {
+	if r.Forge == "" {
+		return ForgeGitHub
+	}
+	return r.Forge
+}
+
+func (r RepoConfig) baseURL() string {
+	if r.ForgeURL != "" {
+		return strings.TrimSuffix(r.ForgeURL, "/")
+	}
+	if r.ForgeName() == ForgeGitLab {
+		return defaultGitLabURL
+	}
+	return defaultGitHubURL
 }
 
 func (r RepoConfig) RemoteOwner() string {
@@ -68,13 +556,17 @@ func (r RepoConfig) String() string {
 }
 
 func (r RepoConfig) CloneURL() string {
-	return fmt.Sprintf("https://github.com/%s/%s.git", r.Owner, r.Name)
+	return fmt.Sprintf("%s/%s/%s.git", r.baseURL(), r.Owner, r.Name)
 }
 
 func (r RepoConfig) RemoteBranch() string {
 	return r.Branch
 }
 
+func (r RepoConfig) CloneDepth() int {
+	return r.Depth
+}
+
 type PerRepoChangeMakerConfig struct {
 	Name           string      `yaml:"name"`
 	FileMatchRegex []string    `yaml:"fileMatchRegex"`
@@ -82,7 +574,10 @@ type PerRepoChangeMakerConfig struct {
 	AutoMerge      bool        `yaml:"autoMerge"`
 	Data           interface{} `yaml:"data"`
 	regexp         []*regexp.Regexp
-	Which          string `yaml:"which"`
+	Which          string         `yaml:"which"`
+	UpgradePolicy  *UpgradePolicy `yaml:"upgradePolicy"`
+	// MergeMethod overrides the merge method of the repository for PRs of this change maker
+	MergeMethod string `yaml:"mergeMethod"`
 }
 
 type ChangeMakerConfig struct {
@@ -120,6 +615,9 @@ func Load(cfg io.WriterTo) (*AutobotConfig, error) {
 	if ret.DelayForAutoApproval == 0 {
 		ret.DelayForAutoApproval = time.Minute
 	}
+	if ret.Concurrency <= 0 {
+		ret.Concurrency = 4
+	}
 	if ret.CloneDataDir == "" {
 		ret.CloneDataDir = os.TempDir()
 	}
@@ -129,6 +627,67 @@ func Load(cfg io.WriterTo) (*AutobotConfig, error) {
 	if err := ret.PRReviewer.Validate(); err != nil {
 		return nil, fmt.Errorf("unable to validate pr reviewer: %w", err)
 	}
+	if ret.PRReviewer != nil && !ret.PRReviewer.IsEnterprise() {
+		// Both act on the same repositories, so they are on the same server
+		ret.PRReviewer.BaseURL = ret.PRCreator.BaseURL
+		ret.PRReviewer.APIURL = ret.PRCreator.APIURL
+		ret.PRReviewer.GraphQLURL = ret.PRCreator.GraphQLURL
+	}
+	if _, err := ret.MarkerSigningKey(); err != nil {
+		return nil, fmt.Errorf("unable to validate marker signing key: %w", err)
+	}
+	if _, err := ret.WebhookSecret(); err != nil {
+		return nil, fmt.Errorf("unable to validate webhook secret: %w", err)
+	}
+	if err := ret.Schedule.parse(); err != nil {
+		return nil, fmt.Errorf("invalid schedule: %w", err)
+	}
+	for idx := range ret.Repos {
+		switch ret.Repos[idx].ForgeName() {
+		case ForgeGitHub:
+			if ret.Repos[idx].ForgeURL == "" {
+				ret.Repos[idx].ForgeURL = ret.PRCreator.WebURL()
+			}
+		case ForgeGitLab:
+			if ret.GitLab == nil {
+				return nil, fmt.Errorf("repository %s is on gitlab, but gitlab is not configured", ret.Repos[idx])
+			}
+			if ret.Repos[idx].ForgeURL == "" {
+				ret.Repos[idx].ForgeURL = ret.GitLab.BaseURL()
+			}
+		default:
+			return nil, fmt.Errorf("repository %s has unknown forge %s", ret.Repos[idx], ret.Repos[idx].Forge)
+		}
+	}
+	seenRepos := make(map[string]bool, len(ret.Repos))
+	for _, r := range ret.Repos {
+		// These would share a clone, which cannot be worked on by two checkouts at once
+		key := fmt.Sprintf("%s\n%s\n%d", r.CloneURL(), r.RemoteBranch(), r.CloneDepth())
+		if seenRepos[key] {
+			return nil, fmt.Errorf("repository %s is configured more than once", r)
+		}
+		seenRepos[key] = true
+	}
+	if ret.GitLab != nil {
+		if ret.GitLab.TokenLoc == "" {
+			return nil, fmt.Errorf("gitlab tokenLoc must be set")
+		}
+		if _, err := ret.GitLab.Token(); err != nil {
+			return nil, fmt.Errorf("unable to validate gitlab token: %w", err)
+		}
+	}
+	if ret.Discovery != nil {
+		for _, glob := range ret.Discovery.Names {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("invalid discovery name %s: %w", glob, err)
+			}
+		}
+	}
+	for idx := range ret.Registries {
+		if err := ret.Registries[idx].Validate(); err != nil {
+			return nil, fmt.Errorf("unable to validate registry: %w", err)
+		}
+	}
 	return &ret, nil
 }
 
@@ -151,7 +710,29 @@ func LoadPerRepoConfig(cfg io.WriterTo) (*AutobotPerRepoConfig, error) {
 			}
 			cm.regexp = append(cm.regexp, re)
 		}
+		if cm.UpgradePolicy == nil {
+			cm.UpgradePolicy = ret.UpgradePolicy
+		}
+		if !validMergeMethod(cm.MergeMethod) {
+			return nil, fmt.Errorf("unknown mergeMethod %s of change maker %s", cm.MergeMethod, cm.Name)
+		}
 		ret.ChangeMakers[idx] = cm
 	}
+	switch ret.GateReport {
+	case "", GateReportCheckRun, GateReportComment:
+	default:
+		return nil, fmt.Errorf("unknown gateReport %s", ret.GateReport)
+	}
+	switch ret.MergeMode {
+	case "", MergeModeDirect, MergeModeNative:
+	default:
+		return nil, fmt.Errorf("unknown mergeMode %s", ret.MergeMode)
+	}
+	if !validMergeMethod(ret.MergeMethod) {
+		return nil, fmt.Errorf("unknown mergeMethod %s", ret.MergeMethod)
+	}
+	if err := ret.Schedule.parse(); err != nil {
+		return nil, fmt.Errorf("invalid schedule: %w", err)
+	}
 	return &ret, nil
 }
@@ -0,0 +1,96 @@
+package autobotcfg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad_Enterprise(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("sekret\n"), 0600))
+	cfg, err := Load(strings.NewReader(fmt.Sprintf(`
+prCreator:
+  tokenLoc: %s
+  baseURL: https://github.example.com/
+prReviewer:
+  tokenLoc: %s
+repos:
+  - owner: cresta
+    name: gitops
+    branch: master
+`, tokenFile, tokenFile)))
+	require.NoError(t, err)
+	require.Equal(t, "https://github.example.com/cresta/gitops.git", cfg.Repos[0].CloneURL())
+	require.True(t, cfg.PRCreator.IsEnterprise())
+	require.Equal(t, "https://github.example.com/api/v3/", cfg.PRCreator.RESTURL())
+	require.Equal(t, "https://github.example.com/api/graphql", cfg.PRCreator.GraphQLEndpoint())
+	require.Equal(t, "https://github.example.com/api/graphql", cfg.PRReviewer.GraphQLEndpoint(), "the reviewer is on the same server")
+	token, err := cfg.PRCreator.Token()
+	require.NoError(t, err)
+	require.Equal(t, "sekret", string(token))
+
+	_, err = Load(strings.NewReader(`
+prCreator:
+  tokenLoc: /does/not/exist
+`))
+	require.Error(t, err)
+
+	cfg, err = Load(strings.NewReader(fmt.Sprintf(`
+prCreator:
+  tokenLoc: %s
+repos:
+  - owner: cresta
+    name: gitops
+`, tokenFile)))
+	require.NoError(t, err)
+	require.Equal(t, "https://github.com/cresta/gitops.git", cfg.Repos[0].CloneURL())
+	require.False(t, cfg.PRCreator.IsEnterprise())
+	require.Equal(t, "https://api.github.com/", cfg.PRCreator.RESTURL())
+
+	_, err = Load(strings.NewReader(fmt.Sprintf(`
+prCreator:
+  tokenLoc: %s
+repos:
+  - owner: cresta
+    name: gitops
+  - owner: cresta
+    name: gitops
+    depth: 10
+  - owner: cresta
+    name: gitops
+`, tokenFile)))
+	require.Error(t, err, "two configs sharing one clone")
+}
+
+func TestLoadPerRepoConfig_MergeMethod(t *testing.T) {
+	cfg, err := LoadPerRepoConfig(strings.NewReader(`
+mergeMode: native
+mergeMethod: rebase
+changeMakers:
+  - name: helm
+    mergeMethod: merge
+  - name: image
+`))
+	require.NoError(t, err)
+	require.True(t, cfg.NativeMerge())
+	require.Equal(t, MergeMethodMerge, cfg.MergeMethodFor("helm"))
+	require.Equal(t, MergeMethodRebase, cfg.MergeMethodFor("image"))
+	require.Equal(t, MergeMethodRebase, cfg.MergeMethodFor(""))
+
+	cfg, err = LoadPerRepoConfig(strings.NewReader("allowAutoMerge: true\n"))
+	require.NoError(t, err)
+	require.False(t, cfg.NativeMerge())
+	require.Equal(t, MergeMethodSquash, cfg.MergeMethodFor("helm"))
+
+	_, err = LoadPerRepoConfig(strings.NewReader("mergeMethod: fast-forward\n"))
+	require.Error(t, err)
+	_, err = LoadPerRepoConfig(strings.NewReader("changeMakers:\n  - name: helm\n    mergeMethod: squish\n"))
+	require.Error(t, err)
+	_, err = LoadPerRepoConfig(strings.NewReader("mergeMode: eventually\n"))
+	require.Error(t, err)
+}
@@ -0,0 +1,145 @@
+package autobotcfg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is when the reviewer and merger may approve and merge.  Outside every window, or inside a freeze, they
+// leave pull requests alone.
+type Schedule struct {
+	// Timezone is the IANA name windows and freezes are in, like America/Los_Angeles.  Defaults to UTC.
+	Timezone string `yaml:"timezone"`
+	// Windows are the weekly times approving and merging is allowed.  If there are none, any time is allowed.
+	Windows []ScheduleWindow `yaml:"windows"`
+	// Freezes are date ranges nothing is approved or merged, whatever the windows say
+	Freezes  []ScheduleFreeze `yaml:"freezes"`
+	location *time.Location
+}
+
+// ScheduleWindow is a time of day, on some days of the week.  A window ending before it starts runs past midnight,
+// into the next day.
+type ScheduleWindow struct {
+	// Days are mon, tue, wed, thu, fri, sat or sun.  If there are none, the window is every day.
+	Days []string `yaml:"days"`
+	// Start and End are 15:04 times.  End may be 24:00.
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	days  map[time.Weekday]bool
+	start int
+	end   int
+}
+
+// ScheduleFreeze is a range of days, both included
+type ScheduleFreeze struct {
+	Name string `yaml:"name"`
+	// Start and End are 2006-01-02 dates
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+	start time.Time
+	end   time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parse checks the schedule, and readies it for Closed
+func (s *Schedule) parse() error {
+	if s == nil {
+		return nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %s: %w", s.Timezone, err)
+	}
+	s.location = loc
+	for idx := range s.Windows {
+		w := &s.Windows[idx]
+		w.days = make(map[time.Weekday]bool, len(w.Days))
+		for _, d := range w.Days {
+			wd, exists := weekdays[strings.ToLower(d)]
+			if !exists {
+				return fmt.Errorf("unknown day %s", d)
+			}
+			w.days[wd] = true
+		}
+		if w.start, err = minuteOfDay(w.Start); err != nil {
+			return err
+		}
+		if w.end, err = minuteOfDay(w.End); err != nil {
+			return err
+		}
+	}
+	for idx := range s.Freezes {
+		f := &s.Freezes[idx]
+		if f.start, err = time.ParseInLocation("2006-01-02", f.Start, loc); err != nil {
+			return fmt.Errorf("invalid start of freeze %s: %w", f.Name, err)
+		}
+		if f.end, err = time.ParseInLocation("2006-01-02", f.End, loc); err != nil {
+			return fmt.Errorf("invalid end of freeze %s: %w", f.Name, err)
+		}
+		if f.end.Before(f.start) {
+			return fmt.Errorf("freeze %s ends before it starts", f.Name)
+		}
+		f.end = f.end.AddDate(0, 0, 1)
+	}
+	return nil
+}
+
+func minuteOfDay(hhmm string) (int, error) {
+	if hhmm == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s: %w", hhmm, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Closed returns why approving and merging is not allowed at now, or empty if it is.  A nil schedule is always open.
+func (s *Schedule) Closed(now time.Time) string {
+	if s == nil {
+		return ""
+	}
+	if s.location == nil {
+		// Schedules are checked when the config is loaded.  Fail closed on one that never was.
+		return "schedule was not loaded"
+	}
+	now = now.In(s.location)
+	for _, f := range s.Freezes {
+		if !now.Before(f.start) && now.Before(f.end) {
+			return fmt.Sprintf("frozen for %s until %s", f.Name, f.end.Format("2006-01-02"))
+		}
+	}
+	if len(s.Windows) == 0 {
+		return ""
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range s.Windows {
+		if w.contains(now.Weekday(), minute) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("outside every schedule window (%s %s)", now.Weekday().String()[:3], now.Format("15:04 MST"))
+}
+
+func (w ScheduleWindow) on(day time.Weekday) bool {
+	return len(w.days) == 0 || w.days[day]
+}
+
+func (w ScheduleWindow) contains(day time.Weekday, minute int) bool {
+	if w.start < w.end {
+		return w.on(day) && minute >= w.start && minute < w.end
+	}
+	// Past midnight: the late part of a listed day, or the early part of the day after one
+	return (w.on(day) && minute >= w.start) || (w.on((day+6)%7) && minute < w.end)
+}
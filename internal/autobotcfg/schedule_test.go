@@ -0,0 +1,64 @@
+package autobotcfg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedule_Closed(t *testing.T) {
+	cfg, err := LoadPerRepoConfig(strings.NewReader(`
+schedule:
+  timezone: America/Los_Angeles
+  windows:
+    - days: [mon, tue, wed, thu, fri]
+      start: "09:00"
+      end: "17:00"
+    - days: [sat]
+      start: "22:00"
+      end: "02:00"
+  freezes:
+    - name: end of year
+      start: 2026-12-20
+      end: 2027-01-04
+`))
+	require.NoError(t, err)
+	la, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	at := func(s string) time.Time {
+		ret, err := time.ParseInLocation("2006-01-02 15:04", s, la)
+		require.NoError(t, err)
+		return ret
+	}
+	require.Empty(t, cfg.Closed(nil, at("2026-10-14 09:00")), "wednesday morning")
+	require.Empty(t, cfg.Closed(nil, at("2026-10-14 16:59")))
+	require.Equal(t, "outside every schedule window (Wed 17:00 PDT)", cfg.Closed(nil, at("2026-10-14 17:00")))
+	require.NotEmpty(t, cfg.Closed(nil, at("2026-10-17 12:00")), "saturday noon")
+	require.Empty(t, cfg.Closed(nil, at("2026-10-17 23:00")), "saturday night")
+	require.Empty(t, cfg.Closed(nil, at("2026-10-18 01:59")), "past midnight into sunday")
+	require.NotEmpty(t, cfg.Closed(nil, at("2026-10-18 02:00")))
+	require.Empty(t, cfg.Closed(nil, at("2026-10-14 16:30").UTC()), "times are compared in the schedule's timezone")
+
+	require.Equal(t, "frozen for end of year until 2027-01-05", cfg.Closed(nil, at("2026-12-21 10:00")))
+	require.NotEmpty(t, cfg.Closed(nil, at("2027-01-04 10:00")), "the last day of a freeze is included")
+	require.Empty(t, cfg.Closed(nil, at("2027-01-05 10:00")))
+
+	global, err := LoadPerRepoConfig(strings.NewReader("schedule:\n  freezes:\n    - name: release\n      start: 2026-10-14\n      end: 2026-10-14\n"))
+	require.NoError(t, err)
+	require.Equal(t, "frozen for release until 2026-10-15", cfg.Closed(global.Schedule, at("2026-10-14 10:00")), "the global schedule applies too")
+	cfg.Freeze = true
+	require.Equal(t, "repository is frozen", cfg.Closed(nil, at("2026-10-14 10:00")))
+
+	for _, bad := range []string{
+		"schedule:\n  timezone: Mars/Olympus\n",
+		"schedule:\n  windows:\n    - days: [someday]\n      start: \"09:00\"\n      end: \"17:00\"\n",
+		"schedule:\n  windows:\n    - start: \"9am\"\n      end: \"17:00\"\n",
+		"schedule:\n  freezes:\n    - name: backwards\n      start: 2026-10-14\n      end: 2026-10-01\n",
+	} {
+		_, err := LoadPerRepoConfig(strings.NewReader(bad))
+		require.Error(t, err, bad)
+	}
+	require.Equal(t, "schedule was not loaded", (&Schedule{}).Closed(time.Now()))
+}
@@ -0,0 +1,81 @@
+package autobotcfg
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+type UpgradeLevel string
+
+const (
+	UpgradeLevelPatch      UpgradeLevel = "patch"
+	UpgradeLevelMinor      UpgradeLevel = "minor"
+	UpgradeLevelMajor      UpgradeLevel = "major"
+	UpgradeLevelPrerelease UpgradeLevel = "prerelease"
+)
+
+// UpgradePolicy maps how large a version bump is to what the autobot may do with the PR.  Levels without a rule get
+// a PR with neither auto-approve nor auto-merge.
+type UpgradePolicy struct {
+	Patch      *UpgradeRule `yaml:"patch"`
+	Minor      *UpgradeRule `yaml:"minor"`
+	Major      *UpgradeRule `yaml:"major"`
+	Prerelease *UpgradeRule `yaml:"prerelease"`
+}
+
+type UpgradeRule struct {
+	AutoApprove bool `yaml:"autoApprove"`
+	AutoMerge   bool `yaml:"autoMerge"`
+}
+
+func (r UpgradeRule) String() string {
+	switch {
+	case r.AutoApprove && r.AutoMerge:
+		return "auto-approve and auto-merge"
+	case r.AutoApprove:
+		return "auto-approve"
+	case r.AutoMerge:
+		return "auto-merge"
+	default:
+		return "hold for review"
+	}
+}
+
+func UpgradeLevelBetween(from *semver.Version, to *semver.Version) UpgradeLevel {
+	switch {
+	case to.Prerelease() != "":
+		return UpgradeLevelPrerelease
+	case to.Major() != from.Major():
+		return UpgradeLevelMajor
+	case to.Minor() != from.Minor():
+		return UpgradeLevelMinor
+	default:
+		return UpgradeLevelPatch
+	}
+}
+
+func (p *UpgradePolicy) RuleFor(level UpgradeLevel) UpgradeRule {
+	var rule *UpgradeRule
+	switch level {
+	case UpgradeLevelPatch:
+		rule = p.Patch
+	case UpgradeLevelMinor:
+		rule = p.Minor
+	case UpgradeLevelMajor:
+		rule = p.Major
+	case UpgradeLevelPrerelease:
+		rule = p.Prerelease
+	}
+	if rule == nil {
+		return UpgradeRule{}
+	}
+	return *rule
+}
+
+// Evaluate returns the rule for upgrading from => to, and a human readable description of why it applied
+func (p *UpgradePolicy) Evaluate(from *semver.Version, to *semver.Version) (UpgradeRule, string) {
+	level := UpgradeLevelBetween(from, to)
+	rule := p.RuleFor(level)
+	return rule, fmt.Sprintf("%s upgrade %s => %s: %s", level, from.Original(), to.Original(), rule)
+}
@@ -0,0 +1,40 @@
+package autobotcfg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgradePolicy_Evaluate(t *testing.T) {
+	cfg, err := LoadPerRepoConfig(strings.NewReader(`
+upgradePolicy:
+  patch:
+    autoApprove: true
+    autoMerge: true
+  minor:
+    autoApprove: true
+changeMakers:
+  - name: helm
+`))
+	require.NoError(t, err)
+	policy := cfg.ChangeMakers[0].UpgradePolicy
+	require.NotNil(t, policy, "repo level policy should apply to each change maker")
+	for _, tc := range []struct {
+		from     string
+		to       string
+		expected UpgradeRule
+		reason   string
+	}{
+		{from: "1.2.3", to: "1.2.4", expected: UpgradeRule{AutoApprove: true, AutoMerge: true}, reason: "patch upgrade 1.2.3 => 1.2.4: auto-approve and auto-merge"},
+		{from: "1.2.3", to: "1.3.0", expected: UpgradeRule{AutoApprove: true}, reason: "minor upgrade 1.2.3 => 1.3.0: auto-approve"},
+		{from: "1.2.3", to: "2.0.0", expected: UpgradeRule{}, reason: "major upgrade 1.2.3 => 2.0.0: hold for review"},
+		{from: "1.2.3", to: "1.2.4-rc.1", expected: UpgradeRule{}, reason: "prerelease upgrade 1.2.3 => 1.2.4-rc.1: hold for review"},
+	} {
+		rule, reason := policy.Evaluate(semver.MustParse(tc.from), semver.MustParse(tc.to))
+		require.Equal(t, tc.expected, rule)
+		require.Equal(t, tc.reason, reason)
+	}
+}
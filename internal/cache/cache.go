@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/cresta/gitops-autobot/internal/metrics"
 )
 
 type Cache interface {
@@ -27,6 +29,8 @@ type inMemoryKey struct {
 }
 
 type InMemoryCache struct {
+	// Name labels the hit and miss metrics of the cache
+	Name  string
 	cache map[string]inMemoryKey
 	mu    sync.Mutex
 }
@@ -56,10 +60,12 @@ func (i *InMemoryCache) GetOrSet(ctx context.Context, key []byte, ttl time.Durat
 			if err := json.Unmarshal(existingItem.val, into); err != nil {
 				return fmt.Errorf("unable to unmarshal value in cache: %w", err)
 			}
+			metrics.CacheRequests.WithLabelValues(i.Name, "hit").Inc()
 			return nil
 		}
 		delete(i.cache, string(key))
 	}
+	metrics.CacheRequests.WithLabelValues(i.Name, "miss").Inc()
 
 	val, err := data(ctx)
 	if err != nil {
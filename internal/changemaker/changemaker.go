@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/marker"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
@@ -54,17 +55,29 @@ func (g *gitCommitter) Commit(w *git.Worktree, msg string, opts *git.CommitOptio
 	if co.Committer != nil && co.Committer.When.IsZero() {
 		co.Committer.When = now
 	}
-	annotations = MergeAnnotations(AnnotationsFromConfig(perRepo), annotations)
+	if annotations == nil || annotations.PolicyRule == "" {
+		// An upgrade policy is authoritative, so the change maker defaults only apply without one
+		annotations = MergeAnnotations(AnnotationsFromConfig(perRepo), annotations)
+	}
 	msg = annotations.tagCommitMessage(msg)
+	if perRepo.Name != "" {
+		// Lets later runs find the change maker of a PR, to regenerate it
+		msg += "\n" + marker.ChangeMakerLine(perRepo.Name) + "\n"
+	}
 	return w.Commit(msg, &co)
 }
 
 type CommitAnnotations struct {
 	AutoApprove bool
 	AutoMerge   bool
+	// PolicyRule describes which upgrade policy rule decided AutoApprove and AutoMerge, if any
+	PolicyRule string
 }
 
 func (c *CommitAnnotations) tagCommitMessage(msg string) string {
+	if c.PolicyRule != "" {
+		msg += "\nUpgrade policy applied: " + c.PolicyRule + "\n"
+	}
 	if c.AutoApprove {
 		msg += "\ngitops-autobot: auto-approve=true\n"
 	}
@@ -85,6 +98,17 @@ type WorkingTreeChanger interface {
 	ChangeWorkingTree(w *git.Worktree, baseCommit *object.Commit, gitCommitter GitCommitter, baseDir string) error
 }
 
+// Declined is the changes humans declined, by closing an autobot PR without merging it
+type Declined interface {
+	IsDeclined(id marker.ChangeID) bool
+}
+
+// DeclinedSkipper is optionally implemented by a WorkingTreeChanger that can skip changes humans declined.  It is told
+// about the declined changes of its repository before ChangeWorkingTree is called.
+type DeclinedSkipper interface {
+	SkipDeclined(declined Declined)
+}
+
 type WorkingTreeChangerFactory func(cfg autobotcfg.ChangeMakerConfig, perRepo autobotcfg.PerRepoChangeMakerConfig) ([]WorkingTreeChanger, error)
 
 type Factory struct {
@@ -98,26 +122,64 @@ func (f *Factory) Load(changeMakers []autobotcfg.ChangeMakerConfig, repoCfg auto
 			if cm.Name != rcm.Name {
 				continue
 			}
-			loaded := false
-			for _, factory := range f.Factories {
-				changers, err := factory(cm, rcm)
-				if err != nil {
-					return nil, fmt.Errorf("unable to load change maker for %s: %w", cm.Name, err)
-				}
-				if changers != nil {
-					ret = append(ret, changers...)
-					loaded = true
-					break
-				}
-			}
-			if !loaded {
-				return nil, fmt.Errorf("unable to discover change maker for %s", cm.Name)
+			changers, err := f.loadOne(cm, rcm)
+			if err != nil {
+				return nil, err
 			}
+			ret = append(ret, changers...)
 		}
 	}
 	return ret, nil
 }
 
+// NamedChanger is a WorkingTreeChanger and the name of the per repo change maker config it came from
+type NamedChanger struct {
+	Name    string
+	Changer WorkingTreeChanger
+	// Err is set, and Changer is nil, if the change maker could not be loaded
+	Err error
+}
+
+// LoadNamed is like Load, but a change maker that cannot be loaded does not stop the others from loading
+func (f *Factory) LoadNamed(changeMakers []autobotcfg.ChangeMakerConfig, repoCfg autobotcfg.AutobotPerRepoConfig) []NamedChanger {
+	var ret []NamedChanger
+	for _, rcm := range repoCfg.ChangeMakers {
+		for _, cm := range changeMakers {
+			if cm.Name != rcm.Name {
+				continue
+			}
+			changers, err := f.loadOne(cm, rcm)
+			if err != nil {
+				ret = append(ret, NamedChanger{
+					Name: rcm.Name,
+					Err:  err,
+				})
+				continue
+			}
+			for _, c := range changers {
+				ret = append(ret, NamedChanger{
+					Name:    rcm.Name,
+					Changer: c,
+				})
+			}
+		}
+	}
+	return ret
+}
+
+func (f *Factory) loadOne(cm autobotcfg.ChangeMakerConfig, rcm autobotcfg.PerRepoChangeMakerConfig) ([]WorkingTreeChanger, error) {
+	for _, factory := range f.Factories {
+		changers, err := factory(cm, rcm)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load change maker for %s: %w", cm.Name, err)
+		}
+		if changers != nil {
+			return changers, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to discover change maker for %s", cm.Name)
+}
+
 func MergeAnnotations(original *CommitAnnotations, priority *CommitAnnotations) *CommitAnnotations {
 	if original == nil {
 		return priority
@@ -128,6 +190,7 @@ func MergeAnnotations(original *CommitAnnotations, priority *CommitAnnotations)
 	return &CommitAnnotations{
 		AutoApprove: original.AutoApprove || priority.AutoApprove,
 		AutoMerge:   original.AutoMerge || priority.AutoMerge,
+		PolicyRule:  priority.PolicyRule,
 	}
 }
 
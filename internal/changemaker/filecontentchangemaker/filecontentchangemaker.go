@@ -1,17 +1,21 @@
 package filecontentchangemaker
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
 	"github.com/cresta/gitops-autobot/internal/changemaker"
+	"github.com/cresta/gitops-autobot/internal/marker"
 	"github.com/cresta/zapctx"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
 )
 
 type FileContentWorkingTreeChanger struct {
@@ -19,6 +23,16 @@ type FileContentWorkingTreeChanger struct {
 	Logger             *zapctx.Logger
 	Cfg                autobotcfg.ChangeMakerConfig
 	PerRepo            autobotcfg.PerRepoChangeMakerConfig
+	declined           changemaker.Declined
+}
+
+// SkipDeclined stops changes humans declined from being made again, and passes them on to the ContentChangeCheck if it
+// can skip them itself
+func (f *FileContentWorkingTreeChanger) SkipDeclined(declined changemaker.Declined) {
+	f.declined = declined
+	if skipper, ok := f.ContentChangeCheck.(changemaker.DeclinedSkipper); ok {
+		skipper.SkipDeclined(declined)
+	}
 }
 
 type ReadableFile interface {
@@ -64,6 +78,21 @@ func (f *FileContentWorkingTreeChanger) ChangeWorkingTree(w *git.Worktree, baseC
 	if err != nil {
 		return fmt.Errorf("unable to list files: %w", err)
 	}
+	if scanner, ok := f.ContentChangeCheck.(TreeScanner); ok {
+		if err := files.ForEach(func(file *object.File) error {
+			gf := gitFile{file: file}
+			if err := scanner.ScanFile(ctx, &gf); err != nil {
+				return fmt.Errorf("unable to scan file %s: %w", file.Name, err)
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("unable to scan each file: %w", err)
+		}
+		files, err = baseCommit.Files()
+		if err != nil {
+			return fmt.Errorf("unable to list files: %w", err)
+		}
+	}
 	var allChanges []ExpectedChange
 	err = files.ForEach(func(file *object.File) error {
 		if !f.PerRepo.MatchFile(file.Name) {
@@ -74,12 +103,25 @@ func (f *FileContentWorkingTreeChanger) ChangeWorkingTree(w *git.Worktree, baseC
 		if err != nil {
 			return fmt.Errorf("unable to get new content for file %s: %w", file.Name, err)
 		}
-		if fc != nil {
-			allChanges = append(allChanges, ExpectedChange{
-				FileChange: *fc,
-				FileName:   file.Name,
-			})
+		if fc == nil {
+			return nil
+		}
+		// The content is read twice: once to identify the change, and again to write it
+		var content bytes.Buffer
+		if _, err := fc.NewContent.WriteTo(&content); err != nil {
+			return fmt.Errorf("unable to read new content for file %s: %w", file.Name, err)
+		}
+		fc.NewContent = bytes.NewReader(content.Bytes())
+		ids := changeIDs(file.Name, fc.Versions, content.Bytes())
+		if f.isDeclined(ids) {
+			f.Logger.Info(ctx, "skipping change a human declined", zap.String("file", file.Name))
+			return nil
 		}
+		allChanges = append(allChanges, ExpectedChange{
+			FileChange: *fc,
+			FileName:   file.Name,
+			IDs:        ids,
+		})
 		return nil
 	})
 	if err != nil {
@@ -109,6 +151,7 @@ func (f *FileContentWorkingTreeChanger) ChangeWorkingTree(w *git.Worktree, baseC
 		annotations := changemaker.CommitAnnotations{
 			AutoMerge:   s.AutoMerge,
 			AutoApprove: s.AutoApprove,
+			PolicyRule:  s.PolicyRule,
 		}
 		for _, c := range s.Changes {
 			f, err := w.Filesystem.Create(c.FileName)
@@ -125,19 +168,69 @@ func (f *FileContentWorkingTreeChanger) ChangeWorkingTree(w *git.Worktree, baseC
 				return fmt.Errorf("unable to git add file %s: %w", c.FileName, err)
 			}
 		}
-		if _, err := gitCommitter.Commit(w, s.CommitTitle+"\n\n"+s.CommitMessage, nil, f.Cfg, f.PerRepo, &annotations); err != nil {
+		if _, err := gitCommitter.Commit(w, s.CommitTitle+"\n\n"+s.CommitMessage+changeIDLines(s.Changes), nil, f.Cfg, f.PerRepo, &annotations); err != nil {
 			return fmt.Errorf("unable to run get commit: %w", err)
 		}
 	}
 	return nil
 }
 
+// isDeclined is true if every part of a change was declined
+func (f *FileContentWorkingTreeChanger) isDeclined(ids []marker.ChangeID) bool {
+	if f.declined == nil || len(ids) == 0 {
+		return false
+	}
+	for _, id := range ids {
+		if !f.declined.IsDeclined(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// changeIDs identifies the change to fileName by the versions it upgrades to, or by its new content if there are none
+func changeIDs(fileName string, versions map[string]string, content []byte) []marker.ChangeID {
+	if len(versions) == 0 {
+		return []marker.ChangeID{{
+			File:        fileName,
+			ContentHash: plumbing.ComputeHash(plumbing.BlobObject, content).String(),
+		}}
+	}
+	ret := make([]marker.ChangeID, 0, len(versions))
+	for name, version := range versions {
+		ret = append(ret, marker.ChangeID{
+			File:    fileName,
+			Name:    name,
+			Version: version,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// changeIDLines records every change of a commit, so it is recognised if a human declines its PR
+func changeIDLines(changes []SingleChange) string {
+	var ret strings.Builder
+	for _, c := range changes {
+		for _, id := range c.IDs {
+			ret.WriteString("\n" + marker.ChangeIDLine(id))
+		}
+	}
+	if ret.Len() == 0 {
+		return ""
+	}
+	return ret.String() + "\n"
+}
+
 type GroupedChange struct {
 	CommitTitle   string
 	CommitMessage string
 	GroupHash     string
 	AutoMerge     bool
 	AutoApprove   bool
+	PolicyRule    string
 	Changes       []SingleChange
 }
 
@@ -161,6 +254,7 @@ func branchName(changes []SingleChange) string {
 type SingleChange struct {
 	FileName   string
 	NewContent io.WriterTo
+	IDs        []marker.ChangeID
 }
 
 func splitChange(ec []ExpectedChange) []GroupedChange {
@@ -170,6 +264,7 @@ func splitChange(ec []ExpectedChange) []GroupedChange {
 		thisChange := SingleChange{
 			FileName:   c.FileName,
 			NewContent: c.NewContent,
+			IDs:        c.IDs,
 		}
 		if c.GroupHash == "" {
 			ret = append(ret, GroupedChange{
@@ -179,14 +274,22 @@ func splitChange(ec []ExpectedChange) []GroupedChange {
 				Changes:       []SingleChange{thisChange},
 				AutoMerge:     c.AutoMerge,
 				AutoApprove:   c.AutoApprove,
+				PolicyRule:    c.PolicyRule,
 			})
 			continue
 		}
 		if prev, exists := changesByHash[c.GroupHash]; exists {
 			prev.Changes = append(prev.Changes, thisChange)
 			prev.CommitMessage += "\n" + c.CommitMessage
-			prev.AutoMerge = prev.AutoMerge || c.AutoMerge
-			prev.AutoApprove = prev.AutoApprove || c.AutoApprove
+			if prev.PolicyRule != "" || c.PolicyRule != "" {
+				// The most cautious rule wins, so a policy cannot be bypassed by grouping with another file
+				prev.AutoMerge = prev.AutoMerge && c.AutoMerge
+				prev.AutoApprove = prev.AutoApprove && c.AutoApprove
+			} else {
+				prev.AutoMerge = prev.AutoMerge || c.AutoMerge
+				prev.AutoApprove = prev.AutoApprove || c.AutoApprove
+			}
+			prev.PolicyRule = joinPolicyRules(prev.PolicyRule, c.PolicyRule)
 		} else {
 			changesByHash[c.GroupHash] = &GroupedChange{
 				CommitTitle:   c.CommitTitle,
@@ -194,6 +297,7 @@ func splitChange(ec []ExpectedChange) []GroupedChange {
 				GroupHash:     c.GroupHash,
 				AutoMerge:     c.AutoMerge,
 				AutoApprove:   c.AutoApprove,
+				PolicyRule:    c.PolicyRule,
 				Changes:       []SingleChange{thisChange},
 			}
 		}
@@ -204,22 +308,45 @@ func splitChange(ec []ExpectedChange) []GroupedChange {
 	return ret
 }
 
+func joinPolicyRules(a string, b string) string {
+	if a == "" || a == b {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return a + "; " + b
+}
+
 type FileChange struct {
 	NewContent    io.WriterTo
 	CommitTitle   string
 	CommitMessage string
 	AutoApprove   bool
 	AutoMerge     bool
-	GroupHash     string
+	// PolicyRule is set when an upgrade policy (rather than annotations or config) decided AutoApprove and AutoMerge
+	PolicyRule string
+	GroupHash  string
+	// Versions maps each name the change upgrades, such as a chart, to its new version.  Declined changes are
+	// recognised by these, or by the new content if there are none.
+	Versions map[string]string
 }
 
 type ExpectedChange struct {
 	FileChange
 	FileName string
+	IDs      []marker.ChangeID
 }
 
 type ContentChangeCheck interface {
 	NewContent(ctx context.Context, file ReadableFile) (*FileChange, error)
 }
 
+// TreeScanner is optionally implemented by a ContentChangeCheck that needs to see every file of the tree (not just
+// the ones matching FileMatchRegex) before NewContent is called.  This lets a check resolve references across files.
+type TreeScanner interface {
+	ScanFile(ctx context.Context, file ReadableFile) error
+}
+
 var _ changemaker.WorkingTreeChanger = &FileContentWorkingTreeChanger{}
+var _ changemaker.DeclinedSkipper = &FileContentWorkingTreeChanger{}
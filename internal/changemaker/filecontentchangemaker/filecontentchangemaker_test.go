@@ -0,0 +1,25 @@
+package filecontentchangemaker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitChange_GroupedPolicy(t *testing.T) {
+	ret := splitChange([]ExpectedChange{
+		{FileName: "a.yaml", FileChange: FileChange{GroupHash: "g", AutoMerge: true, AutoApprove: true, PolicyRule: "gitdb patch bump"}},
+		{FileName: "b.yaml", FileChange: FileChange{GroupHash: "g", PolicyRule: "redis major bump"}},
+	})
+	require.Len(t, ret, 1)
+	require.False(t, ret[0].AutoMerge, "a forbidden bump keeps the whole group from auto merging")
+	require.False(t, ret[0].AutoApprove)
+	require.Equal(t, "gitdb patch bump; redis major bump", ret[0].PolicyRule)
+
+	ret = splitChange([]ExpectedChange{
+		{FileName: "a.yaml", FileChange: FileChange{GroupHash: "g", AutoMerge: true}},
+		{FileName: "b.yaml", FileChange: FileChange{GroupHash: "g"}},
+	})
+	require.Len(t, ret, 1)
+	require.True(t, ret[0].AutoMerge, "without a policy any annotation asking for auto merge is enough")
+}
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/Masterminds/semver/v3"
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
 	"github.com/cresta/gitops-autobot/internal/changemaker"
 	"github.com/cresta/gitops-autobot/internal/changemaker/filecontentchangemaker"
+	"github.com/cresta/gitops-autobot/internal/marker"
 	"github.com/cresta/gitops-autobot/internal/versionfetch/helm"
 	"github.com/cresta/zapctx"
 	"go.uber.org/zap"
@@ -18,6 +20,46 @@ type HelmChangeMaker struct {
 	RepoInfoLoader *helm.RepoInfoLoader
 	Parser         *helm.ChangeParser
 	Logger         *zapctx.Logger
+	// Policy, if set, decides auto approve and auto merge from how large each version bump is
+	Policy           *autobotcfg.UpgradePolicy
+	helmRepositories helm.HelmRepositories
+	declined         changemaker.Declined
+}
+
+// SkipDeclined makes NewContent pick the highest chart version a human did not decline
+func (h *HelmChangeMaker) SkipDeclined(declined changemaker.Declined) {
+	h.declined = declined
+}
+
+func (h *HelmChangeMaker) declinedVersions(fileName string, chartName string) func(version string) bool {
+	if h.declined == nil {
+		return nil
+	}
+	return func(version string) bool {
+		return h.declined.IsDeclined(marker.ChangeID{
+			File:    fileName,
+			Name:    chartName,
+			Version: version,
+		})
+	}
+}
+
+// ScanFile remembers every Flux HelmRepository in the checkout, so HelmRelease sourceRefs can be resolved to a URL
+func (h *HelmChangeMaker) ScanFile(_ context.Context, file filecontentchangemaker.ReadableFile) error {
+	if !strings.HasSuffix(file.Name(), ".yaml") && !strings.HasSuffix(file.Name(), ".yml") {
+		return nil
+	}
+	var buf bytes.Buffer
+	if _, err := file.WriteTo(&buf); err != nil {
+		return fmt.Errorf("unable to read content of file %s: %w", file.Name(), err)
+	}
+	if h.helmRepositories == nil {
+		h.helmRepositories = make(helm.HelmRepositories)
+	}
+	for k, v := range helm.FindHelmRepositories(strings.Split(buf.String(), "\n")) {
+		h.helmRepositories[k] = v
+	}
+	return nil
 }
 
 func (h *HelmChangeMaker) NewContent(ctx context.Context, file filecontentchangemaker.ReadableFile) (*filecontentchangemaker.FileChange, error) {
@@ -26,22 +68,37 @@ func (h *HelmChangeMaker) NewContent(ctx context.Context, file filecontentchange
 		return nil, fmt.Errorf("uable to read content of file %s: %w", file.Name(), err)
 	}
 	lines := strings.Split(buf.String(), "\n")
-	changes, err := helm.ParseHelmReleaseYAML(lines)
+	manifests, err := helm.ParseHelmManifests(lines, h.helmRepositories)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse manifests of file %s: %w", file.Name(), err)
+	}
+	for _, sourceRef := range manifests.UnresolvedSourceRefs {
+		h.Logger.Warn(ctx, "no HelmRepository found for HelmRelease sourceRef", zap.String("file", file.Name()), zap.String("sourceRef", sourceRef))
+	}
+	// Annotations belonging to a HelmRelease or Application were already handled above
+	legacyLines := append([]string(nil), lines...)
+	for _, lineNumber := range manifests.AnnotationLines {
+		legacyLines[lineNumber] = ""
+	}
+	legacyChanges, err := helm.ParseHelmReleaseYAML(legacyLines)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse lines of file %s: %w", file.Name(), err)
 	}
+	changes := append(manifests.Changes, legacyChanges...)
 	byRepo := helm.GroupChangesByRepo(changes)
 	hasChange := false
 	changeCommitMsg := ""
 	autoMerge := false
 	autoApprove := false
+	var policyRules []string
+	versions := make(map[string]string)
 	for repoURL, changesByRepo := range byRepo {
-		idxFile, err := h.RepoInfoLoader.LoadIndexFile(ctx, repoURL)
-		if err != nil {
-			return nil, fmt.Errorf("unable to load index file %s: %w", repoURL, err)
-		}
 		for _, change := range changesByRepo {
-			thisChange, err := h.Parser.LoadVersions(ctx, change, idxFile)
+			idxFile, err := h.RepoInfoLoader.LoadChartIndexFile(ctx, repoURL, change.UpgradeInfo.ChartName)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load index file %s: %w", repoURL, err)
+			}
+			thisChange, err := h.Parser.LoadVersions(ctx, change, idxFile, h.declinedVersions(file.Name(), change.UpgradeInfo.ChartName))
 			if err != nil {
 				return nil, fmt.Errorf("unable to parse versions: %w", err)
 			}
@@ -49,14 +106,29 @@ func (h *HelmChangeMaker) NewContent(ctx context.Context, file filecontentchange
 				continue
 			}
 			h.Logger.Debug(ctx, "line change", zap.String("old", change.CurrentVersionLine), zap.String("new", thisChange.NewLine))
-			if change.UpgradeInfo.AutoMerge != nil {
-				autoMerge = autoMerge || *change.UpgradeInfo.AutoMerge
-			}
-			if change.UpgradeInfo.AutoApprove != nil {
-				autoApprove = autoApprove || *change.UpgradeInfo.AutoApprove
+			if h.Policy != nil {
+				rule, reason, err := h.evaluatePolicy(change.UpgradeInfo.CurrentVersion, thisChange.NewVersion)
+				if err != nil {
+					return nil, fmt.Errorf("unable to evaluate upgrade policy: %w", err)
+				}
+				// The most cautious rule of every chart in the file wins
+				if len(policyRules) == 0 {
+					autoMerge, autoApprove = rule.AutoMerge, rule.AutoApprove
+				} else {
+					autoMerge, autoApprove = autoMerge && rule.AutoMerge, autoApprove && rule.AutoApprove
+				}
+				policyRules = append(policyRules, change.UpgradeInfo.ChartName+" "+reason)
+			} else {
+				if change.UpgradeInfo.AutoMerge != nil {
+					autoMerge = autoMerge || *change.UpgradeInfo.AutoMerge
+				}
+				if change.UpgradeInfo.AutoApprove != nil {
+					autoApprove = autoApprove || *change.UpgradeInfo.AutoApprove
+				}
 			}
 			changeCommitMsg += fmt.Sprintf("Changed %s %s => %s\n", change.UpgradeInfo.ChartName, change.UpgradeInfo.CurrentVersion, thisChange.NewVersion)
 			lines[thisChange.LineNumber] = thisChange.NewLine
+			versions[change.UpgradeInfo.ChartName] = thisChange.NewVersion
 			hasChange = true
 		}
 	}
@@ -68,11 +140,26 @@ func (h *HelmChangeMaker) NewContent(ctx context.Context, file filecontentchange
 			GroupHash:     "",
 			AutoMerge:     autoMerge,
 			AutoApprove:   autoApprove,
+			PolicyRule:    strings.Join(policyRules, "; "),
+			Versions:      versions,
 		}, nil
 	}
 	return nil, nil
 }
 
+func (h *HelmChangeMaker) evaluatePolicy(currentVersion string, newVersion string) (autobotcfg.UpgradeRule, string, error) {
+	from, err := semver.NewVersion(currentVersion)
+	if err != nil {
+		return autobotcfg.UpgradeRule{}, "", fmt.Errorf("unable to parse current version %s: %w", currentVersion, err)
+	}
+	to, err := semver.NewVersion(newVersion)
+	if err != nil {
+		return autobotcfg.UpgradeRule{}, "", fmt.Errorf("unable to parse new version %s: %w", newVersion, err)
+	}
+	rule, reason := h.Policy.Evaluate(from, to)
+	return rule, reason, nil
+}
+
 func MakeFactory(repoInfoLoader *helm.RepoInfoLoader, parser *helm.ChangeParser, logger *zapctx.Logger) changemaker.WorkingTreeChangerFactory {
 	return func(cfg autobotcfg.ChangeMakerConfig, perRepo autobotcfg.PerRepoChangeMakerConfig) ([]changemaker.WorkingTreeChanger, error) {
 		if cfg.Name != "helm" {
@@ -86,10 +173,12 @@ func MakeFactory(repoInfoLoader *helm.RepoInfoLoader, parser *helm.ChangeParser,
 			&filecontentchangemaker.FileContentWorkingTreeChanger{
 				Cfg:     cfg,
 				PerRepo: perRepo,
+				Logger:  logger,
 				ContentChangeCheck: &HelmChangeMaker{
 					Parser:         parser,
 					Logger:         logger,
 					RepoInfoLoader: repoInfoLoader,
+					Policy:         perRepo.UpgradePolicy,
 				},
 			},
 		}, nil
@@ -97,3 +186,5 @@ func MakeFactory(repoInfoLoader *helm.RepoInfoLoader, parser *helm.ChangeParser,
 }
 
 var _ filecontentchangemaker.ContentChangeCheck = &HelmChangeMaker{}
+var _ filecontentchangemaker.TreeScanner = &HelmChangeMaker{}
+var _ changemaker.DeclinedSkipper = &HelmChangeMaker{}
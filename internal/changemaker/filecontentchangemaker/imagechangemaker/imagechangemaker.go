@@ -0,0 +1,111 @@
+package imagechangemaker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/changemaker"
+	"github.com/cresta/gitops-autobot/internal/changemaker/filecontentchangemaker"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/image"
+	"github.com/cresta/zapctx"
+	"go.uber.org/zap"
+)
+
+type ImageChangeMaker struct {
+	Parser   *image.ChangeParser
+	Logger   *zapctx.Logger
+	declined changemaker.Declined
+}
+
+// SkipDeclined makes NewContent pick the highest tag of each image a human did not decline
+func (h *ImageChangeMaker) SkipDeclined(declined changemaker.Declined) {
+	h.declined = declined
+}
+
+func (h *ImageChangeMaker) declinedTags(fileName string, repository string) func(tag string) bool {
+	if h.declined == nil {
+		return nil
+	}
+	return func(tag string) bool {
+		return h.declined.IsDeclined(marker.ChangeID{
+			File:    fileName,
+			Name:    repository,
+			Version: tag,
+		})
+	}
+}
+
+func (h *ImageChangeMaker) NewContent(ctx context.Context, file filecontentchangemaker.ReadableFile) (*filecontentchangemaker.FileChange, error) {
+	var buf bytes.Buffer
+	if _, err := file.WriteTo(&buf); err != nil {
+		return nil, fmt.Errorf("unable to read content of file %s: %w", file.Name(), err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	changes, err := image.ParseImageYAML(lines)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse lines of file %s: %w", file.Name(), err)
+	}
+	hasChange := false
+	changeCommitMsg := ""
+	autoMerge := false
+	autoApprove := false
+	versions := make(map[string]string)
+	for _, change := range changes {
+		thisChange, err := h.Parser.LoadVersions(ctx, change, h.declinedTags(file.Name(), change.UpgradeInfo.Repository))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse versions: %w", err)
+		}
+		if thisChange == nil {
+			continue
+		}
+		h.Logger.Debug(ctx, "line change", zap.String("old", change.CurrentTagLine), zap.String("new", thisChange.NewLine))
+		if change.UpgradeInfo.AutoMerge != nil {
+			autoMerge = autoMerge || *change.UpgradeInfo.AutoMerge
+		}
+		if change.UpgradeInfo.AutoApprove != nil {
+			autoApprove = autoApprove || *change.UpgradeInfo.AutoApprove
+		}
+		changeCommitMsg += fmt.Sprintf("Changed %s %s => %s\n", change.UpgradeInfo.Repository, change.UpgradeInfo.CurrentTag, thisChange.NewTag)
+		lines[thisChange.LineNumber] = thisChange.NewLine
+		versions[change.UpgradeInfo.Repository] = thisChange.NewTag
+		hasChange = true
+	}
+	if hasChange {
+		return &filecontentchangemaker.FileChange{
+			NewContent:    strings.NewReader(strings.Join(lines, "\n")),
+			CommitTitle:   "Deploying new image version",
+			CommitMessage: changeCommitMsg,
+			GroupHash:     "",
+			AutoMerge:     autoMerge,
+			AutoApprove:   autoApprove,
+			Versions:      versions,
+		}, nil
+	}
+	return nil, nil
+}
+
+func MakeFactory(parser *image.ChangeParser, logger *zapctx.Logger) changemaker.WorkingTreeChangerFactory {
+	return func(cfg autobotcfg.ChangeMakerConfig, perRepo autobotcfg.PerRepoChangeMakerConfig) ([]changemaker.WorkingTreeChanger, error) {
+		if cfg.Name != "image" {
+			return nil, nil
+		}
+		return []changemaker.WorkingTreeChanger{
+			&filecontentchangemaker.FileContentWorkingTreeChanger{
+				Cfg:     cfg,
+				PerRepo: perRepo,
+				Logger:  logger,
+				ContentChangeCheck: &ImageChangeMaker{
+					Parser: parser,
+					Logger: logger,
+				},
+			},
+		}, nil
+	}
+}
+
+var _ filecontentchangemaker.ContentChangeCheck = &ImageChangeMaker{}
+var _ changemaker.DeclinedSkipper = &ImageChangeMaker{}
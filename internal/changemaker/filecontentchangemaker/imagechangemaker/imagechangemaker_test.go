@@ -0,0 +1,138 @@
+package imagechangemaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/cache"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/image"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/registry"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+type stringFile struct {
+	name    string
+	content string
+}
+
+func (s *stringFile) Name() string {
+	return s.name
+}
+
+func (s *stringFile) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, strings.NewReader(s.content))
+}
+
+func TestImageChangeMaker_NewContent(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/cresta/gitdb/tags/list", func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Query().Get("last") == "" {
+			writer.Header().Set("Link", `</v2/cresta/gitdb/tags/list?n=3&last=1.2.4>; rel="next"`)
+			require.NoError(t, json.NewEncoder(writer).Encode(map[string]interface{}{
+				"name": "cresta/gitdb",
+				"tags": []string{"latest", "1.2.3", "1.2.4"},
+			}))
+			return
+		}
+		require.NoError(t, json.NewEncoder(writer).Encode(map[string]interface{}{
+			"name": "cresta/gitdb",
+			"tags": []string{"1.3.0", "2.0.0", "master-abcdef"},
+		}))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	logger := testhelp.ZapTestingLogger(t)
+	cm := ImageChangeMaker{
+		Logger: logger,
+		Parser: &image.ChangeParser{
+			Tags: &registry.Client{
+				Client: srv.Client(),
+				Logger: logger,
+				Cache:  &cache.InMemoryCache{},
+			},
+		},
+	}
+	file := &stringFile{
+		name: "values.yaml",
+		content: `image:
+  # gitops-autobot: changer=image versionConstraint=1.x.x registry=` + srv.URL + `
+  repository: cresta/gitdb
+  tag: 1.2.3 # the current tag
+`,
+	}
+	change, err := cm.NewContent(context.Background(), file)
+	require.NoError(t, err)
+	require.NotNil(t, change)
+	var buf bytes.Buffer
+	_, err = change.NewContent.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "  tag: 1.3.0 # the current tag\n")
+	require.Equal(t, "Changed cresta/gitdb 1.2.3 => 1.3.0\n", change.CommitMessage)
+
+	file.content = strings.Replace(file.content, "1.2.3", "1.3.0", 1)
+	change, err = cm.NewContent(context.Background(), file)
+	require.NoError(t, err)
+	require.Nil(t, change)
+}
+
+// declinedSet is a changemaker.Declined of a fixed set of changes
+type declinedSet map[marker.ChangeID]bool
+
+func (d declinedSet) IsDeclined(id marker.ChangeID) bool {
+	return d[id]
+}
+
+func TestImageChangeMaker_SkipDeclined(t *testing.T) {
+	tags := map[string][]string{
+		"/v2/cresta/gitdb/tags/list": {"1.2.4", "1.3.0"},
+		"/v2/cresta/web/tags/list":   {"2.0.0", "2.1.0"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.NoError(t, json.NewEncoder(writer).Encode(map[string]interface{}{"tags": tags[request.URL.Path]}))
+	}))
+	defer srv.Close()
+	logger := testhelp.ZapTestingLogger(t)
+	cm := ImageChangeMaker{
+		Logger: logger,
+		Parser: &image.ChangeParser{
+			Tags: &registry.Client{
+				Client: srv.Client(),
+				Logger: logger,
+				Cache:  &cache.InMemoryCache{},
+			},
+		},
+	}
+	// A human declined gitdb 1.3.0, then web got a new version
+	cm.SkipDeclined(declinedSet{{File: "values.yaml", Name: "cresta/gitdb", Version: "1.3.0"}: true})
+	file := &stringFile{
+		name: "values.yaml",
+		content: `gitdb:
+  # gitops-autobot: changer=image versionConstraint=1.x.x registry=` + srv.URL + `
+  repository: cresta/gitdb
+  tag: 1.2.4
+web:
+  # gitops-autobot: changer=image versionConstraint=2.x.x registry=` + srv.URL + `
+  repository: cresta/web
+  tag: 2.0.0
+`,
+	}
+	change, err := cm.NewContent(context.Background(), file)
+	require.NoError(t, err)
+	require.NotNil(t, change)
+	var buf bytes.Buffer
+	_, err = change.NewContent.WriteTo(&buf)
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "  tag: 1.2.4\n", "the declined tag is not proposed again")
+	require.Contains(t, buf.String(), "  tag: 2.1.0\n")
+	require.Equal(t, "Changed cresta/web 2.0.0 => 2.1.0\n", change.CommitMessage)
+	require.Equal(t, map[string]string{"cresta/web": "2.1.0"}, change.Versions)
+}
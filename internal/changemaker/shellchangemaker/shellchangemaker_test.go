@@ -37,6 +37,14 @@ func (l LocalConfig) RemoteBranch() string {
 	return "master"
 }
 
+func (l LocalConfig) CloneDepth() int {
+	return 0
+}
+
+func (l LocalConfig) ForgeName() string {
+	return "github"
+}
+
 func (l LocalConfig) RemoteOwner() string {
 	panic("Not allowed to call")
 }
@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/forge"
 	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/metrics"
 	"github.com/cresta/zapctx"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
@@ -36,29 +39,46 @@ type RepoConfig interface {
 	RemoteBranch() string
 	RemoteOwner() string
 	RemoteName() string
+	// CloneDepth is how many commits of history to fetch, or 0 for all of it
+	CloneDepth() int
+	// ForgeName is where the repository is hosted, such as autobotcfg.ForgeGitHub
+	ForgeName() string
 	fmt.Stringer
 }
 
 var _ RepoConfig = &autobotcfg.RepoConfig{}
 
+// NewCheckout opens the clone of cfg kept in cloneDataDirectory, cloning it again if it is missing or broken
 func NewCheckout(ctx context.Context, logger *zapctx.Logger, cfg RepoConfig, cloneDataDirectory string, auth transport.AuthMethod) (*Checkout, error) {
-	into, err := ioutil.TempDir(cloneDataDirectory, "checkout")
-	if err != nil {
-		return nil, fmt.Errorf("unable to clone into %s: %w", cloneDataDirectory, err)
+	if cloneDataDirectory == "" {
+		cloneDataDirectory = os.TempDir()
 	}
+	into := filepath.Join(cloneDataDirectory, DirectoryName(cfg))
 	ch := Checkout{
 		RepoConfig:        cfg,
 		auth:              auth,
-		Logger:            logger,
+		Logger:            logger.With(zap.String("repo", cfg.String())),
 		CheckoutDirectory: into,
 	}
+	repo, err := ch.reopen(ctx)
+	if err == nil {
+		ch.Repo = repo
+		return &ch, nil
+	}
+	if !errors.Is(err, git.ErrRepositoryNotExists) {
+		ch.Logger.IfErr(err).Warn(ctx, "existing clone is unusable: cloning again")
+	}
+	if err := os.RemoveAll(into); err != nil {
+		return nil, fmt.Errorf("unable to remove old clone %s: %w", into, err)
+	}
 	var progress bytes.Buffer
-	repo, err := git.PlainCloneContext(ctx, into, false, &git.CloneOptions{
+	repo, err = git.PlainCloneContext(ctx, into, false, &git.CloneOptions{
 		URL:           cfg.CloneURL(),
 		Auth:          ch.auth,
 		Progress:      &progress,
 		SingleBranch:  true,
 		ReferenceName: plumbing.NewBranchReferenceName(cfg.RemoteBranch()),
+		Depth:         cfg.CloneDepth(),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to do initial clone of %s: %w", cfg.CloneURL(), err)
@@ -75,15 +95,31 @@ func (c *Checkout) Refresh(ctx context.Context) error {
 		return fmt.Errorf("unable to list remotes: %w", err)
 	}
 	for _, r := range remotes {
-		if err := r.FetchContext(ctx, &git.FetchOptions{
-			Auth: c.auth,
-		}); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		if err := c.fetch(ctx, r, nil, c.RepoConfig.CloneDepth()); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
 			return fmt.Errorf("unable to fetch from remote %s: %w", r.Config().Name, err)
 		}
 	}
 	return nil
 }
 
+// fetch refSpecs, or the configured refspecs of the remote if empty
+func (c *Checkout) fetch(ctx context.Context, r *git.Remote, refSpecs []config.RefSpec, depth int) error {
+	shallow, err := isShallow(c.Repo)
+	if err != nil {
+		return fmt.Errorf("unable to check for shallow clone: %w", err)
+	}
+	if shallow {
+		// go-git walks the history of local refs to tell the remote what we have, and fails when that walk reaches
+		// the missing parents of a shallow commit.  Hide local refs so we only ask for what is missing.
+		r = git.NewRemote(hiddenRefsStorer{Storer: c.Repo.Storer}, r.Config())
+	}
+	return r.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: refSpecs,
+		Auth:     c.auth,
+		Depth:    depth,
+	})
+}
+
 const gitopsAutobotDefaultBranch = "gitops-autobot-start"
 
 func (c *Checkout) Clean(ctx context.Context) error {
@@ -135,6 +171,25 @@ func (c *Checkout) Clean(ctx context.Context) error {
 	return nil
 }
 
+// NewBranches lists the branches that change makers made since the last Clean
+func (c *Checkout) NewBranches() ([]string, error) {
+	bItr, err := c.Repo.Branches()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get branch iterator: %w", err)
+	}
+	defer bItr.Close()
+	var ret []string
+	if err := bItr.ForEach(func(reference *plumbing.Reference) error {
+		if reference.Name().Short() != gitopsAutobotDefaultBranch {
+			ret = append(ret, reference.Name().Short())
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to iterate branches: %w", err)
+	}
+	return ret, nil
+}
+
 const perRepoConfigFilename = ".gitops-autobot"
 
 func (c *Checkout) CurrentConfig(ctx context.Context) (*autobotcfg.AutobotPerRepoConfig, error) {
@@ -189,7 +244,14 @@ func (c *Checkout) SetupForWorkingTreeChanger(ctx context.Context) (*git.Worktre
 	return w, commitObj, nil
 }
 
-func (c *Checkout) PushAllNewBranches(ctx context.Context, client ghapp.GithubAPI) error {
+type PushOptions struct {
+	// MarkerSigner, if set, replaces the auto approve/merge lines of the PR body with a marker signed for the pushed commit
+	MarkerSigner *marker.Signer
+	// PRFilter limits the open pull requests searched when updating a branch that already exists
+	PRFilter ghapp.PRFilter
+}
+
+func (c *Checkout) PushAllNewBranches(ctx context.Context, client ghapp.GithubAPI, opts PushOptions) error {
 	c.Logger.Debug(ctx, "+Checkout.PushAllNewBranches")
 	defer c.Logger.Debug(ctx, "-Checkout.PushAllNewBranches")
 	var branchesToPush []config.RefSpec
@@ -199,6 +261,7 @@ func (c *Checkout) PushAllNewBranches(ctx context.Context, client ghapp.GithubAP
 	}
 	defer bItr.Close()
 	toPushToPr := make(map[config.RefSpec]*github.NewPullRequest)
+	headOfBranch := make(map[config.RefSpec]plumbing.Hash)
 	if err := bItr.ForEach(func(reference *plumbing.Reference) error {
 		if reference.Name().Short() == gitopsAutobotDefaultBranch {
 			return nil
@@ -209,6 +272,7 @@ func (c *Checkout) PushAllNewBranches(ctx context.Context, client ghapp.GithubAP
 		}
 		refSpec := config.RefSpec(reference.Name().String() + ":" + reference.Name().String())
 		toPushToPr[refSpec] = extractGithubTitleAndMsg(commitObj.Message, reference.Name().Short())
+		headOfBranch[refSpec] = reference.Hash()
 		c.Logger.Debug(ctx, "pushing a branch", zap.String("branch", reference.String()))
 		branchesToPush = append(branchesToPush, refSpec)
 		return nil
@@ -218,13 +282,16 @@ func (c *Checkout) PushAllNewBranches(ctx context.Context, client ghapp.GithubAP
 	c.Logger.Debug(ctx, "pushing new branches", zap.Any("all_branches", branchesToPush))
 	repoInfo, queryErr := client.RepositoryInfo(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName())
 	if queryErr != nil {
-		return fmt.Errorf("unable to execute graphql query: %w", err)
+		return fmt.Errorf("unable to execute graphql query: %w", queryErr)
 	}
 	for _, b := range branchesToPush {
 		if exists, err := client.DoesBranchExist(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), b.Src()); err != nil {
 			c.Logger.IfErr(err).Warn(ctx, "unable to verify if branch exists.  Assume it does not")
 		} else if exists {
-			c.Logger.Debug(ctx, "branch exists.  Skipping another PR")
+			c.Logger.Debug(ctx, "branch exists.  Updating its PR instead of making another")
+			if err := c.updateExistingBranch(ctx, client, b, headOfBranch[b], toPushToPr[b], opts); err != nil {
+				return fmt.Errorf("unable to update existing branch %s: %w", b.Src(), err)
+			}
 			continue
 		}
 		// Fetch commit object to build github PR message
@@ -248,19 +315,150 @@ func (c *Checkout) PushAllNewBranches(ctx context.Context, client ghapp.GithubAP
 		}
 		prObj.Base = github.String(c.RepoConfig.RemoteBranch())
 		prObj.Head = github.String(b.Reverse().Src())
+		body := c.signBody(prObj.GetBody(), plumbing.ReferenceName(b.Src()).Short(), headOfBranch[b], opts)
 		if _, err := client.CreatePullRequest(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), githubv4.CreatePullRequestInput{
 			RepositoryID: repoInfo.Repository.ID,
 			BaseRefName:  repoInfo.Repository.DefaultBranchRef.Name,
 			HeadRefName:  githubv4.String(b.Src()),
-			Title:        githubv4.String(*prObj.Title),
-			Body:         githubv4.NewString(githubv4.String(*prObj.Body)),
+			Title:        githubv4.String(prObj.GetTitle()),
+			Body:         githubv4.NewString(githubv4.String(body)),
 		}); err != nil {
 			return fmt.Errorf("unable to create PR for new push: %w", err)
 		}
+		metrics.PullRequests.WithLabelValues(c.repoLabel(), metrics.ActionCreate).Inc()
 	}
 	return nil
 }
 
+// PushNewBranchesToForge pushes every new branch and opens a merge request for it on a forge other than GitHub.
+// Branches that already exist on the remote are left alone.
+func (c *Checkout) PushNewBranchesToForge(ctx context.Context, f forge.Forge, opts PushOptions) error {
+	c.Logger.Debug(ctx, "+Checkout.PushNewBranchesToForge")
+	defer c.Logger.Debug(ctx, "-Checkout.PushNewBranchesToForge")
+	bItr, err := c.Repo.Branches()
+	if err != nil {
+		return fmt.Errorf("unable to get branch iterator: %w", err)
+	}
+	defer bItr.Close()
+	return bItr.ForEach(func(reference *plumbing.Reference) error {
+		if reference.Name().Short() == gitopsAutobotDefaultBranch {
+			return nil
+		}
+		if exists, err := f.DoesBranchExist(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), reference.Name().String()); err != nil {
+			c.Logger.IfErr(err).Warn(ctx, "unable to verify if branch exists.  Assume it does not")
+		} else if exists {
+			c.Logger.Debug(ctx, "branch exists.  Leaving its merge request alone", zap.String("branch", reference.Name().Short()))
+			return nil
+		}
+		commitObj, err := c.Repo.CommitObject(reference.Hash())
+		if err != nil {
+			return fmt.Errorf("unable to find commit object for branch %s: %w", reference.Name().String(), err)
+		}
+		refSpec := config.RefSpec(reference.Name().String() + ":" + reference.Name().String())
+		if err := c.Repo.PushContext(ctx, &git.PushOptions{
+			RemoteName: "origin",
+			RefSpecs:   []config.RefSpec{refSpec},
+			Auth:       c.auth,
+		}); err != nil {
+			if strings.HasPrefix(err.Error(), "non-fast-forward update") {
+				c.Logger.Debug(ctx, "non fast forward update for branch and assumed it is already in a merge request", zap.String("branch", reference.Name().Short()))
+				return nil
+			}
+			return fmt.Errorf("unable to push to remote branch %s: %w", refSpec, err)
+		}
+		prObj := extractGithubTitleAndMsg(commitObj.Message, reference.Name().Short())
+		if _, err := f.CreateMergeRequest(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), forge.NewMergeRequest{
+			SourceBranch: reference.Name().Short(),
+			TargetBranch: c.RepoConfig.RemoteBranch(),
+			Title:        prObj.GetTitle(),
+			Body:         c.signBody(prObj.GetBody(), reference.Name().Short(), reference.Hash(), opts),
+		}); err != nil {
+			return fmt.Errorf("unable to create merge request for new push: %w", err)
+		}
+		metrics.PullRequests.WithLabelValues(c.repoLabel(), metrics.ActionCreate).Inc()
+		return nil
+	})
+}
+
+// repoLabel is the repository of the checkout, as labeled in metrics
+func (c *Checkout) repoLabel() string {
+	return c.RepoConfig.RemoteOwner() + "/" + c.RepoConfig.RemoteName()
+}
+
+// BranchChecker is anything that can tell if a branch exists on the remote, such as ghapp.GithubAPI or forge.Forge
+type BranchChecker interface {
+	DoesBranchExist(ctx context.Context, owner string, name string, ref string) (bool, error)
+}
+
+// WritePlan describes the branches that PushAllNewBranches would push, including a unified diff of each, without
+// pushing anything.  If client is set, branches that already exist on the remote are marked as skipped.
+func (c *Checkout) WritePlan(ctx context.Context, client BranchChecker, out io.Writer) error {
+	c.Logger.Debug(ctx, "+Checkout.WritePlan")
+	defer c.Logger.Debug(ctx, "-Checkout.WritePlan")
+	_, base, err := c.SetupForWorkingTreeChanger(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to find base commit: %w", err)
+	}
+	bItr, err := c.Repo.Branches()
+	if err != nil {
+		return fmt.Errorf("unable to get branch iterator: %w", err)
+	}
+	defer bItr.Close()
+	return bItr.ForEach(func(reference *plumbing.Reference) error {
+		if reference.Name().Short() == gitopsAutobotDefaultBranch {
+			return nil
+		}
+		commitObj, err := c.Repo.CommitObject(reference.Hash())
+		if err != nil {
+			return fmt.Errorf("unable to find commit object for branch %s: %w", reference.Name().String(), err)
+		}
+		prObj := extractGithubTitleAndMsg(commitObj.Message, reference.Name().Short())
+		var buf bytes.Buffer
+		buf.WriteString(fmt.Sprintf("=== %s branch %s\n", c.RepoConfig.String(), reference.Name().Short()))
+		if client != nil {
+			if exists, err := client.DoesBranchExist(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), reference.Name().String()); err != nil {
+				c.Logger.IfErr(err).Warn(ctx, "unable to verify if branch exists.  Assume it does not")
+			} else if exists {
+				buf.WriteString("branch already exists on remote: its PR would be updated instead of creating one\n")
+			}
+		}
+		buf.WriteString(fmt.Sprintf("title: %s\n", prObj.GetTitle()))
+		if actions := marker.RequestedActions(prObj.GetBody()); len(actions) > 0 {
+			buf.WriteString(fmt.Sprintf("annotations: %s\n", strings.Join(actions, ", ")))
+		}
+		if body := marker.StripMarkers(prObj.GetBody()); strings.TrimSpace(body) != "" {
+			buf.WriteString(fmt.Sprintf("body:\n%s\n", strings.TrimSpace(body)))
+		}
+		patch, err := base.Patch(commitObj)
+		if err != nil {
+			return fmt.Errorf("unable to diff branch %s: %w", reference.Name().String(), err)
+		}
+		buf.WriteString(patch.String())
+		buf.WriteString("\n")
+		if _, err := buf.WriteTo(out); err != nil {
+			return fmt.Errorf("unable to write plan: %w", err)
+		}
+		return nil
+	})
+}
+
+// signBody swaps the plain auto approve/merge lines that the committer wrote for a marker signed for this exact commit
+func (c *Checkout) signBody(body string, branch string, head plumbing.Hash, opts PushOptions) string {
+	if opts.MarkerSigner == nil {
+		return body
+	}
+	actions := marker.RequestedActions(body)
+	if len(actions) == 0 {
+		return body
+	}
+	return marker.StripMarkers(body) + "\n\n" + opts.MarkerSigner.Sign(marker.Marker{
+		Repository: c.RepoConfig.RemoteOwner() + "/" + c.RepoConfig.RemoteName(),
+		Branch:     branch,
+		HeadOID:    head.String(),
+		Actions:    actions,
+	})
+}
+
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
@@ -0,0 +1,395 @@
+package checkout
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/forge"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/shurcooL/githubv4"
+	"github.com/stretchr/testify/require"
+)
+
+type localConfig struct {
+	path  string
+	depth int
+}
+
+func (l localConfig) String() string {
+	return l.path
+}
+
+func (l localConfig) CloneURL() string {
+	return l.path
+}
+
+func (l localConfig) RemoteBranch() string {
+	return "master"
+}
+
+func (l localConfig) CloneDepth() int {
+	return l.depth
+}
+
+func (l localConfig) ForgeName() string {
+	return "github"
+}
+
+func (l localConfig) RemoteOwner() string {
+	return "cresta"
+}
+
+func (l localConfig) RemoteName() string {
+	return "gitops"
+}
+
+var testSignature = &object.Signature{
+	Name:  "John Doe",
+	Email: "john.doe@example.com",
+	When:  time.Now(),
+}
+
+func commitFile(t *testing.T, wt *git.Worktree, name string, content string, msg string) plumbing.Hash {
+	require.NoError(t, ioutil.WriteFile(filepath.Join(wt.Filesystem.Root(), name), []byte(content), 0600))
+	_, err := wt.Add(name)
+	require.NoError(t, err)
+	h, err := wt.Commit(msg, &git.CommitOptions{
+		Author: testSignature,
+	})
+	require.NoError(t, err)
+	return h
+}
+
+func TestCheckout_WritePlan(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir("", "TestCheckout_WritePlan")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+	origin, err := git.PlainInit(filepath.Join(td, "origin"), false)
+	require.NoError(t, err)
+	originWt, err := origin.Worktree()
+	require.NoError(t, err)
+	commitFile(t, originWt, "README.md", "hello\n", "initial commit")
+
+	co, err := NewCheckout(ctx, testhelp.ZapTestingLogger(t), localConfig{path: filepath.Join(td, "origin")}, td, nil)
+	require.NoError(t, err)
+	require.NoError(t, co.Clean(ctx))
+	wt, base, err := co.SetupForWorkingTreeChanger(ctx)
+	require.NoError(t, err)
+	require.NoError(t, wt.Checkout(&git.CheckoutOptions{
+		Hash:   base.Hash,
+		Branch: plumbing.NewBranchReferenceName("filechange_abc"),
+		Create: true,
+	}))
+	commitFile(t, wt, "README.md", "goodbye\n", "Say goodbye\n\nBecause we are leaving\ngitops-autobot: auto-merge=true")
+
+	var buf bytes.Buffer
+	require.NoError(t, co.WritePlan(ctx, nil, &buf))
+	plan := buf.String()
+	require.Contains(t, plan, "branch filechange_abc")
+	require.Contains(t, plan, "title: Say goodbye")
+	require.Contains(t, plan, "annotations: auto-merge")
+	require.Contains(t, plan, "Because we are leaving")
+	require.Contains(t, plan, "-hello\n+goodbye")
+	require.NotContains(t, plan, "gitops-autobot: auto-merge=true")
+}
+
+func TestNewCheckout_Reuse(t *testing.T) {
+	ctx := context.Background()
+	logger := testhelp.ZapTestingLogger(t)
+	td, err := ioutil.TempDir("", "TestNewCheckout_Reuse")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+	origin, err := git.PlainInit(filepath.Join(td, "origin"), false)
+	require.NoError(t, err)
+	originWt, err := origin.Worktree()
+	require.NoError(t, err)
+	commitFile(t, originWt, "README.md", "hello\n", "initial commit")
+	cfg := localConfig{path: filepath.Join(td, "origin")}
+	dataDir := filepath.Join(td, "data")
+
+	co, err := NewCheckout(ctx, logger, cfg, dataDir, nil)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dataDir, DirectoryName(cfg)), co.CheckoutDirectory)
+	reused := filepath.Join(co.CheckoutDirectory, ".git", "reused")
+	require.NoError(t, ioutil.WriteFile(reused, nil, 0600))
+
+	// Reopened, not cloned again
+	co, err = NewCheckout(ctx, logger, cfg, dataDir, nil)
+	require.NoError(t, err)
+	require.FileExists(t, reused)
+	require.NoError(t, co.Clean(ctx))
+
+	// A clone missing objects is replaced
+	require.NoError(t, os.RemoveAll(filepath.Join(co.CheckoutDirectory, ".git", "objects")))
+	require.NoError(t, os.Mkdir(filepath.Join(co.CheckoutDirectory, ".git", "objects"), 0700))
+	co, err = NewCheckout(ctx, logger, cfg, dataDir, nil)
+	require.NoError(t, err)
+	require.NoFileExists(t, reused)
+	require.NoError(t, co.Clean(ctx))
+
+	require.NoError(t, os.Mkdir(filepath.Join(dataDir, "checkout123456"), 0700))
+	require.NoError(t, os.Mkdir(filepath.Join(dataDir, "unrelated"), 0700))
+	require.NoError(t, GarbageCollect(ctx, logger, dataDir, []RepoConfig{cfg}))
+	require.NoDirExists(t, filepath.Join(dataDir, "checkout123456"))
+	require.DirExists(t, filepath.Join(dataDir, "unrelated"))
+	require.DirExists(t, co.CheckoutDirectory)
+	require.NoError(t, GarbageCollect(ctx, logger, dataDir, nil))
+	require.NoDirExists(t, co.CheckoutDirectory)
+}
+
+func TestCheckout_Shallow(t *testing.T) {
+	ctx := context.Background()
+	logger := testhelp.ZapTestingLogger(t)
+	td, err := ioutil.TempDir("", "TestCheckout_Shallow")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+	upstream, err := git.PlainInit(filepath.Join(td, "upstream"), false)
+	require.NoError(t, err)
+	upstreamWt, err := upstream.Worktree()
+	require.NoError(t, err)
+	for _, content := range []string{"one\n", "two\n", "three\n"} {
+		commitFile(t, upstreamWt, "README.md", content, "set to "+content)
+	}
+	origin, err := git.PlainClone(filepath.Join(td, "origin.git"), true, &git.CloneOptions{URL: filepath.Join(td, "upstream")})
+	require.NoError(t, err)
+	cfg := localConfig{path: filepath.Join(td, "origin.git"), depth: 1}
+	dataDir := filepath.Join(td, "data")
+
+	co, err := NewCheckout(ctx, logger, cfg, dataDir, nil)
+	require.NoError(t, err)
+	shallows, err := co.Repo.Storer.Shallow()
+	require.NoError(t, err)
+	require.Len(t, shallows, 1)
+
+	// Refresh picks up new commits without needing the history behind the shallow base
+	newHead := commitFile(t, upstreamWt, "README.md", "four\n", "set to four")
+	require.NoError(t, origin.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{"+refs/heads/*:refs/heads/*"}}))
+	require.NoError(t, co.Refresh(ctx))
+	require.NoError(t, co.Clean(ctx))
+	wt, base, err := co.SetupForWorkingTreeChanger(ctx)
+	require.NoError(t, err)
+	require.Equal(t, newHead, base.Hash)
+
+	require.NoError(t, wt.Checkout(&git.CheckoutOptions{
+		Hash:   base.Hash,
+		Branch: plumbing.NewBranchReferenceName("filechange_abc"),
+		Create: true,
+	}))
+	pushed := commitFile(t, wt, "README.md", "five\n", "set to five")
+	require.NoError(t, co.Repo.PushContext(ctx, &git.PushOptions{
+		RefSpecs: []config.RefSpec{"refs/heads/filechange_abc:refs/heads/filechange_abc"},
+	}))
+	ref, err := origin.Reference(plumbing.NewBranchReferenceName("filechange_abc"), true)
+	require.NoError(t, err)
+	require.Equal(t, pushed, ref.Hash())
+
+	// Asking for full history gets a full clone of its own, so both configs can be worked on at once
+	shallowDir := co.CheckoutDirectory
+	cfg.depth = 0
+	co, err = NewCheckout(ctx, logger, cfg, dataDir, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, shallowDir, co.CheckoutDirectory)
+	shallows, err = co.Repo.Storer.Shallow()
+	require.NoError(t, err)
+	require.Empty(t, shallows)
+}
+
+// fakeClient implements only what updating an existing branch uses
+type fakeClient struct {
+	ghapp.GithubAPI
+	prs      ghapp.GraphQLPRQuery
+	updates  []githubv4.UpdatePullRequestInput
+	comments []string
+}
+
+func (f *fakeClient) EveryOpenPullRequest(_ context.Context, _ string, _ string, _ ghapp.PRFilter) (*ghapp.GraphQLPRQuery, error) {
+	return &f.prs, nil
+}
+
+func (f *fakeClient) UpdatePullRequest(_ context.Context, _ string, _ string, in githubv4.UpdatePullRequestInput) (*ghapp.UpdatePullRequestOutput, error) {
+	f.updates = append(f.updates, in)
+	return &ghapp.UpdatePullRequestOutput{}, nil
+}
+
+func (f *fakeClient) PullRequestComments(_ context.Context, _ string, _ string, _ int) ([]ghapp.IssueComment, error) {
+	ret := make([]ghapp.IssueComment, 0, len(f.comments))
+	for _, c := range f.comments {
+		ret = append(ret, ghapp.IssueComment{Body: githubv4.String(c), ViewerDidAuthor: true})
+	}
+	return ret, nil
+}
+
+func (f *fakeClient) AddComment(_ context.Context, _ string, _ string, in githubv4.AddCommentInput) (*ghapp.AddCommentOutput, error) {
+	f.comments = append(f.comments, string(in.Body))
+	return &ghapp.AddCommentOutput{}, nil
+}
+
+func TestCheckout_updateExistingBranch(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir("", "TestCheckout_updateExistingBranch")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+	upstream, err := git.PlainInit(filepath.Join(td, "upstream"), false)
+	require.NoError(t, err)
+	upstreamWt, err := upstream.Worktree()
+	require.NoError(t, err)
+	commitFile(t, upstreamWt, "chart.yaml", "version: 1.2.0\n", "initial commit")
+	origin, err := git.PlainClone(filepath.Join(td, "origin.git"), true, &git.CloneOptions{URL: filepath.Join(td, "upstream")})
+	require.NoError(t, err)
+	co, err := NewCheckout(ctx, testhelp.ZapTestingLogger(t), localConfig{path: filepath.Join(td, "origin.git")}, filepath.Join(td, "data"), nil)
+	require.NoError(t, err)
+
+	var pr ghapp.GraphQLPRQueryNode
+	pr.Number = 7
+	pr.HeadRefName = "filechange_chart.yaml"
+	pr.Author.Login = "autobot"
+	client := &fakeClient{}
+	client.prs.Repository.PullRequests.Nodes = []ghapp.GraphQLPRQueryNode{pr}
+	branch := config.RefSpec("refs/heads/filechange_chart.yaml:refs/heads/filechange_chart.yaml")
+	// generate makes the branch the way a change maker would, returning its head
+	generate := func(version string) plumbing.Hash {
+		require.NoError(t, co.Clean(ctx))
+		wt, base, err := co.SetupForWorkingTreeChanger(ctx)
+		require.NoError(t, err)
+		require.NoError(t, wt.Checkout(&git.CheckoutOptions{
+			Hash:   base.Hash,
+			Branch: plumbing.NewBranchReferenceName("filechange_chart.yaml"),
+			Create: true,
+		}))
+		return commitFile(t, wt, "chart.yaml", "version: "+version+"\n", "Upgrade chart to "+version)
+	}
+	remoteHead := func() plumbing.Hash {
+		ref, err := origin.Reference(plumbing.NewBranchReferenceName("filechange_chart.yaml"), true)
+		require.NoError(t, err)
+		return ref.Hash()
+	}
+	update := func(head plumbing.Hash) {
+		prObj := extractGithubTitleAndMsg("Upgrade chart", "filechange_chart.yaml")
+		require.NoError(t, co.updateExistingBranch(ctx, client, branch, head, prObj, PushOptions{}))
+	}
+
+	first := generate("1.2.1")
+	require.NoError(t, co.Repo.PushContext(ctx, &git.PushOptions{RefSpecs: []config.RefSpec{branch}}))
+
+	// The same change, even on a newer base, is left alone
+	commitFile(t, upstreamWt, "README.md", "hello\n", "unrelated change")
+	require.NoError(t, origin.Fetch(&git.FetchOptions{RefSpecs: []config.RefSpec{"+refs/heads/*:refs/heads/*"}}))
+	require.NoError(t, co.Refresh(ctx))
+	update(generate("1.2.1"))
+	require.Equal(t, first, remoteHead())
+	require.Empty(t, client.updates)
+
+	// A newer change replaces it
+	second := generate("1.2.2")
+	update(second)
+	require.Equal(t, second, remoteHead())
+	require.Len(t, client.updates, 1)
+	require.Equal(t, "Upgrade chart", string(*client.updates[0].Title))
+
+	// Someone else pushes to the branch: comment once instead of overwriting them
+	editor, err := git.PlainClone(filepath.Join(td, "editor"), false, &git.CloneOptions{
+		URL:           filepath.Join(td, "origin.git"),
+		ReferenceName: plumbing.NewBranchReferenceName("filechange_chart.yaml"),
+	})
+	require.NoError(t, err)
+	editorWt, err := editor.Worktree()
+	require.NoError(t, err)
+	_, err = editorWt.Commit("hand edit", &git.CommitOptions{Author: &object.Signature{Name: "Jane", Email: "jane@example.com", When: time.Now()}})
+	require.NoError(t, err)
+	require.NoError(t, editor.Push(&git.PushOptions{}))
+	edited := remoteHead()
+	update(generate("1.2.3"))
+	update(generate("1.2.3"))
+	require.Equal(t, edited, remoteHead())
+	require.Len(t, client.updates, 1)
+	require.Len(t, client.comments, 1)
+	require.Contains(t, client.comments[0], "edited by hand")
+
+	// The comment, not the process, remembers what was noticed, so a restarted autobot does not repeat it
+	restarted, err := NewCheckout(ctx, testhelp.ZapTestingLogger(t), localConfig{path: filepath.Join(td, "origin.git")}, filepath.Join(td, "data"), nil)
+	require.NoError(t, err)
+	co = restarted
+	update(generate("1.2.3"))
+	require.Len(t, client.comments, 1)
+	update(generate("1.2.4"))
+	require.Len(t, client.comments, 2)
+	require.Equal(t, edited, remoteHead())
+}
+
+// fakeForge implements only what pushing to a forge uses
+type fakeForge struct {
+	forge.Forge
+	existing map[string]bool
+	created  []forge.NewMergeRequest
+}
+
+func (f *fakeForge) DoesBranchExist(_ context.Context, _ string, _ string, branch string) (bool, error) {
+	return f.existing[branch], nil
+}
+
+func (f *fakeForge) CreateMergeRequest(_ context.Context, _ string, _ string, in forge.NewMergeRequest) (*forge.MergeRequest, error) {
+	f.created = append(f.created, in)
+	return &forge.MergeRequest{}, nil
+}
+
+func TestCheckout_PushNewBranchesToForge(t *testing.T) {
+	ctx := context.Background()
+	td, err := ioutil.TempDir("", "TestCheckout_PushNewBranchesToForge")
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, os.RemoveAll(td))
+	}()
+	upstream, err := git.PlainInit(filepath.Join(td, "upstream"), false)
+	require.NoError(t, err)
+	upstreamWt, err := upstream.Worktree()
+	require.NoError(t, err)
+	commitFile(t, upstreamWt, "README.md", "hello\n", "initial commit")
+	origin, err := git.PlainClone(filepath.Join(td, "origin.git"), true, &git.CloneOptions{URL: filepath.Join(td, "upstream")})
+	require.NoError(t, err)
+	co, err := NewCheckout(ctx, testhelp.ZapTestingLogger(t), localConfig{path: filepath.Join(td, "origin.git")}, filepath.Join(td, "data"), nil)
+	require.NoError(t, err)
+	require.NoError(t, co.Clean(ctx))
+	wt, base, err := co.SetupForWorkingTreeChanger(ctx)
+	require.NoError(t, err)
+	for _, branch := range []string{"filechange_new", "filechange_old"} {
+		require.NoError(t, wt.Checkout(&git.CheckoutOptions{
+			Hash:   base.Hash,
+			Branch: plumbing.NewBranchReferenceName(branch),
+			Create: true,
+		}))
+		commitFile(t, wt, "README.md", branch+"\n", "Say "+branch+"\n\nBecause\ngitops-autobot: auto-merge=true")
+	}
+
+	f := &fakeForge{existing: map[string]bool{"refs/heads/filechange_old": true}}
+	require.NoError(t, co.PushNewBranchesToForge(ctx, f, PushOptions{}))
+	require.Len(t, f.created, 1)
+	require.Equal(t, forge.NewMergeRequest{
+		SourceBranch: "filechange_new",
+		TargetBranch: "master",
+		Title:        "Say filechange_new",
+		Body:         "Because\ngitops-autobot: auto-merge=true",
+	}, f.created[0])
+	_, err = origin.Reference(plumbing.NewBranchReferenceName("filechange_new"), true)
+	require.NoError(t, err)
+	_, err = origin.Reference(plumbing.NewBranchReferenceName("filechange_old"), true)
+	require.ErrorIs(t, err, plumbing.ErrReferenceNotFound)
+}
@@ -0,0 +1,138 @@
+package checkout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/cresta/zapctx"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.uber.org/zap"
+)
+
+// checkoutDirPrefix starts the name of every directory autobot clones into.  Older versions used
+// ioutil.TempDir(dir, "checkout"), so those directories are also garbage collected.
+const checkoutDirPrefix = "checkout"
+
+var unsafeDirChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// DirectoryName is the directory, inside the clone data directory, that cfg is always cloned into.  Configs that differ
+// only in clone depth get different directories, so they never share a worktree.
+func DirectoryName(cfg RepoConfig) string {
+	key := cfg.CloneURL() + "\n" + cfg.RemoteBranch()
+	if cfg.CloneDepth() != 0 {
+		// Full clones keep the directory they had before depth was part of the name
+		key += fmt.Sprintf("\n%d", cfg.CloneDepth())
+	}
+	h := sha256.Sum256([]byte(key))
+	readable := strings.Trim(unsafeDirChars.ReplaceAllString(cfg.String(), "_"), "_")
+	if len(readable) > 64 {
+		readable = readable[len(readable)-64:]
+	}
+	return fmt.Sprintf("%s-%s-%s", checkoutDirPrefix, readable, hex.EncodeToString(h[:])[:12])
+}
+
+// reopen opens an existing clone, returning an error if it is not a usable clone of c.RepoConfig
+func (c *Checkout) reopen(ctx context.Context) (*git.Repository, error) {
+	c.Logger.Debug(ctx, "+Checkout.reopen")
+	defer c.Logger.Debug(ctx, "-Checkout.reopen")
+	repo, err := git.PlainOpen(c.CheckoutDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", c.CheckoutDirectory, err)
+	}
+	origin, err := repo.Remote("origin")
+	if err != nil {
+		return nil, fmt.Errorf("unable to find origin remote: %w", err)
+	}
+	if urls := origin.Config().URLs; len(urls) == 0 || urls[0] != c.RepoConfig.CloneURL() {
+		return nil, fmt.Errorf("origin remote %v is not %s", urls, c.RepoConfig.CloneURL())
+	}
+	if shallow, err := isShallow(repo); err != nil {
+		return nil, fmt.Errorf("unable to check for shallow clone: %w", err)
+	} else if shallow && c.RepoConfig.CloneDepth() == 0 {
+		return nil, fmt.Errorf("clone is shallow but full history is configured")
+	}
+	if err := verifyRemoteBranch(repo, c.RepoConfig.RemoteBranch()); err != nil {
+		return nil, fmt.Errorf("unable to verify clone: %w", err)
+	}
+	c.Logger.Info(ctx, "reusing existing clone", zap.String("dir", c.CheckoutDirectory))
+	return repo, nil
+}
+
+// verifyRemoteBranch checks that every object reachable from the tip of the remote branch is stored.  It is a cheap
+// stand in for git fsck that catches clones cut short by a restart.
+func verifyRemoteBranch(repo *git.Repository, branch string) error {
+	ref, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err != nil {
+		return fmt.Errorf("unable to get remote reference: %w", err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return fmt.Errorf("unable to get commit object %s: %w", ref.Hash(), err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("unable to get tree of %s: %w", ref.Hash(), err)
+	}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to walk tree of %s: %w", ref.Hash(), err)
+		}
+		if entry.Mode == filemode.Submodule || entry.Mode == filemode.Dir {
+			continue
+		}
+		if err := repo.Storer.HasEncodedObject(entry.Hash); err != nil {
+			return fmt.Errorf("missing object %s for %s: %w", entry.Hash, name, err)
+		}
+	}
+}
+
+// GarbageCollect removes clone directories in cloneDataDirectory that do not belong to any of keep
+func GarbageCollect(ctx context.Context, logger *zapctx.Logger, cloneDataDirectory string, keep []RepoConfig) error {
+	logger.Debug(ctx, "+GarbageCollect")
+	defer logger.Debug(ctx, "-GarbageCollect")
+	if cloneDataDirectory == "" {
+		cloneDataDirectory = os.TempDir()
+	}
+	keepNames := make(map[string]struct{}, len(keep))
+	for _, k := range keep {
+		keepNames[DirectoryName(k)] = struct{}{}
+	}
+	entries, err := ioutil.ReadDir(cloneDataDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("unable to list %s: %w", cloneDataDirectory, err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), checkoutDirPrefix) {
+			continue
+		}
+		if _, exists := keepNames[e.Name()]; exists {
+			continue
+		}
+		logger.Info(ctx, "removing stale clone", zap.String("dir", e.Name()))
+		if err := os.RemoveAll(filepath.Join(cloneDataDirectory, e.Name())); err != nil {
+			return fmt.Errorf("unable to remove stale clone %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package checkout
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+func isShallow(repo *git.Repository) (bool, error) {
+	shallows, err := repo.Storer.Shallow()
+	if err != nil {
+		return false, err
+	}
+	return len(shallows) > 0, nil
+}
+
+// hiddenRefsStorer lists no references, so a fetch into it only negotiates by the objects it wants
+type hiddenRefsStorer struct {
+	storage.Storer
+}
+
+func (h hiddenRefsStorer) IterReferences() (storer.ReferenceIter, error) {
+	return storer.NewReferenceSliceIter(nil), nil
+}
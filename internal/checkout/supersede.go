@@ -0,0 +1,252 @@
+package checkout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-github/v29/github"
+	"github.com/shurcooL/githubv4"
+	"go.uber.org/zap"
+)
+
+// existingBranchDepth is the least history fetched of an existing branch, so the autobot commit under any merges of
+// the base branch can be found even in shallow clones
+const existingBranchDepth = 10
+
+// updateExistingBranch replaces the content of a branch that is already on the remote, and the title and body of its
+// PR, if the change autobot would make now is different or the PR needs regenerating.  PRs that a human pushed to or
+// edited get a comment instead.
+func (c *Checkout) updateExistingBranch(ctx context.Context, client ghapp.GithubAPI, b config.RefSpec, head plumbing.Hash, prObj *github.NewPullRequest, opts PushOptions) error {
+	c.Logger.Debug(ctx, "+Checkout.updateExistingBranch")
+	defer c.Logger.Debug(ctx, "-Checkout.updateExistingBranch")
+	branch := plumbing.ReferenceName(b.Src()).Short()
+	logger := c.Logger.With(zap.String("branch", branch))
+	pr, err := c.findOpenPR(ctx, client, branch, opts.PRFilter)
+	if err != nil {
+		return fmt.Errorf("unable to find PR: %w", err)
+	}
+	if pr == nil {
+		logger.Debug(ctx, "branch has no open PR.  Leaving it alone")
+		return nil
+	}
+	local, err := c.Repo.CommitObject(head)
+	if err != nil {
+		return fmt.Errorf("unable to find commit %s: %w", head, err)
+	}
+	remote, err := c.fetchExistingBranch(ctx, branch)
+	if err != nil {
+		return fmt.Errorf("unable to fetch remote branch: %w", err)
+	}
+	botCommit, humanCommit, err := findBotCommit(remote, local.Author.Email)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to read history of existing branch.  Leaving it alone")
+		return nil
+	}
+	localChange, err := changedFiles(local)
+	if err != nil {
+		return fmt.Errorf("unable to find change of %s: %w", local.Hash, err)
+	}
+	if botCommit != nil {
+		botChange, err := changedFiles(botCommit)
+		if err != nil {
+			return fmt.Errorf("unable to find change of %s: %w", botCommit.Hash, err)
+		}
+		if sameChange(localChange, botChange) && !c.needsRegenerating(pr, branch, prObj, opts) {
+			logger.Debug(ctx, "existing branch already has this change")
+			return nil
+		}
+	}
+	if humanCommit || (pr.Editor.Login != "" && pr.Editor.Login != pr.Author.Login) {
+		return c.noticeSuperseded(ctx, client, branch, local, localChange, pr)
+	}
+	logger.Info(ctx, "replacing outdated change on existing branch", zap.Int("pr", int(pr.Number)))
+	if err := c.Repo.PushContext(ctx, &git.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{config.RefSpec("+" + b.String())},
+		Auth:       c.auth,
+		// Only overwrite the commit we looked at
+		RequireRemoteRefs: []config.RefSpec{config.RefSpec(remote.Hash.String() + ":" + b.Src())},
+	}); err != nil {
+		return fmt.Errorf("unable to force push: %w", err)
+	}
+	if prObj == nil {
+		prObj = &github.NewPullRequest{}
+	}
+	title := githubv4.String(prObj.GetTitle())
+	body := githubv4.String(c.signBody(prObj.GetBody(), branch, head, opts))
+	if _, err := client.UpdatePullRequest(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), githubv4.UpdatePullRequestInput{
+		PullRequestID: pr.ID,
+		Title:         &title,
+		Body:          &body,
+	}); err != nil {
+		return fmt.Errorf("unable to update PR: %w", err)
+	}
+	return nil
+}
+
+// needsRegenerating is true if a PR whose change is still current must be made again on the current base anyway: it
+// conflicts, it is behind a base that requires up to date branches, or its signed marker does not verify for its head,
+// such as after someone updated the branch with its base.  Unlike a merge commit made by GitHub, the new head can have
+// its marker signed.  PRs that are merely behind are left alone, so CI and reviews are not reset every time the base
+// moves.
+func (c *Checkout) needsRegenerating(pr *ghapp.GraphQLPRQueryNode, branch string, prObj *github.NewPullRequest, opts PushOptions) bool {
+	if pr.Mergeable == githubv4.MergeableStateConflicting || pr.MergeStateStatus == ghapp.MergeStateStatusBehind {
+		return true
+	}
+	if opts.MarkerSigner == nil || len(marker.RequestedActions(prObj.GetBody())) == 0 {
+		return false
+	}
+	repository := c.RepoConfig.RemoteOwner() + "/" + c.RepoConfig.RemoteName()
+	return len(opts.MarkerSigner.VerifiedActions(string(pr.Body), repository, branch, string(pr.HeadRef.Target.Oid))) == 0
+}
+
+func (c *Checkout) findOpenPR(ctx context.Context, client ghapp.GithubAPI, branch string, filter ghapp.PRFilter) (*ghapp.GraphQLPRQueryNode, error) {
+	prs, err := client.EveryOpenPullRequest(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), filter)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list every pr: %w", err)
+	}
+	for idx := range prs.Repository.PullRequests.Nodes {
+		pr := &prs.Repository.PullRequests.Nodes[idx]
+		if string(pr.HeadRefName) == branch && !bool(pr.IsCrossRepository) {
+			return pr, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *Checkout) fetchExistingBranch(ctx context.Context, branch string) (*object.Commit, error) {
+	remoteRef := plumbing.NewRemoteReferenceName("origin", branch)
+	origin, err := c.Repo.Remote("origin")
+	if err != nil {
+		return nil, fmt.Errorf("unable to find origin remote: %w", err)
+	}
+	depth := c.RepoConfig.CloneDepth()
+	if depth != 0 && depth < existingBranchDepth {
+		depth = existingBranchDepth
+	}
+	refSpec := config.RefSpec("+" + plumbing.NewBranchReferenceName(branch).String() + ":" + remoteRef.String())
+	if err := c.fetch(ctx, origin, []config.RefSpec{refSpec}, depth); err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("unable to fetch %s: %w", branch, err)
+	}
+	ref, err := c.Repo.Reference(remoteRef, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get remote reference: %w", err)
+	}
+	return c.Repo.CommitObject(ref.Hash())
+}
+
+// findBotCommit walks the first parents of head, past merges of the base branch, to the commit autobot made.  If a
+// commit by anyone else is found first, humanCommit is true.
+func findBotCommit(head *object.Commit, botEmail string) (botCommit *object.Commit, humanCommit bool, err error) {
+	current := head
+	for i := 0; i < existingBranchDepth; i++ {
+		if current.NumParents() <= 1 {
+			if current.Author.Email == botEmail {
+				return current, false, nil
+			}
+			return nil, true, nil
+		}
+		parent, err := current.Parent(0)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to find parent of %s: %w", current.Hash, err)
+		}
+		current = parent
+	}
+	return nil, true, nil
+}
+
+// sameChange is true if both change the same files to the same content, regardless of the base they were made on
+func sameChange(a map[string]plumbing.Hash, b map[string]plumbing.Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, h := range a {
+		if other, exists := b[name]; !exists || other != h {
+			return false
+		}
+	}
+	return true
+}
+
+// changedFiles maps each file a commit changes to its new blob, or the zero hash if it was removed
+func changedFiles(commit *object.Commit) (map[string]plumbing.Hash, error) {
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find parent of %s: %w", commit.Hash, err)
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tree of %s: %w", parent.Hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get tree of %s: %w", commit.Hash, err)
+	}
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return nil, fmt.Errorf("unable to diff %s: %w", commit.Hash, err)
+	}
+	ret := make(map[string]plumbing.Hash, len(changes))
+	for _, change := range changes {
+		if change.From.Name != "" {
+			ret[change.From.Name] = plumbing.ZeroHash
+		}
+		if change.To.Name != "" {
+			ret[change.To.Name] = change.To.TreeEntry.Hash
+		}
+	}
+	return ret, nil
+}
+
+// supersededMarker starts the hidden line of each "edited by hand" comment, which is followed by changeFingerprint
+const supersededMarker = "<!-- gitops-autobot:superseded "
+
+// changeFingerprint identifies a change made by changedFiles, whatever base it was made on
+func changeFingerprint(change map[string]plumbing.Hash) string {
+	names := make([]string, 0, len(change))
+	for name := range change {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		_, _ = fmt.Fprintf(h, "%s %s\n", name, change[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// noticeSuperseded comments, once per new change, that autobot would update a PR someone edited by hand.  The change
+// is remembered in a hidden marker of the comment, so restarts do not comment again.
+func (c *Checkout) noticeSuperseded(ctx context.Context, client ghapp.GithubAPI, branch string, local *object.Commit, change map[string]plumbing.Hash, pr *ghapp.GraphQLPRQueryNode) error {
+	marker := supersededMarker + changeFingerprint(change) + " -->"
+	comments, err := client.PullRequestComments(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), int(pr.Number))
+	if err != nil {
+		return fmt.Errorf("unable to list comments of edited PR: %w", err)
+	}
+	for _, comment := range comments {
+		if bool(comment.ViewerDidAuthor) && strings.Contains(string(comment.Body), marker) {
+			return nil
+		}
+	}
+	c.Logger.Info(ctx, "not updating edited PR", zap.String("branch", branch), zap.Int("pr", int(pr.Number)))
+	msg := fmt.Sprintf("%s\nautobot has a newer version of this change, but this PR was edited by hand so it was left alone.  "+
+		"Close this PR and delete its branch to get the new version:\n\n> %s", marker, extractGithubTitleAndMsg(local.Message, branch).GetTitle())
+	if _, err := client.AddComment(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), githubv4.AddCommentInput{
+		SubjectID: pr.ID,
+		Body:      githubv4.String(msg),
+	}); err != nil {
+		return fmt.Errorf("unable to comment on edited PR: %w", err)
+	}
+	return nil
+}
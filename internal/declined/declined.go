@@ -0,0 +1,190 @@
+package declined
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/marker"
+)
+
+// Record is an autobot pull request that a human closed without merging it
+type Record struct {
+	Number int `json:"number"`
+	// ID is the GraphQL node ID of the pull request, so it can be commented on
+	ID          string            `json:"id"`
+	Branch      string            `json:"branch"`
+	ChangeMaker string            `json:"changeMaker"`
+	Changes     []marker.ChangeID `json:"changes"`
+	ClosedAt    time.Time         `json:"closedAt"`
+	// Forgotten is set by "/autobot unignore".  The record is kept, so the same closed PR is not recorded again.
+	Forgotten bool `json:"forgotten,omitempty"`
+}
+
+// Store remembers the changes humans declined, per repository, in a JSON file
+type Store struct {
+	// Path is the file records are kept in.  If empty, records are only kept in memory.
+	Path string
+
+	mu sync.Mutex
+	// repos maps a lower case owner/name to each of its records, by PR number
+	repos map[string]map[int]*Record
+}
+
+// Load reads the records kept in path, if it exists
+func Load(path string) (*Store, error) {
+	s := &Store{
+		Path:  path,
+		repos: make(map[string]map[int]*Record),
+	}
+	if path == "" {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	var repos map[string][]*Record
+	if err := json.Unmarshal(b, &repos); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", path, err)
+	}
+	for repo, records := range repos {
+		byNumber := make(map[int]*Record, len(records))
+		for _, r := range records {
+			byNumber[r.Number] = r
+		}
+		s.repos[repo] = byNumber
+	}
+	return s, nil
+}
+
+func repoKey(owner string, name string) string {
+	return strings.ToLower(owner + "/" + name)
+}
+
+// Add records r, returning false if its PR was already recorded
+func (s *Store) Add(owner string, name string, r Record) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := repoKey(owner, name)
+	if _, exists := s.repos[key][r.Number]; exists {
+		return false, nil
+	}
+	if s.repos[key] == nil {
+		s.repos[key] = make(map[int]*Record)
+	}
+	s.repos[key][r.Number] = &r
+	return true, s.save()
+}
+
+// Ignore stops PR number from being recorded, because autobot is closing it itself
+func (s *Store) Ignore(owner string, name string, number int) error {
+	_, err := s.Add(owner, name, Record{
+		Number:    number,
+		Forgotten: true,
+	})
+	return err
+}
+
+// Get returns the record of PR number, or nil if it was never recorded
+func (s *Store) Get(owner string, name string, number int) *Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, exists := s.repos[repoKey(owner, name)][number]
+	if !exists {
+		return nil
+	}
+	ret := *r
+	return &ret
+}
+
+// Forget lets the changes of PR number be proposed again.  It returns the record, or nil if the PR was never recorded.
+func (s *Store) Forget(owner string, name string, number int) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, exists := s.repos[repoKey(owner, name)][number]
+	if !exists {
+		return nil, nil
+	}
+	ret := *r
+	if r.Forgotten {
+		return &ret, nil
+	}
+	r.Forgotten = true
+	ret.Forgotten = true
+	return &ret, s.save()
+}
+
+// For returns the changes declined for one change maker of a repository
+func (s *Store) For(owner string, name string, changeMaker string) Set {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret Set
+	for _, r := range s.repos[repoKey(owner, name)] {
+		if !r.Forgotten && r.ChangeMaker == changeMaker {
+			ret = append(ret, r.Changes...)
+		}
+	}
+	return ret
+}
+
+// save writes every record to Path.  The caller must hold mu.
+func (s *Store) save() error {
+	if s.Path == "" {
+		return nil
+	}
+	repos := make(map[string][]*Record, len(s.repos))
+	for repo, byNumber := range s.repos {
+		for _, r := range byNumber {
+			repos[repo] = append(repos[repo], r)
+		}
+	}
+	b, err := json.MarshalIndent(repos, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode declined changes: %w", err)
+	}
+	// Write then rename, so a restart part way through never leaves a truncated file
+	f, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path))
+	if err != nil {
+		return fmt.Errorf("unable to create temp file: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("unable to write %s: %w", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("unable to close %s: %w", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), s.Path); err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("unable to rename %s to %s: %w", f.Name(), s.Path, err)
+	}
+	return nil
+}
+
+// Set is the changes declined for one change maker of a repository
+type Set []marker.ChangeID
+
+// IsDeclined is true if a human declined id: the same file with the same name, upgraded to the same version or
+// changed to the same content
+func (s Set) IsDeclined(id marker.ChangeID) bool {
+	for _, d := range s {
+		if d.File != id.File || d.Name != id.Name {
+			continue
+		}
+		if (d.Version != "" && d.Version == id.Version) || (d.ContentHash != "" && d.ContentHash == id.ContentHash) {
+			return true
+		}
+	}
+	return false
+}
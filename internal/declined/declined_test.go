@@ -0,0 +1,47 @@
+package declined
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "declined-changes.json")
+	s, err := Load(path)
+	require.NoError(t, err)
+	chart := marker.ChangeID{File: "values.yaml", Name: "nginx", Version: "3.0.0"}
+	content := marker.ChangeID{File: "time.txt", ContentHash: "abc"}
+	added, err := s.Add("Cresta", "gitops", Record{Number: 1, ChangeMaker: "helm", Changes: []marker.ChangeID{chart}})
+	require.NoError(t, err)
+	require.True(t, added)
+	added, err = s.Add("cresta", "gitops", Record{Number: 1, ChangeMaker: "helm"})
+	require.NoError(t, err)
+	require.False(t, added, "a PR is only recorded once")
+	_, err = s.Add("cresta", "gitops", Record{Number: 2, ChangeMaker: "time", Changes: []marker.ChangeID{content}})
+	require.NoError(t, err)
+
+	reloaded, err := Load(path)
+	require.NoError(t, err)
+	helm := reloaded.For("cresta", "gitops", "helm")
+	require.True(t, helm.IsDeclined(chart))
+	require.False(t, helm.IsDeclined(marker.ChangeID{File: "values.yaml", Name: "nginx", Version: "3.0.1"}))
+	require.False(t, helm.IsDeclined(marker.ChangeID{File: "other.yaml", Name: "nginx", Version: "3.0.0"}))
+	require.False(t, helm.IsDeclined(content), "declines are per change maker")
+	require.True(t, reloaded.For("cresta", "gitops", "time").IsDeclined(content))
+	require.Empty(t, reloaded.For("cresta", "other", "helm"))
+
+	r, err := reloaded.Forget("cresta", "gitops", 1)
+	require.NoError(t, err)
+	require.True(t, r.Forgotten)
+	require.False(t, reloaded.For("cresta", "gitops", "helm").IsDeclined(chart))
+	added, err = reloaded.Add("cresta", "gitops", Record{Number: 1, ChangeMaker: "helm", Changes: []marker.ChangeID{chart}})
+	require.NoError(t, err)
+	require.False(t, added, "a forgotten PR is not recorded again")
+
+	r, err = reloaded.Forget("cresta", "gitops", 3)
+	require.NoError(t, err)
+	require.Nil(t, r)
+}
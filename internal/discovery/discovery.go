@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/zapctx"
+	"go.uber.org/zap"
+)
+
+// Discoverer finds the repositories the PR creator can access that match AutobotConfig.Discovery
+type Discoverer struct {
+	Client        ghapp.GithubAPI
+	AutobotConfig *autobotcfg.AutobotConfig
+	Logger        *zapctx.Logger
+}
+
+// Discover lists the matching repositories that are not already configured by hand, tracking their default branch
+func (d *Discoverer) Discover(ctx context.Context) ([]autobotcfg.RepoConfig, error) {
+	d.Logger.Debug(ctx, "+Discoverer.Discover")
+	defer d.Logger.Debug(ctx, "-Discoverer.Discover")
+	cfg := d.AutobotConfig.Discovery
+	if cfg == nil {
+		return nil, nil
+	}
+	repos, err := d.Client.AccessibleRepositories(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list accessible repositories: %w", err)
+	}
+	var ret []autobotcfg.RepoConfig
+	for _, r := range repos {
+		logger := d.Logger.With(zap.String("owner", r.Owner), zap.String("name", r.Name))
+		if r.Archived || r.DefaultBranch == "" {
+			logger.Debug(ctx, "skipping archived or empty repository")
+			continue
+		}
+		if !cfg.Matches(r.Owner, r.Name, r.Topics) {
+			continue
+		}
+		if d.configured(r.Owner, r.Name) {
+			continue
+		}
+		if cfg.RequireConfigFile {
+			// A missing file is an error like any other, so any failure skips the repository until the next refresh
+			if _, err := d.Client.GetContents(ctx, r.Owner, r.Name, ".gitops-autobot"); err != nil {
+				logger.Debug(ctx, "skipping repository without a config file", zap.Error(err))
+				continue
+			}
+		}
+		ret = append(ret, autobotcfg.RepoConfig{
+			Owner:    r.Owner,
+			Name:     r.Name,
+			Branch:   r.DefaultBranch,
+			Depth:    cfg.Depth,
+			ForgeURL: d.AutobotConfig.PRCreator.WebURL(),
+		})
+	}
+	return ret, nil
+}
+
+// configured is true if owner/name is in the Repos of the config, which take priority over discovered repositories
+func (d *Discoverer) configured(owner string, name string) bool {
+	for _, r := range d.AutobotConfig.Repos {
+		if r.ForgeName() == autobotcfg.ForgeGitHub && strings.EqualFold(r.Owner, owner) && strings.EqualFold(r.Name, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient implements only what discovery uses
+type fakeClient struct {
+	ghapp.GithubAPI
+	repos []ghapp.Repository
+	// configured are the owner/name of repositories with a .gitops-autobot file
+	configured map[string]bool
+}
+
+func (f *fakeClient) AccessibleRepositories(_ context.Context) ([]ghapp.Repository, error) {
+	return f.repos, nil
+}
+
+func (f *fakeClient) GetContents(_ context.Context, owner string, name string, _ string) (string, error) {
+	if !f.configured[owner+"/"+name] {
+		return "", errors.New("404 Not Found")
+	}
+	return "allowAutoMerge: true\n", nil
+}
+
+func TestDiscoverer_Discover(t *testing.T) {
+	client := &fakeClient{
+		repos: []ghapp.Repository{
+			{Owner: "cresta", Name: "app-gitops", DefaultBranch: "main", Topics: []string{"GitOps"}},
+			{Owner: "cresta", Name: "infra-gitops", DefaultBranch: "master", Topics: []string{"gitops"}},
+			{Owner: "cresta", Name: "old-gitops", DefaultBranch: "master", Topics: []string{"gitops"}, Archived: true},
+			{Owner: "cresta", Name: "website", DefaultBranch: "main", Topics: []string{"gitops"}},
+			{Owner: "cresta", Name: "notopic-gitops", DefaultBranch: "main"},
+			{Owner: "cresta", Name: "manual-gitops", DefaultBranch: "main", Topics: []string{"gitops"}},
+			{Owner: "cresta", Name: "empty-gitops", Topics: []string{"gitops"}},
+		},
+		configured: map[string]bool{"cresta/app-gitops": true, "cresta/infra-gitops": true},
+	}
+	cfg := &autobotcfg.AutobotConfig{
+		Repos: []autobotcfg.RepoConfig{{Owner: "Cresta", Name: "manual-gitops", Branch: "main"}},
+		Discovery: &autobotcfg.DiscoveryConfig{
+			Topics: []string{"gitops"},
+			Names:  []string{"cresta/*-gitops"},
+			Depth:  1,
+		},
+	}
+	d := Discoverer{
+		Client:        client,
+		AutobotConfig: cfg,
+		Logger:        testhelp.ZapTestingLogger(t),
+	}
+	ctx := context.Background()
+	repos, err := d.Discover(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []autobotcfg.RepoConfig{
+		{Owner: "cresta", Name: "app-gitops", Branch: "main", Depth: 1, ForgeURL: "https://github.com"},
+		{Owner: "cresta", Name: "infra-gitops", Branch: "master", Depth: 1, ForgeURL: "https://github.com"},
+	}, repos)
+	require.Equal(t, "https://github.com/cresta/app-gitops.git", repos[0].CloneURL())
+
+	client.configured["cresta/infra-gitops"] = false
+	cfg.Discovery.RequireConfigFile = true
+	repos, err = d.Discover(ctx)
+	require.NoError(t, err)
+	require.Len(t, repos, 1)
+	require.Equal(t, "app-gitops", repos[0].Name)
+
+	cfg.Discovery = nil
+	repos, err = d.Discover(ctx)
+	require.NoError(t, err)
+	require.Empty(t, repos)
+}
@@ -0,0 +1,121 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+// Forge is a git hosting service other than GitHub, such as GitLab.  Repositories are named by owner and name, where the
+// owner may be a nested group on forges that have them.
+//
+// GitHub is not behind this interface: the PR creator, reviewer and merger still use ghapp.GithubAPI, and repositories
+// on other forges are reviewed and merged by forgebot instead.  See autobotcfg.GitHubOnlyFeatures for what that leaves
+// out.
+type Forge interface {
+	// DefaultBranch is the branch HEAD of the repository points to
+	DefaultBranch(ctx context.Context, owner string, name string) (string, error)
+	// GetContents is the content of file on the default branch
+	GetContents(ctx context.Context, owner string, name string, file string) (string, error)
+	// OpenMergeRequests lists every open merge request of the repository
+	OpenMergeRequests(ctx context.Context, owner string, name string) ([]MergeRequest, error)
+	CreateMergeRequest(ctx context.Context, owner string, name string, in NewMergeRequest) (*MergeRequest, error)
+	// Approve approves mr at its HeadSHA
+	Approve(ctx context.Context, owner string, name string, mr MergeRequest) error
+	// Merge merges mr with method, one of the autobotcfg merge methods, failing if its head is no longer HeadSHA
+	Merge(ctx context.Context, owner string, name string, mr MergeRequest, method string) error
+	DoesBranchExist(ctx context.Context, owner string, name string, branch string) (bool, error)
+	DeleteBranch(ctx context.Context, owner string, name string, branch string) error
+	// Self is the login autobot acts as
+	Self(ctx context.Context) (string, error)
+	GoGetAuthMethod() http.AuthMethod
+}
+
+// CheckState is the combined state of every CI check of a commit
+type CheckState string
+
+const (
+	CheckStateNone    CheckState = ""
+	CheckStatePending CheckState = "pending"
+	CheckStateSuccess CheckState = "success"
+	CheckStateFailure CheckState = "failure"
+)
+
+// MergeRequest is a merge request, what GitHub calls a pull request
+type MergeRequest struct {
+	// Number is the number people refer to the merge request by: the IID on GitLab
+	Number int
+	// ID is how the forge API refers to the merge request, if different from Number
+	ID           string
+	Title        string
+	Body         string
+	SourceBranch string
+	TargetBranch string
+	HeadSHA      string
+	// Author is the login of whoever opened the merge request
+	Author string
+	Draft  bool
+	// CrossRepository is true if the source branch is in a fork
+	CrossRepository bool
+	// Conflicts is true if the merge request cannot be merged cleanly
+	Conflicts bool
+	// Approved is true if the merge request has every approval it needs
+	Approved bool
+	// ApprovedBySelf is true if autobot already approved HeadSHA
+	ApprovedBySelf bool
+	// Checks is the state of CI for HeadSHA
+	Checks CheckState
+	Labels []string
+}
+
+// HasLabel is true if the merge request has label, ignoring case
+func (m *MergeRequest) HasLabel(label string) bool {
+	for _, l := range m.Labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+type NewMergeRequest struct {
+	SourceBranch string
+	TargetBranch string
+	Title        string
+	Body         string
+}
+
+// FetchRepoConfig loads the .gitops-autobot file of the default branch of a repository
+func FetchRepoConfig(ctx context.Context, f Forge, owner string, name string) (*autobotcfg.AutobotPerRepoConfig, error) {
+	content, err := f.GetContents(ctx, owner, name, ".gitops-autobot")
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch contents: %w", err)
+	}
+	ret, err := autobotcfg.LoadPerRepoConfig(strings.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode repo content: %w", err)
+	}
+	return ret, nil
+}
+
+// PopulateDefaultBranches sets the branch of every repository in forges that does not configure one
+func PopulateDefaultBranches(ctx context.Context, cfg *autobotcfg.AutobotConfig, forges map[string]Forge) error {
+	for idx := range cfg.Repos {
+		if cfg.Repos[idx].Branch != "" {
+			continue
+		}
+		f, exists := forges[cfg.Repos[idx].ForgeName()]
+		if !exists {
+			continue
+		}
+		branch, err := f.DefaultBranch(ctx, cfg.Repos[idx].Owner, cfg.Repos[idx].Name)
+		if err != nil {
+			return fmt.Errorf("unable to find default branch of %s/%s: %w", cfg.Repos[idx].Owner, cfg.Repos[idx].Name, err)
+		}
+		cfg.Repos[idx].Branch = branch
+	}
+	return nil
+}
@@ -0,0 +1,421 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/forge"
+	"github.com/cresta/zapctx"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"go.uber.org/zap"
+)
+
+// Client is a forge.Forge for GitLab, through its REST API
+type Client struct {
+	// BaseURL is the web address of GitLab, such as https://gitlab.com
+	BaseURL string
+	// Token is an access token with the api and write_repository scopes
+	Token string
+	// ApproverToken is the access token, with the api scope, of a second user that approves merge requests.  GitLab
+	// does not let authors approve their own merge requests unless the project allows it, and Token authors the merge
+	// requests autobot makes.  Defaults to Token.
+	ApproverToken string
+	HTTP          *http.Client
+	Logger        *zapctx.Logger
+
+	usersMu sync.Mutex
+	// users are the usernames of tokens
+	users map[string]string
+}
+
+var _ forge.Forge = &Client{}
+
+// maxPages stops a misbehaving server from paging forever
+const maxPages = 100
+
+// StatusError is a response from GitLab that was not successful
+type StatusError struct {
+	Method string
+	Path   string
+	Code   int
+	Body   string
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: status %d: %s", s.Method, s.Path, s.Code, s.Body)
+}
+
+func projectPath(owner string, name string) string {
+	return "/projects/" + url.PathEscape(owner+"/"+name)
+}
+
+func (c *Client) client() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return c.HTTP
+}
+
+func (c *Client) approverToken() string {
+	if c.ApproverToken == "" {
+		return c.Token
+	}
+	return c.ApproverToken
+}
+
+// request calls the API at path, which must already be escaped, returning the body and headers of a successful
+// response
+func (c *Client) request(ctx context.Context, method string, path string, query url.Values, in interface{}) ([]byte, http.Header, error) {
+	return c.requestAs(ctx, c.Token, method, path, query, in)
+}
+
+// requestAs is request, authenticated by token
+func (c *Client) requestAs(ctx context.Context, token string, method string, path string, query url.Values, in interface{}) ([]byte, http.Header, error) {
+	u := strings.TrimSuffix(c.BaseURL, "/") + "/api/v4" + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to encode request: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to make request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to %s %s: %w", method, path, err)
+	}
+	defer func() {
+		c.Logger.IfErr(resp.Body.Close()).Warn(ctx, "unable to close response body")
+	}()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read response of %s %s: %w", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, &StatusError{
+			Method: method,
+			Path:   path,
+			Code:   resp.StatusCode,
+			Body:   strings.TrimSpace(string(b)),
+		}
+	}
+	return b, resp.Header, nil
+}
+
+// requestJSON is request, decoding the response into out if it is set
+func (c *Client) requestJSON(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) (http.Header, error) {
+	b, header, err := c.request(ctx, method, path, query, in)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return header, nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return nil, fmt.Errorf("unable to decode response of %s %s: %w", method, path, err)
+	}
+	return header, nil
+}
+
+func isNotFound(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound
+}
+
+func (c *Client) DefaultBranch(ctx context.Context, owner string, name string) (string, error) {
+	c.Logger.Debug(ctx, "+Client.DefaultBranch", zap.String("owner", owner), zap.String("name", name))
+	defer c.Logger.Debug(ctx, "-Client.DefaultBranch")
+	var project struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if _, err := c.requestJSON(ctx, http.MethodGet, projectPath(owner, name), nil, nil, &project); err != nil {
+		return "", fmt.Errorf("unable to get project: %w", err)
+	}
+	if project.DefaultBranch == "" {
+		return "", fmt.Errorf("project %s/%s has no default branch", owner, name)
+	}
+	return project.DefaultBranch, nil
+}
+
+func (c *Client) GetContents(ctx context.Context, owner string, name string, file string) (string, error) {
+	c.Logger.Debug(ctx, "+Client.GetContents", zap.String("name", name), zap.String("file", file))
+	defer c.Logger.Debug(ctx, "-Client.GetContents")
+	b, _, err := c.request(ctx, http.MethodGet, projectPath(owner, name)+"/repository/files/"+url.PathEscape(file)+"/raw", url.Values{"ref": []string{"HEAD"}}, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to get file %s: %w", file, err)
+	}
+	return string(b), nil
+}
+
+type apiMergeRequest struct {
+	IID             int      `json:"iid"`
+	Title           string   `json:"title"`
+	Description     string   `json:"description"`
+	SourceBranch    string   `json:"source_branch"`
+	TargetBranch    string   `json:"target_branch"`
+	SHA             string   `json:"sha"`
+	Draft           bool     `json:"draft"`
+	WorkInProgress  bool     `json:"work_in_progress"`
+	HasConflicts    bool     `json:"has_conflicts"`
+	SourceProjectID int      `json:"source_project_id"`
+	TargetProjectID int      `json:"target_project_id"`
+	Labels          []string `json:"labels"`
+	Author          struct {
+		Username string `json:"username"`
+	} `json:"author"`
+	// HeadPipeline is only returned when a single merge request is fetched
+	HeadPipeline *struct {
+		SHA    string `json:"sha"`
+		Status string `json:"status"`
+	} `json:"head_pipeline"`
+}
+
+func (a *apiMergeRequest) toMergeRequest() forge.MergeRequest {
+	ret := forge.MergeRequest{
+		Number:          a.IID,
+		ID:              strconv.Itoa(a.IID),
+		Title:           a.Title,
+		Body:            a.Description,
+		SourceBranch:    a.SourceBranch,
+		TargetBranch:    a.TargetBranch,
+		HeadSHA:         a.SHA,
+		Author:          a.Author.Username,
+		Draft:           a.Draft || a.WorkInProgress,
+		CrossRepository: a.SourceProjectID != a.TargetProjectID,
+		Conflicts:       a.HasConflicts,
+		Labels:          a.Labels,
+	}
+	if a.HeadPipeline != nil && a.HeadPipeline.SHA == a.SHA {
+		ret.Checks = pipelineCheckState(a.HeadPipeline.Status)
+	}
+	return ret
+}
+
+func pipelineCheckState(status string) forge.CheckState {
+	switch status {
+	case "success":
+		return forge.CheckStateSuccess
+	case "failed", "canceled":
+		return forge.CheckStateFailure
+	case "":
+		return forge.CheckStateNone
+	}
+	// created, pending, running, manual and the rest have not finished
+	return forge.CheckStatePending
+}
+
+func (c *Client) OpenMergeRequests(ctx context.Context, owner string, name string) ([]forge.MergeRequest, error) {
+	c.Logger.Debug(ctx, "+Client.OpenMergeRequests", zap.String("owner", owner), zap.String("name", name))
+	defer c.Logger.Debug(ctx, "-Client.OpenMergeRequests")
+	approver, err := c.username(ctx, c.approverToken())
+	if err != nil {
+		return nil, fmt.Errorf("unable to find approver: %w", err)
+	}
+	var listed []apiMergeRequest
+	page := "1"
+	for i := 0; page != "" && i < maxPages; i++ {
+		var mrs []apiMergeRequest
+		header, err := c.requestJSON(ctx, http.MethodGet, projectPath(owner, name)+"/merge_requests", url.Values{
+			"state":    []string{"opened"},
+			"per_page": []string{"100"},
+			"page":     []string{page},
+		}, nil, &mrs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list merge requests: %w", err)
+		}
+		listed = append(listed, mrs...)
+		page = header.Get("X-Next-Page")
+	}
+	ret := make([]forge.MergeRequest, 0, len(listed))
+	for _, listedMR := range listed {
+		mr, err := c.mergeRequest(ctx, owner, name, listedMR.IID, approver)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *mr)
+	}
+	return ret, nil
+}
+
+// mergeRequest fetches one merge request with its pipeline and approvals.  ApprovedBySelf is set if approver approved
+// it.
+func (c *Client) mergeRequest(ctx context.Context, owner string, name string, iid int, approver string) (*forge.MergeRequest, error) {
+	path := projectPath(owner, name) + "/merge_requests/" + strconv.Itoa(iid)
+	var apiMR apiMergeRequest
+	if _, err := c.requestJSON(ctx, http.MethodGet, path, nil, nil, &apiMR); err != nil {
+		return nil, fmt.Errorf("unable to get merge request !%d: %w", iid, err)
+	}
+	var approvals struct {
+		Approved   bool `json:"approved"`
+		ApprovedBy []struct {
+			User struct {
+				Username string `json:"username"`
+			} `json:"user"`
+		} `json:"approved_by"`
+	}
+	if _, err := c.requestJSON(ctx, http.MethodGet, path+"/approvals", nil, nil, &approvals); err != nil {
+		return nil, fmt.Errorf("unable to get approvals of merge request !%d: %w", iid, err)
+	}
+	ret := apiMR.toMergeRequest()
+	ret.Approved = approvals.Approved
+	for _, a := range approvals.ApprovedBy {
+		if a.User.Username == approver {
+			ret.ApprovedBySelf = true
+		}
+	}
+	return &ret, nil
+}
+
+func (c *Client) CreateMergeRequest(ctx context.Context, owner string, name string, in forge.NewMergeRequest) (*forge.MergeRequest, error) {
+	c.Logger.Debug(ctx, "+Client.CreateMergeRequest", zap.String("name", name), zap.String("source", in.SourceBranch))
+	defer c.Logger.Debug(ctx, "-Client.CreateMergeRequest")
+	var created apiMergeRequest
+	if _, err := c.requestJSON(ctx, http.MethodPost, projectPath(owner, name)+"/merge_requests", nil, map[string]interface{}{
+		"source_branch":        in.SourceBranch,
+		"target_branch":        in.TargetBranch,
+		"title":                in.Title,
+		"description":          in.Body,
+		"remove_source_branch": true,
+	}, &created); err != nil {
+		return nil, fmt.Errorf("unable to create merge request: %w", err)
+	}
+	ret := created.toMergeRequest()
+	return &ret, nil
+}
+
+// Approve approves mr as the user of ApproverToken
+func (c *Client) Approve(ctx context.Context, owner string, name string, mr forge.MergeRequest) error {
+	c.Logger.Debug(ctx, "+Client.Approve", zap.String("name", name), zap.Int("mr", mr.Number))
+	defer c.Logger.Debug(ctx, "-Client.Approve")
+	if _, _, err := c.requestAs(ctx, c.approverToken(), http.MethodPost, projectPath(owner, name)+"/merge_requests/"+strconv.Itoa(mr.Number)+"/approve", nil, map[string]string{
+		"sha": mr.HeadSHA,
+	}); err != nil {
+		return fmt.Errorf("unable to approve merge request !%d: %w", mr.Number, err)
+	}
+	return nil
+}
+
+// Merge merges mr with method.  GitLab has no merge method per merge request: whether a merge commit is made is up to
+// the merge method of the project, so only squashing is asked for, and methods the project cannot do are refused.
+func (c *Client) Merge(ctx context.Context, owner string, name string, mr forge.MergeRequest, method string) error {
+	c.Logger.Debug(ctx, "+Client.Merge", zap.String("name", name), zap.Int("mr", mr.Number), zap.String("method", method))
+	defer c.Logger.Debug(ctx, "-Client.Merge")
+	if method != autobotcfg.MergeMethodSquash {
+		var project struct {
+			MergeMethod string `json:"merge_method"`
+		}
+		if _, err := c.requestJSON(ctx, http.MethodGet, projectPath(owner, name), nil, nil, &project); err != nil {
+			return fmt.Errorf("unable to get project: %w", err)
+		}
+		if err := checkMergeMethod(method, project.MergeMethod); err != nil {
+			return err
+		}
+	}
+	if _, err := c.requestJSON(ctx, http.MethodPut, projectPath(owner, name)+"/merge_requests/"+strconv.Itoa(mr.Number)+"/merge", nil, map[string]interface{}{
+		"sha":    mr.HeadSHA,
+		"squash": method == autobotcfg.MergeMethodSquash,
+	}, nil); err != nil {
+		return fmt.Errorf("unable to merge merge request !%d: %w", mr.Number, err)
+	}
+	return nil
+}
+
+// checkMergeMethod fails unless a project with the GitLab merge method projectMethod merges by method: rebase needs
+// fast-forward merges, and merge needs merge commits
+func checkMergeMethod(method string, projectMethod string) error {
+	switch method {
+	case autobotcfg.MergeMethodRebase:
+		if projectMethod != "ff" {
+			return fmt.Errorf("unable to merge by rebase: the project merges by %s rather than fast-forward", projectMethod)
+		}
+	case autobotcfg.MergeMethodMerge:
+		if projectMethod == "ff" {
+			return fmt.Errorf("unable to merge with a merge commit: the project only fast-forwards")
+		}
+	default:
+		return fmt.Errorf("unknown merge method %s", method)
+	}
+	return nil
+}
+
+func (c *Client) DoesBranchExist(ctx context.Context, owner string, name string, branch string) (bool, error) {
+	c.Logger.Debug(ctx, "+Client.DoesBranchExist", zap.String("name", name), zap.String("branch", branch))
+	defer c.Logger.Debug(ctx, "-Client.DoesBranchExist")
+	branch = strings.TrimPrefix(branch, "refs/heads/")
+	_, _, err := c.request(ctx, http.MethodGet, projectPath(owner, name)+"/repository/branches/"+url.PathEscape(branch), nil, nil)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFound(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("unable to get branch %s: %w", branch, err)
+}
+
+func (c *Client) DeleteBranch(ctx context.Context, owner string, name string, branch string) error {
+	c.Logger.Debug(ctx, "+Client.DeleteBranch", zap.String("name", name), zap.String("branch", branch))
+	defer c.Logger.Debug(ctx, "-Client.DeleteBranch")
+	branch = strings.TrimPrefix(branch, "refs/heads/")
+	if _, _, err := c.request(ctx, http.MethodDelete, projectPath(owner, name)+"/repository/branches/"+url.PathEscape(branch), nil, nil); err != nil {
+		return fmt.Errorf("unable to delete branch %s: %w", branch, err)
+	}
+	return nil
+}
+
+// Self is the username of the user of Token, who authors merge requests
+func (c *Client) Self(ctx context.Context) (string, error) {
+	return c.username(ctx, c.Token)
+}
+
+// username is the username of the user of token.  It is only asked for once.
+func (c *Client) username(ctx context.Context, token string) (string, error) {
+	c.usersMu.Lock()
+	defer c.usersMu.Unlock()
+	if name, exists := c.users[token]; exists {
+		return name, nil
+	}
+	b, _, err := c.requestAs(ctx, token, http.MethodGet, "/user", nil, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to get current user: %w", err)
+	}
+	var user struct {
+		Username string `json:"username"`
+	}
+	if err := json.Unmarshal(b, &user); err != nil {
+		return "", fmt.Errorf("unable to decode current user: %w", err)
+	}
+	if c.users == nil {
+		c.users = make(map[string]string)
+	}
+	c.users[token] = user.Username
+	return user.Username, nil
+}
+
+func (c *Client) GoGetAuthMethod() githttp.AuthMethod {
+	return &githttp.BasicAuth{
+		Username: "oauth2",
+		Password: c.Token,
+	}
+}
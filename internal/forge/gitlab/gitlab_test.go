@@ -0,0 +1,233 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/forge"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGitLab is just enough of the GitLab REST API for one project, cresta/infra/gitops.  Like GitLab by default, it
+// does not let authors approve their own merge requests.
+type fakeGitLab struct {
+	t  *testing.T
+	mu sync.Mutex
+	// mergeMethod is the merge method of the project
+	mergeMethod string
+	branches    map[string]bool
+	mrs         []map[string]interface{}
+	approved    map[int][]string
+	merged      []map[string]interface{}
+	created     []map[string]interface{}
+}
+
+const fakeProject = "/api/v4/projects/cresta%2Finfra%2Fgitops"
+
+func (f *fakeGitLab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user, exists := map[string]string{"Bearer sekret": "autobot", "Bearer approver-sekret": "reviewer"}[r.Header.Get("Authorization")]
+	if !exists {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := r.URL.EscapedPath()
+	reply := func(v interface{}) {
+		require.NoError(f.t, json.NewEncoder(w).Encode(v))
+	}
+	decode := func() map[string]interface{} {
+		var ret map[string]interface{}
+		require.NoError(f.t, json.NewDecoder(r.Body).Decode(&ret))
+		return ret
+	}
+	switch {
+	case path == "/api/v4/user":
+		reply(map[string]string{"username": user})
+	case path == fakeProject:
+		reply(map[string]string{"default_branch": "main", "merge_method": f.mergeMethod})
+	case path == fakeProject+"/repository/files/.gitops-autobot/raw":
+		require.Equal(f.t, "HEAD", r.URL.Query().Get("ref"))
+		_, _ = w.Write([]byte("allowAutoMerge: true\n"))
+	case strings.HasPrefix(path, fakeProject+"/repository/branches/"):
+		branch := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/cresta/infra/gitops/repository/branches/")
+		if !f.branches[branch] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.branches, branch)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		reply(map[string]string{"name": branch})
+	case path == fakeProject+"/merge_requests" && r.Method == http.MethodPost:
+		in := decode()
+		f.created = append(f.created, in)
+		reply(map[string]interface{}{"iid": 9, "title": in["title"], "source_branch": in["source_branch"], "target_branch": in["target_branch"]})
+	case path == fakeProject+"/merge_requests":
+		require.Equal(f.t, "opened", r.URL.Query().Get("state"))
+		// One merge request a page, to exercise paging
+		page := r.URL.Query().Get("page")
+		idx := map[string]int{"1": 0, "2": 1}[page]
+		if idx+1 < len(f.mrs) {
+			w.Header().Set("X-Next-Page", "2")
+		}
+		reply([]map[string]interface{}{f.mrs[idx]})
+	case strings.HasSuffix(path, "/approvals"):
+		iid := strings.TrimSuffix(strings.TrimPrefix(path, fakeProject+"/merge_requests/"), "/approvals")
+		var by []map[string]interface{}
+		for _, u := range f.approved[atoi(f.t, iid)] {
+			by = append(by, map[string]interface{}{"user": map[string]string{"username": u}})
+		}
+		reply(map[string]interface{}{"approved": len(by) > 0, "approved_by": by})
+	case strings.HasSuffix(path, "/approve"):
+		iid := strings.TrimSuffix(strings.TrimPrefix(path, fakeProject+"/merge_requests/"), "/approve")
+		require.Equal(f.t, "abc", decode()["sha"])
+		for _, mr := range f.mrs {
+			if mr["iid"] == atoi(f.t, iid) && mr["author"].(map[string]string)["username"] == user {
+				w.WriteHeader(http.StatusUnauthorized)
+				reply(map[string]string{"message": "401 Unauthorized"})
+				return
+			}
+		}
+		f.approved[atoi(f.t, iid)] = append(f.approved[atoi(f.t, iid)], user)
+		reply(map[string]interface{}{})
+	case strings.HasSuffix(path, "/merge"):
+		f.merged = append(f.merged, decode())
+		reply(map[string]interface{}{})
+	case strings.HasPrefix(path, fakeProject+"/merge_requests/"):
+		iid := atoi(f.t, strings.TrimPrefix(path, fakeProject+"/merge_requests/"))
+		for _, mr := range f.mrs {
+			if mr["iid"] == iid {
+				reply(mr)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func atoi(t *testing.T, s string) int {
+	var ret int
+	require.NoError(t, json.Unmarshal([]byte(s), &ret))
+	return ret
+}
+
+func TestClient(t *testing.T) {
+	fake := &fakeGitLab{
+		t:           t,
+		mergeMethod: "merge",
+		branches:    map[string]bool{"filechange_values.yaml": true},
+		approved:    map[int][]string{2: {"jack", "autobot"}},
+		mrs: []map[string]interface{}{
+			{
+				"iid": 1, "title": "Deploying new helm version", "description": "gitops-autobot: auto-merge=true",
+				"source_branch": "filechange_values.yaml", "target_branch": "main", "sha": "abc",
+				"source_project_id": 5, "target_project_id": 5, "has_conflicts": false, "labels": []string{"autobot-hold"},
+				"author":        map[string]string{"username": "autobot"},
+				"head_pipeline": map[string]string{"sha": "abc", "status": "success"},
+			},
+			{
+				"iid": 2, "title": "Manual change", "source_branch": "feature", "target_branch": "main", "sha": "def",
+				"source_project_id": 6, "target_project_id": 5, "has_conflicts": true, "draft": true,
+				"author":        map[string]string{"username": "jack"},
+				"head_pipeline": map[string]string{"sha": "old", "status": "failed"},
+			},
+		},
+	}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	c := &Client{
+		BaseURL: srv.URL + "/",
+		Token:   "sekret",
+		HTTP:    srv.Client(),
+		Logger:  testhelp.ZapTestingLogger(t),
+	}
+	ctx := context.Background()
+
+	branch, err := c.DefaultBranch(ctx, "cresta/infra", "gitops")
+	require.NoError(t, err)
+	require.Equal(t, "main", branch)
+	cfg, err := forge.FetchRepoConfig(ctx, c, "cresta/infra", "gitops")
+	require.NoError(t, err)
+	require.True(t, cfg.AllowAutoMerge)
+
+	mrs, err := c.OpenMergeRequests(ctx, "cresta/infra", "gitops")
+	require.NoError(t, err)
+	require.Len(t, mrs, 2)
+	require.Equal(t, 1, mrs[0].Number)
+	require.Equal(t, "abc", mrs[0].HeadSHA)
+	require.Equal(t, "autobot", mrs[0].Author)
+	require.Equal(t, forge.CheckStateSuccess, mrs[0].Checks)
+	require.True(t, mrs[0].HasLabel("AUTOBOT-HOLD"))
+	require.False(t, mrs[0].Approved)
+	require.False(t, mrs[0].CrossRepository)
+	require.True(t, mrs[1].Draft)
+	require.True(t, mrs[1].Conflicts)
+	require.True(t, mrs[1].CrossRepository)
+	require.True(t, mrs[1].Approved)
+	require.True(t, mrs[1].ApprovedBySelf)
+	require.Equal(t, forge.CheckStateNone, mrs[1].Checks, "a pipeline of an older commit says nothing about the head")
+
+	var statusErr *StatusError
+	require.ErrorAs(t, c.Approve(ctx, "cresta/infra", "gitops", mrs[0]), &statusErr, "authors may not approve their own merge requests")
+	require.Equal(t, http.StatusUnauthorized, statusErr.Code)
+	approver := &Client{
+		BaseURL:       srv.URL,
+		Token:         "sekret",
+		ApproverToken: "approver-sekret",
+		HTTP:          srv.Client(),
+		Logger:        testhelp.ZapTestingLogger(t),
+	}
+	self, err := approver.Self(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "autobot", self, "merge requests are still authored by the user of Token")
+	require.NoError(t, approver.Approve(ctx, "cresta/infra", "gitops", mrs[0]))
+	require.Equal(t, []string{"reviewer"}, fake.approved[1])
+	mrs, err = approver.OpenMergeRequests(ctx, "cresta/infra", "gitops")
+	require.NoError(t, err)
+	require.True(t, mrs[0].ApprovedBySelf)
+	require.False(t, mrs[1].ApprovedBySelf, "approved by others")
+
+	require.NoError(t, c.Merge(ctx, "cresta/infra", "gitops", mrs[0], autobotcfg.MergeMethodSquash))
+	require.NoError(t, c.Merge(ctx, "cresta/infra", "gitops", mrs[0], autobotcfg.MergeMethodMerge))
+	require.Error(t, c.Merge(ctx, "cresta/infra", "gitops", mrs[0], autobotcfg.MergeMethodRebase), "the project makes merge commits")
+	fake.mergeMethod = "ff"
+	require.NoError(t, c.Merge(ctx, "cresta/infra", "gitops", mrs[0], autobotcfg.MergeMethodRebase))
+	require.Error(t, c.Merge(ctx, "cresta/infra", "gitops", mrs[0], autobotcfg.MergeMethodMerge), "the project only fast-forwards")
+	require.Equal(t, []map[string]interface{}{{"sha": "abc", "squash": true}, {"sha": "abc", "squash": false}, {"sha": "abc", "squash": false}}, fake.merged)
+
+	created, err := c.CreateMergeRequest(ctx, "cresta/infra", "gitops", forge.NewMergeRequest{
+		SourceBranch: "filechange_other.yaml",
+		TargetBranch: "main",
+		Title:        "Deploying new image version",
+		Body:         "Changed nginx 1 => 2",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 9, created.Number)
+	require.Equal(t, "Changed nginx 1 => 2", fake.created[0]["description"])
+	require.Equal(t, true, fake.created[0]["remove_source_branch"])
+
+	exists, err := c.DoesBranchExist(ctx, "cresta/infra", "gitops", "refs/heads/filechange_values.yaml")
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.NoError(t, c.DeleteBranch(ctx, "cresta/infra", "gitops", "filechange_values.yaml"))
+	exists, err = c.DoesBranchExist(ctx, "cresta/infra", "gitops", "filechange_values.yaml")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	_, err = (&Client{BaseURL: srv.URL, Token: "wrong", HTTP: srv.Client()}).Self(ctx)
+	require.ErrorAs(t, err, &statusErr)
+	require.Equal(t, http.StatusUnauthorized, statusErr.Code)
+}
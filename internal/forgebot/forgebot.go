@@ -0,0 +1,233 @@
+package forgebot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/forge"
+	"github.com/cresta/gitops-autobot/internal/gate"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/metrics"
+	"github.com/cresta/zapctx"
+	"go.uber.org/zap"
+)
+
+// ForgeBot approves and merges the merge requests of repositories hosted on forges other than GitHub, making the same
+// decisions the GitHub reviewer and merger make
+type ForgeBot struct {
+	// Forges are the forges repositories may be hosted on, by name
+	Forges        map[string]forge.Forge
+	AutobotConfig *autobotcfg.AutobotConfig
+	// MarkerSigner, if set, means only merge requests with a validly signed marker are approved or merged
+	MarkerSigner *marker.Signer
+	Logger       *zapctx.Logger
+	// Plan, if set, turns on plan mode: what would be approved or merged, and why, is written here and nothing is done
+	Plan io.Writer
+	// Now is the current time.  Defaults to time.Now.
+	Now func() time.Time
+
+	// heads is when each merge request head was first seen, which the delay window counts from, as on GitHub
+	heads gate.HeadClock
+}
+
+func (b *ForgeBot) now() time.Time {
+	if b.Now == nil {
+		return time.Now()
+	}
+	return b.Now()
+}
+
+// Execute runs ExecuteRepo for owner/name, ignoring repositories that are not configured
+func (b *ForgeBot) Execute(ctx context.Context, owner string, name string) error {
+	r := b.AutobotConfig.FindRepo(owner, name)
+	if r == nil {
+		b.Logger.Debug(ctx, "ignoring unknown repository", zap.String("owner", owner), zap.String("name", name))
+		return nil
+	}
+	return b.ExecuteRepo(ctx, *r)
+}
+
+// ExecuteRepo approves, then merges, the merge requests of repo that ask for it
+func (b *ForgeBot) ExecuteRepo(ctx context.Context, repo autobotcfg.RepoConfig) error {
+	b.Logger.Debug(ctx, "+ForgeBot.ExecuteRepo")
+	defer b.Logger.Debug(ctx, "-ForgeBot.ExecuteRepo")
+	f, exists := b.Forges[repo.ForgeName()]
+	if !exists {
+		return fmt.Errorf("no client for forge %s", repo.ForgeName())
+	}
+	repoCfg, err := forge.FetchRepoConfig(ctx, f, repo.Owner, repo.Name)
+	if err != nil {
+		return fmt.Errorf("unable to fetch repo content for %s: %w", repo, err)
+	}
+	if err := b.review(ctx, f, repo, repoCfg); err != nil {
+		return fmt.Errorf("unable to review merge requests of %s: %w", repo, err)
+	}
+	// Merge decisions are made on a fresh listing, so approvals just given count
+	if err := b.merge(ctx, f, repo, repoCfg); err != nil {
+		return fmt.Errorf("unable to merge merge requests of %s: %w", repo, err)
+	}
+	return nil
+}
+
+func (b *ForgeBot) review(ctx context.Context, f forge.Forge, repo autobotcfg.RepoConfig, cfg *autobotcfg.AutobotPerRepoConfig) error {
+	if !cfg.AllowAutoReview {
+		b.Logger.Debug(ctx, "not allowed to auto review")
+		b.planf(ctx, "%s/%s: auto review is not allowed", repo.Owner, repo.Name)
+		return nil
+	}
+	self, err := f.Self(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to find self: %w", err)
+	}
+	mrs, err := f.OpenMergeRequests(ctx, repo.Owner, repo.Name)
+	if err != nil {
+		return fmt.Errorf("unable to list open merge requests: %w", err)
+	}
+	open := make(map[string]bool, len(mrs))
+	for _, mr := range mrs {
+		open[headKey(repo, mr)] = true
+	}
+	b.heads.Retain(repo.Owner+"/"+repo.Name+"!", open)
+	if reason := frozenByLabel(mrs, cfg); reason != "" {
+		b.Logger.Info(ctx, "not reviewing frozen repository", zap.Stringer("repo", repo), zap.String("reason", reason))
+		b.planf(ctx, "%s/%s: would not approve: %s", repo.Owner, repo.Name, reason)
+		return nil
+	}
+	for _, mr := range mrs {
+		approve, reason := b.approvalDecision(repo, mr, cfg, self)
+		b.Logger.Debug(ctx, "approval decision", zap.Int("mr", mr.Number), zap.Bool("approve", approve), zap.String("reason", reason))
+		if b.Plan != nil {
+			b.planDecision(ctx, repo, mr, "approve", approve, reason)
+			continue
+		}
+		if !approve {
+			metrics.Skipped(repo.Owner+"/"+repo.Name, metrics.ActionApprove, reason)
+			continue
+		}
+		if err := f.Approve(ctx, repo.Owner, repo.Name, mr); err != nil {
+			return fmt.Errorf("unable to approve merge request %d: %w", mr.Number, err)
+		}
+		metrics.PullRequests.WithLabelValues(repo.Owner+"/"+repo.Name, metrics.ActionApprove).Inc()
+	}
+	return nil
+}
+
+func (b *ForgeBot) merge(ctx context.Context, f forge.Forge, repo autobotcfg.RepoConfig, cfg *autobotcfg.AutobotPerRepoConfig) error {
+	if !cfg.AllowAutoMerge {
+		b.Logger.Debug(ctx, "not allowed to auto merge")
+		b.planf(ctx, "%s/%s: auto merge is not allowed", repo.Owner, repo.Name)
+		return nil
+	}
+	mrs, err := f.OpenMergeRequests(ctx, repo.Owner, repo.Name)
+	if err != nil {
+		return fmt.Errorf("unable to list open merge requests: %w", err)
+	}
+	if reason := frozenByLabel(mrs, cfg); reason != "" {
+		b.Logger.Info(ctx, "not merging frozen repository", zap.Stringer("repo", repo), zap.String("reason", reason))
+		b.planf(ctx, "%s/%s: would not merge: %s", repo.Owner, repo.Name, reason)
+		return nil
+	}
+	for _, mr := range mrs {
+		merge, reason := b.mergeDecision(repo, mr, cfg)
+		b.Logger.Debug(ctx, "merge decision", zap.Int("mr", mr.Number), zap.Bool("merge", merge), zap.String("reason", reason))
+		if b.Plan != nil {
+			b.planDecision(ctx, repo, mr, "merge", merge, reason)
+			continue
+		}
+		if !merge {
+			metrics.Skipped(repo.Owner+"/"+repo.Name, metrics.ActionMerge, reason)
+			continue
+		}
+		if err := f.Merge(ctx, repo.Owner, repo.Name, mr, cfg.MergeMethodFor(marker.ChangeMaker(mr.Body))); err != nil {
+			return fmt.Errorf("unable to merge merge request %d: %w", mr.Number, err)
+		}
+		metrics.PullRequests.WithLabelValues(repo.Owner+"/"+repo.Name, metrics.ActionMerge).Inc()
+	}
+	return nil
+}
+
+// frozenByLabel returns why the repository is frozen, if any of mrs has the freeze label of cfg
+func frozenByLabel(mrs []forge.MergeRequest, cfg *autobotcfg.AutobotPerRepoConfig) string {
+	for _, mr := range mrs {
+		if mr.HasLabel(cfg.FreezeLabelName()) {
+			return fmt.Sprintf("frozen by the %s label on !%d", cfg.FreezeLabelName(), mr.Number)
+		}
+	}
+	return ""
+}
+
+// approvalDecision returns if mr should be approved, and why
+func (b *ForgeBot) approvalDecision(repo autobotcfg.RepoConfig, mr forge.MergeRequest, cfg *autobotcfg.AutobotPerRepoConfig, self string) (bool, string) {
+	return gate.Decide(b.ApprovalGates(repo, mr, cfg, self), "asking for approval and all checks passed")
+}
+
+// ApprovalGates returns every condition mr has to meet to be approved, in the order they are checked.  They are the
+// rules of the GitHub reviewer, with what the forge reports in place of GitHub specific state.
+func (b *ForgeBot) ApprovalGates(repo autobotcfg.RepoConfig, mr forge.MergeRequest, cfg *autobotcfg.AutobotPerRepoConfig, self string) []gate.Gate {
+	now := b.now()
+	return []gate.Gate{
+		gate.AutoReviewAllowed(cfg),
+		gate.NotOnHold(cfg, mr.HasLabel),
+		gate.Schedule(cfg.Closed(b.AutobotConfig.Schedule, now)),
+		gate.AskingForApproval(b.askingFor(repo, mr, marker.ActionAutoApprove), "merge request"),
+		gate.AuthorAllowance(cfg, mr.Author == self, mr.CrossRepository, "merge request"),
+		gate.NotADraft(mr.Draft, "merge request"),
+		gate.DelayWindow(b.AutobotConfig.DelayForAutoApproval, b.heads.Since(headKey(repo, mr), mr.HeadSHA, now), now, "merge request"),
+		checksPassed(mr),
+		gate.Check("not yet approved", !mr.ApprovedBySelf, "already approved this merge request"),
+	}
+}
+
+// mergeDecision returns if mr should be merged, and why
+func (b *ForgeBot) mergeDecision(repo autobotcfg.RepoConfig, mr forge.MergeRequest, cfg *autobotcfg.AutobotPerRepoConfig) (bool, string) {
+	return gate.Decide(b.MergeGates(repo, mr, cfg), "asking for merge, mergeable and all checks passed")
+}
+
+// MergeGates returns every condition mr has to meet to be merged, in the order they are checked
+func (b *ForgeBot) MergeGates(repo autobotcfg.RepoConfig, mr forge.MergeRequest, cfg *autobotcfg.AutobotPerRepoConfig) []gate.Gate {
+	return []gate.Gate{
+		gate.AutoMergeAllowed(cfg),
+		gate.NotOnHold(cfg, mr.HasLabel),
+		gate.Schedule(cfg.Closed(b.AutobotConfig.Schedule, b.now())),
+		gate.AskingForMerge(b.askingFor(repo, mr, marker.ActionAutoMerge), "merge request"),
+		gate.NotADraft(mr.Draft, "merge request"),
+		gate.Check("mergeable", !mr.Conflicts, "cannot merge with conflicts"),
+		checksPassed(mr),
+		gate.Check("approved", mr.Approved, "unable to auto merge without every approval it needs"),
+	}
+}
+
+// headKey is mr, as kept by the HeadClock of the bot
+func headKey(repo autobotcfg.RepoConfig, mr forge.MergeRequest) string {
+	return fmt.Sprintf("%s/%s!%d", repo.Owner, repo.Name, mr.Number)
+}
+
+func checksPassed(mr forge.MergeRequest) gate.Gate {
+	return gate.Check("checks", mr.Checks == forge.CheckStateSuccess, fmt.Sprintf("checks not success (%s)", mr.Checks))
+}
+
+func (b *ForgeBot) askingFor(repo autobotcfg.RepoConfig, mr forge.MergeRequest, action string) bool {
+	if b.MarkerSigner != nil {
+		return b.MarkerSigner.HasVerifiedAction(mr.Body, repo.Owner+"/"+repo.Name, mr.SourceBranch, mr.HeadSHA, action)
+	}
+	return marker.HasRequestedAction(mr.Body, action)
+}
+
+func (b *ForgeBot) planDecision(ctx context.Context, repo autobotcfg.RepoConfig, mr forge.MergeRequest, verb string, do bool, reason string) {
+	if do {
+		b.planf(ctx, "%s/%s!%d: would %s: %s", repo.Owner, repo.Name, mr.Number, verb, reason)
+	} else {
+		b.planf(ctx, "%s/%s!%d: would not %s: %s", repo.Owner, repo.Name, mr.Number, verb, reason)
+	}
+}
+
+func (b *ForgeBot) planf(ctx context.Context, format string, args ...interface{}) {
+	if b.Plan == nil {
+		return
+	}
+	_, err := fmt.Fprintf(b.Plan, format+"\n", args...)
+	b.Logger.IfErr(err).Warn(ctx, "unable to write plan")
+}
@@ -0,0 +1,125 @@
+package forgebot
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/forge"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeForge implements only what ForgeBot uses.  Approving a merge request it knows about marks it approved.
+type fakeForge struct {
+	forge.Forge
+	config   string
+	mrs      []forge.MergeRequest
+	approved []int
+	merged   []int
+	methods  []string
+}
+
+func (f *fakeForge) GetContents(_ context.Context, _ string, _ string, _ string) (string, error) {
+	return f.config, nil
+}
+
+func (f *fakeForge) Self(_ context.Context) (string, error) {
+	return "autobot", nil
+}
+
+func (f *fakeForge) OpenMergeRequests(_ context.Context, _ string, _ string) ([]forge.MergeRequest, error) {
+	return append([]forge.MergeRequest(nil), f.mrs...), nil
+}
+
+func (f *fakeForge) Approve(_ context.Context, _ string, _ string, mr forge.MergeRequest) error {
+	f.approved = append(f.approved, mr.Number)
+	for idx := range f.mrs {
+		if f.mrs[idx].Number == mr.Number {
+			f.mrs[idx].Approved = true
+			f.mrs[idx].ApprovedBySelf = true
+		}
+	}
+	return nil
+}
+
+func (f *fakeForge) Merge(_ context.Context, _ string, _ string, mr forge.MergeRequest, method string) error {
+	f.merged = append(f.merged, mr.Number)
+	f.methods = append(f.methods, method)
+	return nil
+}
+
+func TestForgeBot_ExecuteRepo(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	mr := func(number int, author string, body string) forge.MergeRequest {
+		return forge.MergeRequest{
+			Number:       number,
+			Body:         body,
+			SourceBranch: "filechange_values.yaml",
+			HeadSHA:      "abc",
+			Author:       author,
+			Checks:       forge.CheckStateSuccess,
+		}
+	}
+	both := "gitops-autobot: auto-approve=true\ngitops-autobot: auto-merge=true"
+	ready := mr(1, "autobot", both)
+	human := mr(2, "jack", both)
+	pending := mr(3, "autobot", both)
+	pending.Checks = forge.CheckStatePending
+	held := mr(4, "autobot", both)
+	held.Labels = []string{"autobot-hold"}
+	mergeOnly := mr(5, "autobot", "gitops-autobot: auto-merge=true")
+	conflicted := mr(6, "autobot", both)
+	conflicted.Conflicts = true
+	recent := mr(7, "autobot", both)
+
+	f := &fakeForge{
+		config: "allowAutoReview: true\nallowAutoMerge: true\nmergeMethod: rebase\n",
+		mrs:    []forge.MergeRequest{ready, human, pending, held, mergeOnly, conflicted, recent},
+	}
+	b := ForgeBot{
+		Forges: map[string]forge.Forge{autobotcfg.ForgeGitLab: f},
+		AutobotConfig: &autobotcfg.AutobotConfig{
+			DelayForAutoApproval: time.Minute,
+		},
+		Logger: testhelp.ZapTestingLogger(t),
+		Now:    func() time.Time { return now.Add(-time.Hour) },
+	}
+	repo := autobotcfg.RepoConfig{Owner: "cresta/infra", Name: "gitops", Forge: autobotcfg.ForgeGitLab}
+	ctx := context.Background()
+
+	// The delay counts from when a head is first seen, so the recent merge request gets a new one just now
+	var plan bytes.Buffer
+	b.Plan = &plan
+	require.NoError(t, b.ExecuteRepo(ctx, repo))
+	b.Now = func() time.Time { return now }
+	f.mrs[6].HeadSHA = "def"
+	plan.Reset()
+	require.NoError(t, b.ExecuteRepo(ctx, repo))
+	require.Empty(t, f.approved)
+	require.Empty(t, f.merged)
+	require.Contains(t, plan.String(), "cresta/infra/gitops!1: would approve: asking for approval and all checks passed\n")
+	require.Contains(t, plan.String(), "cresta/infra/gitops!2: would not approve: not allowing users to accept reviews\n")
+	require.Contains(t, plan.String(), "cresta/infra/gitops!7: would not approve: ignoring merge request too recently made (1m0s left)\n")
+	require.Contains(t, plan.String(), "cresta/infra/gitops!1: would not merge: unable to auto merge without every approval it needs\n")
+
+	b.Plan = nil
+	require.NoError(t, b.ExecuteRepo(ctx, repo))
+	require.Equal(t, []int{1, 6}, f.approved)
+	require.Equal(t, []int{1}, f.merged)
+	require.Equal(t, []string{autobotcfg.MergeMethodRebase}, f.methods, "the merge method of the repository is used")
+
+	// Nothing is approved twice
+	require.NoError(t, b.ExecuteRepo(ctx, repo))
+	require.Equal(t, []int{1, 6}, f.approved)
+
+	f.config = "allowAutoReview: false\n"
+	f.approved, f.merged = nil, nil
+	require.NoError(t, b.ExecuteRepo(ctx, repo))
+	require.Empty(t, f.approved)
+	require.Empty(t, f.merged)
+
+	require.Error(t, b.ExecuteRepo(ctx, autobotcfg.RepoConfig{Owner: "cresta", Name: "gitops", Forge: "bitbucket"}))
+}
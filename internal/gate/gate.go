@@ -0,0 +1,27 @@
+// Package gate describes the conditions a pull request has to meet before the bot approves or merges it.
+package gate
+
+// Gate is one condition.  Reason says why it failed, and is empty if it passed.
+type Gate struct {
+	Name   string
+	Passed bool
+	Reason string
+}
+
+// Check returns the gate name, failing with reason unless passed
+func Check(name string, passed bool, reason string) Gate {
+	if passed {
+		return Gate{Name: name, Passed: true}
+	}
+	return Gate{Name: name, Reason: reason}
+}
+
+// Decide returns if every gate passed.  If so, the reason is okReason, otherwise the reason of the first failed gate.
+func Decide(gates []Gate, okReason string) (bool, string) {
+	for _, g := range gates {
+		if !g.Passed {
+			return false, g.Reason
+		}
+	}
+	return true, okReason
+}
@@ -0,0 +1,51 @@
+package gate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecide(t *testing.T) {
+	gates := []Gate{
+		Check("draft", true, "ignoring draft PR"),
+		Check("mergeable", false, "conflicting"),
+		Check("checks", false, "pending"),
+	}
+	require.Equal(t, Gate{Name: "draft", Passed: true}, gates[0])
+	ok, reason := Decide(gates, "all passed")
+	require.False(t, ok)
+	require.Equal(t, "conflicting", reason)
+	ok, reason = Decide(gates[:1], "all passed")
+	require.True(t, ok)
+	require.Equal(t, "all passed", reason)
+}
+
+func TestAuthorAllowance(t *testing.T) {
+	cfg := &autobotcfg.AutobotPerRepoConfig{}
+	require.True(t, AuthorAllowance(cfg, true, true, "PR").Passed)
+	require.Equal(t, "not allowing users to accept reviews", AuthorAllowance(cfg, false, false, "PR").Reason)
+	cfg.AllowUsersToTriggerAccept = true
+	require.True(t, AuthorAllowance(cfg, false, false, "PR").Passed)
+	require.Equal(t, "auto approve not allowed for cross repository merge requests", AuthorAllowance(cfg, false, true, "merge request").Reason)
+}
+
+func TestDelayWindow(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.True(t, DelayWindow(time.Minute, now.Add(-time.Minute), now, "PR").Passed)
+	require.Equal(t, "ignoring PR too recently made (50s left)", DelayWindow(time.Minute, now.Add(-10*time.Second), now, "PR").Reason)
+}
+
+func TestHeadClock(t *testing.T) {
+	var h HeadClock
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.Equal(t, start, h.Since("cresta/gitops#1", "abc", start))
+	require.Equal(t, start, h.Since("cresta/gitops#1", "abc", start.Add(time.Minute)))
+	require.Equal(t, start.Add(time.Hour), h.Since("cresta/gitops#1", "def", start.Add(time.Hour)), "a new head starts over")
+	h.Since("cresta/other#1", "abc", start)
+	h.Retain("cresta/gitops#", nil)
+	require.Equal(t, start.Add(2*time.Hour), h.Since("cresta/gitops#1", "def", start.Add(2*time.Hour)), "closed PRs are forgotten")
+	require.Equal(t, start, h.Since("cresta/other#1", "abc", start.Add(time.Hour)), "other repositories are kept")
+}
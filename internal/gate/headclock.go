@@ -0,0 +1,46 @@
+package gate
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeadClock remembers when autobot first saw each head commit of each pull request, which is when the delay window
+// starts.  That is the closest to when a head was pushed that cannot be faked: commit dates are whatever the committer
+// says, and pull requests are updated by every comment.  It is only kept in memory, so after a restart every delay
+// starts again, which errs on the side of waiting.  The zero value is ready to use.
+type HeadClock struct {
+	mu   sync.Mutex
+	seen map[string]seenHead
+}
+
+type seenHead struct {
+	head string
+	at   time.Time
+}
+
+// Since is when head was first seen as the head of the pull request key, which is now if it was not seen before
+func (h *HeadClock) Since(key string, head string, now time.Time) time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, exists := h.seen[key]; exists && s.head == head {
+		return s.at
+	}
+	if h.seen == nil {
+		h.seen = make(map[string]seenHead)
+	}
+	h.seen[key] = seenHead{head: head, at: now}
+	return now
+}
+
+// Retain forgets every pull request whose key starts with prefix, other than those in open
+func (h *HeadClock) Retain(prefix string, open map[string]bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key := range h.seen {
+		if strings.HasPrefix(key, prefix) && !open[key] {
+			delete(h.seen, key)
+		}
+	}
+}
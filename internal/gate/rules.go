@@ -0,0 +1,64 @@
+package gate
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+)
+
+// The rules below are shared by the GitHub reviewer and merger and the bot of every other forge, so a pull request is
+// held to the same rules wherever it is hosted.  noun is what the forge calls a pull request.
+
+func AutoReviewAllowed(cfg *autobotcfg.AutobotPerRepoConfig) Gate {
+	return Check("auto review allowed", cfg.AllowAutoReview, "auto review is not allowed")
+}
+
+func AutoMergeAllowed(cfg *autobotcfg.AutobotPerRepoConfig) Gate {
+	return Check("auto merge allowed", cfg.AllowAutoMerge, "auto merge is not allowed")
+}
+
+// NotOnHold fails if the pull request has the hold label of cfg, which hasLabel checks for
+func NotOnHold(cfg *autobotcfg.AutobotPerRepoConfig, hasLabel func(label string) bool) Gate {
+	return Check("not on hold", !hasLabel(cfg.HoldLabelName()), "on hold")
+}
+
+// Schedule fails with closed, the reason from AutobotPerRepoConfig.Closed, unless it is empty
+func Schedule(closed string) Gate {
+	return Check("schedule", closed == "", closed)
+}
+
+// AskingForApproval fails unless the body asks for approval.  Whether it does depends on markers being signed, which
+// the caller knows.
+func AskingForApproval(asking bool, noun string) Gate {
+	return Check("asking for approval", asking, noun+" not asking for review")
+}
+
+// AskingForMerge is AskingForApproval for merging
+func AskingForMerge(asking bool, noun string) Gate {
+	return Check("asking for merge", asking, noun+" not asking for merge")
+}
+
+// AuthorAllowance always allows pull requests autobot made.  Those of users are only allowed if cfg lets users trigger
+// approvals, and never from forks.
+func AuthorAllowance(cfg *autobotcfg.AutobotPerRepoConfig, byAutobot bool, crossRepository bool, noun string) Gate {
+	reason := ""
+	switch {
+	case byAutobot:
+	case !cfg.AllowUsersToTriggerAccept:
+		reason = "not allowing users to accept reviews"
+	case crossRepository:
+		reason = fmt.Sprintf("auto approve not allowed for cross repository %ss", noun)
+	}
+	return Check("author allowance", reason == "", reason)
+}
+
+func NotADraft(draft bool, noun string) Gate {
+	return Check("not a draft", !draft, "ignoring draft "+noun)
+}
+
+// DelayWindow fails until delay has passed since updatedAt
+func DelayWindow(delay time.Duration, updatedAt time.Time, now time.Time, noun string) Gate {
+	left := delay - now.Sub(updatedAt)
+	return Check("delay window", left <= 0, fmt.Sprintf("ignoring %s too recently made (%s left)", noun, left.Round(time.Second)))
+}
@@ -0,0 +1,238 @@
+// Package gatereport publishes, on every pull request carrying an autobot marker, which review and merge gates pass
+// and which do not, so people can tell why the bot is waiting without reading its logs.
+package gatereport
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/gate"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/prmerger"
+	"github.com/cresta/gitops-autobot/internal/prreviewer"
+	"github.com/cresta/zapctx"
+	"github.com/shurcooL/githubv4"
+	"go.uber.org/zap"
+)
+
+// CheckRunName is the name of the check run the report is published as
+const CheckRunName = "gitops-autobot gates"
+
+// commentMarker is hidden in the sticky comment, so it can be found again
+const commentMarker = "<!-- gitops-autobot:gate-report -->"
+
+// countdown is the time left in a gate reason, such as that of gate.DelayWindow.  It is left out of reports, which
+// would otherwise change, and be published again, every cycle.
+var countdown = regexp.MustCompile(` \(-?[0-9][0-9hmsµn.]* left\)`)
+
+// Reporter publishes the gates of the reviewer and merger as a check run or a sticky comment, depending on the
+// gateReport setting of each repository.  Check runs are only available to GitHub Apps.
+type Reporter struct {
+	Client        ghapp.GithubAPI
+	Reviewer      *prreviewer.PrReviewer
+	Merger        *prmerger.PRMerger
+	AutobotConfig *autobotcfg.AutobotConfig
+	Logger        *zapctx.Logger
+
+	mu sync.Mutex
+	// checkRuns are the check runs made so far, by owner/name@sha
+	checkRuns map[string]githubv4.ID
+	// published is the last report of each owner/name#number, so unchanged reports are not published again
+	published map[string]string
+}
+
+// ExecuteRepo publishes the report of every pull request of owner/name that matches sel and carries an autobot marker
+func (r *Reporter) ExecuteRepo(ctx context.Context, owner string, name string, sel ghapp.PRSelector) error {
+	r.Logger.Debug(ctx, "+Reporter.ExecuteRepo")
+	defer r.Logger.Debug(ctx, "-Reporter.ExecuteRepo")
+	repo := r.AutobotConfig.FindRepo(owner, name)
+	if repo == nil {
+		r.Logger.Debug(ctx, "ignoring unknown repository", zap.String("owner", owner), zap.String("name", name))
+		return nil
+	}
+	cfg, err := ghapp.FetchMasterConfigFile(ctx, r.Client, *repo)
+	if err != nil {
+		return fmt.Errorf("unable to fetch repo content for %s: %w", repo, err)
+	}
+	if cfg.GateReport == "" {
+		r.forget(owner, name, nil)
+		return nil
+	}
+	prs, err := r.Client.EveryOpenPullRequest(ctx, owner, name, ghapp.PRFilterFromConfig(r.AutobotConfig))
+	if err != nil {
+		return fmt.Errorf("cannot list every pr: %w", err)
+	}
+	r.forget(owner, name, prs.Repository.PullRequests.Nodes)
+	var repoID githubv4.ID
+	if cfg.GateReport == autobotcfg.GateReportCheckRun {
+		info, err := r.Client.RepositoryInfo(ctx, owner, name)
+		if err != nil {
+			return fmt.Errorf("unable to get repository info: %w", err)
+		}
+		repoID = info.Repository.ID
+	}
+	for _, pr := range prs.Repository.PullRequests.Nodes {
+		if !sel.Matches(pr) || !marker.HasMarker(string(pr.Body)) {
+			continue
+		}
+		if err := r.publish(ctx, owner, name, repoID, pr, cfg); err != nil {
+			return fmt.Errorf("unable to publish gates of #%d: %w", pr.Number, err)
+		}
+	}
+	return nil
+}
+
+// forget drops what was published for pull requests of owner/name that are not in open, so closed ones do not pile up
+func (r *Reporter) forget(owner string, name string, open []ghapp.GraphQLPRQueryNode) {
+	keep := make(map[string]bool, len(open)*2)
+	for _, pr := range open {
+		keep[fmt.Sprintf("%s/%s#%d", owner, name, pr.Number)] = true
+		keep[fmt.Sprintf("%s/%s@%s", owner, name, pr.HeadRef.Target.Oid)] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key := range r.published {
+		if strings.HasPrefix(key, owner+"/"+name+"#") && !keep[key] {
+			delete(r.published, key)
+		}
+	}
+	for key := range r.checkRuns {
+		if strings.HasPrefix(key, owner+"/"+name+"@") && !keep[key] {
+			delete(r.checkRuns, key)
+		}
+	}
+}
+
+func (r *Reporter) publish(ctx context.Context, owner string, name string, repoID githubv4.ID, pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) error {
+	approve, approveReason := r.Reviewer.ApprovalDecision(pr, cfg)
+	merge, mergeReason := r.Merger.MergeDecision(pr, cfg)
+	title := countdown.ReplaceAllString(fmt.Sprintf("%s, %s", summary("approve", approve, approveReason), summary("merge", merge, mergeReason)), "")
+	body := countdown.ReplaceAllString(Render(r.Reviewer.ApprovalGates(pr, cfg), r.Merger.MergeGates(pr, cfg)), "")
+	key := fmt.Sprintf("%s/%s#%d", owner, name, pr.Number)
+	r.mu.Lock()
+	unchanged := r.published[key] == cfg.GateReport+title+body
+	r.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+	r.Logger.Debug(ctx, "publishing gates", zap.String("pr", key), zap.String("title", title))
+	var err error
+	switch cfg.GateReport {
+	case autobotcfg.GateReportCheckRun:
+		err = r.publishCheckRun(ctx, owner, name, repoID, pr, title, body)
+	case autobotcfg.GateReportComment:
+		err = r.publishComment(ctx, owner, name, pr, title, body)
+	}
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.published == nil {
+		r.published = make(map[string]string)
+	}
+	r.published[key] = cfg.GateReport + title + body
+	return nil
+}
+
+// publishCheckRun adds the report to the head commit of pr.  The check run is always neutral, so it never blocks the
+// status check rollup the gates themselves look at.
+func (r *Reporter) publishCheckRun(ctx context.Context, owner string, name string, repoID githubv4.ID, pr ghapp.GraphQLPRQueryNode, title string, body string) error {
+	conclusion := githubv4.CheckConclusionStateNeutral
+	output := &githubv4.CheckRunOutput{
+		Title:   githubv4.String(title),
+		Summary: githubv4.String(body),
+	}
+	key := fmt.Sprintf("%s/%s@%s", owner, name, pr.HeadRef.Target.Oid)
+	r.mu.Lock()
+	id, exists := r.checkRuns[key]
+	r.mu.Unlock()
+	if exists {
+		if _, err := r.Client.UpdateCheckRun(ctx, owner, name, githubv4.UpdateCheckRunInput{
+			RepositoryID: repoID,
+			CheckRunID:   id,
+			Conclusion:   &conclusion,
+			Output:       output,
+		}); err != nil {
+			return fmt.Errorf("unable to update check run: %w", err)
+		}
+		return nil
+	}
+	out, err := r.Client.CreateCheckRun(ctx, owner, name, githubv4.CreateCheckRunInput{
+		RepositoryID: repoID,
+		Name:         CheckRunName,
+		HeadSha:      pr.HeadRef.Target.Oid,
+		Conclusion:   &conclusion,
+		Output:       output,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create check run: %w", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checkRuns == nil {
+		r.checkRuns = make(map[string]githubv4.ID)
+	}
+	r.checkRuns[key] = out.CreateCheckRun.CheckRun.ID
+	return nil
+}
+
+// publishComment edits our earlier report comment on pr, or adds one if there is none
+func (r *Reporter) publishComment(ctx context.Context, owner string, name string, pr ghapp.GraphQLPRQueryNode, title string, body string) error {
+	text := fmt.Sprintf("%s\n**gitops-autobot**: %s\n\n%s", commentMarker, title, body)
+	comments, err := r.Client.PullRequestComments(ctx, owner, name, int(pr.Number))
+	if err != nil {
+		return fmt.Errorf("unable to list comments: %w", err)
+	}
+	for _, c := range comments {
+		if !bool(c.ViewerDidAuthor) || !strings.Contains(string(c.Body), commentMarker) {
+			continue
+		}
+		if _, err := r.Client.UpdateIssueComment(ctx, owner, name, githubv4.UpdateIssueCommentInput{
+			ID:   c.ID,
+			Body: githubv4.String(text),
+		}); err != nil {
+			return fmt.Errorf("unable to update comment: %w", err)
+		}
+		return nil
+	}
+	if _, err := r.Client.AddComment(ctx, owner, name, githubv4.AddCommentInput{
+		SubjectID: pr.ID,
+		Body:      githubv4.String(text),
+	}); err != nil {
+		return fmt.Errorf("unable to add comment: %w", err)
+	}
+	return nil
+}
+
+func summary(action string, will bool, reason string) string {
+	if will {
+		return "will " + action
+	}
+	return fmt.Sprintf("will not %s (%s)", action, reason)
+}
+
+// Render is a markdown table of the approval gates, then one of the merge gates
+func Render(approval []gate.Gate, merge []gate.Gate) string {
+	var sb strings.Builder
+	writeTable(&sb, "Approve", approval)
+	sb.WriteString("\n")
+	writeTable(&sb, "Merge", merge)
+	return sb.String()
+}
+
+func writeTable(sb *strings.Builder, heading string, gates []gate.Gate) {
+	fmt.Fprintf(sb, "#### %s\n\n| Gate | Passed | Reason |\n| --- | --- | --- |\n", heading)
+	for _, g := range gates {
+		passed := "✅"
+		if !g.Passed {
+			passed = "❌"
+		}
+		fmt.Fprintf(sb, "| %s | %s | %s |\n", g.Name, passed, strings.ReplaceAll(g.Reason, "|", "\\|"))
+	}
+}
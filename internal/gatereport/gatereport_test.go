@@ -0,0 +1,167 @@
+package gatereport
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/ghapp/fakegithub"
+	"github.com/cresta/gitops-autobot/internal/prmerger"
+	"github.com/cresta/gitops-autobot/internal/prreviewer"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/shurcooL/githubv4"
+	"github.com/stretchr/testify/require"
+)
+
+const repoConfig = `allowAutoReview: true
+allowAutoMerge: true
+gateReport: %s
+`
+
+// newReporter is a reporter for a repository with an autobot PR, whose head commit is returned, and a PR by a human
+func newReporter(t *testing.T, mode string) (*fakegithub.GitHub, *Reporter, string) {
+	ctx := context.Background()
+	logger := testhelp.ZapTestingLogger(t)
+	gh := fakegithub.New(t.TempDir())
+	require.NoError(t, gh.AddRepository(fakegithub.Repository{
+		Owner:         "cresta",
+		Name:          "gitops",
+		Files:         map[string]string{".gitops-autobot": strings.Replace(repoConfig, "%s", mode, 1)},
+		RequireReview: true,
+	}))
+	creator := gh.Client("autobot")
+	prMaker, err := creator.Self(ctx)
+	require.NoError(t, err)
+	var head string
+	for _, branch := range []string{"human-change", "autobot-change"} {
+		head, err = gh.Commit("cresta", "gitops", branch, map[string]string{branch + ".txt": "a\n"}, "Change")
+		require.NoError(t, err)
+	}
+	_, err = creator.CreatePullRequest(ctx, "cresta", "gitops", githubv4.CreatePullRequestInput{
+		BaseRefName: "master",
+		HeadRefName: "autobot-change",
+		Title:       "Change",
+		Body:        githubv4.NewString("gitops-autobot: auto-approve=true\ngitops-autobot: auto-merge=true"),
+	})
+	require.NoError(t, err)
+	_, err = gh.Client("human").CreatePullRequest(ctx, "cresta", "gitops", githubv4.CreatePullRequestInput{
+		BaseRefName: "master",
+		HeadRefName: "human-change",
+		Title:       "Not for the bot",
+	})
+	require.NoError(t, err)
+
+	cfg := &autobotcfg.AutobotConfig{
+		Repos: []autobotcfg.RepoConfig{{Owner: "cresta", Name: "gitops", Branch: "master"}},
+	}
+	reviewer := gh.Client("reviewer")
+	return gh, &Reporter{
+		Client: reviewer,
+		Reviewer: &prreviewer.PrReviewer{
+			Client:        reviewer,
+			Logger:        logger,
+			AutobotConfig: cfg,
+			PRMaker:       prMaker,
+		},
+		Merger: &prmerger.PRMerger{
+			Client:        reviewer,
+			Logger:        logger,
+			AutobotConfig: cfg,
+		},
+		AutobotConfig: cfg,
+		Logger:        logger,
+	}, head
+}
+
+func TestReporter_Comment(t *testing.T) {
+	ctx := context.Background()
+	gh, r, head := newReporter(t, autobotcfg.GateReportComment)
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	prs := gh.PullRequests("cresta", "gitops")
+	require.Len(t, prs[0].Comments, 1)
+	require.Empty(t, prs[1].Comments, "only PRs with an autobot marker get a report")
+	report := prs[0].Comments[0]
+	require.Equal(t, "reviewer", report.Author)
+	require.Contains(t, report.Body, "will approve, will not merge (unable to auto merge PR with a required reviewer left)")
+	require.Contains(t, report.Body, "| review decision | ❌ | unable to auto merge PR with a required reviewer left |")
+	require.Contains(t, report.Body, "| delay window | ✅ |  |")
+
+	// The report is edited in place when a gate changes
+	require.NoError(t, gh.SetCheckState("cresta", "gitops", head, githubv4.StatusStatePending))
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	prs = gh.PullRequests("cresta", "gitops")
+	require.Len(t, prs[0].Comments, 1)
+	require.Equal(t, report.ID, prs[0].Comments[0].ID)
+	require.Contains(t, prs[0].Comments[0].Body, "| rollup state | ❌ | status state not success (PENDING) |")
+}
+
+func TestReporter_DelayWindow(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now()
+	gh, r, _ := newReporter(t, autobotcfg.GateReportComment)
+	r.AutobotConfig.DelayForAutoApproval = time.Minute
+	now := start.Add(10 * time.Second)
+	gh.Now = func() time.Time { return now }
+	r.Reviewer.Now = gh.Now
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	pr := gh.PullRequests("cresta", "gitops")[0]
+	require.Contains(t, pr.Comments[0].Body, "will not approve (ignoring PR too recently made)")
+	require.NotContains(t, pr.Comments[0].Body, "s left)", "the countdown is not published")
+
+	// Time passing does not rewrite the report, which would bump the PR
+	now = now.Add(10 * time.Second)
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	require.Equal(t, pr.UpdatedAt, gh.PullRequests("cresta", "gitops")[0].UpdatedAt)
+
+	// The delay counts from the head commit, so the report itself does not hold the PR back
+	now = now.Add(time.Minute)
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	now = now.Add(time.Second)
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	pr = gh.PullRequests("cresta", "gitops")[0]
+	require.Len(t, pr.Comments, 1)
+	require.Contains(t, pr.Comments[0].Body, "will approve, ")
+}
+
+func TestReporter_ForgetsClosed(t *testing.T) {
+	ctx := context.Background()
+	gh, r, _ := newReporter(t, autobotcfg.GateReportCheckRun)
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	require.Len(t, r.published, 1)
+	require.Len(t, r.checkRuns, 1)
+	pr := gh.PullRequests("cresta", "gitops")[0]
+	_, err := gh.Client("autobot").ClosePullRequest(ctx, "cresta", "gitops", githubv4.ClosePullRequestInput{PullRequestID: pr.ID})
+	require.NoError(t, err)
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	require.Empty(t, r.published)
+	require.Empty(t, r.checkRuns)
+}
+
+func TestReporter_CheckRun(t *testing.T) {
+	ctx := context.Background()
+	gh, r, head := newReporter(t, autobotcfg.GateReportCheckRun)
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	runs := gh.CheckRuns("cresta", "gitops")
+	require.Len(t, runs, 1)
+	require.Equal(t, CheckRunName, runs[0].Name)
+	require.Equal(t, githubv4.CheckConclusionStateNeutral, runs[0].Conclusion)
+	require.Equal(t, "will approve, will not merge (unable to auto merge PR with a required reviewer left)", runs[0].Title)
+
+	require.NoError(t, gh.SetCheckState("cresta", "gitops", head, githubv4.StatusStateFailure))
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	runs = gh.CheckRuns("cresta", "gitops")
+	require.Len(t, runs, 1, "the check run of the head commit is updated")
+	require.Contains(t, runs[0].Title, "will not approve (status state not success (FAILURE))")
+}
+
+func TestReporter_Off(t *testing.T) {
+	ctx := context.Background()
+	gh, r, _ := newReporter(t, `""`)
+	require.NoError(t, r.ExecuteRepo(ctx, "cresta", "gitops", ghapp.PRSelector{}))
+	require.Empty(t, gh.CheckRuns("cresta", "gitops"))
+	require.Empty(t, gh.PullRequests("cresta", "gitops")[0].Comments)
+}
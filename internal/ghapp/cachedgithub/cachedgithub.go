@@ -17,6 +17,9 @@ type CachedGithub struct {
 	Cache cache.Cache
 	mu    sync.Mutex
 	self  *ghapp.UserInfo
+	// prFilters are the filters each repository's pull requests were listed with, so every one can be invalidated
+	prFilters   map[string]map[string]ghapp.PRFilter
+	prFiltersMu sync.Mutex
 }
 
 func (c *CachedGithub) DoesBranchExist(ctx context.Context, owner string, name string, ref string) (bool, error) {
@@ -35,8 +38,37 @@ func (c *CachedGithub) generalKey(function string, owner string, name string, ex
 	return []byte(fmt.Sprintf("%s:%s:%s:%s:%s", cacheVersion, function, owner, name, extraInfo))
 }
 
-func (c *CachedGithub) listPrsKey(owner string, name string) []byte {
-	return c.generalKey("listPrs", owner, name, "")
+func (c *CachedGithub) listPrsKey(owner string, name string, filter ghapp.PRFilter) []byte {
+	return c.generalKey("listPrs", owner, name, filter.String())
+}
+
+func (c *CachedGithub) rememberPrFilter(owner string, name string, filter ghapp.PRFilter) {
+	c.prFiltersMu.Lock()
+	defer c.prFiltersMu.Unlock()
+	if c.prFilters == nil {
+		c.prFilters = make(map[string]map[string]ghapp.PRFilter)
+	}
+	repoKey := owner + "/" + name
+	if c.prFilters[repoKey] == nil {
+		c.prFilters[repoKey] = make(map[string]ghapp.PRFilter)
+	}
+	c.prFilters[repoKey][filter.String()] = filter
+}
+
+// deleteListPrs forgets every cached listing of the repository's pull requests
+func (c *CachedGithub) deleteListPrs(ctx context.Context, owner string, name string) error {
+	c.prFiltersMu.Lock()
+	filters := make([]ghapp.PRFilter, 0, len(c.prFilters[owner+"/"+name]))
+	for _, f := range c.prFilters[owner+"/"+name] {
+		filters = append(filters, f)
+	}
+	c.prFiltersMu.Unlock()
+	for _, f := range filters {
+		if err := c.Cache.Delete(ctx, c.listPrsKey(owner, name, f)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *CachedGithub) RepositoryInfo(ctx context.Context, owner string, name string) (*ghapp.RepositoryInfo, error) {
@@ -77,25 +109,34 @@ func (c *CachedGithub) Self(ctx context.Context) (*ghapp.UserInfo, error) {
 	return c.self, nil
 }
 
-func (c *CachedGithub) EveryOpenPullRequest(ctx context.Context, owner string, name string) (*ghapp.GraphQLPRQuery, error) {
+func (c *CachedGithub) EveryOpenPullRequest(ctx context.Context, owner string, name string, filter ghapp.PRFilter) (*ghapp.GraphQLPRQuery, error) {
 	var ret ghapp.GraphQLPRQuery
-	if err := c.Cache.GetOrSet(ctx, c.listPrsKey(owner, name), time.Minute, &ret, func(ctx context.Context) (interface{}, error) {
-		return c.Into.EveryOpenPullRequest(ctx, owner, name)
+	c.rememberPrFilter(owner, name, filter)
+	if err := c.Cache.GetOrSet(ctx, c.listPrsKey(owner, name, filter), time.Minute, &ret, func(ctx context.Context) (interface{}, error) {
+		return c.Into.EveryOpenPullRequest(ctx, owner, name, filter)
 	}); err != nil {
 		return nil, fmt.Errorf("unable to fetch from cache: %w", err)
 	}
 	return &ret, nil
 }
 
+// InvalidatePullRequests forgets the cached pull requests of a repository, for when we are told they changed
+func (c *CachedGithub) InvalidatePullRequests(ctx context.Context, owner string, name string) error {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
+		return fmt.Errorf("unable to clear out cache: %w", err)
+	}
+	return nil
+}
+
 func (c *CachedGithub) AcceptPullRequest(ctx context.Context, owner string, name string, in githubv4.AddPullRequestReviewInput) (*ghapp.AcceptPullRequestOutput, error) {
-	if err := c.Cache.Delete(ctx, c.listPrsKey(owner, name)); err != nil {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
 		return nil, fmt.Errorf("unable to clear out cache: %w", err)
 	}
 	return c.Into.AcceptPullRequest(ctx, owner, name, in)
 }
 
 func (c *CachedGithub) MergePullRequest(ctx context.Context, owner string, name string, ref string, in githubv4.MergePullRequestInput) (*ghapp.MergePullRequestOutput, error) {
-	if err := c.Cache.Delete(ctx, c.listPrsKey(owner, name)); err != nil {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
 		return nil, fmt.Errorf("unable to clear out cache for prs: %w", err)
 	}
 	if err := c.Cache.Delete(ctx, c.generalKey("branchexist", owner, name, ref)); err != nil {
@@ -108,10 +149,123 @@ func (c *CachedGithub) CreatePullRequest(ctx context.Context, owner string, name
 	if err := c.Cache.Delete(ctx, c.generalKey("branchexist", owner, name, string(in.HeadRefName))); err != nil {
 		return nil, fmt.Errorf("unable to clear out cache for branch: %w", err)
 	}
-	if err := c.Cache.Delete(ctx, c.listPrsKey(owner, name)); err != nil {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
 		return nil, fmt.Errorf("unable to clear out cache: %w", err)
 	}
 	return c.Into.CreatePullRequest(ctx, owner, name, in)
 }
 
+func (c *CachedGithub) RepositoryPermission(ctx context.Context, owner string, name string, login string) (string, error) {
+	var ret string
+	if err := c.Cache.GetOrSet(ctx, c.generalKey("permission", owner, name, login), time.Minute*5, &ret, func(ctx context.Context) (interface{}, error) {
+		return c.Into.RepositoryPermission(ctx, owner, name, login)
+	}); err != nil {
+		return "", fmt.Errorf("unable to fetch from cache: %w", err)
+	}
+	return ret, nil
+}
+
+func (c *CachedGithub) AddComment(ctx context.Context, owner string, name string, in githubv4.AddCommentInput) (*ghapp.AddCommentOutput, error) {
+	return c.Into.AddComment(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) AddLabel(ctx context.Context, owner string, name string, number int, label string) error {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
+		return fmt.Errorf("unable to clear out cache: %w", err)
+	}
+	return c.Into.AddLabel(ctx, owner, name, number, label)
+}
+
+func (c *CachedGithub) RemoveLabel(ctx context.Context, owner string, name string, number int, label string) error {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
+		return fmt.Errorf("unable to clear out cache: %w", err)
+	}
+	return c.Into.RemoveLabel(ctx, owner, name, number, label)
+}
+
+func (c *CachedGithub) UpdatePullRequestBranch(ctx context.Context, owner string, name string, in githubv4.UpdatePullRequestBranchInput) (*ghapp.UpdatePullRequestBranchOutput, error) {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
+		return nil, fmt.Errorf("unable to clear out cache: %w", err)
+	}
+	return c.Into.UpdatePullRequestBranch(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) ClosePullRequest(ctx context.Context, owner string, name string, in githubv4.ClosePullRequestInput) (*ghapp.ClosePullRequestOutput, error) {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
+		return nil, fmt.Errorf("unable to clear out cache: %w", err)
+	}
+	return c.Into.ClosePullRequest(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) UpdatePullRequest(ctx context.Context, owner string, name string, in githubv4.UpdatePullRequestInput) (*ghapp.UpdatePullRequestOutput, error) {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
+		return nil, fmt.Errorf("unable to clear out cache: %w", err)
+	}
+	return c.Into.UpdatePullRequest(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) EveryBranch(ctx context.Context, owner string, name string, prefix string) (*ghapp.GraphQLBranchQuery, error) {
+	// Only the janitor lists branches, once a cycle, so there is nothing to gain from caching
+	return c.Into.EveryBranch(ctx, owner, name, prefix)
+}
+
+func (c *CachedGithub) RecentlyClosedPullRequests(ctx context.Context, owner string, name string) (*ghapp.GraphQLClosedPRQuery, error) {
+	// Closed pull requests are looked at once a cycle, so there is nothing to gain from caching
+	return c.Into.RecentlyClosedPullRequests(ctx, owner, name)
+}
+
+func (c *CachedGithub) AccessibleRepositories(ctx context.Context) ([]ghapp.Repository, error) {
+	// Only asked for when discovery refreshes, which is rarer than the cache is cleared
+	return c.Into.AccessibleRepositories(ctx)
+}
+
+func (c *CachedGithub) CreateCheckRun(ctx context.Context, owner string, name string, in githubv4.CreateCheckRunInput) (*ghapp.CreateCheckRunOutput, error) {
+	return c.Into.CreateCheckRun(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) UpdateCheckRun(ctx context.Context, owner string, name string, in githubv4.UpdateCheckRunInput) (*ghapp.UpdateCheckRunOutput, error) {
+	return c.Into.UpdateCheckRun(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) PullRequestComments(ctx context.Context, owner string, name string, number int) ([]ghapp.IssueComment, error) {
+	// Comments change under us as people talk, so they are always fetched
+	return c.Into.PullRequestComments(ctx, owner, name, number)
+}
+
+func (c *CachedGithub) UpdateIssueComment(ctx context.Context, owner string, name string, in githubv4.UpdateIssueCommentInput) (*ghapp.UpdateIssueCommentOutput, error) {
+	return c.Into.UpdateIssueComment(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) EnablePullRequestAutoMerge(ctx context.Context, owner string, name string, in githubv4.EnablePullRequestAutoMergeInput) (*ghapp.EnablePullRequestAutoMergeOutput, error) {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
+		return nil, fmt.Errorf("unable to clear out cache: %w", err)
+	}
+	return c.Into.EnablePullRequestAutoMerge(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) DisablePullRequestAutoMerge(ctx context.Context, owner string, name string, in githubv4.DisablePullRequestAutoMergeInput) (*ghapp.DisablePullRequestAutoMergeOutput, error) {
+	return c.Into.DisablePullRequestAutoMerge(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) EnqueuePullRequest(ctx context.Context, owner string, name string, in ghapp.EnqueuePullRequestInput) (*ghapp.EnqueuePullRequestOutput, error) {
+	if err := c.deleteListPrs(ctx, owner, name); err != nil {
+		return nil, fmt.Errorf("unable to clear out cache: %w", err)
+	}
+	return c.Into.EnqueuePullRequest(ctx, owner, name, in)
+}
+
+func (c *CachedGithub) PullRequestMergeState(ctx context.Context, owner string, name string, number int) (*ghapp.GraphQLPRMergeStateQuery, error) {
+	return c.Into.PullRequestMergeState(ctx, owner, name, number)
+}
+
+func (c *CachedGithub) DeleteBranch(ctx context.Context, owner string, name string, ref string) error {
+	// DoesBranchExist is asked about both short and fully qualified names
+	for _, existRef := range []string{ref, "refs/heads/" + ref} {
+		if err := c.Cache.Delete(ctx, c.generalKey("branchexist", owner, name, existRef)); err != nil {
+			return fmt.Errorf("unable to clear out cache for branch: %w", err)
+		}
+	}
+	return c.Into.DeleteBranch(ctx, owner, name, ref)
+}
+
 var _ ghapp.GithubAPI = &CachedGithub{}
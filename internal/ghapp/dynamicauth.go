@@ -1,16 +1,28 @@
 package ghapp
 
 import (
+	"context"
 	"fmt"
 	http2 "net/http"
 
-	"github.com/bradleyfalzon/ghinstallation"
 	"github.com/cresta/zapctx"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 )
 
+// TokenSource hands out the token to authenticate to GitHub with, such as a *ghinstallation.Transport
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a TokenSource for a token that never changes, such as a personal access token
+type StaticToken string
+
+func (s StaticToken) Token(_ context.Context) (string, error) {
+	return string(s), nil
+}
+
 type DynamicAuthMethod struct {
-	Itr    *ghinstallation.Transport
+	Itr    TokenSource
 	Logger *zapctx.Logger
 }
 
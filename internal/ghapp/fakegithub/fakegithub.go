@@ -0,0 +1,1243 @@
+// Package fakegithub is an in-memory GitHub, for end to end tests and local development.  Pull requests, reviews,
+// labels, comments, check states and check runs live in memory.  Every repository is a bare git repository on disk, so
+// checkouts clone from and push to it like they would to GitHub.
+package fakegithub
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/shurcooL/githubv4"
+)
+
+// GitHub is the state of the fake.  Use Client to act on it as a user.
+type GitHub struct {
+	// Dir holds the bare repositories, as <Dir>/<owner>/<name>.git.  An autobotcfg.RepoConfig with a ForgeURL of Dir
+	// clones from them.
+	Dir string
+	// Now is the current time.  Defaults to time.Now.
+	Now func() time.Time
+
+	mu     sync.Mutex
+	repos  map[string]*repository
+	prByID map[string]*pullRequest
+	// nextID numbers comments and check runs
+	nextID int
+}
+
+// Repository is a repository to create
+type Repository struct {
+	Owner         string
+	Name          string
+	DefaultBranch string
+	// Files are the content of the first commit of DefaultBranch, by path
+	Files    map[string]string
+	Topics   []string
+	Archived bool
+	// RequireReview makes pull requests wait for an approval before they can merge, like a protected branch would
+	RequireReview bool
+	// RequireUpToDate makes pull requests behind their base wait to be updated before they can merge
+	RequireUpToDate bool
+	// MergeQueue makes pull requests merge only through a merge queue, like a branch protected by one would
+	MergeQueue bool
+}
+
+type repository struct {
+	Repository
+	path        string
+	nextNumber  int
+	prs         []*pullRequest
+	checks      map[string]githubv4.StatusState
+	checkRuns   []*CheckRun
+	permissions map[string]string
+}
+
+type review struct {
+	login string
+	state githubv4.PullRequestReviewState
+	oid   string
+}
+
+type pullRequest struct {
+	repo *repository
+	PullRequest
+	reviews []review
+	// closedHead is the head the pull request had when it was closed or merged
+	closedHead string
+}
+
+// PullRequest is what the fake knows about a pull request
+type PullRequest struct {
+	ID          string
+	Number      int
+	Title       string
+	Body        string
+	HeadRefName string
+	BaseRefName string
+	Author      string
+	Draft       bool
+	State       githubv4.PullRequestState
+	Labels      []string
+	Comments    []Comment
+	// Editor is the last user to edit the title or body, if anyone has
+	Editor      string
+	MergeMethod githubv4.PullRequestMergeMethod
+	// AutoMergeMethod is the method auto merge was enabled with, or empty if it is not enabled
+	AutoMergeMethod githubv4.PullRequestMergeMethod
+	InMergeQueue    bool
+	ClosedBy        string
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	ClosedAt        time.Time
+}
+
+// Comment is a comment on a pull request
+type Comment struct {
+	ID     string
+	Author string
+	Body   string
+}
+
+// CheckRun is a check run an app added to a commit
+type CheckRun struct {
+	ID         string
+	Name       string
+	HeadSha    string
+	Author     string
+	Status     githubv4.RequestableCheckStatusState
+	Conclusion githubv4.CheckConclusionState
+	Title      string
+	Summary    string
+}
+
+// New is a fake GitHub without any repositories, kept in dir
+func New(dir string) *GitHub {
+	return &GitHub{
+		Dir:    dir,
+		repos:  make(map[string]*repository),
+		prByID: make(map[string]*pullRequest),
+	}
+}
+
+func (g *GitHub) now() time.Time {
+	if g.Now == nil {
+		return time.Now()
+	}
+	return g.Now()
+}
+
+func repoKey(owner string, name string) string {
+	return strings.ToLower(owner + "/" + name)
+}
+
+// AddRepository creates a repository with a single commit
+func (g *GitHub) AddRepository(r Repository) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, exists := g.repos[repoKey(r.Owner, r.Name)]; exists {
+		return fmt.Errorf("repository %s/%s already exists", r.Owner, r.Name)
+	}
+	if r.DefaultBranch == "" {
+		r.DefaultBranch = "master"
+	}
+	path := filepath.Join(g.Dir, r.Owner, r.Name+".git")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("unable to make directory for %s: %w", path, err)
+	}
+	repo, err := git.PlainInit(path, true)
+	if err != nil {
+		return fmt.Errorf("unable to init %s: %w", path, err)
+	}
+	content := make(map[string][]byte, len(r.Files))
+	for name, c := range r.Files {
+		content[name] = []byte(c)
+	}
+	h, err := commitFiles(repo, nil, content, "Initial commit", g.now())
+	if err != nil {
+		return fmt.Errorf("unable to make first commit: %w", err)
+	}
+	branch := plumbing.NewBranchReferenceName(r.DefaultBranch)
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, h)); err != nil {
+		return fmt.Errorf("unable to set %s: %w", branch, err)
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)); err != nil {
+		return fmt.Errorf("unable to set HEAD: %w", err)
+	}
+	g.repos[repoKey(r.Owner, r.Name)] = &repository{
+		Repository:  r,
+		path:        path,
+		nextNumber:  1,
+		checks:      make(map[string]githubv4.StatusState),
+		permissions: make(map[string]string),
+	}
+	return nil
+}
+
+// Commit commits files to branch of owner/name, like someone pushing to it would, and returns the new head.  A branch
+// that does not exist yet is started from the default branch.
+func (g *GitHub) Commit(owner string, name string, branch string, files map[string]string, message string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, gr, err := g.open(owner, name)
+	if err != nil {
+		return "", err
+	}
+	parent, err := branchCommit(gr, branch)
+	if err != nil {
+		return "", err
+	}
+	if parent == nil {
+		if parent, err = branchCommit(gr, r.DefaultBranch); err != nil {
+			return "", err
+		}
+	}
+	content := make(map[string][]byte, len(files))
+	for n, c := range files {
+		content[n] = []byte(c)
+	}
+	h, err := commitFiles(gr, []*object.Commit{parent}, content, message, g.now())
+	if err != nil {
+		return "", fmt.Errorf("unable to commit: %w", err)
+	}
+	if err := gr.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), h)); err != nil {
+		return "", fmt.Errorf("unable to update %s: %w", branch, err)
+	}
+	return h.String(), nil
+}
+
+// ReadFile is the content of file on branch of owner/name
+func (g *GitHub) ReadFile(owner string, name string, branch string, file string) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, gr, err := g.open(owner, name)
+	if err != nil {
+		return "", err
+	}
+	c, err := branchCommit(gr, branch)
+	if err != nil {
+		return "", err
+	}
+	if c == nil {
+		return "", fmt.Errorf("no branch %s", branch)
+	}
+	return readFile(c, file)
+}
+
+// Branches lists the branches of owner/name
+func (g *GitHub) Branches(owner string, name string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, gr, err := g.open(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	return branches(gr)
+}
+
+// SetCheckState sets the combined state of the checks of commit oid of owner/name.  Commits without a state have
+// passed their checks.
+func (g *GitHub) SetCheckState(owner string, name string, oid string, state githubv4.StatusState) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, exists := g.repos[repoKey(owner, name)]
+	if !exists {
+		return fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	r.checks[oid] = state
+	return nil
+}
+
+// SetPermission sets the permission of login on owner/name: one of admin, write, read or none
+func (g *GitHub) SetPermission(owner string, name string, login string, permission string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, exists := g.repos[repoKey(owner, name)]
+	if !exists {
+		return fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	r.permissions[login] = permission
+	return nil
+}
+
+// PullRequests lists every pull request of owner/name, in the order they were made
+func (g *GitHub) PullRequests(owner string, name string) []PullRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, exists := g.repos[repoKey(owner, name)]
+	if !exists {
+		return nil
+	}
+	ret := make([]PullRequest, 0, len(r.prs))
+	for _, pr := range r.prs {
+		cp := pr.PullRequest
+		cp.Labels = append([]string(nil), pr.Labels...)
+		cp.Comments = append([]Comment(nil), pr.Comments...)
+		ret = append(ret, cp)
+	}
+	return ret
+}
+
+// CheckRuns lists every check run of owner/name, in the order they were made
+func (g *GitHub) CheckRuns(owner string, name string) []CheckRun {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, exists := g.repos[repoKey(owner, name)]
+	if !exists {
+		return nil
+	}
+	ret := make([]CheckRun, 0, len(r.checkRuns))
+	for _, cr := range r.checkRuns {
+		ret = append(ret, *cr)
+	}
+	return ret
+}
+
+func (g *GitHub) newID(prefix string) string {
+	g.nextID++
+	return fmt.Sprintf("%s_%d", prefix, g.nextID)
+}
+
+// Client acts on the fake as login
+func (g *GitHub) Client(login string) *Client {
+	return &Client{
+		GitHub: g,
+		Login:  login,
+	}
+}
+
+// open finds owner/name and opens its bare repository.  It is opened every time, so pushes since are seen.
+func (g *GitHub) open(owner string, name string) (*repository, *git.Repository, error) {
+	r, exists := g.repos[repoKey(owner, name)]
+	if !exists {
+		return nil, nil, fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	gr, err := git.PlainOpen(r.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open %s: %w", r.path, err)
+	}
+	return r, gr, nil
+}
+
+func (g *GitHub) findPR(id githubv4.ID) (*pullRequest, *git.Repository, error) {
+	s, _ := id.(string)
+	pr, exists := g.prByID[s]
+	if !exists {
+		return nil, nil, fmt.Errorf("no pull request %v", id)
+	}
+	_, gr, err := g.open(pr.repo.Owner, pr.repo.Name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pr, gr, nil
+}
+
+func branches(gr *git.Repository) ([]string, error) {
+	itr, err := gr.Branches()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list branches: %w", err)
+	}
+	defer itr.Close()
+	var ret []string
+	if err := itr.ForEach(func(ref *plumbing.Reference) error {
+		ret = append(ret, ref.Name().Short())
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to list branches: %w", err)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// Client is the GitHub API of the fake, as one user.  Anything it does is done as Login.
+type Client struct {
+	GitHub *GitHub
+	Login  string
+}
+
+var _ ghapp.GithubAPI = &Client{}
+
+func userID(login string) string {
+	return "U_" + login
+}
+
+func (c *Client) RepositoryInfo(_ context.Context, owner string, name string) (*ghapp.RepositoryInfo, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, exists := c.GitHub.repos[repoKey(owner, name)]
+	if !exists {
+		return nil, fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	var ret ghapp.RepositoryInfo
+	ret.Repository.ID = "R_" + repoKey(owner, name)
+	ret.Repository.DefaultBranchRef.Name = githubv4.String(r.DefaultBranch)
+	ret.Repository.DefaultBranchRef.ID = "REF_" + r.DefaultBranch
+	return &ret, nil
+}
+
+func (c *Client) CreatePullRequest(_ context.Context, owner string, name string, in githubv4.CreatePullRequestInput) (*ghapp.CreatePullRequest, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, gr, err := c.GitHub.open(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	// Like GitHub, branches can be given as full references
+	baseRef := plumbing.ReferenceName(in.BaseRefName).Short()
+	headRef := plumbing.ReferenceName(in.HeadRefName).Short()
+	for _, branch := range []string{baseRef, headRef} {
+		if head, err := branchCommit(gr, branch); err != nil {
+			return nil, err
+		} else if head == nil {
+			return nil, fmt.Errorf("no branch %s", branch)
+		}
+	}
+	for _, pr := range r.prs {
+		if pr.State == githubv4.PullRequestStateOpen && pr.HeadRefName == headRef && pr.BaseRefName == baseRef {
+			return nil, fmt.Errorf("a pull request already exists for %s", headRef)
+		}
+	}
+	now := c.GitHub.now()
+	pr := &pullRequest{
+		repo: r,
+		PullRequest: PullRequest{
+			ID:          fmt.Sprintf("PR_%s#%d", repoKey(owner, name), r.nextNumber),
+			Number:      r.nextNumber,
+			Title:       string(in.Title),
+			HeadRefName: headRef,
+			BaseRefName: baseRef,
+			Author:      c.Login,
+			State:       githubv4.PullRequestStateOpen,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		},
+	}
+	if in.Body != nil {
+		pr.Body = string(*in.Body)
+	}
+	if in.Draft != nil {
+		pr.Draft = bool(*in.Draft)
+	}
+	r.nextNumber++
+	r.prs = append(r.prs, pr)
+	c.GitHub.prByID[pr.ID] = pr
+	return &ghapp.CreatePullRequest{}, nil
+}
+
+// GoGetAuthMethod is nil: the bare repositories are local and need no auth
+func (c *Client) GoGetAuthMethod() http.AuthMethod {
+	return nil
+}
+
+func (c *Client) GetContents(_ context.Context, owner string, name string, file string) (string, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, gr, err := c.GitHub.open(owner, name)
+	if err != nil {
+		return "", err
+	}
+	head, err := branchCommit(gr, r.DefaultBranch)
+	if err != nil {
+		return "", err
+	}
+	return readFile(head, file)
+}
+
+func (c *Client) Self(_ context.Context) (*ghapp.UserInfo, error) {
+	return &ghapp.UserInfo{
+		Login: githubv4.String(c.Login),
+		ID:    userID(c.Login),
+	}, nil
+}
+
+func (c *Client) AcceptPullRequest(_ context.Context, _ string, _ string, in githubv4.AddPullRequestReviewInput) (*ghapp.AcceptPullRequestOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, gr, err := c.GitHub.findPR(in.PullRequestID)
+	if err != nil {
+		return nil, err
+	}
+	if pr.State != githubv4.PullRequestStateOpen {
+		return nil, fmt.Errorf("pull request #%d is %s", pr.Number, pr.State)
+	}
+	state := githubv4.PullRequestReviewStateCommented
+	if in.Event != nil {
+		switch *in.Event {
+		case githubv4.PullRequestReviewEventApprove:
+			state = githubv4.PullRequestReviewStateApproved
+		case githubv4.PullRequestReviewEventRequestChanges:
+			state = githubv4.PullRequestReviewStateChangesRequested
+		}
+	}
+	if pr.Author == c.Login && state != githubv4.PullRequestReviewStateCommented {
+		return nil, fmt.Errorf("can not approve or request changes on your own pull request")
+	}
+	head, err := branchCommit(gr, pr.HeadRefName)
+	if err != nil {
+		return nil, err
+	}
+	oid := head.Hash.String()
+	if in.CommitOID != nil {
+		oid = string(*in.CommitOID)
+	}
+	pr.reviews = append(pr.reviews, review{login: c.Login, state: state, oid: oid})
+	var ret ghapp.AcceptPullRequestOutput
+	ret.AddPullRequestReview.PullRequestReview.ID = fmt.Sprintf("PRR_%s_%d", pr.ID, len(pr.reviews))
+	return &ret, nil
+}
+
+func (c *Client) MergePullRequest(_ context.Context, _ string, _ string, _ string, in githubv4.MergePullRequestInput) (*ghapp.MergePullRequestOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, gr, err := c.GitHub.findPR(in.PullRequestID)
+	if err != nil {
+		return nil, err
+	}
+	if pr.repo.MergeQueue {
+		return nil, fmt.Errorf("pull request #%d can only be merged through the merge queue of %s", pr.Number, pr.BaseRefName)
+	}
+	method := githubv4.PullRequestMergeMethodMerge
+	if in.MergeMethod != nil {
+		method = *in.MergeMethod
+	}
+	if err := c.GitHub.mergePR(pr, gr, method, in.ExpectedHeadOid, false); err != nil {
+		return nil, err
+	}
+	var ret ghapp.MergePullRequestOutput
+	ret.MergePullRequest.PullRequest.ID = pr.ID
+	return &ret, nil
+}
+
+// mergeBlocker returns why pr can not be merged yet, or nil if it can.  The merge queue tests pull requests against
+// the latest base, so they do not need to be up to date to merge from it.
+func (g *GitHub) mergeBlocker(pr *pullRequest, gr *git.Repository, fromQueue bool) error {
+	if pr.State != githubv4.PullRequestStateOpen {
+		return fmt.Errorf("pull request #%d is %s", pr.Number, pr.State)
+	}
+	if pr.Draft {
+		return fmt.Errorf("pull request #%d is still a draft", pr.Number)
+	}
+	base, head, err := pr.commits(gr)
+	if err != nil {
+		return err
+	}
+	if pr.repo.RequireReview && pr.reviewDecision() != githubv4.PullRequestReviewDecisionApproved {
+		return fmt.Errorf("at least 1 approving review is required by reviewers with write access")
+	}
+	if g.checkState(pr.repo, head.Hash.String()) != githubv4.StatusStateSuccess {
+		return fmt.Errorf("required status checks have not passed")
+	}
+	m, err := merge(base, head)
+	if err != nil {
+		return err
+	}
+	if len(m.conflicts) > 0 {
+		return fmt.Errorf("pull request #%d is not mergeable: conflicts in %s", pr.Number, strings.Join(m.conflicts, ", "))
+	}
+	if pr.repo.RequireUpToDate && !fromQueue {
+		if behind, err := isBehind(base, head); err != nil {
+			return err
+		} else if behind {
+			return fmt.Errorf("head branch is not up to date with the base branch")
+		}
+	}
+	return nil
+}
+
+// mergePR merges pr into its base with method, with the lock held
+func (g *GitHub) mergePR(pr *pullRequest, gr *git.Repository, method githubv4.PullRequestMergeMethod, expectedHead *githubv4.GitObjectID, fromQueue bool) error {
+	if err := g.mergeBlocker(pr, gr, fromQueue); err != nil {
+		return err
+	}
+	base, head, err := pr.commits(gr)
+	if err != nil {
+		return err
+	}
+	if expectedHead != nil && string(*expectedHead) != head.Hash.String() {
+		return fmt.Errorf("head branch was modified. Review and try the merge again")
+	}
+	m, err := merge(base, head)
+	if err != nil {
+		return err
+	}
+	if !m.upToDate {
+		// Squash and rebase merges both end up as one new commit on the base, as autobot PRs are a single commit
+		parents := []*object.Commit{base}
+		if method == githubv4.PullRequestMergeMethodMerge {
+			parents = append(parents, head)
+		}
+		h, err := commitTree(gr, parents, m.files, fmt.Sprintf("%s (#%d)", pr.Title, pr.Number), g.now())
+		if err != nil {
+			return fmt.Errorf("unable to merge: %w", err)
+		}
+		if err := gr.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(pr.BaseRefName), h)); err != nil {
+			return fmt.Errorf("unable to update %s: %w", pr.BaseRefName, err)
+		}
+	}
+	pr.close(g.now(), head.Hash.String())
+	pr.State = githubv4.PullRequestStateMerged
+	pr.MergeMethod = method
+	pr.AutoMergeMethod = ""
+	pr.InMergeQueue = false
+	return nil
+}
+
+// ProcessAutoMerges does what GitHub does in the background: it merges every pull request of owner/name in the merge
+// queue, or with auto merge enabled, whose requirements are met.  It returns the numbers of the merged pull requests.
+func (g *GitHub) ProcessAutoMerges(owner string, name string) ([]int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r, gr, err := g.open(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	var ret []int
+	for _, pr := range r.prs {
+		if pr.State != githubv4.PullRequestStateOpen || (pr.AutoMergeMethod == "" && !pr.InMergeQueue) {
+			continue
+		}
+		if g.mergeBlocker(pr, gr, r.MergeQueue) != nil {
+			continue
+		}
+		method := pr.AutoMergeMethod
+		if r.MergeQueue {
+			// Auto merge on a merge queue branch enqueues the pull request once it is ready, and the queue merges it
+			pr.InMergeQueue = true
+			method = githubv4.PullRequestMergeMethodSquash
+		}
+		if err := g.mergePR(pr, gr, method, nil, r.MergeQueue); err != nil {
+			return nil, err
+		}
+		ret = append(ret, pr.Number)
+	}
+	return ret, nil
+}
+
+func (c *Client) EnablePullRequestAutoMerge(_ context.Context, _ string, _ string, in githubv4.EnablePullRequestAutoMergeInput) (*ghapp.EnablePullRequestAutoMergeOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, gr, err := c.GitHub.findPR(in.PullRequestID)
+	if err != nil {
+		return nil, err
+	}
+	if pr.State != githubv4.PullRequestStateOpen || pr.Draft {
+		return nil, fmt.Errorf("pull request #%d can not be auto merged", pr.Number)
+	}
+	if !pr.repo.MergeQueue && c.GitHub.mergeBlocker(pr, gr, false) == nil {
+		return nil, fmt.Errorf("pull request #%d is in clean status", pr.Number)
+	}
+	pr.AutoMergeMethod = githubv4.PullRequestMergeMethodMerge
+	if in.MergeMethod != nil {
+		pr.AutoMergeMethod = *in.MergeMethod
+	}
+	var ret ghapp.EnablePullRequestAutoMergeOutput
+	ret.EnablePullRequestAutoMerge.PullRequest.ID = pr.ID
+	return &ret, nil
+}
+
+func (c *Client) DisablePullRequestAutoMerge(_ context.Context, _ string, _ string, in githubv4.DisablePullRequestAutoMergeInput) (*ghapp.DisablePullRequestAutoMergeOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, _, err := c.GitHub.findPR(in.PullRequestID)
+	if err != nil {
+		return nil, err
+	}
+	pr.AutoMergeMethod = ""
+	var ret ghapp.DisablePullRequestAutoMergeOutput
+	ret.DisablePullRequestAutoMerge.PullRequest.ID = pr.ID
+	return &ret, nil
+}
+
+func (c *Client) EnqueuePullRequest(_ context.Context, _ string, _ string, in ghapp.EnqueuePullRequestInput) (*ghapp.EnqueuePullRequestOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, gr, err := c.GitHub.findPR(in.PullRequestID)
+	if err != nil {
+		return nil, err
+	}
+	if !pr.repo.MergeQueue {
+		return nil, fmt.Errorf("%s has no merge queue", pr.BaseRefName)
+	}
+	if err := c.GitHub.mergeBlocker(pr, gr, true); err != nil {
+		return nil, err
+	}
+	if in.ExpectedHeadOid != nil {
+		if _, head, err := pr.commits(gr); err != nil {
+			return nil, err
+		} else if string(*in.ExpectedHeadOid) != head.Hash.String() {
+			return nil, fmt.Errorf("head branch was modified")
+		}
+	}
+	pr.InMergeQueue = true
+	var ret ghapp.EnqueuePullRequestOutput
+	ret.EnqueuePullRequest.MergeQueueEntry.ID = "MQE_" + pr.ID
+	return &ret, nil
+}
+
+func (c *Client) PullRequestMergeState(_ context.Context, owner string, name string, number int) (*ghapp.GraphQLPRMergeStateQuery, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, err := c.GitHub.findNumber(owner, name, number)
+	if err != nil {
+		return nil, err
+	}
+	var ret ghapp.GraphQLPRMergeStateQuery
+	if pr.AutoMergeMethod != "" {
+		ret.Repository.PullRequest.AutoMergeRequest = &struct {
+			MergeMethod githubv4.PullRequestMergeMethod
+		}{MergeMethod: pr.AutoMergeMethod}
+	}
+	ret.Repository.PullRequest.IsInMergeQueue = githubv4.Boolean(pr.InMergeQueue)
+	ret.Repository.PullRequest.IsMergeQueueEnabled = githubv4.Boolean(pr.repo.MergeQueue)
+	return &ret, nil
+}
+
+func (c *Client) EveryOpenPullRequest(_ context.Context, owner string, name string, filter ghapp.PRFilter) (*ghapp.GraphQLPRQuery, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, gr, err := c.GitHub.open(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	var ret ghapp.GraphQLPRQuery
+	for _, pr := range r.prs {
+		if pr.State != githubv4.PullRequestStateOpen || !filter.Matches(pr.HeadRefName, pr.Author) {
+			continue
+		}
+		node, err := c.node(gr, pr)
+		if err != nil {
+			return nil, err
+		}
+		ret.Repository.PullRequests.Nodes = append(ret.Repository.PullRequests.Nodes, *node)
+	}
+	return &ret, nil
+}
+
+func (c *Client) DoesBranchExist(_ context.Context, owner string, name string, ref string) (bool, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	_, gr, err := c.GitHub.open(owner, name)
+	if err != nil {
+		return false, err
+	}
+	head, err := branchCommit(gr, plumbing.ReferenceName(ref).Short())
+	if err != nil {
+		return false, err
+	}
+	return head != nil, nil
+}
+
+func (c *Client) RepositoryPermission(_ context.Context, owner string, name string, login string) (string, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, exists := c.GitHub.repos[repoKey(owner, name)]
+	if !exists {
+		return "", fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	if p, exists := r.permissions[login]; exists {
+		return p, nil
+	}
+	return "none", nil
+}
+
+func (c *Client) AddComment(_ context.Context, _ string, _ string, in githubv4.AddCommentInput) (*ghapp.AddCommentOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, _, err := c.GitHub.findPR(in.SubjectID)
+	if err != nil {
+		return nil, err
+	}
+	pr.Comments = append(pr.Comments, Comment{
+		ID:     c.GitHub.newID("IC"),
+		Author: c.Login,
+		Body:   string(in.Body),
+	})
+	pr.UpdatedAt = c.GitHub.now()
+	return &ghapp.AddCommentOutput{}, nil
+}
+
+func (c *Client) AddLabel(_ context.Context, owner string, name string, number int, label string) error {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, err := c.GitHub.findNumber(owner, name, number)
+	if err != nil {
+		return err
+	}
+	for _, l := range pr.Labels {
+		if strings.EqualFold(l, label) {
+			return nil
+		}
+	}
+	pr.Labels = append(pr.Labels, label)
+	return nil
+}
+
+func (c *Client) RemoveLabel(_ context.Context, owner string, name string, number int, label string) error {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, err := c.GitHub.findNumber(owner, name, number)
+	if err != nil {
+		return err
+	}
+	for idx, l := range pr.Labels {
+		if strings.EqualFold(l, label) {
+			pr.Labels = append(pr.Labels[:idx], pr.Labels[idx+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("label %s does not exist on #%d", label, number)
+}
+
+func (g *GitHub) findNumber(owner string, name string, number int) (*pullRequest, error) {
+	r, exists := g.repos[repoKey(owner, name)]
+	if !exists {
+		return nil, fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	for _, pr := range r.prs {
+		if pr.Number == number {
+			return pr, nil
+		}
+	}
+	return nil, fmt.Errorf("no pull request #%d in %s/%s", number, owner, name)
+}
+
+func (c *Client) UpdatePullRequestBranch(_ context.Context, _ string, _ string, in githubv4.UpdatePullRequestBranchInput) (*ghapp.UpdatePullRequestBranchOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, gr, err := c.GitHub.findPR(in.PullRequestID)
+	if err != nil {
+		return nil, err
+	}
+	base, head, err := pr.commits(gr)
+	if err != nil {
+		return nil, err
+	}
+	if in.ExpectedHeadOid != nil && string(*in.ExpectedHeadOid) != head.Hash.String() {
+		return nil, fmt.Errorf("expected head sha %s does not match %s", *in.ExpectedHeadOid, head.Hash)
+	}
+	m, err := merge(head, base)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.conflicts) > 0 {
+		return nil, fmt.Errorf("merge conflict updating #%d: conflicts in %s", pr.Number, strings.Join(m.conflicts, ", "))
+	}
+	if !m.upToDate {
+		h, err := commitTree(gr, []*object.Commit{head, base}, m.files, fmt.Sprintf("Merge branch '%s' into %s", pr.BaseRefName, pr.HeadRefName), c.GitHub.now())
+		if err != nil {
+			return nil, fmt.Errorf("unable to merge: %w", err)
+		}
+		if err := gr.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(pr.HeadRefName), h)); err != nil {
+			return nil, fmt.Errorf("unable to update %s: %w", pr.HeadRefName, err)
+		}
+		pr.UpdatedAt = c.GitHub.now()
+	}
+	var ret ghapp.UpdatePullRequestBranchOutput
+	ret.UpdatePullRequestBranch.PullRequest.ID = pr.ID
+	return &ret, nil
+}
+
+func (c *Client) ClosePullRequest(_ context.Context, _ string, _ string, in githubv4.ClosePullRequestInput) (*ghapp.ClosePullRequestOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, gr, err := c.GitHub.findPR(in.PullRequestID)
+	if err != nil {
+		return nil, err
+	}
+	if pr.State != githubv4.PullRequestStateOpen {
+		return nil, fmt.Errorf("pull request #%d is %s", pr.Number, pr.State)
+	}
+	var headOid string
+	if head, err := branchCommit(gr, pr.HeadRefName); err != nil {
+		return nil, err
+	} else if head != nil {
+		headOid = head.Hash.String()
+	}
+	pr.close(c.GitHub.now(), headOid)
+	pr.State = githubv4.PullRequestStateClosed
+	pr.ClosedBy = c.Login
+	var ret ghapp.ClosePullRequestOutput
+	ret.ClosePullRequest.PullRequest.ID = pr.ID
+	return &ret, nil
+}
+
+func (c *Client) UpdatePullRequest(_ context.Context, _ string, _ string, in githubv4.UpdatePullRequestInput) (*ghapp.UpdatePullRequestOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, _, err := c.GitHub.findPR(in.PullRequestID)
+	if err != nil {
+		return nil, err
+	}
+	if in.Title != nil {
+		pr.Title = string(*in.Title)
+	}
+	if in.Body != nil {
+		pr.Body = string(*in.Body)
+		pr.Editor = c.Login
+	}
+	pr.UpdatedAt = c.GitHub.now()
+	var ret ghapp.UpdatePullRequestOutput
+	ret.UpdatePullRequest.PullRequest.ID = pr.ID
+	return &ret, nil
+}
+
+func (c *Client) DeleteBranch(_ context.Context, owner string, name string, ref string) error {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, gr, err := c.GitHub.open(owner, name)
+	if err != nil {
+		return err
+	}
+	if ref == r.DefaultBranch {
+		return fmt.Errorf("cannot delete the default branch %s", ref)
+	}
+	branch := plumbing.NewBranchReferenceName(ref)
+	if _, err := gr.Reference(branch, false); err != nil {
+		return fmt.Errorf("unable to delete branch %s: %w", ref, err)
+	}
+	if err := gr.Storer.RemoveReference(branch); err != nil {
+		return fmt.Errorf("unable to delete branch %s: %w", ref, err)
+	}
+	// Deleting the branch of an open pull request closes it
+	for _, pr := range r.prs {
+		if pr.State == githubv4.PullRequestStateOpen && pr.HeadRefName == ref {
+			pr.close(c.GitHub.now(), "")
+			pr.State = githubv4.PullRequestStateClosed
+			pr.ClosedBy = c.Login
+		}
+	}
+	return nil
+}
+
+func (c *Client) EveryBranch(_ context.Context, owner string, name string, prefix string) (*ghapp.GraphQLBranchQuery, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, gr, err := c.GitHub.open(owner, name)
+	if err != nil {
+		return nil, err
+	}
+	all, err := branches(gr)
+	if err != nil {
+		return nil, err
+	}
+	var ret ghapp.GraphQLBranchQuery
+	for _, b := range all {
+		if !strings.HasPrefix(b, prefix) {
+			continue
+		}
+		head, err := branchCommit(gr, b)
+		if err != nil {
+			return nil, err
+		}
+		var node ghapp.GraphQLBranchNode
+		node.Name = githubv4.String(b)
+		node.Target.Oid = githubv4.GitObjectID(head.Hash.String())
+		// Most recently created first
+		for idx := len(r.prs) - 1; idx >= 0 && len(node.AssociatedPullRequests.Nodes) < 10; idx-- {
+			pr := r.prs[idx]
+			if pr.HeadRefName != b {
+				continue
+			}
+			var bpr ghapp.GraphQLBranchPullRequest
+			bpr.Number = githubv4.Int(pr.Number)
+			bpr.State = pr.State
+			bpr.HeadRefOid = githubv4.GitObjectID(head.Hash.String())
+			if pr.State != githubv4.PullRequestStateOpen {
+				bpr.HeadRefOid = githubv4.GitObjectID(pr.closedHead)
+				bpr.ClosedAt = &githubv4.DateTime{Time: pr.ClosedAt}
+			}
+			bpr.Author.Login = githubv4.String(pr.Author)
+			bpr.Author.User.ID = userID(pr.Author)
+			node.AssociatedPullRequests.Nodes = append(node.AssociatedPullRequests.Nodes, bpr)
+		}
+		ret.Repository.Refs.Nodes = append(ret.Repository.Refs.Nodes, node)
+	}
+	return &ret, nil
+}
+
+func (c *Client) RecentlyClosedPullRequests(_ context.Context, owner string, name string) (*ghapp.GraphQLClosedPRQuery, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, exists := c.GitHub.repos[repoKey(owner, name)]
+	if !exists {
+		return nil, fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	var closed []*pullRequest
+	for _, pr := range r.prs {
+		if pr.State == githubv4.PullRequestStateClosed {
+			closed = append(closed, pr)
+		}
+	}
+	sort.SliceStable(closed, func(i, j int) bool {
+		return closed[i].UpdatedAt.After(closed[j].UpdatedAt)
+	})
+	if len(closed) > 50 {
+		closed = closed[:50]
+	}
+	var ret ghapp.GraphQLClosedPRQuery
+	for _, pr := range closed {
+		var node ghapp.GraphQLClosedPullRequest
+		node.ID = pr.ID
+		node.Number = githubv4.Int(pr.Number)
+		node.Body = githubv4.String(pr.Body)
+		node.HeadRefName = githubv4.String(pr.HeadRefName)
+		node.ClosedAt = &githubv4.DateTime{Time: pr.ClosedAt}
+		node.Author.Login = githubv4.String(pr.Author)
+		node.Author.User.ID = userID(pr.Author)
+		var event ghapp.GraphQLClosedEvent
+		event.ClosedEvent.Actor.Login = githubv4.String(pr.ClosedBy)
+		node.TimelineItems.Nodes = []ghapp.GraphQLClosedEvent{event}
+		ret.Repository.PullRequests.Nodes = append(ret.Repository.PullRequests.Nodes, node)
+	}
+	return &ret, nil
+}
+
+func (c *Client) AccessibleRepositories(_ context.Context) ([]ghapp.Repository, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	ret := make([]ghapp.Repository, 0, len(c.GitHub.repos))
+	for _, r := range c.GitHub.repos {
+		ret = append(ret, ghapp.Repository{
+			Owner:         r.Owner,
+			Name:          r.Name,
+			DefaultBranch: r.DefaultBranch,
+			Topics:        append([]string(nil), r.Topics...),
+			Archived:      r.Archived,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return repoKey(ret[i].Owner, ret[i].Name) < repoKey(ret[j].Owner, ret[j].Name)
+	})
+	return ret, nil
+}
+
+func (c *Client) CreateCheckRun(_ context.Context, owner string, name string, in githubv4.CreateCheckRunInput) (*ghapp.CreateCheckRunOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, exists := c.GitHub.repos[repoKey(owner, name)]
+	if !exists {
+		return nil, fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	cr := &CheckRun{
+		ID:      c.GitHub.newID("CR"),
+		Name:    string(in.Name),
+		HeadSha: string(in.HeadSha),
+		Author:  c.Login,
+		Status:  githubv4.RequestableCheckStatusStateQueued,
+	}
+	cr.update(in.Status, in.Conclusion, in.Output)
+	r.checkRuns = append(r.checkRuns, cr)
+	var ret ghapp.CreateCheckRunOutput
+	ret.CreateCheckRun.CheckRun.ID = cr.ID
+	return &ret, nil
+}
+
+func (c *Client) UpdateCheckRun(_ context.Context, owner string, name string, in githubv4.UpdateCheckRunInput) (*ghapp.UpdateCheckRunOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	r, exists := c.GitHub.repos[repoKey(owner, name)]
+	if !exists {
+		return nil, fmt.Errorf("no repository %s/%s", owner, name)
+	}
+	for _, cr := range r.checkRuns {
+		if cr.ID != in.CheckRunID {
+			continue
+		}
+		if cr.Author != c.Login {
+			return nil, fmt.Errorf("%s can not update check run %s of %s", c.Login, cr.ID, cr.Author)
+		}
+		cr.update(in.Status, in.Conclusion, in.Output)
+		var ret ghapp.UpdateCheckRunOutput
+		ret.UpdateCheckRun.CheckRun.ID = cr.ID
+		return &ret, nil
+	}
+	return nil, fmt.Errorf("no check run %v", in.CheckRunID)
+}
+
+func (cr *CheckRun) update(status *githubv4.RequestableCheckStatusState, conclusion *githubv4.CheckConclusionState, output *githubv4.CheckRunOutput) {
+	if status != nil {
+		cr.Status = *status
+	}
+	if conclusion != nil {
+		cr.Conclusion = *conclusion
+		cr.Status = githubv4.RequestableCheckStatusStateCompleted
+	}
+	if output != nil {
+		cr.Title = string(output.Title)
+		cr.Summary = string(output.Summary)
+	}
+}
+
+func (c *Client) PullRequestComments(_ context.Context, owner string, name string, number int) ([]ghapp.IssueComment, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	pr, err := c.GitHub.findNumber(owner, name, number)
+	if err != nil {
+		return nil, err
+	}
+	comments := pr.Comments
+	if len(comments) > 100 {
+		comments = comments[len(comments)-100:]
+	}
+	ret := make([]ghapp.IssueComment, 0, len(comments))
+	for _, comment := range comments {
+		ret = append(ret, ghapp.IssueComment{
+			ID:              comment.ID,
+			Body:            githubv4.String(comment.Body),
+			ViewerDidAuthor: githubv4.Boolean(comment.Author == c.Login),
+		})
+	}
+	return ret, nil
+}
+
+func (c *Client) UpdateIssueComment(_ context.Context, _ string, _ string, in githubv4.UpdateIssueCommentInput) (*ghapp.UpdateIssueCommentOutput, error) {
+	c.GitHub.mu.Lock()
+	defer c.GitHub.mu.Unlock()
+	for _, pr := range c.GitHub.prByID {
+		for idx := range pr.Comments {
+			if pr.Comments[idx].ID != in.ID {
+				continue
+			}
+			if pr.Comments[idx].Author != c.Login {
+				return nil, fmt.Errorf("%s can not edit comment %s of %s", c.Login, pr.Comments[idx].ID, pr.Comments[idx].Author)
+			}
+			pr.Comments[idx].Body = string(in.Body)
+			pr.UpdatedAt = c.GitHub.now()
+			var ret ghapp.UpdateIssueCommentOutput
+			ret.UpdateIssueComment.IssueComment.ID = pr.Comments[idx].ID
+			return &ret, nil
+		}
+	}
+	return nil, fmt.Errorf("no comment %v", in.ID)
+}
+
+// node is pr as the GraphQL API returns it to the client
+func (c *Client) node(gr *git.Repository, pr *pullRequest) (*ghapp.GraphQLPRQueryNode, error) {
+	base, head, err := pr.commits(gr)
+	if err != nil {
+		return nil, err
+	}
+	var ret ghapp.GraphQLPRQueryNode
+	ret.ID = pr.ID
+	ret.Number = githubv4.Int(pr.Number)
+	ret.Title = githubv4.String(pr.Title)
+	ret.IsDraft = githubv4.Boolean(pr.Draft)
+	ret.State = pr.State
+	ret.Body = githubv4.String(pr.Body)
+	ret.UpdatedAt = githubv4.DateTime{Time: pr.UpdatedAt}
+	ret.ReviewDecision = pr.reviewDecision()
+	if ret.ReviewDecision == "" && pr.repo.RequireReview {
+		ret.ReviewDecision = githubv4.PullRequestReviewDecisionReviewRequired
+	}
+	ret.HeadRefName = githubv4.String(pr.HeadRefName)
+	ret.BaseRef.Name = githubv4.String(pr.BaseRefName)
+	ret.Repository.Owner.Login = githubv4.String(pr.repo.Owner)
+	ret.Repository.Name = githubv4.String(pr.repo.Name)
+	ret.Editor.Login = githubv4.String(pr.Editor)
+	ret.Author.Login = githubv4.String(pr.Author)
+	ret.Author.User.ID = userID(pr.Author)
+	for _, l := range pr.Labels {
+		ret.Labels.Nodes = append(ret.Labels.Nodes, struct{ Name githubv4.String }{Name: githubv4.String(l)})
+	}
+	for _, r := range pr.reviews {
+		if r.login == c.Login {
+			ret.ViewerLatestReview.State = githubv4.String(r.state)
+			ret.ViewerLatestReview.Commit.Oid = githubv4.GitObjectID(r.oid)
+			ret.ViewerLatestReview.AuthorCanPushToRepository = true
+		}
+	}
+	ret.HeadRef.Target.Oid = githubv4.GitObjectID(head.Hash.String())
+	ret.HeadRef.Target.Commit.StatusCheckRollup.State = c.GitHub.checkState(pr.repo, head.Hash.String())
+	m, err := merge(base, head)
+	if err != nil {
+		return nil, err
+	}
+	behind, err := isBehind(base, head)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(m.conflicts) > 0:
+		ret.Mergeable = githubv4.MergeableStateConflicting
+		ret.MergeStateStatus = ghapp.MergeStateStatusDirty
+	case behind && pr.repo.RequireUpToDate:
+		ret.Mergeable = githubv4.MergeableStateMergeable
+		ret.MergeStateStatus = ghapp.MergeStateStatusBehind
+	default:
+		ret.Mergeable = githubv4.MergeableStateMergeable
+		ret.MergeStateStatus = "CLEAN"
+	}
+	return &ret, nil
+}
+
+func (g *GitHub) checkState(r *repository, oid string) githubv4.StatusState {
+	if s, exists := r.checks[oid]; exists {
+		return s
+	}
+	return githubv4.StatusStateSuccess
+}
+
+// isBehind is true if head does not have every commit of base
+func isBehind(base *object.Commit, head *object.Commit) (bool, error) {
+	if base.Hash == head.Hash {
+		return false, nil
+	}
+	contained, err := base.IsAncestor(head)
+	if err != nil {
+		return false, fmt.Errorf("unable to compare %s with %s: %w", base.Hash, head.Hash, err)
+	}
+	return !contained, nil
+}
+
+// commits are the heads of the base and head branches of the pull request
+func (p *pullRequest) commits(gr *git.Repository) (*object.Commit, *object.Commit, error) {
+	base, err := branchCommit(gr, p.BaseRefName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if base == nil {
+		return nil, nil, fmt.Errorf("base branch %s of #%d is gone", p.BaseRefName, p.Number)
+	}
+	head, err := branchCommit(gr, p.HeadRefName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if head == nil {
+		return nil, nil, fmt.Errorf("head branch %s of #%d is gone", p.HeadRefName, p.Number)
+	}
+	return base, head, nil
+}
+
+// reviewDecision is from the latest review of each reviewer, or empty if nobody approved or requested changes
+func (p *pullRequest) reviewDecision() githubv4.PullRequestReviewDecision {
+	latest := make(map[string]githubv4.PullRequestReviewState)
+	for _, r := range p.reviews {
+		if r.state != githubv4.PullRequestReviewStateCommented {
+			latest[r.login] = r.state
+		}
+	}
+	ret := githubv4.PullRequestReviewDecision("")
+	for _, state := range latest {
+		if state == githubv4.PullRequestReviewStateChangesRequested {
+			return githubv4.PullRequestReviewDecisionChangesRequested
+		}
+		ret = githubv4.PullRequestReviewDecisionApproved
+	}
+	return ret
+}
+
+func (p *pullRequest) close(now time.Time, head string) {
+	p.ClosedAt = now
+	p.UpdatedAt = now
+	p.closedHead = head
+}
@@ -0,0 +1,108 @@
+package fakegithub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/shurcooL/githubv4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHub_PullRequestLifecycle(t *testing.T) {
+	ctx := context.Background()
+	g := New(t.TempDir())
+	require.NoError(t, g.AddRepository(Repository{
+		Owner:           "cresta",
+		Name:            "gitops",
+		Files:           map[string]string{"a.txt": "a\n", "dir/b.txt": "b\n"},
+		RequireReview:   true,
+		RequireUpToDate: true,
+	}))
+	author := g.Client("autobot")
+	reviewer := g.Client("reviewer")
+	info, err := author.RepositoryInfo(ctx, "cresta", "gitops")
+	require.NoError(t, err)
+	require.Equal(t, githubv4.String("master"), info.Repository.DefaultBranchRef.Name)
+
+	_, err = g.Commit("cresta", "gitops", "change", map[string]string{"a.txt": "changed\n"}, "Change a")
+	require.NoError(t, err)
+	_, err = g.Commit("cresta", "gitops", "conflict", map[string]string{"dir/b.txt": "conflict\n"}, "Change b")
+	require.NoError(t, err)
+	for _, branch := range []string{"change", "conflict"} {
+		_, err = author.CreatePullRequest(ctx, "cresta", "gitops", githubv4.CreatePullRequestInput{
+			BaseRefName: "master",
+			HeadRefName: githubv4.String(branch),
+			Title:       githubv4.String(branch),
+		})
+		require.NoError(t, err)
+	}
+	_, err = author.CreatePullRequest(ctx, "cresta", "gitops", githubv4.CreatePullRequestInput{BaseRefName: "master", HeadRefName: "change"})
+	require.Error(t, err, "only one open pull request per branch")
+	_, err = g.Commit("cresta", "gitops", "master", map[string]string{"dir/b.txt": "human\n"}, "Human change")
+	require.NoError(t, err)
+
+	prs, err := reviewer.EveryOpenPullRequest(ctx, "cresta", "gitops", ghapp.PRFilter{})
+	require.NoError(t, err)
+	require.Len(t, prs.Repository.PullRequests.Nodes, 2)
+	change, conflict := prs.Repository.PullRequests.Nodes[0], prs.Repository.PullRequests.Nodes[1]
+	require.Equal(t, githubv4.MergeableStateMergeable, change.Mergeable)
+	require.Equal(t, ghapp.MergeStateStatusBehind, change.MergeStateStatus)
+	require.Equal(t, githubv4.PullRequestReviewDecisionReviewRequired, change.ReviewDecision)
+	require.Equal(t, githubv4.MergeableStateConflicting, conflict.Mergeable)
+
+	_, err = author.UpdatePullRequestBranch(ctx, "cresta", "gitops", githubv4.UpdatePullRequestBranchInput{PullRequestID: conflict.ID})
+	require.Error(t, err)
+	_, err = author.UpdatePullRequestBranch(ctx, "cresta", "gitops", githubv4.UpdatePullRequestBranchInput{PullRequestID: change.ID})
+	require.NoError(t, err)
+
+	approve := githubv4.PullRequestReviewEventApprove
+	_, err = author.AcceptPullRequest(ctx, "cresta", "gitops", githubv4.AddPullRequestReviewInput{PullRequestID: change.ID, Event: &approve})
+	require.Error(t, err, "authors cannot approve their own pull request")
+	squash := githubv4.PullRequestMergeMethodSquash
+	_, err = author.MergePullRequest(ctx, "cresta", "gitops", "master", githubv4.MergePullRequestInput{PullRequestID: change.ID, MergeMethod: &squash})
+	require.Error(t, err, "review is required")
+	_, err = reviewer.AcceptPullRequest(ctx, "cresta", "gitops", githubv4.AddPullRequestReviewInput{PullRequestID: change.ID, Event: &approve})
+	require.NoError(t, err)
+
+	prs, err = reviewer.EveryOpenPullRequest(ctx, "cresta", "gitops", ghapp.PRFilter{HeadRefPrefixes: []string{"filechange_", "cha"}})
+	require.NoError(t, err)
+	require.Len(t, prs.Repository.PullRequests.Nodes, 1)
+	change = prs.Repository.PullRequests.Nodes[0]
+	require.Equal(t, githubv4.PullRequestReviewDecisionApproved, change.ReviewDecision)
+	require.Equal(t, change.HeadRef.Target.Oid, change.ViewerLatestReview.Commit.Oid)
+	require.NotEqual(t, ghapp.MergeStateStatusBehind, change.MergeStateStatus)
+
+	require.NoError(t, g.SetCheckState("cresta", "gitops", string(change.HeadRef.Target.Oid), githubv4.StatusStatePending))
+	_, err = author.MergePullRequest(ctx, "cresta", "gitops", "master", githubv4.MergePullRequestInput{PullRequestID: change.ID, MergeMethod: &squash})
+	require.Error(t, err, "checks are pending")
+	require.NoError(t, g.SetCheckState("cresta", "gitops", string(change.HeadRef.Target.Oid), githubv4.StatusStateSuccess))
+	_, err = author.MergePullRequest(ctx, "cresta", "gitops", "master", githubv4.MergePullRequestInput{PullRequestID: change.ID, MergeMethod: &squash})
+	require.NoError(t, err)
+
+	content, err := author.GetContents(ctx, "cresta", "gitops", "a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "changed\n", content)
+	content, err = g.ReadFile("cresta", "gitops", "master", "dir/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, "human\n", content)
+	all := g.PullRequests("cresta", "gitops")
+	require.Equal(t, githubv4.PullRequestStateMerged, all[0].State)
+	require.Equal(t, githubv4.PullRequestStateOpen, all[1].State)
+
+	branches, err := author.EveryBranch(ctx, "cresta", "gitops", "cha")
+	require.NoError(t, err)
+	require.Len(t, branches.Repository.Refs.Nodes, 1)
+	require.Equal(t, githubv4.PullRequestStateMerged, branches.Repository.Refs.Nodes[0].AssociatedPullRequests.Nodes[0].State)
+	require.NoError(t, author.DeleteBranch(ctx, "cresta", "gitops", "change"))
+	exists, err := author.DoesBranchExist(ctx, "cresta", "gitops", "refs/heads/change")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	_, err = reviewer.ClosePullRequest(ctx, "cresta", "gitops", githubv4.ClosePullRequestInput{PullRequestID: conflict.ID})
+	require.NoError(t, err)
+	closed, err := author.RecentlyClosedPullRequests(ctx, "cresta", "gitops")
+	require.NoError(t, err)
+	require.Len(t, closed.Repository.PullRequests.Nodes, 1)
+	require.Equal(t, "reviewer", closed.Repository.PullRequests.Nodes[0].ClosedBy())
+}
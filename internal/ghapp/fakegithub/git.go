@@ -0,0 +1,263 @@
+package fakegithub
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// fileEntry is a file of a tree, by its full path
+type fileEntry struct {
+	hash plumbing.Hash
+	mode filemode.FileMode
+}
+
+var signature = object.Signature{
+	Name:  "GitHub",
+	Email: "noreply@github.com",
+}
+
+// branchCommit is the commit at the head of branch, or nil if there is no such branch
+func branchCommit(repo *git.Repository, branch string) (*object.Commit, error) {
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to find branch %s: %w", branch, err)
+	}
+	c, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("unable to find commit %s: %w", ref.Hash(), err)
+	}
+	return c, nil
+}
+
+// files lists every file of the tree of c, or none if c is nil
+func files(c *object.Commit) (map[string]fileEntry, error) {
+	ret := make(map[string]fileEntry)
+	if c == nil {
+		return ret, nil
+	}
+	t, err := c.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to find tree of %s: %w", c.Hash, err)
+	}
+	if err := t.Files().ForEach(func(f *object.File) error {
+		ret[f.Name] = fileEntry{hash: f.Hash, mode: f.Mode}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("unable to list files of %s: %w", c.Hash, err)
+	}
+	return ret, nil
+}
+
+// commitFiles stores a commit of parents whose tree is the tree of the first parent with files replaced.  A file with
+// nil content is removed.
+func commitFiles(repo *git.Repository, parents []*object.Commit, changed map[string][]byte, message string, now time.Time) (plumbing.Hash, error) {
+	var first *object.Commit
+	if len(parents) > 0 {
+		first = parents[0]
+	}
+	all, err := files(first)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	for name, content := range changed {
+		if content == nil {
+			delete(all, name)
+			continue
+		}
+		h, err := storeBlob(repo, content)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		all[name] = fileEntry{hash: h, mode: filemode.Regular}
+	}
+	return commitTree(repo, parents, all, message, now)
+}
+
+// commitTree stores a commit of parents whose tree is exactly all
+func commitTree(repo *git.Repository, parents []*object.Commit, all map[string]fileEntry, message string, now time.Time) (plumbing.Hash, error) {
+	tree, err := storeTree(repo, all)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	sig := signature
+	sig.When = now
+	c := object.Commit{
+		Author:    sig,
+		Committer: sig,
+		Message:   message,
+		TreeHash:  tree,
+	}
+	for _, p := range parents {
+		c.ParentHashes = append(c.ParentHashes, p.Hash)
+	}
+	obj := repo.Storer.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to encode commit: %w", err)
+	}
+	h, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to store commit: %w", err)
+	}
+	return h, nil
+}
+
+func storeBlob(repo *git.Repository, content []byte) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to write blob: %w", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to write blob: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to close blob: %w", err)
+	}
+	h, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to store blob: %w", err)
+	}
+	return h, nil
+}
+
+// storeTree stores the nested trees of a flat list of files, returning the hash of the root
+func storeTree(repo *git.Repository, all map[string]fileEntry) (plumbing.Hash, error) {
+	var t object.Tree
+	subdirs := make(map[string]map[string]fileEntry)
+	for name, e := range all {
+		if idx := strings.Index(name, "/"); idx != -1 {
+			dir := name[:idx]
+			if subdirs[dir] == nil {
+				subdirs[dir] = make(map[string]fileEntry)
+			}
+			subdirs[dir][name[idx+1:]] = e
+			continue
+		}
+		t.Entries = append(t.Entries, object.TreeEntry{Name: name, Mode: e.mode, Hash: e.hash})
+	}
+	for dir, sub := range subdirs {
+		h, err := storeTree(repo, sub)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		t.Entries = append(t.Entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: h})
+	}
+	// Git sorts directories as if their name ended with a slash
+	sortKey := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(t.Entries, func(i, j int) bool {
+		return sortKey(t.Entries[i]) < sortKey(t.Entries[j])
+	})
+	obj := repo.Storer.NewEncodedObject()
+	if err := t.Encode(obj); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to encode tree: %w", err)
+	}
+	h, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to store tree: %w", err)
+	}
+	return h, nil
+}
+
+// mergeResult is the tree of merging source into target
+type mergeResult struct {
+	// upToDate is true if source is already part of target, and there is nothing to merge
+	upToDate bool
+	files    map[string]fileEntry
+	// conflicts are the files both sides changed differently
+	conflicts []string
+}
+
+// merge works out the files of merging source into target, file by file.  A file changed on both sides, differently,
+// is a conflict.
+func merge(target *object.Commit, source *object.Commit) (*mergeResult, error) {
+	if upToDate, err := source.IsAncestor(target); err != nil {
+		return nil, fmt.Errorf("unable to compare %s with %s: %w", source.Hash, target.Hash, err)
+	} else if upToDate || source.Hash == target.Hash {
+		return &mergeResult{upToDate: true}, nil
+	}
+	bases, err := target.MergeBase(source)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find merge base of %s and %s: %w", target.Hash, source.Hash, err)
+	}
+	var base *object.Commit
+	if len(bases) > 0 {
+		base = bases[0]
+	}
+	baseFiles, err := files(base)
+	if err != nil {
+		return nil, err
+	}
+	targetFiles, err := files(target)
+	if err != nil {
+		return nil, err
+	}
+	sourceFiles, err := files(source)
+	if err != nil {
+		return nil, err
+	}
+	ret := &mergeResult{files: targetFiles}
+	names := make(map[string]struct{})
+	for _, m := range []map[string]fileEntry{baseFiles, targetFiles, sourceFiles} {
+		for name := range m {
+			names[name] = struct{}{}
+		}
+	}
+	for name := range names {
+		b, inBase := baseFiles[name]
+		t, inTarget := targetFiles[name]
+		s, inSource := sourceFiles[name]
+		sourceChanged := inBase != inSource || b != s
+		targetChanged := inBase != inTarget || b != t
+		switch {
+		case !sourceChanged:
+		case !targetChanged || (inTarget == inSource && t == s):
+			if inSource {
+				ret.files[name] = s
+			} else {
+				delete(ret.files, name)
+			}
+		default:
+			ret.conflicts = append(ret.conflicts, name)
+		}
+	}
+	sort.Strings(ret.conflicts)
+	return ret, nil
+}
+
+// readFile is the content of name in the tree of c
+func readFile(c *object.Commit, name string) (string, error) {
+	f, err := c.File(name)
+	if err != nil {
+		return "", fmt.Errorf("unable to find file %s: %w", name, err)
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return "", fmt.Errorf("unable to read file %s: %w", name, err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("unable to read file %s: %w", name, err)
+	}
+	return string(b), nil
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/marker"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/shurcooL/githubv4"
 )
@@ -18,8 +19,50 @@ type GithubAPI interface {
 	Self(ctx context.Context) (*UserInfo, error)
 	AcceptPullRequest(ctx context.Context, owner string, name string, in githubv4.AddPullRequestReviewInput) (*AcceptPullRequestOutput, error)
 	MergePullRequest(ctx context.Context, owner string, name string, ref string, in githubv4.MergePullRequestInput) (*MergePullRequestOutput, error)
-	EveryOpenPullRequest(ctx context.Context, owner string, name string) (*GraphQLPRQuery, error)
+	// EveryOpenPullRequest lists every open pull request matching filter, across every page of results
+	EveryOpenPullRequest(ctx context.Context, owner string, name string, filter PRFilter) (*GraphQLPRQuery, error)
 	DoesBranchExist(ctx context.Context, owner string, name string, ref string) (bool, error)
+	// RepositoryPermission is the permission of login on the repository: one of admin, write, read or none
+	RepositoryPermission(ctx context.Context, owner string, name string, login string) (string, error)
+	AddComment(ctx context.Context, owner string, name string, in githubv4.AddCommentInput) (*AddCommentOutput, error)
+	AddLabel(ctx context.Context, owner string, name string, number int, label string) error
+	RemoveLabel(ctx context.Context, owner string, name string, number int, label string) error
+	UpdatePullRequestBranch(ctx context.Context, owner string, name string, in githubv4.UpdatePullRequestBranchInput) (*UpdatePullRequestBranchOutput, error)
+	ClosePullRequest(ctx context.Context, owner string, name string, in githubv4.ClosePullRequestInput) (*ClosePullRequestOutput, error)
+	// UpdatePullRequest changes the title or body of a pull request
+	UpdatePullRequest(ctx context.Context, owner string, name string, in githubv4.UpdatePullRequestInput) (*UpdatePullRequestOutput, error)
+	DeleteBranch(ctx context.Context, owner string, name string, ref string) error
+	// EveryBranch lists every branch whose name starts with prefix, with the pull requests opened from it
+	EveryBranch(ctx context.Context, owner string, name string, prefix string) (*GraphQLBranchQuery, error)
+	// RecentlyClosedPullRequests lists the most recently updated pull requests that were closed without being merged
+	RecentlyClosedPullRequests(ctx context.Context, owner string, name string) (*GraphQLClosedPRQuery, error)
+	// AccessibleRepositories lists every repository the client can act on: the repositories of the app installation,
+	// or of the token owner
+	AccessibleRepositories(ctx context.Context) ([]Repository, error)
+	// CreateCheckRun adds a check run to a commit.  Only GitHub Apps can create check runs.
+	CreateCheckRun(ctx context.Context, owner string, name string, in githubv4.CreateCheckRunInput) (*CreateCheckRunOutput, error)
+	UpdateCheckRun(ctx context.Context, owner string, name string, in githubv4.UpdateCheckRunInput) (*UpdateCheckRunOutput, error)
+	// PullRequestComments lists the most recent comments of a pull request, oldest first
+	PullRequestComments(ctx context.Context, owner string, name string, number int) ([]IssueComment, error)
+	UpdateIssueComment(ctx context.Context, owner string, name string, in githubv4.UpdateIssueCommentInput) (*UpdateIssueCommentOutput, error)
+	// EnablePullRequestAutoMerge has GitHub merge a pull request once its requirements are met, through the merge
+	// queue if its base branch requires one
+	EnablePullRequestAutoMerge(ctx context.Context, owner string, name string, in githubv4.EnablePullRequestAutoMergeInput) (*EnablePullRequestAutoMergeOutput, error)
+	DisablePullRequestAutoMerge(ctx context.Context, owner string, name string, in githubv4.DisablePullRequestAutoMergeInput) (*DisablePullRequestAutoMergeOutput, error)
+	// EnqueuePullRequest adds a pull request to the merge queue of its base branch
+	EnqueuePullRequest(ctx context.Context, owner string, name string, in EnqueuePullRequestInput) (*EnqueuePullRequestOutput, error)
+	// PullRequestMergeState is how GitHub itself is going to merge a pull request, if at all.  It is a query of its
+	// own, as GitHub Enterprise Server versions without merge queues do not know about these fields.
+	PullRequestMergeState(ctx context.Context, owner string, name string, number int) (*GraphQLPRMergeStateQuery, error)
+}
+
+// Repository is a repository the client can access
+type Repository struct {
+	Owner         string
+	Name          string
+	DefaultBranch string
+	Topics        []string
+	Archived      bool
 }
 
 type RepositoryInfo struct {
@@ -44,16 +87,24 @@ type CreatePullRequest struct {
 type GraphQLPRQueryNode struct {
 	ID                githubv4.ID
 	Number            githubv4.Int
+	Title             githubv4.String
 	Locked            githubv4.Boolean
 	Merged            githubv4.Boolean
 	IsDraft           githubv4.Boolean
 	Mergeable         githubv4.MergeableState
+	MergeStateStatus  MergeStateStatus
 	State             githubv4.PullRequestState
 	Body              githubv4.String
 	UpdatedAt         githubv4.DateTime
 	ReviewDecision    githubv4.PullRequestReviewDecision
 	IsCrossRepository githubv4.Boolean
-	BaseRef           struct {
+	HeadRefName       githubv4.String
+	Labels            struct {
+		Nodes []struct {
+			Name githubv4.String
+		}
+	} `graphql:"labels(first: 20)"`
+	BaseRef struct {
 		Name githubv4.String
 	}
 	Repository struct {
@@ -62,6 +113,10 @@ type GraphQLPRQueryNode struct {
 		}
 		Name githubv4.String
 	}
+	// Editor is whoever last edited the body, if anyone has
+	Editor struct {
+		Login githubv4.String
+	}
 	Author struct {
 		Login githubv4.String
 		Bot   struct {
@@ -93,11 +148,218 @@ type GraphQLPRQueryNode struct {
 type GraphQLPRQuery struct {
 	Repository struct {
 		PullRequests struct {
-			Nodes []GraphQLPRQueryNode
-		} `graphql:"pullRequests(first: 100, states: [OPEN])"`
+			Nodes    []GraphQLPRQueryNode
+			PageInfo PageInfo
+		} `graphql:"pullRequests(first: 100, states: [OPEN], after: $cursor)"`
+	} `graphql:"repository(owner: $owner, name: $name)"`
+}
+
+// GraphQLBranchNode is a branch and the most recent pull requests opened from it
+type GraphQLBranchNode struct {
+	Name   githubv4.String
+	Target struct {
+		Oid githubv4.GitObjectID
+	}
+	AssociatedPullRequests struct {
+		Nodes []GraphQLBranchPullRequest
+	} `graphql:"associatedPullRequests(first: 10, orderBy: {field: CREATED_AT, direction: DESC})"`
+}
+
+// GraphQLBranchPullRequest is a pull request opened from a GraphQLBranchNode
+type GraphQLBranchPullRequest struct {
+	Number     githubv4.Int
+	State      githubv4.PullRequestState
+	ClosedAt   *githubv4.DateTime
+	HeadRefOid githubv4.GitObjectID
+	Author     struct {
+		Login githubv4.String
+		Bot   struct {
+			ID githubv4.ID
+		} `graphql:"... on Bot"`
+		User struct {
+			ID githubv4.ID
+		} `graphql:"... on User"`
+	}
+}
+
+type GraphQLBranchQuery struct {
+	Repository struct {
+		Refs struct {
+			Nodes    []GraphQLBranchNode
+			PageInfo PageInfo
+		} `graphql:"refs(refPrefix: \"refs/heads/\", query: $query, first: 100, after: $cursor)"`
 	} `graphql:"repository(owner: $owner, name: $name)"`
 }
 
+// GraphQLClosedPullRequest is a pull request that was closed without being merged
+type GraphQLClosedPullRequest struct {
+	ID          githubv4.ID
+	Number      githubv4.Int
+	Body        githubv4.String
+	HeadRefName githubv4.String
+	ClosedAt    *githubv4.DateTime
+	Author      struct {
+		Login githubv4.String
+		Bot   struct {
+			ID githubv4.ID
+		} `graphql:"... on Bot"`
+		User struct {
+			ID githubv4.ID
+		} `graphql:"... on User"`
+	}
+	// TimelineItems is who closed the pull request
+	TimelineItems struct {
+		Nodes []GraphQLClosedEvent
+	} `graphql:"timelineItems(itemTypes: [CLOSED_EVENT], last: 1)"`
+}
+
+// GraphQLClosedEvent is the timeline item of a pull request being closed
+type GraphQLClosedEvent struct {
+	ClosedEvent struct {
+		Actor struct {
+			Login githubv4.String
+		}
+	} `graphql:"... on ClosedEvent"`
+}
+
+// ClosedBy is the login of whoever closed the pull request, or empty if unknown
+func (g *GraphQLClosedPullRequest) ClosedBy() string {
+	if len(g.TimelineItems.Nodes) == 0 {
+		return ""
+	}
+	return string(g.TimelineItems.Nodes[0].ClosedEvent.Actor.Login)
+}
+
+type GraphQLClosedPRQuery struct {
+	Repository struct {
+		PullRequests struct {
+			Nodes []GraphQLClosedPullRequest
+		} `graphql:"pullRequests(first: 50, states: [CLOSED], orderBy: {field: UPDATED_AT, direction: DESC})"`
+	} `graphql:"repository(owner: $owner, name: $name)"`
+}
+
+type PageInfo struct {
+	HasNextPage githubv4.Boolean
+	EndCursor   githubv4.String
+}
+
+// GraphQLPRHeadsQuery is a page of open pull requests with only what PRFilter looks at, so the rest of the data is
+// only downloaded for pull requests that match
+type GraphQLPRHeadsQuery struct {
+	Repository struct {
+		PullRequests struct {
+			Nodes []struct {
+				Number      githubv4.Int
+				HeadRefName githubv4.String
+				Author      struct {
+					Login githubv4.String
+				}
+			}
+			PageInfo PageInfo
+		} `graphql:"pullRequests(first: 100, states: [OPEN], after: $cursor)"`
+	} `graphql:"repository(owner: $owner, name: $name)"`
+}
+
+// GraphQLSinglePRQuery is one pull request, by number
+type GraphQLSinglePRQuery struct {
+	Repository struct {
+		PullRequest GraphQLPRQueryNode `graphql:"pullRequest(number: $number)"`
+	} `graphql:"repository(owner: $owner, name: $name)"`
+}
+
+// PRFilter narrows down which open pull requests are fully downloaded.  The zero value lists them all.
+type PRFilter struct {
+	// HeadRefPrefixes only lists pull requests whose branch starts with one of these
+	HeadRefPrefixes []string
+	// Author only lists pull requests made by this login.  GitHub apps are written as "app/<app-name>".
+	Author string
+}
+
+func (f PRFilter) IsZero() bool {
+	return len(f.HeadRefPrefixes) == 0 && f.Author == ""
+}
+
+func (f PRFilter) String() string {
+	return strings.Join(f.HeadRefPrefixes, ",") + "|" + f.Author
+}
+
+// Matches is true if a pull request of branch headRefName made by author is listed with f.  Depending on the API,
+// GitHub apps author as "<app-name>" or "<app-name>[bot]".
+func (f PRFilter) Matches(headRefName string, author string) bool {
+	if len(f.HeadRefPrefixes) != 0 {
+		matched := false
+		for _, prefix := range f.HeadRefPrefixes {
+			matched = matched || strings.HasPrefix(headRefName, prefix)
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.Author == "" {
+		return true
+	}
+	return f.Author == author || f.Author == "app/"+strings.TrimSuffix(author, "[bot]")
+}
+
+// PRFilterFromConfig is the filter the reviewer, merger and slash commands list pull requests with
+func PRFilterFromConfig(cfg *autobotcfg.AutobotConfig) PRFilter {
+	return PRFilter{
+		HeadRefPrefixes: cfg.PullRequestFilter.Prefixes(),
+		Author:          cfg.PullRequestFilter.Author,
+	}
+}
+
+// MergeStateStatus is the merge state of a pull request, which githubv4 does not have an enum for
+type MergeStateStatus string
+
+const (
+	// MergeStateStatusBehind means the head is out of date with a base that requires up to date branches
+	MergeStateStatusBehind MergeStateStatus = "BEHIND"
+	// MergeStateStatusDirty means merge conflicts stop the merge commit from being made
+	MergeStateStatusDirty MergeStateStatus = "DIRTY"
+)
+
+func (n GraphQLPRQueryNode) HasLabel(label string) bool {
+	for _, l := range n.Labels.Nodes {
+		if strings.EqualFold(string(l.Name), label) {
+			return true
+		}
+	}
+	return false
+}
+
+// LabelledPR is the first of prs with label, or nil if none has it
+func LabelledPR(prs []GraphQLPRQueryNode, label string) *GraphQLPRQueryNode {
+	for idx := range prs {
+		if prs[idx].HasLabel(label) {
+			return &prs[idx]
+		}
+	}
+	return nil
+}
+
+// MergeMethod is the merge method cfg sets for the change maker that made n
+func (n GraphQLPRQueryNode) MergeMethod(cfg *autobotcfg.AutobotPerRepoConfig) githubv4.PullRequestMergeMethod {
+	return githubv4.PullRequestMergeMethod(strings.ToUpper(cfg.MergeMethodFor(marker.ChangeMaker(string(n.Body)))))
+}
+
+// PRSelector narrows processing down to a single pull request (by number) or the pull requests of a commit (by head
+// OID).  The zero value selects every pull request.
+type PRSelector struct {
+	Number  int
+	HeadOID string
+}
+
+func (p PRSelector) Matches(pr GraphQLPRQueryNode) bool {
+	if p.Number != 0 && int(pr.Number) != p.Number {
+		return false
+	}
+	if p.HeadOID != "" && !strings.EqualFold(string(pr.HeadRef.Target.Oid), p.HeadOID) {
+		return false
+	}
+	return true
+}
+
 type MergePullRequestOutput struct {
 	MergePullRequest struct {
 		PullRequest struct {
@@ -106,6 +368,122 @@ type MergePullRequestOutput struct {
 	} `graphql:"mergePullRequest(input: $input)"`
 }
 
+type AddCommentOutput struct {
+	AddComment struct {
+		ClientMutationID githubv4.ID
+	} `graphql:"addComment(input: $input)"`
+}
+
+type UpdatePullRequestBranchOutput struct {
+	UpdatePullRequestBranch struct {
+		PullRequest struct {
+			ID githubv4.ID
+		}
+	} `graphql:"updatePullRequestBranch(input: $input)"`
+}
+
+type ClosePullRequestOutput struct {
+	ClosePullRequest struct {
+		PullRequest struct {
+			ID githubv4.ID
+		}
+	} `graphql:"closePullRequest(input: $input)"`
+}
+
+type CreateCheckRunOutput struct {
+	CreateCheckRun struct {
+		CheckRun struct {
+			ID githubv4.ID
+		}
+	} `graphql:"createCheckRun(input: $input)"`
+}
+
+type UpdateCheckRunOutput struct {
+	UpdateCheckRun struct {
+		CheckRun struct {
+			ID githubv4.ID
+		}
+	} `graphql:"updateCheckRun(input: $input)"`
+}
+
+type UpdateIssueCommentOutput struct {
+	UpdateIssueComment struct {
+		IssueComment struct {
+			ID githubv4.ID
+		}
+	} `graphql:"updateIssueComment(input: $input)"`
+}
+
+// IssueComment is a comment on a pull request
+type IssueComment struct {
+	ID              githubv4.ID
+	Body            githubv4.String
+	ViewerDidAuthor githubv4.Boolean
+}
+
+type GraphQLPRCommentsQuery struct {
+	Repository struct {
+		PullRequest struct {
+			Comments struct {
+				Nodes []IssueComment
+			} `graphql:"comments(last: 100)"`
+		} `graphql:"pullRequest(number: $number)"`
+	} `graphql:"repository(owner: $owner, name: $name)"`
+}
+
+type EnablePullRequestAutoMergeOutput struct {
+	EnablePullRequestAutoMerge struct {
+		PullRequest struct {
+			ID githubv4.ID
+		}
+	} `graphql:"enablePullRequestAutoMerge(input: $input)"`
+}
+
+type DisablePullRequestAutoMergeOutput struct {
+	DisablePullRequestAutoMerge struct {
+		PullRequest struct {
+			ID githubv4.ID
+		}
+	} `graphql:"disablePullRequestAutoMerge(input: $input)"`
+}
+
+// EnqueuePullRequestInput is the input of enqueuePullRequest, which the githubv4 version we use does not know about
+type EnqueuePullRequestInput struct {
+	// ID of the pull request to enqueue. (Required.)
+	PullRequestID githubv4.ID `json:"pullRequestId"`
+	// The expected head OID of the pull request. (Optional.)
+	ExpectedHeadOid *githubv4.GitObjectID `json:"expectedHeadOid,omitempty"`
+}
+
+type EnqueuePullRequestOutput struct {
+	EnqueuePullRequest struct {
+		MergeQueueEntry struct {
+			ID githubv4.ID
+		}
+	} `graphql:"enqueuePullRequest(input: $input)"`
+}
+
+type GraphQLPRMergeStateQuery struct {
+	Repository struct {
+		PullRequest struct {
+			// AutoMergeRequest is nil unless auto merge is enabled
+			AutoMergeRequest *struct {
+				MergeMethod githubv4.PullRequestMergeMethod
+			}
+			IsInMergeQueue      githubv4.Boolean
+			IsMergeQueueEnabled githubv4.Boolean
+		} `graphql:"pullRequest(number: $number)"`
+	} `graphql:"repository(owner: $owner, name: $name)"`
+}
+
+type UpdatePullRequestOutput struct {
+	UpdatePullRequest struct {
+		PullRequest struct {
+			ID githubv4.ID
+		}
+	} `graphql:"updatePullRequest(input: $input)"`
+}
+
 type UserInfo struct {
 	Login githubv4.String
 	ID    githubv4.ID
@@ -121,7 +499,7 @@ type AcceptPullRequestOutput struct {
 
 func PopulateRepoDefaultBranches(ctx context.Context, cfg *autobotcfg.AutobotConfig, g GithubAPI) (*autobotcfg.AutobotConfig, error) {
 	for idx := range cfg.Repos {
-		if cfg.Repos[idx].Branch != "" {
+		if cfg.Repos[idx].Branch != "" || cfg.Repos[idx].ForgeName() != autobotcfg.ForgeGitHub {
 			continue
 		}
 		ri, err := g.RepositoryInfo(ctx, cfg.Repos[idx].Owner, cfg.Repos[idx].Name)
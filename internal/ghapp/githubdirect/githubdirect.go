@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	http2 "net/http"
+	"net/url"
+	"strings"
 
 	"go.uber.org/zap"
 
@@ -17,31 +19,83 @@ import (
 )
 
 func NewFromConfig(ctx context.Context, cfg autobotcfg.GithubAppConfig, rt http2.RoundTripper, logger *zapctx.Logger) (*GithubDirect, error) {
-	trans, err := ghinstallation.NewKeyFromFile(rt, cfg.AppID, cfg.InstallationID, cfg.PEMKeyLoc)
-	if err != nil {
-		return nil, fmt.Errorf("unable to find key file: %w", err)
+	var tokens ghapp.TokenSource
+	var trans http2.RoundTripper
+	if cfg.TokenLoc != "" {
+		tok, err := cfg.Token()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load token: %w", err)
+		}
+		tokens = ghapp.StaticToken(tok)
+		trans = &tokenTransport{
+			tokens: tokens,
+			base:   rt,
+		}
+	} else {
+		itr, err := ghinstallation.NewKeyFromFile(rt, cfg.AppID, cfg.InstallationID, cfg.PEMKeyLoc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find key file: %w", err)
+		}
+		// ghinstallation wants the API address without its trailing slash
+		itr.BaseURL = strings.TrimSuffix(cfg.RESTURL(), "/")
+		_, err = itr.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to validate token: %w", err)
+		}
+		tokens = itr
+		trans = itr
 	}
-	_, err = trans.Token(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("unable to validate token: %w", err)
+	httpClient := &http2.Client{Transport: trans}
+	gql := githubv4.NewClient(httpClient)
+	client := github.NewClient(httpClient)
+	if cfg.IsEnterprise() {
+		gql = githubv4.NewEnterpriseClient(cfg.GraphQLEndpoint(), httpClient)
+		restURL, err := url.Parse(cfg.RESTURL())
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse api url %s: %w", cfg.RESTURL(), err)
+		}
+		client.BaseURL = restURL
+		client.UploadURL = restURL
 	}
-	gql := githubv4.NewClient(&http2.Client{Transport: trans})
-	client := github.NewClient(&http2.Client{Transport: trans})
 	return &GithubDirect{
-		clientV3:  client,
-		clientV4:  gql,
-		transport: trans,
-		logger:    logger,
+		clientV3: client,
+		clientV4: gql,
+		tokens:   tokens,
+		isApp:    cfg.TokenLoc == "",
+		logger:   logger,
 	}, nil
 }
 
+// tokenTransport authenticates every request with a token
+type tokenTransport struct {
+	tokens ghapp.TokenSource
+	base   http2.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(r *http2.Request) (*http2.Response, error) {
+	tok, err := t.tokens.Token(r.Context())
+	if err != nil {
+		return nil, fmt.Errorf("unable to get token: %w", err)
+	}
+	// A RoundTripper must not modify the request it is given
+	req := r.Clone(r.Context())
+	req.Header.Set("Authorization", "bearer "+tok)
+	base := t.base
+	if base == nil {
+		base = http2.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
+
 var _ ghapp.GithubAPI = &GithubDirect{}
 
 type GithubDirect struct {
-	clientV3  *github.Client
-	clientV4  *githubv4.Client
-	transport *ghinstallation.Transport
-	logger    *zapctx.Logger
+	clientV3 *github.Client
+	clientV4 *githubv4.Client
+	tokens   ghapp.TokenSource
+	// isApp is true for GitHub App installation auth, and false for a personal access token
+	isApp  bool
+	logger *zapctx.Logger
 }
 
 func (g *GithubDirect) RepositoryInfo(ctx context.Context, owner string, name string) (*ghapp.RepositoryInfo, error) {
@@ -69,7 +123,7 @@ func (g *GithubDirect) CreatePullRequest(ctx context.Context, _ string, _ string
 
 func (g *GithubDirect) GoGetAuthMethod() http.AuthMethod {
 	return &ghapp.DynamicAuthMethod{
-		Itr:    g.transport,
+		Itr:    g.tokens,
 		Logger: g.logger,
 	}
 }
@@ -124,10 +178,63 @@ func (g *GithubDirect) MergePullRequest(ctx context.Context, _ string, name stri
 	return &mergeMutation, nil
 }
 
-func (g *GithubDirect) EveryOpenPullRequest(ctx context.Context, owner string, name string) (*ghapp.GraphQLPRQuery, error) {
-	g.logger.Debug(ctx, "+GithubDirect.EveryOpenPullRequest", zap.String("name", name))
+func (g *GithubDirect) EveryOpenPullRequest(ctx context.Context, owner string, name string, filter ghapp.PRFilter) (*ghapp.GraphQLPRQuery, error) {
+	g.logger.Debug(ctx, "+GithubDirect.EveryOpenPullRequest", zap.String("name", name), zap.Stringer("filter", filter))
 	defer g.logger.Debug(ctx, "-GithubDirect.EveryOpenPullRequest")
+	if !filter.IsZero() {
+		return g.filteredOpenPullRequests(ctx, owner, name, filter)
+	}
 	var ret ghapp.GraphQLPRQuery
+	var cursor *githubv4.String
+	for {
+		var page ghapp.GraphQLPRQuery
+		if err := g.clientV4.Query(ctx, &page, map[string]interface{}{
+			"owner":  githubv4.String(owner),
+			"name":   githubv4.String(name),
+			"cursor": cursor,
+		}); err != nil {
+			return nil, fmt.Errorf("unable to query graphql: %w", err)
+		}
+		ret.Repository.PullRequests.Nodes = append(ret.Repository.PullRequests.Nodes, page.Repository.PullRequests.Nodes...)
+		if !page.Repository.PullRequests.PageInfo.HasNextPage {
+			return &ret, nil
+		}
+		cursor = githubv4.NewString(page.Repository.PullRequests.PageInfo.EndCursor)
+	}
+}
+
+func (g *GithubDirect) EveryBranch(ctx context.Context, owner string, name string, prefix string) (*ghapp.GraphQLBranchQuery, error) {
+	g.logger.Debug(ctx, "+GithubDirect.EveryBranch", zap.String("name", name), zap.String("prefix", prefix))
+	defer g.logger.Debug(ctx, "-GithubDirect.EveryBranch")
+	var ret ghapp.GraphQLBranchQuery
+	var cursor *githubv4.String
+	for {
+		var page ghapp.GraphQLBranchQuery
+		if err := g.clientV4.Query(ctx, &page, map[string]interface{}{
+			"owner":  githubv4.String(owner),
+			"name":   githubv4.String(name),
+			"query":  githubv4.String(prefix),
+			"cursor": cursor,
+		}); err != nil {
+			return nil, fmt.Errorf("unable to query graphql: %w", err)
+		}
+		// The query matches anywhere in the name, not just the start
+		for _, b := range page.Repository.Refs.Nodes {
+			if strings.HasPrefix(string(b.Name), prefix) {
+				ret.Repository.Refs.Nodes = append(ret.Repository.Refs.Nodes, b)
+			}
+		}
+		if !page.Repository.Refs.PageInfo.HasNextPage {
+			return &ret, nil
+		}
+		cursor = githubv4.NewString(page.Repository.Refs.PageInfo.EndCursor)
+	}
+}
+
+func (g *GithubDirect) RecentlyClosedPullRequests(ctx context.Context, owner string, name string) (*ghapp.GraphQLClosedPRQuery, error) {
+	g.logger.Debug(ctx, "+GithubDirect.RecentlyClosedPullRequests", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.RecentlyClosedPullRequests")
+	var ret ghapp.GraphQLClosedPRQuery
 	if err := g.clientV4.Query(ctx, &ret, map[string]interface{}{
 		"owner": githubv4.String(owner),
 		"name":  githubv4.String(name),
@@ -137,6 +244,41 @@ func (g *GithubDirect) EveryOpenPullRequest(ctx context.Context, owner string, n
 	return &ret, nil
 }
 
+// filteredOpenPullRequests pages through every open pull request, but only downloads the details of those matching
+// filter.  Unlike the search API, this sees pull requests made moments ago and is not capped at 1000 results.
+func (g *GithubDirect) filteredOpenPullRequests(ctx context.Context, owner string, name string, filter ghapp.PRFilter) (*ghapp.GraphQLPRQuery, error) {
+	var ret ghapp.GraphQLPRQuery
+	var cursor *githubv4.String
+	for {
+		var page ghapp.GraphQLPRHeadsQuery
+		if err := g.clientV4.Query(ctx, &page, map[string]interface{}{
+			"owner":  githubv4.String(owner),
+			"name":   githubv4.String(name),
+			"cursor": cursor,
+		}); err != nil {
+			return nil, fmt.Errorf("unable to query graphql: %w", err)
+		}
+		for _, n := range page.Repository.PullRequests.Nodes {
+			if !filter.Matches(string(n.HeadRefName), string(n.Author.Login)) {
+				continue
+			}
+			var pr ghapp.GraphQLSinglePRQuery
+			if err := g.clientV4.Query(ctx, &pr, map[string]interface{}{
+				"owner":  githubv4.String(owner),
+				"name":   githubv4.String(name),
+				"number": n.Number,
+			}); err != nil {
+				return nil, fmt.Errorf("unable to query pull request %d: %w", n.Number, err)
+			}
+			ret.Repository.PullRequests.Nodes = append(ret.Repository.PullRequests.Nodes, pr.Repository.PullRequest)
+		}
+		if !page.Repository.PullRequests.PageInfo.HasNextPage {
+			return &ret, nil
+		}
+		cursor = githubv4.NewString(page.Repository.PullRequests.PageInfo.EndCursor)
+	}
+}
+
 func (g *GithubDirect) DoesBranchExist(ctx context.Context, owner string, name string, ref string) (bool, error) {
 	g.logger.Debug(ctx, "+GithubDirect.DoesBranchExist", zap.String("branch", ref))
 	defer g.logger.Debug(ctx, "-GithubDirect.DoesBranchExist")
@@ -156,3 +298,202 @@ func (g *GithubDirect) DoesBranchExist(ctx context.Context, owner string, name s
 	}
 	return query.Repository.Ref != nil, nil
 }
+
+func (g *GithubDirect) RepositoryPermission(ctx context.Context, owner string, name string, login string) (string, error) {
+	g.logger.Debug(ctx, "+GithubDirect.RepositoryPermission", zap.String("name", name), zap.String("login", login))
+	defer g.logger.Debug(ctx, "-GithubDirect.RepositoryPermission")
+	level, _, err := g.clientV3.Repositories.GetPermissionLevel(ctx, owner, name, login)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch permission level: %w", err)
+	}
+	return level.GetPermission(), nil
+}
+
+func (g *GithubDirect) AddComment(ctx context.Context, _ string, name string, in githubv4.AddCommentInput) (*ghapp.AddCommentOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.AddComment", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.AddComment")
+	var ret ghapp.AddCommentOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql add comment: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) AddLabel(ctx context.Context, owner string, name string, number int, label string) error {
+	g.logger.Debug(ctx, "+GithubDirect.AddLabel", zap.String("name", name), zap.Int("number", number))
+	defer g.logger.Debug(ctx, "-GithubDirect.AddLabel")
+	// Note: The REST API creates labels that do not exist yet, while GraphQL needs label IDs
+	if _, _, err := g.clientV3.Issues.AddLabelsToIssue(ctx, owner, name, number, []string{label}); err != nil {
+		return fmt.Errorf("unable to add label %s: %w", label, err)
+	}
+	return nil
+}
+
+func (g *GithubDirect) RemoveLabel(ctx context.Context, owner string, name string, number int, label string) error {
+	g.logger.Debug(ctx, "+GithubDirect.RemoveLabel", zap.String("name", name), zap.Int("number", number))
+	defer g.logger.Debug(ctx, "-GithubDirect.RemoveLabel")
+	if _, err := g.clientV3.Issues.RemoveLabelForIssue(ctx, owner, name, number, label); err != nil {
+		return fmt.Errorf("unable to remove label %s: %w", label, err)
+	}
+	return nil
+}
+
+func (g *GithubDirect) UpdatePullRequestBranch(ctx context.Context, _ string, name string, in githubv4.UpdatePullRequestBranchInput) (*ghapp.UpdatePullRequestBranchOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.UpdatePullRequestBranch", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.UpdatePullRequestBranch")
+	var ret ghapp.UpdatePullRequestBranchOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql update PR branch: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) ClosePullRequest(ctx context.Context, _ string, name string, in githubv4.ClosePullRequestInput) (*ghapp.ClosePullRequestOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.ClosePullRequest", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.ClosePullRequest")
+	var ret ghapp.ClosePullRequestOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql close PR: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) UpdatePullRequest(ctx context.Context, _ string, name string, in githubv4.UpdatePullRequestInput) (*ghapp.UpdatePullRequestOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.UpdatePullRequest", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.UpdatePullRequest")
+	var ret ghapp.UpdatePullRequestOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql update PR: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) CreateCheckRun(ctx context.Context, _ string, name string, in githubv4.CreateCheckRunInput) (*ghapp.CreateCheckRunOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.CreateCheckRun", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.CreateCheckRun")
+	var ret ghapp.CreateCheckRunOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql create check run: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) UpdateCheckRun(ctx context.Context, _ string, name string, in githubv4.UpdateCheckRunInput) (*ghapp.UpdateCheckRunOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.UpdateCheckRun", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.UpdateCheckRun")
+	var ret ghapp.UpdateCheckRunOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql update check run: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) PullRequestComments(ctx context.Context, owner string, name string, number int) ([]ghapp.IssueComment, error) {
+	g.logger.Debug(ctx, "+GithubDirect.PullRequestComments", zap.String("name", name), zap.Int("number", number))
+	defer g.logger.Debug(ctx, "-GithubDirect.PullRequestComments")
+	var ret ghapp.GraphQLPRCommentsQuery
+	if err := g.clientV4.Query(ctx, &ret, map[string]interface{}{
+		"owner":  githubv4.String(owner),
+		"name":   githubv4.String(name),
+		"number": githubv4.Int(number),
+	}); err != nil {
+		return nil, fmt.Errorf("unable to query graphql for comments: %w", err)
+	}
+	return ret.Repository.PullRequest.Comments.Nodes, nil
+}
+
+func (g *GithubDirect) UpdateIssueComment(ctx context.Context, _ string, name string, in githubv4.UpdateIssueCommentInput) (*ghapp.UpdateIssueCommentOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.UpdateIssueComment", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.UpdateIssueComment")
+	var ret ghapp.UpdateIssueCommentOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql update comment: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) AccessibleRepositories(ctx context.Context) ([]ghapp.Repository, error) {
+	g.logger.Debug(ctx, "+GithubDirect.AccessibleRepositories")
+	defer g.logger.Debug(ctx, "-GithubDirect.AccessibleRepositories")
+	var ret []ghapp.Repository
+	opts := github.ListOptions{PerPage: 100}
+	for {
+		var repos []*github.Repository
+		var resp *github.Response
+		var err error
+		if g.isApp {
+			repos, resp, err = g.clientV3.Apps.ListRepos(ctx, &opts)
+		} else {
+			repos, resp, err = g.clientV3.Repositories.List(ctx, "", &github.RepositoryListOptions{ListOptions: opts})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to list repositories: %w", err)
+		}
+		for _, r := range repos {
+			ret = append(ret, ghapp.Repository{
+				Owner:         r.GetOwner().GetLogin(),
+				Name:          r.GetName(),
+				DefaultBranch: r.GetDefaultBranch(),
+				Topics:        r.Topics,
+				Archived:      r.GetArchived(),
+			})
+		}
+		if resp.NextPage == 0 {
+			return ret, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (g *GithubDirect) DeleteBranch(ctx context.Context, owner string, name string, ref string) error {
+	g.logger.Debug(ctx, "+GithubDirect.DeleteBranch", zap.String("name", name), zap.String("branch", ref))
+	defer g.logger.Debug(ctx, "-GithubDirect.DeleteBranch")
+	if _, err := g.clientV3.Git.DeleteRef(ctx, owner, name, "heads/"+ref); err != nil {
+		return fmt.Errorf("unable to delete branch %s: %w", ref, err)
+	}
+	return nil
+}
+
+func (g *GithubDirect) EnablePullRequestAutoMerge(ctx context.Context, _ string, name string, in githubv4.EnablePullRequestAutoMergeInput) (*ghapp.EnablePullRequestAutoMergeOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.EnablePullRequestAutoMerge", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.EnablePullRequestAutoMerge")
+	var ret ghapp.EnablePullRequestAutoMergeOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql enable auto merge: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) DisablePullRequestAutoMerge(ctx context.Context, _ string, name string, in githubv4.DisablePullRequestAutoMergeInput) (*ghapp.DisablePullRequestAutoMergeOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.DisablePullRequestAutoMerge", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.DisablePullRequestAutoMerge")
+	var ret ghapp.DisablePullRequestAutoMergeOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql disable auto merge: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) EnqueuePullRequest(ctx context.Context, _ string, name string, in ghapp.EnqueuePullRequestInput) (*ghapp.EnqueuePullRequestOutput, error) {
+	g.logger.Debug(ctx, "+GithubDirect.EnqueuePullRequest", zap.String("name", name))
+	defer g.logger.Debug(ctx, "-GithubDirect.EnqueuePullRequest")
+	var ret ghapp.EnqueuePullRequestOutput
+	if err := g.clientV4.Mutate(ctx, &ret, in, nil); err != nil {
+		return nil, fmt.Errorf("unable to graphql enqueue pull request: %w", err)
+	}
+	return &ret, nil
+}
+
+func (g *GithubDirect) PullRequestMergeState(ctx context.Context, owner string, name string, number int) (*ghapp.GraphQLPRMergeStateQuery, error) {
+	g.logger.Debug(ctx, "+GithubDirect.PullRequestMergeState", zap.String("name", name), zap.Int("number", number))
+	defer g.logger.Debug(ctx, "-GithubDirect.PullRequestMergeState")
+	var ret ghapp.GraphQLPRMergeStateQuery
+	if err := g.clientV4.Query(ctx, &ret, map[string]interface{}{
+		"owner":  githubv4.String(owner),
+		"name":   githubv4.String(name),
+		"number": githubv4.Int(number),
+	}); err != nil {
+		return nil, fmt.Errorf("unable to query graphql for merge state: %w", err)
+	}
+	return &ret, nil
+}
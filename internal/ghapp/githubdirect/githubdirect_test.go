@@ -0,0 +1,149 @@
+package githubdirect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/shurcooL/githubv4"
+	"github.com/stretchr/testify/require"
+)
+
+type graphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+func pullRequestNode(n int) map[string]interface{} {
+	headRefName := "filechange_values.yaml"
+	if n%2 == 0 {
+		headRefName = "someone/feature"
+	}
+	return map[string]interface{}{"number": n, "headRefName": headRefName, "author": map[string]interface{}{"login": "autobot"}}
+}
+
+// pagedServer answers every query with pages of two pull requests each, numbered from 1 to total.  Pull requests with
+// an even number are from a human branch.
+func pagedServer(t *testing.T, total int, requests *[]graphQLRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphQLRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		*requests = append(*requests, req)
+		if number, ok := req.Variables["number"].(float64); ok {
+			data := map[string]interface{}{
+				"repository": map[string]interface{}{"pullRequest": pullRequestNode(int(number))},
+			}
+			require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"data": data}))
+			return
+		}
+		start := 1
+		if cursor, ok := req.Variables["cursor"].(string); ok {
+			_, err := fmt.Sscanf(cursor, "after-%d", &start)
+			require.NoError(t, err)
+			start++
+		}
+		var nodes []map[string]interface{}
+		for n := start; n < start+2 && n <= total; n++ {
+			nodes = append(nodes, pullRequestNode(n))
+		}
+		last := start + len(nodes) - 1
+		connection := map[string]interface{}{
+			"nodes": nodes,
+			"pageInfo": map[string]interface{}{
+				"hasNextPage": last < total,
+				"endCursor":   fmt.Sprintf("after-%d", last),
+			},
+		}
+		data := map[string]interface{}{
+			"repository": map[string]interface{}{"pullRequests": connection},
+		}
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{"data": data}))
+	}))
+}
+
+func numbers(q *ghapp.GraphQLPRQuery) []int {
+	ret := make([]int, 0, len(q.Repository.PullRequests.Nodes))
+	for _, n := range q.Repository.PullRequests.Nodes {
+		ret = append(ret, int(n.Number))
+	}
+	return ret
+}
+
+func TestGithubDirect_EveryOpenPullRequest(t *testing.T) {
+	ctx := context.Background()
+	var requests []graphQLRequest
+	srv := pagedServer(t, 5, &requests)
+	defer srv.Close()
+	g := &GithubDirect{
+		clientV4: githubv4.NewEnterpriseClient(srv.URL, srv.Client()),
+		logger:   testhelp.ZapTestingLogger(t),
+	}
+
+	prs, err := g.EveryOpenPullRequest(ctx, "cresta", "gitops", ghapp.PRFilter{})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5}, numbers(prs))
+	require.Len(t, requests, 3)
+	require.Nil(t, requests[0].Variables["cursor"])
+	require.Equal(t, "after-2", requests[1].Variables["cursor"])
+
+	requests = nil
+	prs, err = g.EveryOpenPullRequest(ctx, "cresta", "gitops", ghapp.PRFilter{HeadRefPrefixes: []string{"shellchange", "filechange_"}, Author: "app/autobot"})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 3, 5}, numbers(prs))
+	require.Len(t, requests, 6, "three pages, and the details of each matching pull request")
+	require.Equal(t, float64(3), requests[3].Variables["number"])
+
+	requests = nil
+	prs, err = g.EveryOpenPullRequest(ctx, "cresta", "gitops", ghapp.PRFilter{Author: "someone"})
+	require.NoError(t, err)
+	require.Empty(t, numbers(prs))
+	require.Len(t, requests, 3)
+}
+
+func TestNewFromConfig_EnterpriseToken(t *testing.T) {
+	ctx := context.Background()
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "bearer sekret", r.Header.Get("Authorization"))
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/api/graphql":
+			_, _ = w.Write([]byte(`{"data": {"viewer": {"login": "autobot", "id": "U_1"}}}`))
+		case "/api/v3/repos/cresta/gitops/contents/.gitops-autobot":
+			_, _ = w.Write([]byte(`{"type": "file", "encoding": "base64", "content": "YWxsb3dBdXRvTWVyZ2U6IHRydWUK"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("sekret\n"), 0600))
+
+	g, err := NewFromConfig(ctx, autobotcfg.GithubAppConfig{
+		TokenLoc: tokenFile,
+		BaseURL:  srv.URL + "/",
+	}, http.DefaultTransport, testhelp.ZapTestingLogger(t))
+	require.NoError(t, err)
+	self, err := g.Self(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "autobot", string(self.Login))
+	content, err := g.GetContents(ctx, "cresta", "gitops", ".gitops-autobot")
+	require.NoError(t, err)
+	require.Equal(t, "allowAutoMerge: true\n", content)
+	require.Equal(t, []string{"/api/graphql", "/api/v3/repos/cresta/gitops/contents/.gitops-autobot"}, paths)
+
+	req := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	g.GoGetAuthMethod().SetAuth(req)
+	user, pass, ok := req.BasicAuth()
+	require.True(t, ok)
+	require.Equal(t, "x-access-token", user)
+	require.Equal(t, "sekret", pass)
+}
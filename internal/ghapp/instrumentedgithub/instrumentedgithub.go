@@ -0,0 +1,190 @@
+// Package instrumentedgithub counts the calls made to a ghapp.GithubAPI
+package instrumentedgithub
+
+import (
+	"context"
+
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/metrics"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/shurcooL/githubv4"
+)
+
+// InstrumentedGithub counts every call to Into, by method and result, in metrics.GithubAPICalls
+type InstrumentedGithub struct {
+	Into ghapp.GithubAPI
+	// Client labels the calls, so the calls of each GitHub app can be told apart
+	Client string
+}
+
+func (i *InstrumentedGithub) observe(method string, err error) {
+	metrics.GithubAPICalls.WithLabelValues(i.Client, method, metrics.Result(err)).Inc()
+}
+
+func (i *InstrumentedGithub) RepositoryInfo(ctx context.Context, owner string, name string) (*ghapp.RepositoryInfo, error) {
+	ret, err := i.Into.RepositoryInfo(ctx, owner, name)
+	i.observe("RepositoryInfo", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) CreatePullRequest(ctx context.Context, owner string, name string, in githubv4.CreatePullRequestInput) (*ghapp.CreatePullRequest, error) {
+	ret, err := i.Into.CreatePullRequest(ctx, owner, name, in)
+	i.observe("CreatePullRequest", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) GoGetAuthMethod() http.AuthMethod {
+	return i.Into.GoGetAuthMethod()
+}
+
+func (i *InstrumentedGithub) GetContents(ctx context.Context, owner string, name string, file string) (string, error) {
+	ret, err := i.Into.GetContents(ctx, owner, name, file)
+	i.observe("GetContents", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) Self(ctx context.Context) (*ghapp.UserInfo, error) {
+	ret, err := i.Into.Self(ctx)
+	i.observe("Self", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) AcceptPullRequest(ctx context.Context, owner string, name string, in githubv4.AddPullRequestReviewInput) (*ghapp.AcceptPullRequestOutput, error) {
+	ret, err := i.Into.AcceptPullRequest(ctx, owner, name, in)
+	i.observe("AcceptPullRequest", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) MergePullRequest(ctx context.Context, owner string, name string, ref string, in githubv4.MergePullRequestInput) (*ghapp.MergePullRequestOutput, error) {
+	ret, err := i.Into.MergePullRequest(ctx, owner, name, ref, in)
+	i.observe("MergePullRequest", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) EveryOpenPullRequest(ctx context.Context, owner string, name string, filter ghapp.PRFilter) (*ghapp.GraphQLPRQuery, error) {
+	ret, err := i.Into.EveryOpenPullRequest(ctx, owner, name, filter)
+	i.observe("EveryOpenPullRequest", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) DoesBranchExist(ctx context.Context, owner string, name string, ref string) (bool, error) {
+	ret, err := i.Into.DoesBranchExist(ctx, owner, name, ref)
+	i.observe("DoesBranchExist", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) RepositoryPermission(ctx context.Context, owner string, name string, login string) (string, error) {
+	ret, err := i.Into.RepositoryPermission(ctx, owner, name, login)
+	i.observe("RepositoryPermission", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) AddComment(ctx context.Context, owner string, name string, in githubv4.AddCommentInput) (*ghapp.AddCommentOutput, error) {
+	ret, err := i.Into.AddComment(ctx, owner, name, in)
+	i.observe("AddComment", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) AddLabel(ctx context.Context, owner string, name string, number int, label string) error {
+	err := i.Into.AddLabel(ctx, owner, name, number, label)
+	i.observe("AddLabel", err)
+	return err
+}
+
+func (i *InstrumentedGithub) RemoveLabel(ctx context.Context, owner string, name string, number int, label string) error {
+	err := i.Into.RemoveLabel(ctx, owner, name, number, label)
+	i.observe("RemoveLabel", err)
+	return err
+}
+
+func (i *InstrumentedGithub) UpdatePullRequestBranch(ctx context.Context, owner string, name string, in githubv4.UpdatePullRequestBranchInput) (*ghapp.UpdatePullRequestBranchOutput, error) {
+	ret, err := i.Into.UpdatePullRequestBranch(ctx, owner, name, in)
+	i.observe("UpdatePullRequestBranch", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) ClosePullRequest(ctx context.Context, owner string, name string, in githubv4.ClosePullRequestInput) (*ghapp.ClosePullRequestOutput, error) {
+	ret, err := i.Into.ClosePullRequest(ctx, owner, name, in)
+	i.observe("ClosePullRequest", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) UpdatePullRequest(ctx context.Context, owner string, name string, in githubv4.UpdatePullRequestInput) (*ghapp.UpdatePullRequestOutput, error) {
+	ret, err := i.Into.UpdatePullRequest(ctx, owner, name, in)
+	i.observe("UpdatePullRequest", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) DeleteBranch(ctx context.Context, owner string, name string, ref string) error {
+	err := i.Into.DeleteBranch(ctx, owner, name, ref)
+	i.observe("DeleteBranch", err)
+	return err
+}
+
+func (i *InstrumentedGithub) EveryBranch(ctx context.Context, owner string, name string, prefix string) (*ghapp.GraphQLBranchQuery, error) {
+	ret, err := i.Into.EveryBranch(ctx, owner, name, prefix)
+	i.observe("EveryBranch", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) RecentlyClosedPullRequests(ctx context.Context, owner string, name string) (*ghapp.GraphQLClosedPRQuery, error) {
+	ret, err := i.Into.RecentlyClosedPullRequests(ctx, owner, name)
+	i.observe("RecentlyClosedPullRequests", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) AccessibleRepositories(ctx context.Context) ([]ghapp.Repository, error) {
+	ret, err := i.Into.AccessibleRepositories(ctx)
+	i.observe("AccessibleRepositories", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) CreateCheckRun(ctx context.Context, owner string, name string, in githubv4.CreateCheckRunInput) (*ghapp.CreateCheckRunOutput, error) {
+	ret, err := i.Into.CreateCheckRun(ctx, owner, name, in)
+	i.observe("CreateCheckRun", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) UpdateCheckRun(ctx context.Context, owner string, name string, in githubv4.UpdateCheckRunInput) (*ghapp.UpdateCheckRunOutput, error) {
+	ret, err := i.Into.UpdateCheckRun(ctx, owner, name, in)
+	i.observe("UpdateCheckRun", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) PullRequestComments(ctx context.Context, owner string, name string, number int) ([]ghapp.IssueComment, error) {
+	ret, err := i.Into.PullRequestComments(ctx, owner, name, number)
+	i.observe("PullRequestComments", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) UpdateIssueComment(ctx context.Context, owner string, name string, in githubv4.UpdateIssueCommentInput) (*ghapp.UpdateIssueCommentOutput, error) {
+	ret, err := i.Into.UpdateIssueComment(ctx, owner, name, in)
+	i.observe("UpdateIssueComment", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) EnablePullRequestAutoMerge(ctx context.Context, owner string, name string, in githubv4.EnablePullRequestAutoMergeInput) (*ghapp.EnablePullRequestAutoMergeOutput, error) {
+	ret, err := i.Into.EnablePullRequestAutoMerge(ctx, owner, name, in)
+	i.observe("EnablePullRequestAutoMerge", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) DisablePullRequestAutoMerge(ctx context.Context, owner string, name string, in githubv4.DisablePullRequestAutoMergeInput) (*ghapp.DisablePullRequestAutoMergeOutput, error) {
+	ret, err := i.Into.DisablePullRequestAutoMerge(ctx, owner, name, in)
+	i.observe("DisablePullRequestAutoMerge", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) EnqueuePullRequest(ctx context.Context, owner string, name string, in ghapp.EnqueuePullRequestInput) (*ghapp.EnqueuePullRequestOutput, error) {
+	ret, err := i.Into.EnqueuePullRequest(ctx, owner, name, in)
+	i.observe("EnqueuePullRequest", err)
+	return ret, err
+}
+
+func (i *InstrumentedGithub) PullRequestMergeState(ctx context.Context, owner string, name string, number int) (*ghapp.GraphQLPRMergeStateQuery, error) {
+	ret, err := i.Into.PullRequestMergeState(ctx, owner, name, number)
+	i.observe("PullRequestMergeState", err)
+	return ret, err
+}
+
+var _ ghapp.GithubAPI = &InstrumentedGithub{}
@@ -0,0 +1,24 @@
+package instrumentedgithub
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/ghapp/fakegithub"
+	"github.com/cresta/gitops-autobot/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrumentedGithub(t *testing.T) {
+	ctx := context.Background()
+	gh := fakegithub.New(t.TempDir())
+	require.NoError(t, gh.AddRepository(fakegithub.Repository{Owner: "cresta", Name: "gitops", Files: map[string]string{"a.txt": "a\n"}}))
+	i := &InstrumentedGithub{Into: gh.Client("autobot"), Client: "test"}
+	_, err := i.GetContents(ctx, "cresta", "gitops", "a.txt")
+	require.NoError(t, err)
+	_, err = i.GetContents(ctx, "cresta", "missing", "a.txt")
+	require.Error(t, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.GithubAPICalls.WithLabelValues("test", "GetContents", "success")))
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.GithubAPICalls.WithLabelValues("test", "GetContents", "error")))
+}
@@ -0,0 +1,457 @@
+package gitopsbot
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/changemaker"
+	"github.com/cresta/gitops-autobot/internal/changemaker/filecontentchangemaker"
+	"github.com/cresta/gitops-autobot/internal/checkout"
+	"github.com/cresta/gitops-autobot/internal/forge"
+	"github.com/cresta/gitops-autobot/internal/forgebot"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/ghapp/fakegithub"
+	"github.com/cresta/gitops-autobot/internal/janitor"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/metrics"
+	"github.com/cresta/gitops-autobot/internal/prcreator"
+	"github.com/cresta/gitops-autobot/internal/prmerger"
+	"github.com/cresta/gitops-autobot/internal/prreviewer"
+	"github.com/cresta/gotracing"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shurcooL/githubv4"
+	"github.com/stretchr/testify/require"
+)
+
+// bumpCheck is a change maker that upgrades version=1 to version=2
+type bumpCheck struct{}
+
+func (b bumpCheck) NewContent(_ context.Context, file filecontentchangemaker.ReadableFile) (*filecontentchangemaker.FileChange, error) {
+	var buf bytes.Buffer
+	if _, err := file.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(buf.String(), "version=1\n") {
+		return nil, nil
+	}
+	return &filecontentchangemaker.FileChange{
+		NewContent:  strings.NewReader(strings.Replace(buf.String(), "version=1\n", "version=2\n", 1)),
+		CommitTitle: "Upgrade to version 2",
+		Versions:    map[string]string{"app": "2"},
+	}, nil
+}
+
+func bumpFactory(cfg autobotcfg.ChangeMakerConfig, perRepo autobotcfg.PerRepoChangeMakerConfig) ([]changemaker.WorkingTreeChanger, error) {
+	if cfg.Name != "bump" {
+		return nil, nil
+	}
+	return []changemaker.WorkingTreeChanger{
+		&filecontentchangemaker.FileContentWorkingTreeChanger{
+			Cfg:                cfg,
+			PerRepo:            perRepo,
+			ContentChangeCheck: bumpCheck{},
+		},
+	}, nil
+}
+
+const e2eRepoConfig = `allowAutoReview: true
+allowAutoMerge: %s
+changeMakers:
+  - name: bump
+    autoApprove: true
+    autoMerge: true
+`
+
+// harness is a GitopsBot running against a fake GitHub, where autobot makes pull requests and reviewer approves and
+// merges them, like the PR creator and reviewer apps would
+type harness struct {
+	github *fakegithub.GitHub
+	bot    *GitopsBot
+}
+
+func newHarness(t *testing.T, repo fakegithub.Repository) *harness {
+	ctx := context.Background()
+	logger := testhelp.ZapTestingLogger(t)
+	gh := fakegithub.New(t.TempDir())
+	require.NoError(t, gh.AddRepository(repo))
+	creator := gh.Client("autobot")
+	reviewer := gh.Client("reviewer")
+	prMaker, err := creator.Self(ctx)
+	require.NoError(t, err)
+	repoCfg := autobotcfg.RepoConfig{Owner: repo.Owner, Name: repo.Name, Branch: repo.DefaultBranch, ForgeURL: gh.Dir}
+	cfg := &autobotcfg.AutobotConfig{
+		ChangeMakers:  []autobotcfg.ChangeMakerConfig{{Name: "bump"}},
+		Repos:         []autobotcfg.RepoConfig{repoCfg},
+		BranchCleanup: &autobotcfg.BranchCleanupConfig{},
+	}
+	committer, err := changemaker.CommitterFromConfig(autobotcfg.CommitterConfig{AuthorName: "autobot", AuthorEmail: "autobot@example.com"})
+	require.NoError(t, err)
+	co, err := checkout.NewCheckout(ctx, logger, repoCfg, t.TempDir(), creator.GoGetAuthMethod())
+	require.NoError(t, err)
+	return &harness{
+		github: gh,
+		bot: &GitopsBot{
+			PRCreator: &prcreator.PrCreator{
+				F:             &changemaker.Factory{Factories: []changemaker.WorkingTreeChangerFactory{bumpFactory}},
+				AutobotConfig: cfg,
+				Logger:        logger,
+				GitCommitter:  committer,
+				Client:        creator,
+				PRMaker:       prMaker,
+			},
+			PrReviewer: &prreviewer.PrReviewer{
+				Client:        reviewer,
+				Logger:        logger,
+				AutobotConfig: cfg,
+				PRMaker:       prMaker,
+			},
+			PRMerger: &prmerger.PRMerger{
+				Client:        reviewer,
+				Logger:        logger,
+				AutobotConfig: cfg,
+			},
+			Janitor: &janitor.Janitor{
+				Client:        creator,
+				AutobotConfig: cfg,
+				PRMaker:       prMaker,
+				Logger:        logger,
+				// Past the grace period of every closed pull request
+				Now: func() time.Time { return time.Now().Add(time.Hour * 48) },
+			},
+			Checkouts:   []*checkout.Checkout{co},
+			Tracer:      gotracing.Noop{},
+			Logger:      logger,
+			Concurrency: 2,
+		},
+	}
+}
+
+func TestGitopsBot_EndToEnd(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, fakegithub.Repository{
+		Owner:         "cresta",
+		Name:          "gitops",
+		DefaultBranch: "main",
+		Files: map[string]string{
+			".gitops-autobot":  strings.Replace(e2eRepoConfig, "%s", "true", 1),
+			"apps/values.yaml": "version=1\n",
+		},
+		RequireReview: true,
+	})
+	created := testutil.ToFloat64(metrics.PullRequests.WithLabelValues("cresta/gitops", metrics.ActionCreate))
+	merged := testutil.ToFloat64(metrics.PullRequests.WithLabelValues("cresta/gitops", metrics.ActionMerge))
+	require.NoError(t, h.bot.execute(ctx))
+	require.Equal(t, created+1, testutil.ToFloat64(metrics.PullRequests.WithLabelValues("cresta/gitops", metrics.ActionCreate)))
+	require.Equal(t, merged+1, testutil.ToFloat64(metrics.PullRequests.WithLabelValues("cresta/gitops", metrics.ActionMerge)))
+
+	prs := h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, githubv4.PullRequestStateMerged, prs[0].State)
+	require.Equal(t, "autobot", prs[0].Author)
+	require.Equal(t, "Upgrade to version 2", prs[0].Title)
+	content, err := h.github.ReadFile("cresta", "gitops", "main", "apps/values.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "version=2\n", content)
+	branches, err := h.github.Branches("cresta", "gitops")
+	require.NoError(t, err)
+	require.Equal(t, []string{"main"}, branches, "the janitor deletes the merged branch")
+
+	// Nothing is left to do
+	require.NoError(t, h.bot.execute(ctx))
+	require.Len(t, h.github.PullRequests("cresta", "gitops"), 1)
+}
+
+func TestGitopsBot_EndToEndBehindBase(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, fakegithub.Repository{
+		Owner:         "cresta",
+		Name:          "gitops",
+		DefaultBranch: "master",
+		Files: map[string]string{
+			".gitops-autobot": strings.Replace(e2eRepoConfig, "%s", "false", 1),
+			"values.yaml":     "version=1\n",
+		},
+		RequireReview:   true,
+		RequireUpToDate: true,
+	})
+	require.NoError(t, h.bot.execute(ctx))
+	prs := h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, githubv4.PullRequestStateOpen, prs[0].State, "auto merge is not allowed yet")
+
+	// A human allows auto merge, which leaves the PR behind its base
+	_, err := h.github.Commit("cresta", "gitops", "master", map[string]string{
+		".gitops-autobot": strings.Replace(e2eRepoConfig, "%s", "true", 1),
+	}, "Allow auto merge")
+	require.NoError(t, err)
+	require.NoError(t, h.bot.execute(ctx))
+	prs = h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, githubv4.PullRequestStateMerged, prs[0].State, "the PR is brought up to date, approved again and merged")
+	content, err := h.github.ReadFile("cresta", "gitops", "master", "values.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "version=2\n", content)
+	content, err = h.github.ReadFile("cresta", "gitops", "master", ".gitops-autobot")
+	require.NoError(t, err)
+	require.Contains(t, content, "allowAutoMerge: true")
+}
+
+func TestGitopsBot_EndToEndSignedBehindBase(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, fakegithub.Repository{
+		Owner:         "cresta",
+		Name:          "gitops",
+		DefaultBranch: "master",
+		Files: map[string]string{
+			".gitops-autobot": strings.Replace(e2eRepoConfig, "%s", "false", 1),
+			"values.yaml":     "version=1\n",
+		},
+		RequireReview:   true,
+		RequireUpToDate: true,
+	})
+	signer := &marker.Signer{Key: []byte("sekret")}
+	h.bot.PRCreator.MarkerSigner = signer
+	h.bot.PrReviewer.MarkerSigner = signer
+	h.bot.PRMerger.MarkerSigner = signer
+	require.NoError(t, h.bot.execute(ctx))
+	prs := h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, githubv4.PullRequestStateOpen, prs[0].State, "auto merge is not allowed yet")
+
+	// The PR falls behind, so it is made again on the new base and signed for its new head
+	_, err := h.github.Commit("cresta", "gitops", "master", map[string]string{
+		".gitops-autobot": strings.Replace(e2eRepoConfig, "%s", "true", 1),
+	}, "Allow auto merge")
+	require.NoError(t, err)
+	require.NoError(t, h.bot.execute(ctx))
+	prs = h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, githubv4.PullRequestStateMerged, prs[0].State, "the signed marker still verifies after the PR is brought up to date")
+	content, err := h.github.ReadFile("cresta", "gitops", "master", "values.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "version=2\n", content)
+}
+
+func TestGitopsBot_EndToEndSignedUpdatedBranch(t *testing.T) {
+	ctx := context.Background()
+	h := newHarness(t, fakegithub.Repository{
+		Owner:         "cresta",
+		Name:          "gitops",
+		DefaultBranch: "master",
+		Files: map[string]string{
+			".gitops-autobot": strings.Replace(e2eRepoConfig, "%s", "false", 1),
+			"values.yaml":     "version=1\n",
+		},
+		RequireReview: true,
+	})
+	signer := &marker.Signer{Key: []byte("sekret")}
+	h.bot.PRCreator.MarkerSigner = signer
+	h.bot.PrReviewer.MarkerSigner = signer
+	h.bot.PRMerger.MarkerSigner = signer
+	require.NoError(t, h.bot.execute(ctx))
+	prs := h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, githubv4.PullRequestStateOpen, prs[0].State, "auto merge is not allowed yet")
+	body := prs[0].Body
+
+	// The base does not require up to date branches, so a PR that is merely behind is left alone
+	_, err := h.github.Commit("cresta", "gitops", "master", map[string]string{"README.md": "hello\n"}, "Add readme")
+	require.NoError(t, err)
+	require.NoError(t, h.bot.execute(ctx))
+	prs = h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, body, prs[0].Body, "the PR is not pushed again")
+
+	// Someone updates the branch with its base, so the signed marker no longer verifies for the head
+	_, err = h.github.Commit("cresta", "gitops", "master", map[string]string{
+		".gitops-autobot": strings.Replace(e2eRepoConfig, "%s", "true", 1),
+	}, "Allow auto merge")
+	require.NoError(t, err)
+	_, err = h.github.Client("jack").UpdatePullRequestBranch(ctx, "cresta", "gitops", githubv4.UpdatePullRequestBranchInput{
+		PullRequestID: prs[0].ID,
+	})
+	require.NoError(t, err)
+	require.NoError(t, h.bot.execute(ctx))
+	prs = h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, githubv4.PullRequestStateMerged, prs[0].State, "the PR is made again and signed for its new head")
+	content, err := h.github.ReadFile("cresta", "gitops", "master", "values.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "version=2\n", content)
+}
+
+func TestGitopsBot_EndToEndFreeze(t *testing.T) {
+	ctx := context.Background()
+	frozen := strings.Replace(e2eRepoConfig, "%s", "true", 1) + "freeze: true\n"
+	h := newHarness(t, fakegithub.Repository{
+		Owner:         "cresta",
+		Name:          "gitops",
+		DefaultBranch: "master",
+		Files: map[string]string{
+			".gitops-autobot": frozen,
+			"values.yaml":     "version=1\n",
+		},
+		RequireReview: true,
+	})
+	require.NoError(t, h.bot.execute(ctx))
+	prs := h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1, "PRs are still made during a freeze")
+	require.Equal(t, githubv4.PullRequestStateOpen, prs[0].State, "but not approved or merged")
+
+	// Lifting the freeze takes effect on the next cycle
+	_, err := h.github.Commit("cresta", "gitops", "master", map[string]string{
+		".gitops-autobot": strings.Replace(frozen, "freeze: true\n", "", 1),
+	}, "Lift the freeze")
+	require.NoError(t, err)
+	require.NoError(t, h.bot.execute(ctx))
+	prs = h.github.PullRequests("cresta", "gitops")
+	require.Len(t, prs, 1)
+	require.Equal(t, githubv4.PullRequestStateMerged, prs[0].State)
+}
+
+// noGitHub panics if any GitHub API is used
+type noGitHub struct {
+	ghapp.GithubAPI
+}
+
+// fakeGitLab is the merge request API of a GitLab repository whose git remote is served by a fake GitHub
+type fakeGitLab struct {
+	forge.Forge
+	gh     *fakegithub.GitHub
+	mrs    []forge.MergeRequest
+	merged []int
+}
+
+func (f *fakeGitLab) GetContents(_ context.Context, owner string, name string, file string) (string, error) {
+	return f.gh.ReadFile(owner, name, "master", file)
+}
+
+func (f *fakeGitLab) Self(_ context.Context) (string, error) {
+	return "autobot", nil
+}
+
+func (f *fakeGitLab) DoesBranchExist(_ context.Context, owner string, name string, branch string) (bool, error) {
+	branches, err := f.gh.Branches(owner, name)
+	if err != nil {
+		return false, err
+	}
+	for _, b := range branches {
+		if "refs/heads/"+b == branch || b == branch {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeGitLab) CreateMergeRequest(_ context.Context, _ string, _ string, in forge.NewMergeRequest) (*forge.MergeRequest, error) {
+	mr := forge.MergeRequest{
+		Number:       len(f.mrs) + 1,
+		Title:        in.Title,
+		Body:         in.Body,
+		SourceBranch: in.SourceBranch,
+		TargetBranch: in.TargetBranch,
+		Author:       "autobot",
+		Checks:       forge.CheckStateSuccess,
+	}
+	f.mrs = append(f.mrs, mr)
+	return &mr, nil
+}
+
+func (f *fakeGitLab) OpenMergeRequests(_ context.Context, _ string, _ string) ([]forge.MergeRequest, error) {
+	var ret []forge.MergeRequest
+	for _, mr := range f.mrs {
+		if !containsInt(f.merged, mr.Number) {
+			ret = append(ret, mr)
+		}
+	}
+	return ret, nil
+}
+
+func (f *fakeGitLab) Approve(_ context.Context, _ string, _ string, mr forge.MergeRequest) error {
+	f.mrs[mr.Number-1].Approved = true
+	f.mrs[mr.Number-1].ApprovedBySelf = true
+	return nil
+}
+
+func (f *fakeGitLab) Merge(_ context.Context, _ string, _ string, mr forge.MergeRequest, _ string) error {
+	f.merged = append(f.merged, mr.Number)
+	return nil
+}
+
+func containsInt(s []int, i int) bool {
+	for _, v := range s {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+// TestGitopsBot_EndToEndGitLab checks a repository on GitLab gets merge requests made, approved and merged through its
+// forge, and that none of autobotcfg.GitHubOnlyFeatures touch GitHub for it
+func TestGitopsBot_EndToEndGitLab(t *testing.T) {
+	ctx := context.Background()
+	logger := testhelp.ZapTestingLogger(t)
+	gh := fakegithub.New(t.TempDir())
+	require.NoError(t, gh.AddRepository(fakegithub.Repository{
+		Owner:         "cresta/infra",
+		Name:          "gitops",
+		DefaultBranch: "master",
+		Files: map[string]string{
+			".gitops-autobot": strings.Replace(e2eRepoConfig, "%s", "true", 1),
+			"values.yaml":     "version=1\n",
+		},
+	}))
+	gl := &fakeGitLab{gh: gh}
+	forges := map[string]forge.Forge{autobotcfg.ForgeGitLab: gl}
+	repoCfg := autobotcfg.RepoConfig{Owner: "cresta/infra", Name: "gitops", Branch: "master", Forge: autobotcfg.ForgeGitLab, ForgeURL: gh.Dir}
+	cfg := &autobotcfg.AutobotConfig{
+		ChangeMakers:  []autobotcfg.ChangeMakerConfig{{Name: "bump"}},
+		Repos:         []autobotcfg.RepoConfig{repoCfg},
+		BranchCleanup: &autobotcfg.BranchCleanupConfig{},
+	}
+	committer, err := changemaker.CommitterFromConfig(autobotcfg.CommitterConfig{AuthorName: "autobot", AuthorEmail: "autobot@example.com"})
+	require.NoError(t, err)
+	co, err := checkout.NewCheckout(ctx, logger, repoCfg, t.TempDir(), nil)
+	require.NoError(t, err)
+	bot := &GitopsBot{
+		PRCreator: &prcreator.PrCreator{
+			F:             &changemaker.Factory{Factories: []changemaker.WorkingTreeChangerFactory{bumpFactory}},
+			AutobotConfig: cfg,
+			Logger:        logger,
+			GitCommitter:  committer,
+			Client:        noGitHub{},
+			Forges:        forges,
+		},
+		PrReviewer: &prreviewer.PrReviewer{Client: noGitHub{}, Logger: logger, AutobotConfig: cfg},
+		PRMerger:   &prmerger.PRMerger{Client: noGitHub{}, Logger: logger, AutobotConfig: cfg},
+		Janitor:    &janitor.Janitor{Client: noGitHub{}, AutobotConfig: cfg, Logger: logger},
+		ForgeBot: &forgebot.ForgeBot{
+			Forges:        forges,
+			AutobotConfig: cfg,
+			Logger:        logger,
+		},
+		Checkouts:   []*checkout.Checkout{co},
+		Tracer:      gotracing.Noop{},
+		Logger:      logger,
+		Concurrency: 2,
+	}
+	require.NoError(t, bot.execute(ctx))
+	require.Len(t, gl.mrs, 1)
+	require.Equal(t, "Upgrade to version 2", gl.mrs[0].Title)
+	require.Equal(t, "master", gl.mrs[0].TargetBranch)
+	require.True(t, gl.mrs[0].Approved)
+	require.Equal(t, []int{1}, gl.merged)
+	content, err := gh.ReadFile("cresta/infra", "gitops", gl.mrs[0].SourceBranch, "values.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "version=2\n", content, "the branch is pushed to the GitLab remote")
+
+	// The branch is not pushed or proposed again
+	require.NoError(t, bot.execute(ctx))
+	require.Len(t, gl.mrs, 1)
+}
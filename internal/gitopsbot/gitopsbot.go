@@ -3,37 +3,152 @@ package gitopsbot
 import (
 	"context"
 	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cresta/gotracing"
 
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
 	"github.com/cresta/gitops-autobot/internal/checkout"
+	"github.com/cresta/gitops-autobot/internal/forgebot"
+	"github.com/cresta/gitops-autobot/internal/gatereport"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/janitor"
+	"github.com/cresta/gitops-autobot/internal/metrics"
 	"github.com/cresta/gitops-autobot/internal/prcreator"
 	"github.com/cresta/gitops-autobot/internal/prmerger"
 	"github.com/cresta/gitops-autobot/internal/prreviewer"
+	"github.com/cresta/gitops-autobot/internal/slashcmd"
 	"github.com/cresta/zapctx"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
 type GitopsBot struct {
-	PRCreator    *prcreator.PrCreator
-	PrReviewer   *prreviewer.PrReviewer
-	PRMerger     *prmerger.PRMerger
-	Checkouts    []*checkout.Checkout
-	Tracer       gotracing.Tracing
-	Logger       *zapctx.Logger
-	CronInterval time.Duration
-	OnCron       func(ctx context.Context, logger *zapctx.Logger)
-	cronTrigger  chan struct{}
-	stopTrigger  chan struct{}
+	PRCreator  *prcreator.PrCreator
+	PrReviewer *prreviewer.PrReviewer
+	PRMerger   *prmerger.PRMerger
+	// CommandRunner, if set, carries out slash commands left on pull requests
+	CommandRunner *slashcmd.Runner
+	// Janitor, if set, deletes the branches of finished autobot PRs after the merger runs
+	Janitor *janitor.Janitor
+	// GateReporter, if set, publishes the review and merge gates of autobot PRs after the merger runs
+	GateReporter *gatereport.Reporter
+	// ForgeBot reviews and merges the merge requests of repositories not hosted on GitHub, instead of PrReviewer and
+	// PRMerger
+	ForgeBot *forgebot.ForgeBot
+	// Checkouts are the repositories configured by hand
+	Checkouts []*checkout.Checkout
+	// Discoverer, if set, finds more repositories to manage.  The list is refreshed at the start of a full iteration
+	// once DiscoveryInterval has passed.
+	Discoverer        RepoDiscoverer
+	DiscoveryInterval time.Duration
+	// NewCheckout opens the checkout of a discovered repository
+	NewCheckout func(ctx context.Context, repo autobotcfg.RepoConfig) (*checkout.Checkout, error)
+	// AutobotConfig is told about discovered repositories, so the reviewer, merger and commands manage them too
+	AutobotConfig *autobotcfg.AutobotConfig
+	Tracer        gotracing.Tracing
+	Logger        *zapctx.Logger
+	CronInterval  time.Duration
+	// Concurrency is how many repositories are processed at once
+	Concurrency int
+	OnCron      func(ctx context.Context, logger *zapctx.Logger)
+	// OnRepoEvent is called before targeted work for a repository runs, so cached state for it can be dropped
+	OnRepoEvent func(ctx context.Context, logger *zapctx.Logger, owner string, name string)
+	cronTrigger chan struct{}
+	stopTrigger chan struct{}
+	workQueue   chan targetedWork
+	resultMu    sync.Mutex
+	lastResult  *CycleResult
+	checkoutsMu sync.Mutex
+	// discovered are the checkouts of discovered repositories.  Only the goroutine doing the work changes it.
+	discovered   map[autobotcfg.RepoConfig]*checkout.Checkout
+	discoveredAt time.Time
 }
 
+// RepoDiscoverer finds repositories to manage on top of the configured ones
+type RepoDiscoverer interface {
+	Discover(ctx context.Context) ([]autobotcfg.RepoConfig, error)
+}
+
+// targetedWork is a unit of work that only touches one repository, usually scheduled from a webhook
+type targetedWork struct {
+	owner string
+	name  string
+	// branch, if set, means new PRs should be created for checkouts of this branch
+	branch string
+	// everyBranch means new PRs should be created for every checkout of the repository
+	everyBranch bool
+	// changeMaker, if set, limits PR creation to this change maker
+	changeMaker string
+	// prs, if set, means the reviewer and merger should look at these pull requests
+	prs *ghapp.PRSelector
+	// command, if set, is a slash command to run
+	command *slashcmd.Command
+}
+
+const workQueueSize = 100
+
 func (g *GitopsBot) execute(ctx context.Context) error {
 	return g.Tracer.StartSpanFromContext(ctx, gotracing.SpanConfig{
 		OperationName: "GitopsBot.execute",
 	}, g.executeNoTrace)
 }
 
+// CycleResult is what happened during one full iteration
+type CycleResult struct {
+	Start time.Time
+	End   time.Time
+	Repos []*RepoResult
+}
+
+// RepoResult is what happened to one repository during a full iteration
+type RepoResult struct {
+	Repo       string
+	Creator    *prcreator.RepoResult
+	ReviewErr  error
+	MergeErr   error
+	CleanupErr error
+	ReportErr  error
+}
+
+// Error combines every failure of the repository, or is nil if there were none
+func (r *RepoResult) Error() error {
+	var creatorErr error
+	if r.Creator != nil {
+		creatorErr = r.Creator.Error()
+	}
+	return multierr.Combine(creatorErr, wrapIfErr("review", r.ReviewErr), wrapIfErr("merge", r.MergeErr), wrapIfErr("clean up branches", r.CleanupErr), wrapIfErr("report gates", r.ReportErr))
+}
+
+// Error combines every failure of the cycle, or is nil if there were none
+func (c *CycleResult) Error() error {
+	var errs []error
+	for _, r := range c.Repos {
+		if err := r.Error(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.Repo, err))
+		}
+	}
+	return multierr.Combine(errs...)
+}
+
+func wrapIfErr(phase string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("unable to %s: %w", phase, err)
+}
+
+// LastResult is the result of the most recent full iteration, or nil if none has finished
+func (g *GitopsBot) LastResult() *CycleResult {
+	g.resultMu.Lock()
+	defer g.resultMu.Unlock()
+	return g.lastResult
+}
+
 func (g *GitopsBot) executeNoTrace(ctx context.Context) error {
 	g.Logger.Info(ctx, "+GitopsBot.execute")
 	defer g.Logger.Info(ctx, "-GitopsBot.execute")
@@ -42,22 +157,318 @@ func (g *GitopsBot) executeNoTrace(ctx context.Context) error {
 			g.OnCron(ctx, g.Logger)
 		}
 	}()
-	for _, c := range g.Checkouts {
-		l := g.Logger.With(zap.Stringer("checkout", c.RepoConfig))
-		if err := g.PRCreator.Execute(ctx, c); err != nil {
-			l.IfErr(err).Warn(ctx, "unable to execute PR creation")
-			return fmt.Errorf("unable to create prs for %s: %w", c.RepoConfig.String(), err)
+	if g.Discoverer != nil && time.Since(g.discoveredAt) >= g.DiscoveryInterval {
+		// Keep going with the repositories we already know of
+		g.Logger.IfErr(g.RefreshRepos(ctx)).Warn(ctx, "unable to refresh discovered repositories")
+	}
+	checkouts := g.allCheckouts()
+	result := &CycleResult{
+		Start: time.Now(),
+		Repos: make([]*RepoResult, len(checkouts)),
+	}
+	// Every phase finishes for every repository before the next starts, so PRs created this cycle can be reviewed
+	// and PRs reviewed this cycle can be merged
+	forEachLimit(len(checkouts), g.Concurrency, func(idx int) {
+		c := checkouts[idx]
+		result.Repos[idx] = &RepoResult{
+			Repo:    c.RepoConfig.String(),
+			Creator: g.PRCreator.ExecuteRepo(ctx, c),
+		}
+		g.Logger.With(zap.Stringer("checkout", c.RepoConfig)).IfErr(result.Repos[idx].Creator.Error()).Warn(ctx, "unable to execute PR creation")
+	})
+	remotes := uniqueRemotes(checkouts)
+	forEachLimit(len(remotes), g.Concurrency, func(i int) {
+		idx := remotes[i]
+		c := checkouts[idx]
+		if !onGitHub(c) {
+			// ForgeBot reviews and merges in one go
+			result.Repos[idx].ReviewErr = g.executeForgeBot(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName())
+			return
+		}
+		result.Repos[idx].ReviewErr = g.PrReviewer.ExecutePullRequests(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), ghapp.PRSelector{})
+	})
+	forEachLimit(len(remotes), g.Concurrency, func(i int) {
+		idx := remotes[i]
+		c := checkouts[idx]
+		if !onGitHub(c) {
+			return
+		}
+		result.Repos[idx].MergeErr = g.PRMerger.ExecutePullRequests(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), ghapp.PRSelector{})
+	})
+	if g.Janitor != nil {
+		forEachLimit(len(remotes), g.Concurrency, func(i int) {
+			idx := remotes[i]
+			c := checkouts[idx]
+			if !onGitHub(c) {
+				// Merge requests on other forges delete their source branch when merged
+				return
+			}
+			result.Repos[idx].CleanupErr = g.Janitor.ExecuteRepo(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName())
+		})
+	}
+	if g.GateReporter != nil {
+		forEachLimit(len(remotes), g.Concurrency, func(i int) {
+			idx := remotes[i]
+			c := checkouts[idx]
+			if !onGitHub(c) {
+				return
+			}
+			result.Repos[idx].ReportErr = g.GateReporter.ExecuteRepo(ctx, c.RepoConfig.RemoteOwner(), c.RepoConfig.RemoteName(), ghapp.PRSelector{})
+		})
+	}
+	result.End = time.Now()
+	g.resultMu.Lock()
+	g.lastResult = result
+	g.resultMu.Unlock()
+	g.recordMetrics(result)
+	return result.Error()
+}
+
+// recordMetrics counts how the cycle, and each phase and change maker of each repository, went
+func (g *GitopsBot) recordMetrics(result *CycleResult) {
+	metrics.CycleDuration.Observe(result.End.Sub(result.Start).Seconds())
+	metrics.Cycles.WithLabelValues(metrics.Result(result.Error())).Inc()
+	for _, r := range result.Repos {
+		metrics.RepoPhases.WithLabelValues(r.Repo, "create", metrics.Result(r.Creator.Err)).Inc()
+		for _, cm := range r.Creator.ChangeMakers {
+			metrics.ChangeMakerRuns.WithLabelValues(r.Repo, cm.Name, metrics.Result(cm.Err)).Inc()
+		}
+		metrics.RepoPhases.WithLabelValues(r.Repo, "review", metrics.Result(r.ReviewErr)).Inc()
+		metrics.RepoPhases.WithLabelValues(r.Repo, "merge", metrics.Result(r.MergeErr)).Inc()
+		if g.Janitor != nil {
+			metrics.RepoPhases.WithLabelValues(r.Repo, "cleanup", metrics.Result(r.CleanupErr)).Inc()
+		}
+		if g.GateReporter != nil {
+			metrics.RepoPhases.WithLabelValues(r.Repo, "report", metrics.Result(r.ReportErr)).Inc()
+		}
+	}
+}
+
+// uniqueRemotes are the indexes of the first checkout of each remote repository.  Pull requests belong to the
+// repository rather than a branch, so handling them once per tracked branch would race on approvals and merges.
+func uniqueRemotes(checkouts []*checkout.Checkout) []int {
+	seen := make(map[string]bool, len(checkouts))
+	ret := make([]int, 0, len(checkouts))
+	for idx, c := range checkouts {
+		key := strings.ToLower(c.RepoConfig.ForgeName() + ":" + c.RepoConfig.RemoteOwner() + "/" + c.RepoConfig.RemoteName())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ret = append(ret, idx)
+	}
+	return ret
+}
+
+func onGitHub(c *checkout.Checkout) bool {
+	return c.RepoConfig.ForgeName() == autobotcfg.ForgeGitHub
+}
+
+func (g *GitopsBot) executeForgeBot(ctx context.Context, owner string, name string) error {
+	if g.ForgeBot == nil {
+		return fmt.Errorf("no forge bot to review and merge %s/%s", owner, name)
+	}
+	return g.ForgeBot.Execute(ctx, owner, name)
+}
+
+// allCheckouts are the checkouts of the configured repositories, then of the discovered ones
+func (g *GitopsBot) allCheckouts() []*checkout.Checkout {
+	g.checkoutsMu.Lock()
+	defer g.checkoutsMu.Unlock()
+	ret := append([]*checkout.Checkout(nil), g.Checkouts...)
+	discovered := make([]*checkout.Checkout, 0, len(g.discovered))
+	for _, c := range g.discovered {
+		discovered = append(discovered, c)
+	}
+	sort.Slice(discovered, func(i, j int) bool {
+		return discovered[i].RepoConfig.String() < discovered[j].RepoConfig.String()
+	})
+	return append(ret, discovered...)
+}
+
+// repoCheckouts are the checkouts of owner/name, one per tracked branch
+func (g *GitopsBot) repoCheckouts(owner string, name string) []*checkout.Checkout {
+	var ret []*checkout.Checkout
+	for _, c := range g.allCheckouts() {
+		if strings.EqualFold(c.RepoConfig.RemoteOwner(), owner) && strings.EqualFold(c.RepoConfig.RemoteName(), name) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// RefreshRepos asks the Discoverer for the repositories to manage, opening checkouts for new ones and removing the
+// checkouts of the ones no longer found
+func (g *GitopsBot) RefreshRepos(ctx context.Context) error {
+	g.Logger.Debug(ctx, "+GitopsBot.RefreshRepos")
+	defer g.Logger.Debug(ctx, "-GitopsBot.RefreshRepos")
+	repos, err := g.Discoverer.Discover(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to discover repositories: %w", err)
+	}
+	g.checkoutsMu.Lock()
+	previous := g.discovered
+	g.checkoutsMu.Unlock()
+	next := make(map[autobotcfg.RepoConfig]*checkout.Checkout, len(repos))
+	kept := make([]autobotcfg.RepoConfig, 0, len(repos))
+	for _, r := range repos {
+		co, exists := previous[r]
+		if !exists {
+			co, err = g.NewCheckout(ctx, r)
+			if err != nil {
+				// One broken repository should not keep the others from being managed
+				g.Logger.IfErr(err).Warn(ctx, "unable to check out discovered repository", zap.Stringer("repo", r))
+				continue
+			}
+			g.Logger.Info(ctx, "managing discovered repository", zap.Stringer("repo", r))
+		}
+		next[r] = co
+		kept = append(kept, r)
+	}
+	g.checkoutsMu.Lock()
+	g.discovered = next
+	g.checkoutsMu.Unlock()
+	if g.AutobotConfig != nil {
+		g.AutobotConfig.SetDiscoveredRepos(kept)
+	}
+	for r, co := range previous {
+		if _, exists := next[r]; exists {
+			continue
+		}
+		g.Logger.Info(ctx, "retiring repository that is no longer discovered", zap.Stringer("repo", r))
+		g.Logger.IfErr(os.RemoveAll(co.CheckoutDirectory)).Warn(ctx, "unable to remove checkout", zap.String("dir", co.CheckoutDirectory))
+	}
+	g.discoveredAt = time.Now()
+	return nil
+}
+
+// forEachLimit calls f for every index below n, with at most limit calls running at once
+func forEachLimit(n int, limit int, f func(idx int)) {
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for idx := 0; idx < n; idx++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f(idx)
+		}(idx)
+	}
+	wg.Wait()
+}
+
+// RunOnce does a single full iteration, exactly like the cron would
+func (g *GitopsBot) RunOnce(ctx context.Context) error {
+	return g.execute(ctx)
+}
+
+func (g *GitopsBot) executeTargeted(ctx context.Context, w targetedWork) error {
+	return g.Tracer.StartSpanFromContext(ctx, gotracing.SpanConfig{
+		OperationName: "GitopsBot.executeTargeted",
+	}, func(ctx context.Context) error {
+		return g.executeTargetedNoTrace(ctx, w)
+	})
+}
+
+func (g *GitopsBot) executeTargetedNoTrace(ctx context.Context, w targetedWork) error {
+	g.Logger.Debug(ctx, "+GitopsBot.executeTargeted")
+	defer g.Logger.Debug(ctx, "-GitopsBot.executeTargeted")
+	if g.OnRepoEvent != nil {
+		g.OnRepoEvent(ctx, g.Logger, w.owner, w.name)
+	}
+	if w.branch != "" || w.everyBranch {
+		for _, c := range g.repoCheckouts(w.owner, w.name) {
+			if !w.everyBranch && c.RepoConfig.RemoteBranch() != w.branch {
+				continue
+			}
+			var result *prcreator.RepoResult
+			if w.changeMaker != "" {
+				result = g.PRCreator.ExecuteChangeMaker(ctx, c, w.changeMaker)
+			} else {
+				result = g.PRCreator.ExecuteRepo(ctx, c)
+			}
+			if err := result.Error(); err != nil {
+				return fmt.Errorf("unable to create prs for %s: %w", c.RepoConfig.String(), err)
+			}
 		}
 	}
-	if err := g.PrReviewer.Execute(ctx); err != nil {
-		return fmt.Errorf("unable to review any PRs: %w", err)
+	if w.command != nil && g.CommandRunner != nil {
+		if err := g.CommandRunner.Execute(ctx, *w.command); err != nil {
+			return fmt.Errorf("unable to run command %s on %s/%s#%d: %w", w.command.Verb, w.owner, w.name, w.command.Number, err)
+		}
 	}
-	if err := g.PRMerger.Execute(ctx); err != nil {
-		return fmt.Errorf("unable to execute any PRs: %w", err)
+	if w.prs != nil {
+		if checkouts := g.repoCheckouts(w.owner, w.name); len(checkouts) > 0 && !onGitHub(checkouts[0]) {
+			// ForgeBot has no way to pick pull requests, so it looks at all of them
+			return g.executeForgeBot(ctx, w.owner, w.name)
+		}
+		if err := g.PrReviewer.ExecutePullRequests(ctx, w.owner, w.name, *w.prs); err != nil {
+			return fmt.Errorf("unable to review PRs of %s/%s: %w", w.owner, w.name, err)
+		}
+		if err := g.PRMerger.ExecutePullRequests(ctx, w.owner, w.name, *w.prs); err != nil {
+			return fmt.Errorf("unable to merge PRs of %s/%s: %w", w.owner, w.name, err)
+		}
+		if g.GateReporter != nil {
+			if err := g.GateReporter.ExecuteRepo(ctx, w.owner, w.name, *w.prs); err != nil {
+				return fmt.Errorf("unable to report gates of PRs of %s/%s: %w", w.owner, w.name, err)
+			}
+		}
 	}
 	return nil
 }
 
+// TriggerRepo schedules PR creation for checkouts of owner/name tracking branch
+func (g *GitopsBot) TriggerRepo(owner string, name string, branch string) {
+	g.enqueue(targetedWork{
+		owner:  owner,
+		name:   name,
+		branch: branch,
+	})
+}
+
+// TriggerRepoNow schedules PR creation for every checkout of owner/name, then review and merge of its pull requests,
+// like a full iteration limited to one repository.  If changeMaker is set, only that change maker is run.
+func (g *GitopsBot) TriggerRepoNow(owner string, name string, changeMaker string) {
+	g.enqueue(targetedWork{
+		owner:       owner,
+		name:        name,
+		everyBranch: true,
+		changeMaker: changeMaker,
+		prs:         &ghapp.PRSelector{},
+	})
+}
+
+// TriggerPullRequests schedules the reviewer and merger for the pull requests of owner/name matching sel
+func (g *GitopsBot) TriggerPullRequests(owner string, name string, sel ghapp.PRSelector) {
+	g.enqueue(targetedWork{
+		owner: owner,
+		name:  name,
+		prs:   &sel,
+	})
+}
+
+// TriggerCommand schedules a slash command
+func (g *GitopsBot) TriggerCommand(cmd slashcmd.Command) {
+	g.enqueue(targetedWork{
+		owner:   cmd.Owner,
+		name:    cmd.Name,
+		command: &cmd,
+	})
+}
+
+func (g *GitopsBot) enqueue(w targetedWork) {
+	select {
+	case g.workQueue <- w:
+	default:
+		// Too far behind to do targeted work: a full iteration will pick up whatever we dropped
+		g.TriggerNow()
+	}
+}
+
 func (g *GitopsBot) TriggerNow() {
 	select {
 	case g.cronTrigger <- struct{}{}:
@@ -72,9 +483,13 @@ func (g *GitopsBot) Stop() {
 func (g *GitopsBot) Setup() {
 	g.stopTrigger = make(chan struct{})
 	g.cronTrigger = make(chan struct{}, 1)
+	g.workQueue = make(chan targetedWork, workQueueSize)
 }
 
 func (g *GitopsBot) Cron(ctx context.Context) {
+	// Targeted work should not push back the full iteration, so the timer is only reset after full iterations
+	cronTimer := time.NewTimer(g.CronInterval)
+	defer cronTimer.Stop()
 	for {
 		select {
 		case <-g.stopTrigger:
@@ -82,9 +497,24 @@ func (g *GitopsBot) Cron(ctx context.Context) {
 		case <-g.cronTrigger:
 			err := g.execute(ctx)
 			g.Logger.IfErr(err).Warn(ctx, "unable to execute manual iteration of cron")
-		case <-time.After(g.CronInterval):
+			resetTimer(cronTimer, g.CronInterval)
+		case w := <-g.workQueue:
+			err := g.executeTargeted(ctx, w)
+			g.Logger.IfErr(err).Warn(ctx, "unable to execute targeted work", zap.String("owner", w.owner), zap.String("name", w.name))
+		case <-cronTimer.C:
 			err := g.execute(ctx)
 			g.Logger.IfErr(err).Warn(ctx, "unable to execute iteration of cron")
+			cronTimer.Reset(g.CronInterval)
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
 		}
 	}
+	t.Reset(d)
 }
@@ -0,0 +1,138 @@
+package gitopsbot
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/checkout"
+	"github.com/cresta/gitops-autobot/internal/prcreator"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/multierr"
+)
+
+func TestForEachLimit(t *testing.T) {
+	var mu sync.Mutex
+	running := 0
+	maxRunning := 0
+	seen := make([]bool, 10)
+	forEachLimit(len(seen), 3, func(idx int) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		seen[idx] = true
+		mu.Unlock()
+		time.Sleep(time.Millisecond * 5)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	require.Equal(t, 3, maxRunning)
+	for idx := range seen {
+		require.True(t, seen[idx])
+	}
+}
+
+func TestCycleResult_Error(t *testing.T) {
+	res := CycleResult{
+		Repos: []*RepoResult{
+			{
+				Repo: "cresta/a:master",
+				Creator: &prcreator.RepoResult{
+					ChangeMakers: []prcreator.ChangeMakerResult{
+						{Name: "helm"},
+						{Name: "time", Err: errors.New("bad config")},
+					},
+				},
+				MergeErr: errors.New("merge failed"),
+			},
+			{
+				Repo:    "cresta/b:master",
+				Creator: &prcreator.RepoResult{},
+			},
+		},
+	}
+	require.Nil(t, res.Repos[1].Error())
+	err := res.Error()
+	require.Len(t, multierr.Errors(err), 1)
+	require.Contains(t, err.Error(), "cresta/a:master")
+	require.Contains(t, err.Error(), "change maker time: bad config")
+	require.Contains(t, err.Error(), "unable to merge: merge failed")
+}
+
+func TestUniqueRemotes(t *testing.T) {
+	checkouts := []*checkout.Checkout{
+		{RepoConfig: autobotcfg.RepoConfig{Owner: "cresta", Name: "gitops", Branch: "master"}},
+		{RepoConfig: autobotcfg.RepoConfig{Owner: "cresta", Name: "other", Branch: "master"}},
+		{RepoConfig: autobotcfg.RepoConfig{Owner: "Cresta", Name: "gitops", Branch: "staging"}},
+	}
+	require.Equal(t, []int{0, 1}, uniqueRemotes(checkouts))
+}
+
+type fakeDiscoverer struct {
+	repos []autobotcfg.RepoConfig
+}
+
+func (f *fakeDiscoverer) Discover(_ context.Context) ([]autobotcfg.RepoConfig, error) {
+	return f.repos, nil
+}
+
+func TestGitopsBot_RefreshRepos(t *testing.T) {
+	ctx := context.Background()
+	dataDir := t.TempDir()
+	opened := 0
+	discoverer := &fakeDiscoverer{}
+	cfg := &autobotcfg.AutobotConfig{}
+	static := &checkout.Checkout{RepoConfig: autobotcfg.RepoConfig{Owner: "cresta", Name: "manual", Branch: "master"}}
+	g := &GitopsBot{
+		Checkouts:     []*checkout.Checkout{static},
+		Discoverer:    discoverer,
+		AutobotConfig: cfg,
+		Logger:        testhelp.ZapTestingLogger(t),
+		NewCheckout: func(_ context.Context, repo autobotcfg.RepoConfig) (*checkout.Checkout, error) {
+			opened++
+			if repo.Name == "broken" {
+				return nil, errors.New("unable to clone")
+			}
+			dir := filepath.Join(dataDir, repo.Name+"-"+repo.Branch)
+			require.NoError(t, os.Mkdir(dir, 0700))
+			return &checkout.Checkout{RepoConfig: repo, CheckoutDirectory: dir}, nil
+		},
+	}
+	repoB := autobotcfg.RepoConfig{Owner: "cresta", Name: "b", Branch: "main"}
+	repoA := autobotcfg.RepoConfig{Owner: "cresta", Name: "a", Branch: "main"}
+	discoverer.repos = []autobotcfg.RepoConfig{repoB, repoA, {Owner: "cresta", Name: "broken", Branch: "main"}}
+	require.NoError(t, g.RefreshRepos(ctx))
+	checkouts := g.allCheckouts()
+	require.Len(t, checkouts, 3)
+	require.Equal(t, static, checkouts[0])
+	require.Equal(t, repoA, checkouts[1].RepoConfig)
+	require.Equal(t, repoB, checkouts[2].RepoConfig)
+	require.Equal(t, 3, opened)
+	require.NotNil(t, cfg.FindRepo("Cresta", "A"))
+	require.Nil(t, cfg.FindRepo("cresta", "broken"))
+
+	// Kept checkouts are reused, and a changed default branch is a new checkout
+	movedB := repoB
+	movedB.Branch = "master"
+	discoverer.repos = []autobotcfg.RepoConfig{repoA, movedB}
+	require.NoError(t, g.RefreshRepos(ctx))
+	require.Equal(t, 4, opened)
+	require.Len(t, g.allCheckouts(), 3)
+	require.NoDirExists(t, filepath.Join(dataDir, "b-main"))
+	require.DirExists(t, filepath.Join(dataDir, "a-main"))
+
+	discoverer.repos = nil
+	require.NoError(t, g.RefreshRepos(ctx))
+	require.Equal(t, []*checkout.Checkout{static}, g.allCheckouts())
+	require.NoDirExists(t, filepath.Join(dataDir, "a-main"))
+	require.Empty(t, cfg.AllRepos())
+}
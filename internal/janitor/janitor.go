@@ -0,0 +1,105 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/zapctx"
+	"github.com/shurcooL/githubv4"
+	"go.uber.org/zap"
+)
+
+// Janitor deletes the remote branches of autobot pull requests that were merged or closed.  A branch is only deleted if
+// its most recent pull request was made by autobot, and nobody pushed to it since that pull request closed.
+type Janitor struct {
+	Client        ghapp.GithubAPI
+	AutobotConfig *autobotcfg.AutobotConfig
+	PRMaker       *ghapp.UserInfo
+	Logger        *zapctx.Logger
+	// Plan, if set, turns on plan mode: branches that would be deleted are written here and nothing is deleted
+	Plan io.Writer
+	// Now defaults to time.Now
+	Now func() time.Time
+}
+
+func (j *Janitor) now() time.Time {
+	if j.Now == nil {
+		return time.Now()
+	}
+	return j.Now()
+}
+
+// ExecuteRepo deletes the finished autobot branches of owner/name
+func (j *Janitor) ExecuteRepo(ctx context.Context, owner string, name string) error {
+	j.Logger.Debug(ctx, "+Janitor.ExecuteRepo")
+	defer j.Logger.Debug(ctx, "-Janitor.ExecuteRepo")
+	cfg := j.AutobotConfig.BranchCleanup
+	if cfg == nil {
+		return nil
+	}
+	if j.PRMaker == nil {
+		j.Logger.Debug(ctx, "unable to tell which pull requests are ours")
+		return nil
+	}
+	for _, prefix := range cfg.BranchPrefixes() {
+		branches, err := j.Client.EveryBranch(ctx, owner, name, prefix)
+		if err != nil {
+			return fmt.Errorf("unable to list branches starting with %s: %w", prefix, err)
+		}
+		for _, b := range branches.Repository.Refs.Nodes {
+			remove, reason := j.deleteDecision(b, cfg.Grace())
+			j.Logger.Debug(ctx, "delete decision", zap.String("branch", string(b.Name)), zap.Bool("delete", remove), zap.String("reason", reason))
+			if j.Plan != nil {
+				if remove {
+					j.planf(ctx, "%s/%s branch %s: would delete: %s", owner, name, b.Name, reason)
+				}
+				continue
+			}
+			if !remove {
+				continue
+			}
+			j.Logger.Info(ctx, "deleting finished branch", zap.String("branch", string(b.Name)), zap.String("reason", reason))
+			if err := j.Client.DeleteBranch(ctx, owner, name, string(b.Name)); err != nil {
+				return fmt.Errorf("unable to delete branch %s: %w", b.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteDecision returns if branch b should be deleted, and why
+func (j *Janitor) deleteDecision(b ghapp.GraphQLBranchNode, grace time.Duration) (bool, string) {
+	prs := b.AssociatedPullRequests.Nodes
+	if len(prs) == 0 {
+		return false, "no pull request"
+	}
+	for _, pr := range prs {
+		if pr.State == githubv4.PullRequestStateOpen {
+			return false, fmt.Sprintf("pull request #%d is open", pr.Number)
+		}
+	}
+	// Most recently created first
+	last := prs[0]
+	if j.PRMaker.ID != last.Author.Bot.ID && j.PRMaker.ID != last.Author.User.ID {
+		return false, fmt.Sprintf("pull request #%d was not made by autobot", last.Number)
+	}
+	if last.HeadRefOid != b.Target.Oid {
+		return false, fmt.Sprintf("pushed to after pull request #%d", last.Number)
+	}
+	if last.ClosedAt == nil {
+		return false, fmt.Sprintf("pull request #%d has no close time", last.Number)
+	}
+	if closedFor := j.now().Sub(last.ClosedAt.Time); closedFor < grace {
+		return false, fmt.Sprintf("pull request #%d closed %s ago", last.Number, closedFor.Round(time.Second))
+	}
+	return true, fmt.Sprintf("pull request #%d is %s", last.Number, last.State)
+}
+
+func (j *Janitor) planf(ctx context.Context, format string, args ...interface{}) {
+	_, err := fmt.Fprintf(j.Plan, format+"\n", args...)
+	j.Logger.IfErr(err).Warn(ctx, "unable to write plan")
+}
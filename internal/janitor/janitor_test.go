@@ -0,0 +1,97 @@
+package janitor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/shurcooL/githubv4"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient implements only what the janitor uses
+type fakeClient struct {
+	ghapp.GithubAPI
+	branches map[string][]ghapp.GraphQLBranchNode
+	deleted  []string
+}
+
+func (f *fakeClient) EveryBranch(_ context.Context, _ string, _ string, prefix string) (*ghapp.GraphQLBranchQuery, error) {
+	var ret ghapp.GraphQLBranchQuery
+	ret.Repository.Refs.Nodes = f.branches[prefix]
+	return &ret, nil
+}
+
+func (f *fakeClient) DeleteBranch(_ context.Context, _ string, _ string, ref string) error {
+	f.deleted = append(f.deleted, ref)
+	return nil
+}
+
+func TestJanitor_ExecuteRepo(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	branch := func(name string, head string) ghapp.GraphQLBranchNode {
+		var b ghapp.GraphQLBranchNode
+		b.Name = githubv4.String(name)
+		b.Target.Oid = githubv4.GitObjectID(head)
+		return b
+	}
+	addPR := func(b *ghapp.GraphQLBranchNode, author string, state githubv4.PullRequestState, head string, closedAgo time.Duration) {
+		pr := ghapp.GraphQLBranchPullRequest{
+			Number:     githubv4.Int(len(b.AssociatedPullRequests.Nodes) + 1),
+			State:      state,
+			HeadRefOid: githubv4.GitObjectID(head),
+		}
+		pr.Author.Bot.ID = author
+		if state != githubv4.PullRequestStateOpen {
+			pr.ClosedAt = &githubv4.DateTime{Time: now.Add(-closedAgo)}
+		}
+		b.AssociatedPullRequests.Nodes = append(b.AssociatedPullRequests.Nodes, pr)
+	}
+	merged := branch("filechange_merged", "aaa")
+	addPR(&merged, "bot", githubv4.PullRequestStateMerged, "aaa", time.Hour*2)
+	recent := branch("filechange_recent", "bbb")
+	addPR(&recent, "bot", githubv4.PullRequestStateClosed, "bbb", time.Minute)
+	pushedTo := branch("filechange_pushed", "ccc")
+	addPR(&pushedTo, "bot", githubv4.PullRequestStateClosed, "old", time.Hour*2)
+	notOurs := branch("filechange_human", "ddd")
+	addPR(&notOurs, "jack", githubv4.PullRequestStateMerged, "ddd", time.Hour*2)
+	noPR := branch("filechange_nopr", "eee")
+	reopened := branch("shellchangeupdate", "fff")
+	addPR(&reopened, "bot", githubv4.PullRequestStateOpen, "fff", 0)
+	addPR(&reopened, "bot", githubv4.PullRequestStateClosed, "fff", time.Hour*2)
+
+	client := &fakeClient{
+		branches: map[string][]ghapp.GraphQLBranchNode{
+			"filechange_": {merged, recent, pushedTo, notOurs, noPR},
+			"shellchange": {reopened},
+		},
+	}
+	j := Janitor{
+		Client: client,
+		AutobotConfig: &autobotcfg.AutobotConfig{
+			BranchCleanup: &autobotcfg.BranchCleanupConfig{GracePeriod: time.Hour},
+		},
+		PRMaker: &ghapp.UserInfo{ID: "bot"},
+		Logger:  testhelp.ZapTestingLogger(t),
+		Now:     func() time.Time { return now },
+	}
+	ctx := context.Background()
+	require.NoError(t, j.ExecuteRepo(ctx, "cresta", "gitops"))
+	require.Equal(t, []string{"filechange_merged"}, client.deleted)
+
+	client.deleted = nil
+	var plan bytes.Buffer
+	j.Plan = &plan
+	require.NoError(t, j.ExecuteRepo(ctx, "cresta", "gitops"))
+	require.Empty(t, client.deleted)
+	require.Equal(t, "cresta/gitops branch filechange_merged: would delete: pull request #1 is MERGED\n", plan.String())
+
+	j.AutobotConfig.BranchCleanup = nil
+	j.Plan = nil
+	require.NoError(t, j.ExecuteRepo(ctx, "cresta", "gitops"))
+	require.Empty(t, client.deleted)
+}
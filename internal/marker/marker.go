@@ -0,0 +1,215 @@
+package marker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	ActionAutoApprove = "auto-approve"
+	ActionAutoMerge   = "auto-merge"
+)
+
+const (
+	linePrefix       = "gitops-autobot:"
+	signedLinePrefix = linePrefix + " signed-actions="
+)
+
+// Marker is what the autobot asks reviewers and mergers to do with one specific commit of a branch
+type Marker struct {
+	// Repository is owner/name
+	Repository string
+	Branch     string
+	HeadOID    string
+	Actions    []string
+}
+
+func (m Marker) payload() []byte {
+	actions := append([]string(nil), m.Actions...)
+	sort.Strings(actions)
+	return []byte(strings.Join([]string{
+		"v1",
+		strings.ToLower(m.Repository),
+		m.Branch,
+		strings.ToLower(m.HeadOID),
+		strings.Join(actions, ","),
+	}, "\n"))
+}
+
+const changeMakerLinePrefix = linePrefix + " change-maker="
+
+// ChangeMakerLine records, in a commit message or PR body, which per repo change maker made the change
+func ChangeMakerLine(name string) string {
+	return changeMakerLinePrefix + name
+}
+
+// ChangeMaker is the change maker recorded by ChangeMakerLine in msg, or empty if there is none
+func ChangeMaker(msg string) string {
+	for _, line := range strings.Split(msg, "\n") {
+		if trimmed := strings.TrimSpace(line); strings.HasPrefix(trimmed, changeMakerLinePrefix) {
+			return strings.TrimPrefix(trimmed, changeMakerLinePrefix)
+		}
+	}
+	return ""
+}
+
+const changeIDLinePrefix = linePrefix + " change "
+
+// ChangeID identifies one change to one file, so a change humans declined can be recognised when it is made again
+type ChangeID struct {
+	File string `json:"file"`
+	// Name is what was upgraded inside File, such as a chart name, if the change maker knows
+	Name string `json:"name,omitempty"`
+	// Version is what Name was upgraded to, if the change maker knows
+	Version string `json:"version,omitempty"`
+	// ContentHash is the git blob hash of the new content of File, for changes without a version
+	ContentHash string `json:"contentHash,omitempty"`
+}
+
+// ChangeIDLine records id in a commit message or PR body
+func ChangeIDLine(id ChangeID) string {
+	v := url.Values{}
+	v.Set("file", id.File)
+	for key, value := range map[string]string{"name": id.Name, "version": id.Version, "content": id.ContentHash} {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	return changeIDLinePrefix + v.Encode()
+}
+
+// ChangeIDs are every change recorded by ChangeIDLine in msg
+func ChangeIDs(msg string) []ChangeID {
+	var ret []ChangeID
+	for _, line := range strings.Split(msg, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, changeIDLinePrefix) {
+			continue
+		}
+		v, err := url.ParseQuery(strings.TrimPrefix(trimmed, changeIDLinePrefix))
+		if err != nil || v.Get("file") == "" {
+			continue
+		}
+		ret = append(ret, ChangeID{
+			File:        v.Get("file"),
+			Name:        v.Get("name"),
+			Version:     v.Get("version"),
+			ContentHash: v.Get("content"),
+		})
+	}
+	return ret
+}
+
+// RequestedActions returns the actions of unsigned "gitops-autobot: auto-merge=true" style lines in msg
+func RequestedActions(msg string) []string {
+	var ret []string
+	for _, line := range strings.Split(msg, "\n") {
+		for _, action := range []string{ActionAutoApprove, ActionAutoMerge} {
+			if strings.TrimSpace(line) == linePrefix+" "+action+"=true" {
+				ret = append(ret, action)
+			}
+		}
+	}
+	return ret
+}
+
+// HasRequestedAction is true if msg has an unsigned marker line for action
+func HasRequestedAction(msg string, action string) bool {
+	for _, a := range RequestedActions(msg) {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// HasMarker is true if msg has any "gitops-autobot:" marker line, signed or not
+func HasMarker(msg string) bool {
+	for _, line := range strings.Split(msg, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), linePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// StripMarkers removes every unsigned and signed marker line from msg
+func StripMarkers(msg string) string {
+	lines := strings.Split(msg, "\n")
+	ret := make([]string, 0, len(lines))
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, signedLinePrefix) || len(RequestedActions(trimmed)) != 0 {
+			continue
+		}
+		ret = append(ret, line)
+	}
+	return strings.TrimSpace(strings.Join(ret, "\n"))
+}
+
+// Signer creates and verifies HMAC signed markers, so only the autobot can ask for auto approval or auto merge
+type Signer struct {
+	Key []byte
+}
+
+func (s *Signer) signature(m Marker) string {
+	mac := hmac.New(sha256.New, s.Key)
+	_, _ = mac.Write(m.payload())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the marker line to put into a PR body
+func (s *Signer) Sign(m Marker) string {
+	actions := append([]string(nil), m.Actions...)
+	sort.Strings(actions)
+	return fmt.Sprintf("%s%s head=%s signature=%s", signedLinePrefix, strings.Join(actions, ","), m.HeadOID, s.signature(m))
+}
+
+// VerifiedActions returns the actions of every marker line in body whose signature is valid for this exact repository,
+// branch and head commit
+func (s *Signer) VerifiedActions(body string, repository string, branch string, headOID string) []string {
+	var ret []string
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, signedLinePrefix) {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(trimmed, linePrefix))
+		values := make(map[string]string, len(fields))
+		for _, f := range fields {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) == 2 {
+				values[parts[0]] = parts[1]
+			}
+		}
+		if !strings.EqualFold(values["head"], headOID) {
+			continue
+		}
+		m := Marker{
+			Repository: repository,
+			Branch:     branch,
+			HeadOID:    headOID,
+			Actions:    strings.Split(values["signed-actions"], ","),
+		}
+		if !hmac.Equal([]byte(s.signature(m)), []byte(strings.ToLower(values["signature"]))) {
+			continue
+		}
+		ret = append(ret, m.Actions...)
+	}
+	return ret
+}
+
+// HasVerifiedAction is true if body has a valid signed marker asking for action
+func (s *Signer) HasVerifiedAction(body string, repository string, branch string, headOID string, action string) bool {
+	for _, a := range s.VerifiedActions(body, repository, branch, headOID) {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package marker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner(t *testing.T) {
+	s := &Signer{Key: []byte("sekret")}
+	m := Marker{
+		Repository: "cresta/gitops",
+		Branch:     "filechange_values.yaml",
+		HeadOID:    "0123456789abcdef0123456789abcdef01234567",
+		Actions:    []string{ActionAutoMerge, ActionAutoApprove},
+	}
+	body := "Deploying new helm version\n\n" + s.Sign(m)
+	require.Equal(t, []string{ActionAutoApprove, ActionAutoMerge}, s.VerifiedActions(body, "Cresta/gitops", m.Branch, m.HeadOID))
+	require.True(t, s.HasVerifiedAction(body, m.Repository, m.Branch, m.HeadOID, ActionAutoMerge))
+
+	require.Empty(t, s.VerifiedActions(body, m.Repository, m.Branch, "1123456789abcdef0123456789abcdef01234567"), "new commits invalidate the marker")
+	require.Empty(t, s.VerifiedActions(body, m.Repository, "other-branch", m.HeadOID))
+	require.Empty(t, s.VerifiedActions(body, "cresta/other", m.Branch, m.HeadOID))
+	require.Empty(t, (&Signer{Key: []byte("other")}).VerifiedActions(body, m.Repository, m.Branch, m.HeadOID))
+
+	m.Actions = []string{ActionAutoApprove}
+	tampered := "gitops-autobot: signed-actions=auto-approve,auto-merge head=" + m.HeadOID + " signature=" + s.signature(m)
+	require.Empty(t, s.VerifiedActions(tampered, m.Repository, m.Branch, m.HeadOID), "actions cannot be added to a signature")
+}
+
+func TestRequestedActions(t *testing.T) {
+	msg := "title\n\nbody\ngitops-autobot: auto-approve=true\n\n  gitops-autobot: auto-merge=true  \n"
+	require.Equal(t, []string{ActionAutoApprove, ActionAutoMerge}, RequestedActions(msg))
+	require.Equal(t, "title\n\nbody", StripMarkers(msg))
+	require.True(t, HasMarker(msg))
+	require.False(t, HasMarker("title\n\nmentions gitops-autobot: in prose"))
+}
+
+func TestChangeMaker(t *testing.T) {
+	msg := "title\n\nbody\n" + ChangeMakerLine("helm") + "\ngitops-autobot: auto-merge=true\n"
+	require.Equal(t, "helm", ChangeMaker(msg))
+	require.Equal(t, "", ChangeMaker("title\n\nbody"))
+}
+
+func TestChangeIDs(t *testing.T) {
+	chart := ChangeID{File: "apps/my values.yaml", Name: "nginx", Version: "3.0.0"}
+	content := ChangeID{File: "time.txt", ContentHash: "0123456789abcdef0123456789abcdef01234567"}
+	msg := "title\n\nbody\n" + ChangeIDLine(chart) + "\n" + ChangeIDLine(content) + "\n" + ChangeMakerLine("helm") + "\n"
+	require.Equal(t, []ChangeID{chart, content}, ChangeIDs(msg))
+	require.Empty(t, ChangeIDs("title\n\ngitops-autobot: change name=nginx"))
+}
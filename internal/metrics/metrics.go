@@ -0,0 +1,117 @@
+// Package metrics holds the Prometheus metrics of gitops-autobot, which Handler serves
+package metrics
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gitops_autobot"
+
+var registry = prometheus.NewRegistry()
+
+var factory = promauto.With(registry)
+
+var (
+	// CycleDuration is how long full iterations take
+	CycleDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cycle_duration_seconds",
+		Help:      "How long full iterations over every repository take",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	// Cycles counts full iterations by result
+	Cycles = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cycles_total",
+		Help:      "Full iterations over every repository, by result",
+	}, []string{"result"})
+	// RepoPhases counts how each phase of a full iteration went for each repository
+	RepoPhases = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "repo_phases_total",
+		Help:      "Phases of full iterations (create, review, merge, cleanup) run on a checkout (owner/name:branch), by result",
+	}, []string{"repo", "phase", "result"})
+	// ChangeMakerRuns counts how each change maker of each repository went
+	ChangeMakerRuns = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "change_maker_runs_total",
+		Help:      "Change makers run on a checkout (owner/name:branch), by result",
+	}, []string{"repo", "change_maker", "result"})
+	// PullRequests counts pull requests created, approved, merged, set to auto merge or enqueued
+	PullRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pull_requests_total",
+		Help:      "Pull requests created, approved, merged, set to auto merge or added to a merge queue",
+	}, []string{"repo", "action"})
+	// PullRequestsSkipped counts pull requests left alone when they could have been approved or merged
+	PullRequestsSkipped = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pull_requests_skipped_total",
+		Help:      "Pull requests not approved or merged, by reason",
+	}, []string{"repo", "action", "reason"})
+	// GithubAPICalls counts calls to GitHub by client, method and result
+	GithubAPICalls = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "github_api_calls_total",
+		Help:      "Calls to the GitHub API, by client, method and result",
+	}, []string{"client", "method", "result"})
+	// CacheRequests counts cache lookups by cache and result
+	CacheRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Cache lookups, by cache and result (hit or miss)",
+	}, []string{"cache", "result"})
+	// HelmIndexFetchDuration is how long loading helm repository indexes takes
+	HelmIndexFetchDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "helm_index_fetch_duration_seconds",
+		Help:      "How long loading a helm repository index takes, by URL scheme and result",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"scheme", "result"})
+)
+
+// Actions of PullRequests and PullRequestsSkipped
+const (
+	ActionCreate  = "create"
+	ActionApprove = "approve"
+	ActionMerge   = "merge"
+	// ActionAutoMerge is enabling GitHub auto merge, and ActionEnqueue adding to a merge queue
+	ActionAutoMerge = "auto_merge"
+	ActionEnqueue   = "enqueue"
+)
+
+func init() {
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Handler serves every metric in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Result is the result label for err: success or error
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// Reason drops the details in parentheses at the end of a decision reason, so reasons make few series
+func Reason(reason string) string {
+	if idx := strings.Index(reason, " ("); idx != -1 {
+		return reason[:idx]
+	}
+	return reason
+}
+
+// Skipped counts a pull request of repo that action was not taken on, and why
+func Skipped(repo string, action string, reason string) {
+	PullRequestsSkipped.WithLabelValues(repo, action, Reason(reason)).Inc()
+}
@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReason(t *testing.T) {
+	require.Equal(t, "status state not success", Reason("status state not success (PENDING)"))
+	require.Equal(t, "ignoring draft PR", Reason("ignoring draft PR"))
+}
+
+func TestResult(t *testing.T) {
+	require.Equal(t, "success", Result(nil))
+	require.Equal(t, "error", Result(errors.New("bad")))
+}
+
+func TestHandler(t *testing.T) {
+	Skipped("cresta/test", ActionMerge, "checks not success (FAILURE)")
+	require.Equal(t, float64(1), testutil.ToFloat64(PullRequestsSkipped.WithLabelValues("cresta/test", ActionMerge, "checks not success")))
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.Contains(t, rec.Body.String(), `gitops_autobot_pull_requests_skipped_total{action="merge",reason="checks not success",repo="cresta/test"} 1`)
+}
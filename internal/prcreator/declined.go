@@ -0,0 +1,92 @@
+package prcreator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cresta/gitops-autobot/internal/checkout"
+	"github.com/cresta/gitops-autobot/internal/declined"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"go.uber.org/zap"
+)
+
+// recordDeclined remembers the changes of autobot PRs that a human closed without merging, so they are not made again.
+// PRs autobot closed itself, to recreate or because they are obsolete, are not declined.  The branch of a declined PR
+// is deleted, so later versions of the change get a new PR on it.
+func (p *PrCreator) recordDeclined(ctx context.Context, repo checkout.RepoConfig) error {
+	p.Logger.Debug(ctx, "+PrCreator.recordDeclined")
+	defer p.Logger.Debug(ctx, "-PrCreator.recordDeclined")
+	if p.Declined == nil {
+		return nil
+	}
+	prs, err := p.Client.RecentlyClosedPullRequests(ctx, repo.RemoteOwner(), repo.RemoteName())
+	if err != nil {
+		return fmt.Errorf("unable to list closed pull requests: %w", err)
+	}
+	for _, pr := range prs.Repository.PullRequests.Nodes {
+		changeMaker := marker.ChangeMaker(string(pr.Body))
+		changes := marker.ChangeIDs(string(pr.Body))
+		if changeMaker == "" || len(changes) == 0 || !p.authoredByAutobot(pr.Author.Bot.ID, pr.Author.User.ID) {
+			continue
+		}
+		if closedBy := pr.ClosedBy(); closedBy == "" || closedBy == string(pr.Author.Login) {
+			continue
+		}
+		if p.Declined.Get(repo.RemoteOwner(), repo.RemoteName(), int(pr.Number)) != nil {
+			continue
+		}
+		// Deleted before the record is added, so a failure is tried again next time
+		if err := p.deleteDeclinedBranch(ctx, repo, int(pr.Number), string(pr.HeadRefName)); err != nil {
+			return err
+		}
+		r := declined.Record{
+			Number:      int(pr.Number),
+			Branch:      string(pr.HeadRefName),
+			ChangeMaker: changeMaker,
+			Changes:     changes,
+		}
+		if id, ok := pr.ID.(string); ok {
+			r.ID = id
+		}
+		if pr.ClosedAt != nil {
+			r.ClosedAt = pr.ClosedAt.Time
+		}
+		added, err := p.Declined.Add(repo.RemoteOwner(), repo.RemoteName(), r)
+		if err != nil {
+			return fmt.Errorf("unable to record declined #%d: %w", pr.Number, err)
+		}
+		if added {
+			p.Logger.Info(ctx, "remembering declined change", zap.Int("pr", r.Number), zap.String("change_maker", changeMaker), zap.String("closed_by", pr.ClosedBy()))
+		}
+	}
+	return nil
+}
+
+// deleteDeclinedBranch deletes the branch of declined PR number, unless it is gone or another PR is open from it
+func (p *PrCreator) deleteDeclinedBranch(ctx context.Context, repo checkout.RepoConfig, number int, branch string) error {
+	exists, err := p.Client.DoesBranchExist(ctx, repo.RemoteOwner(), repo.RemoteName(), branch)
+	if err != nil {
+		return fmt.Errorf("unable to check branch of declined #%d: %w", number, err)
+	}
+	if !exists {
+		return nil
+	}
+	prs, err := p.Client.EveryOpenPullRequest(ctx, repo.RemoteOwner(), repo.RemoteName(), ghapp.PRFilterFromConfig(p.AutobotConfig))
+	if err != nil {
+		return fmt.Errorf("cannot list every pr: %w", err)
+	}
+	for _, pr := range prs.Repository.PullRequests.Nodes {
+		if string(pr.HeadRefName) == branch && !bool(pr.IsCrossRepository) {
+			return nil
+		}
+	}
+	if p.Plan != nil {
+		return p.planf("%s/%s#%d: would delete branch %s of declined PR", repo.RemoteOwner(), repo.RemoteName(), number, branch)
+	}
+	p.Logger.Info(ctx, "deleting branch of declined PR", zap.Int("pr", number), zap.String("branch", branch))
+	if err := p.Client.DeleteBranch(ctx, repo.RemoteOwner(), repo.RemoteName(), branch); err != nil {
+		return fmt.Errorf("unable to delete branch of declined #%d: %w", number, err)
+	}
+	return nil
+}
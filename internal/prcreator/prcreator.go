@@ -3,12 +3,17 @@ package prcreator
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
 	"github.com/cresta/gitops-autobot/internal/changemaker"
 	"github.com/cresta/gitops-autobot/internal/checkout"
+	"github.com/cresta/gitops-autobot/internal/declined"
+	"github.com/cresta/gitops-autobot/internal/forge"
 	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
 	"github.com/cresta/zapctx"
+	"go.uber.org/multierr"
 )
 
 type PrCreator struct {
@@ -17,43 +22,208 @@ type PrCreator struct {
 	Logger        *zapctx.Logger
 	GitCommitter  changemaker.GitCommitter
 	Client        ghapp.GithubAPI
+	MarkerSigner  *marker.Signer
+	// Plan, if set, turns on plan mode: the branches that would be pushed are described here and nothing is pushed
+	Plan io.Writer
+	// RepoConfigOverride, if set, is used instead of the .gitops-autobot file of the checkout.  Useful to plan what a new
+	// config would do.
+	RepoConfigOverride *autobotcfg.AutobotPerRepoConfig
+	// PRMaker, if set, limits updating and closing PRs to the ones it authored
+	PRMaker *ghapp.UserInfo
+	// Declined, if set, is where changes humans declined are remembered, so change makers do not make them again
+	Declined *declined.Store
+	// Forges are the forges other than GitHub, by name.  Branches of repositories hosted on them are pushed there.
+	Forges map[string]forge.Forge
+}
+
+// forgeFor is the forge repo is pushed to, or nil for GitHub, which is pushed to with Client
+func (p *PrCreator) forgeFor(repo checkout.RepoConfig) (forge.Forge, error) {
+	if repo.ForgeName() == autobotcfg.ForgeGitHub {
+		return nil, nil
+	}
+	f, exists := p.Forges[repo.ForgeName()]
+	if !exists {
+		return nil, fmt.Errorf("no client for forge %s", repo.ForgeName())
+	}
+	return f, nil
+}
+
+func (p *PrCreator) pushOptions() checkout.PushOptions {
+	return checkout.PushOptions{
+		MarkerSigner: p.MarkerSigner,
+		PRFilter:     ghapp.PRFilterFromConfig(p.AutobotConfig),
+	}
+}
+
+// ChangeMakerResult is how one change maker of a repository did
+type ChangeMakerResult struct {
+	Name string
+	Err  error
+}
+
+// RepoResult is how PR creation for one checkout went
+type RepoResult struct {
+	Repo string
+	// Config is the per repository config the change makers ran with, or nil if it was not loaded
+	Config *autobotcfg.AutobotPerRepoConfig
+	// Err is set if the repository failed before, or in between, its change makers
+	Err          error
+	ChangeMakers []ChangeMakerResult
+}
+
+// Error combines every failure of the repository, or is nil if there were none
+func (r *RepoResult) Error() error {
+	errs := []error{r.Err}
+	for _, cm := range r.ChangeMakers {
+		if cm.Err != nil {
+			errs = append(errs, fmt.Errorf("change maker %s: %w", cm.Name, cm.Err))
+		}
+	}
+	return multierr.Combine(errs...)
 }
 
 func (p *PrCreator) Execute(ctx context.Context, checkout *checkout.Checkout) error {
-	p.Logger.Debug(ctx, "+PrCreator.Execute")
-	defer p.Logger.Debug(ctx, "-PrCreator.Execute")
+	result := p.ExecuteRepo(ctx, checkout)
+	return result.Error()
+}
+
+// ExecuteRepo runs every change maker of the checkout.  A failing change maker does not stop the ones after it.
+func (p *PrCreator) ExecuteRepo(ctx context.Context, checkout *checkout.Checkout) *RepoResult {
+	p.Logger.Debug(ctx, "+PrCreator.ExecuteRepo")
+	defer p.Logger.Debug(ctx, "-PrCreator.ExecuteRepo")
+	return p.executeRepo(ctx, checkout, "")
+}
+
+// ExecuteChangeMaker is ExecuteRepo for only the change maker named changeMaker.  Pull requests of the other change
+// makers are left alone.
+func (p *PrCreator) ExecuteChangeMaker(ctx context.Context, checkout *checkout.Checkout, changeMaker string) *RepoResult {
+	p.Logger.Debug(ctx, "+PrCreator.ExecuteChangeMaker")
+	defer p.Logger.Debug(ctx, "-PrCreator.ExecuteChangeMaker")
+	return p.executeRepo(ctx, checkout, changeMaker)
+}
+
+// executeRepo runs the change maker named only, or every one if only is empty
+func (p *PrCreator) executeRepo(ctx context.Context, checkout *checkout.Checkout, only string) *RepoResult {
+	ret := &RepoResult{
+		Repo: checkout.RepoConfig.String(),
+	}
 	if err := checkout.Refresh(ctx); err != nil {
-		return fmt.Errorf("unable to refresh repo: %w", err)
+		ret.Err = fmt.Errorf("unable to refresh repo: %w", err)
+		return ret
 	}
 	if err := checkout.Clean(ctx); err != nil {
-		return fmt.Errorf("unable to clean repo: %w", err)
+		ret.Err = fmt.Errorf("unable to clean repo: %w", err)
+		return ret
 	}
 	cfg, err := checkout.CurrentConfig(ctx)
 	if err != nil {
-		return fmt.Errorf("unable to get current config: %w", err)
+		ret.Err = fmt.Errorf("unable to get current config: %w", err)
+		return ret
+	}
+	if p.RepoConfigOverride != nil {
+		cfg = p.RepoConfigOverride
 	}
 	if cfg == nil {
 		p.Logger.Debug(ctx, "no config for this repo")
-		return nil
+		return ret
 	}
-	changers, err2 := p.F.Load(p.AutobotConfig.ChangeMakers, *cfg)
-	if err2 != nil {
-		return fmt.Errorf("unable to load changers: %w", err2)
+	ret.Config = cfg
+	f, err := p.forgeFor(checkout.RepoConfig)
+	if err != nil {
+		ret.Err = err
+		return ret
+	}
+	// Closed merge requests are only looked for on GitHub
+	if f == nil {
+		if err := p.recordDeclined(ctx, checkout.RepoConfig); err != nil {
+			// Running change makers now could propose a change that was just declined
+			ret.Err = fmt.Errorf("unable to record declined changes: %w", err)
+			return ret
+		}
 	}
-	for _, c := range changers {
+	// made are the branches change makers made this run, and ran the change makers that fully ran, so PRs that are no
+	// longer made can be found
+	made := make(map[string]bool)
+	ran := make(map[string]bool)
+	failed := make(map[string]bool)
+	for _, c := range p.F.LoadNamed(p.AutobotConfig.ChangeMakers, *cfg) {
+		if only != "" && c.Name != only {
+			continue
+		}
+		if c.Err != nil {
+			failed[c.Name] = true
+			ret.ChangeMakers = append(ret.ChangeMakers, ChangeMakerResult{
+				Name: c.Name,
+				Err:  fmt.Errorf("unable to load changer: %w", c.Err),
+			})
+			continue
+		}
+		// A checkout we cannot clean would leak one change maker's branches into the next, so give up on the repo
 		if err := checkout.Clean(ctx); err != nil {
-			return fmt.Errorf("unable to clean repo: %w", err)
+			ret.Err = fmt.Errorf("unable to clean repo: %w", err)
+			return ret
+		}
+		if skipper, ok := c.Changer.(changemaker.DeclinedSkipper); ok && p.Declined != nil {
+			skipper.SkipDeclined(p.Declined.For(checkout.RepoConfig.RemoteOwner(), checkout.RepoConfig.RemoteName(), c.Name))
 		}
-		wt, obj, err := checkout.SetupForWorkingTreeChanger(ctx)
+		branches, err := p.runChanger(ctx, checkout, f, c.Changer)
 		if err != nil {
-			return fmt.Errorf("unable to setup working tree: %w", err)
+			failed[c.Name] = true
+		}
+		ran[c.Name] = true
+		for _, b := range branches {
+			made[b] = true
+		}
+		ret.ChangeMakers = append(ret.ChangeMakers, ChangeMakerResult{
+			Name: c.Name,
+			Err:  err,
+		})
+	}
+	for name := range failed {
+		delete(ran, name)
+	}
+	if f != nil {
+		// Updating and closing obsolete merge requests is only done on GitHub
+		return ret
+	}
+	if err := p.reconcilePullRequests(ctx, checkout.RepoConfig, cfg, made, ran); err != nil {
+		ret.Err = fmt.Errorf("unable to reconcile pull requests: %w", err)
+	}
+	return ret
+}
+
+// runChanger runs one change maker, returning the branches it made.  They are pushed to f, or to GitHub if f is nil.
+func (p *PrCreator) runChanger(ctx context.Context, checkout *checkout.Checkout, f forge.Forge, c changemaker.WorkingTreeChanger) ([]string, error) {
+	wt, obj, err := checkout.SetupForWorkingTreeChanger(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to setup working tree: %w", err)
+	}
+	if err := c.ChangeWorkingTree(wt, obj, p.GitCommitter, checkout.CheckoutDirectory); err != nil {
+		return nil, fmt.Errorf("unable to change working tree: %w", err)
+	}
+	branches, err := checkout.NewBranches()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list new branches: %w", err)
+	}
+	if p.Plan != nil {
+		if f != nil {
+			err = checkout.WritePlan(ctx, f, p.Plan)
+		} else {
+			err = checkout.WritePlan(ctx, p.Client, p.Plan)
 		}
-		if err := c.ChangeWorkingTree(wt, obj, p.GitCommitter, checkout.CheckoutDirectory); err != nil {
-			return fmt.Errorf("unable to change working tree: %w", err)
+		if err != nil {
+			return branches, fmt.Errorf("unable to write plan: %w", err)
 		}
-		if err := checkout.PushAllNewBranches(ctx, p.Client); err != nil {
-			return fmt.Errorf("unable to push new branches: %w", err)
+		return branches, nil
+	}
+	if f != nil {
+		if err := checkout.PushNewBranchesToForge(ctx, f, p.pushOptions()); err != nil {
+			return branches, fmt.Errorf("unable to push new branches: %w", err)
 		}
+		return branches, nil
+	}
+	if err := checkout.PushAllNewBranches(ctx, p.Client, p.pushOptions()); err != nil {
+		return branches, fmt.Errorf("unable to push new branches: %w", err)
 	}
-	return nil
+	return branches, nil
 }
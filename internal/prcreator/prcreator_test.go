@@ -21,10 +21,13 @@ import (
 	"github.com/cresta/gitops-autobot/internal/changemaker"
 	"github.com/cresta/gitops-autobot/internal/changemaker/filecontentchangemaker/timechangemaker"
 	"github.com/cresta/gitops-autobot/internal/checkout"
+	"github.com/cresta/gitops-autobot/internal/declined"
 	"github.com/cresta/gitops-autobot/internal/ghapp"
 	"github.com/cresta/gitops-autobot/internal/ghapp/cachedgithub"
 	"github.com/cresta/gitops-autobot/internal/ghapp/githubdirect"
+	"github.com/cresta/gitops-autobot/internal/marker"
 	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/shurcooL/githubv4"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
@@ -114,3 +117,135 @@ func TestPrCreator_Execute(t *testing.T) {
 		require.NoError(t, pr.Execute(ctx, co))
 	}
 }
+
+// fakeClient implements only what reconciling pull requests uses
+type fakeClient struct {
+	ghapp.GithubAPI
+	prs       ghapp.GraphQLPRQuery
+	closedPRs ghapp.GraphQLClosedPRQuery
+	updated   []string
+	closed    []string
+	deleted   []string
+	branches  map[string]bool
+}
+
+func (f *fakeClient) DoesBranchExist(_ context.Context, _ string, _ string, branch string) (bool, error) {
+	return f.branches[branch], nil
+}
+
+func (f *fakeClient) EveryOpenPullRequest(_ context.Context, _ string, _ string, _ ghapp.PRFilter) (*ghapp.GraphQLPRQuery, error) {
+	return &f.prs, nil
+}
+
+func (f *fakeClient) UpdatePullRequestBranch(_ context.Context, _ string, _ string, in githubv4.UpdatePullRequestBranchInput) (*ghapp.UpdatePullRequestBranchOutput, error) {
+	f.updated = append(f.updated, in.PullRequestID.(string))
+	return &ghapp.UpdatePullRequestBranchOutput{}, nil
+}
+
+func (f *fakeClient) AddComment(_ context.Context, _ string, _ string, _ githubv4.AddCommentInput) (*ghapp.AddCommentOutput, error) {
+	return &ghapp.AddCommentOutput{}, nil
+}
+
+func (f *fakeClient) ClosePullRequest(_ context.Context, _ string, _ string, in githubv4.ClosePullRequestInput) (*ghapp.ClosePullRequestOutput, error) {
+	f.closed = append(f.closed, in.PullRequestID.(string))
+	return &ghapp.ClosePullRequestOutput{}, nil
+}
+
+func (f *fakeClient) DeleteBranch(_ context.Context, _ string, _ string, ref string) error {
+	f.deleted = append(f.deleted, ref)
+	return nil
+}
+
+func TestPrCreator_reconcilePullRequests(t *testing.T) {
+	pr := func(number int, id string, branch string, changeMaker string, mergeable githubv4.MergeableState, state ghapp.MergeStateStatus) ghapp.GraphQLPRQueryNode {
+		var ret ghapp.GraphQLPRQueryNode
+		ret.Number = githubv4.Int(number)
+		ret.ID = id
+		ret.HeadRefName = githubv4.String(branch)
+		ret.Body = githubv4.String("Upgrade\n\n" + marker.ChangeMakerLine(changeMaker))
+		ret.Mergeable = mergeable
+		ret.MergeStateStatus = state
+		ret.Author.Bot.ID = "bot"
+		return ret
+	}
+	client := &fakeClient{}
+	client.prs.Repository.PullRequests.Nodes = []ghapp.GraphQLPRQueryNode{
+		pr(1, "behind", "filechange_a", "helm", githubv4.MergeableStateMergeable, ghapp.MergeStateStatusBehind),
+		pr(2, "obsolete", "filechange_b", "helm", githubv4.MergeableStateConflicting, ghapp.MergeStateStatusDirty),
+		pr(3, "still-made", "filechange_c", "helm", githubv4.MergeableStateConflicting, ghapp.MergeStateStatusDirty),
+		pr(4, "failed-maker", "filechange_d", "image", githubv4.MergeableStateConflicting, ghapp.MergeStateStatusDirty),
+		pr(5, "not-ours", "filechange_e", "", githubv4.MergeableStateMergeable, ghapp.MergeStateStatusBehind),
+	}
+	p := PrCreator{
+		AutobotConfig: &autobotcfg.AutobotConfig{},
+		Logger:        testhelp.ZapTestingLogger(t),
+		Client:        client,
+		PRMaker:       &ghapp.UserInfo{ID: "bot"},
+	}
+	repo := autobotcfg.RepoConfig{Owner: "cresta", Name: "gitops", Branch: "master"}
+	made := map[string]bool{"filechange_c": true}
+	ran := map[string]bool{"helm": true}
+	require.NoError(t, p.reconcilePullRequests(context.Background(), repo, &autobotcfg.AutobotPerRepoConfig{}, made, ran))
+	require.Equal(t, []string{"behind"}, client.updated)
+	require.Equal(t, []string{"obsolete"}, client.closed)
+	require.Equal(t, []string{"filechange_b"}, client.deleted)
+
+	var plan bytes.Buffer
+	p.Plan = &plan
+	client.updated, client.closed, client.deleted = nil, nil, nil
+	require.NoError(t, p.reconcilePullRequests(context.Background(), repo, &autobotcfg.AutobotPerRepoConfig{}, made, ran))
+	require.Empty(t, client.updated)
+	require.Empty(t, client.closed)
+	require.Contains(t, plan.String(), "cresta/gitops#1: would update branch with")
+	require.Contains(t, plan.String(), "cresta/gitops#2: would close: conflicts and helm no longer makes it")
+}
+
+func (f *fakeClient) RecentlyClosedPullRequests(_ context.Context, _ string, _ string) (*ghapp.GraphQLClosedPRQuery, error) {
+	return &f.closedPRs, nil
+}
+
+func TestPrCreator_recordDeclined(t *testing.T) {
+	change := marker.ChangeID{File: "values.yaml", Name: "nginx", Version: "3.0.0"}
+	pr := func(number int, author string, closedBy string, body string) ghapp.GraphQLClosedPullRequest {
+		var ret ghapp.GraphQLClosedPullRequest
+		ret.Number = githubv4.Int(number)
+		ret.ID = "PR_" + author
+		ret.HeadRefName = "filechange_values.yaml"
+		ret.Body = githubv4.String(body)
+		ret.Author.Login = githubv4.String(author)
+		ret.Author.Bot.ID = author
+		var closed ghapp.GraphQLClosedEvent
+		closed.ClosedEvent.Actor.Login = githubv4.String(closedBy)
+		ret.TimelineItems.Nodes = []ghapp.GraphQLClosedEvent{closed}
+		return ret
+	}
+	body := "Deploying new helm version\n\n" + marker.ChangeIDLine(change) + "\n" + marker.ChangeMakerLine("helm")
+	client := &fakeClient{branches: map[string]bool{"filechange_values.yaml": true}}
+	client.closedPRs.Repository.PullRequests.Nodes = []ghapp.GraphQLClosedPullRequest{
+		pr(1, "bot", "jack", body),
+		pr(2, "bot", "bot", body),
+		pr(3, "jill", "jack", body),
+		pr(4, "bot", "jack", "Deploying new helm version"),
+	}
+	store, err := declined.Load("")
+	require.NoError(t, err)
+	p := PrCreator{
+		AutobotConfig: &autobotcfg.AutobotConfig{},
+		Logger:        testhelp.ZapTestingLogger(t),
+		Client:        client,
+		PRMaker:       &ghapp.UserInfo{ID: "bot"},
+		Declined:      store,
+	}
+	repo := autobotcfg.RepoConfig{Owner: "cresta", Name: "gitops", Branch: "master"}
+	require.NoError(t, p.recordDeclined(context.Background(), repo))
+	require.True(t, store.For("cresta", "gitops", "helm").IsDeclined(change))
+	require.NotNil(t, store.Get("cresta", "gitops", 1))
+	require.Nil(t, store.Get("cresta", "gitops", 2), "PRs autobot closed itself are not declined")
+	require.Nil(t, store.Get("cresta", "gitops", 3), "PRs autobot did not make are not declined")
+	require.Nil(t, store.Get("cresta", "gitops", 4), "PRs without change identities are not declined")
+	require.Equal(t, []string{"filechange_values.yaml"}, client.deleted, "later versions get a new PR on the branch")
+
+	// Only newly declined PRs have their branch deleted
+	require.NoError(t, p.recordDeclined(context.Background(), repo))
+	require.Len(t, client.deleted, 1)
+}
@@ -0,0 +1,106 @@
+package prcreator
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/checkout"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/shurcooL/githubv4"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// reconcilePullRequests brings autobot PRs that are behind their base up to date, and closes conflicting ones that
+// their change maker no longer makes.  Conflicting or behind PRs that are still made were regenerated on the current
+// base when their branch was pushed.  made are the branches made this run, and ran the change makers that ran without
+// error.
+func (p *PrCreator) reconcilePullRequests(ctx context.Context, repo checkout.RepoConfig, cfg *autobotcfg.AutobotPerRepoConfig, made map[string]bool, ran map[string]bool) error {
+	p.Logger.Debug(ctx, "+PrCreator.reconcilePullRequests")
+	defer p.Logger.Debug(ctx, "-PrCreator.reconcilePullRequests")
+	prs, err := p.Client.EveryOpenPullRequest(ctx, repo.RemoteOwner(), repo.RemoteName(), ghapp.PRFilterFromConfig(p.AutobotConfig))
+	if err != nil {
+		return fmt.Errorf("cannot list every pr: %w", err)
+	}
+	var errs []error
+	for _, pr := range prs.Repository.PullRequests.Nodes {
+		changeMaker := marker.ChangeMaker(string(pr.Body))
+		if changeMaker == "" || !p.madeByAutobot(pr) || pr.HasLabel(cfg.HoldLabelName()) {
+			continue
+		}
+		logger := p.Logger.With(zap.Int32("pr", int32(pr.Number)), zap.String("change_maker", changeMaker))
+		switch {
+		case pr.Mergeable == githubv4.MergeableStateConflicting && ran[changeMaker] && !made[string(pr.HeadRefName)]:
+			logger.Info(ctx, "closing conflicting PR its change maker no longer makes")
+			errs = append(errs, p.closeObsolete(ctx, repo, pr, changeMaker))
+		case pr.MergeStateStatus == ghapp.MergeStateStatusBehind && pr.Mergeable == githubv4.MergeableStateMergeable && !made[string(pr.HeadRefName)]:
+			if p.MarkerSigner != nil {
+				// The merge commit GitHub would add cannot be signed, so the PR would never be approved or merged again
+				logger.Info(ctx, "leaving PR that is behind its base for its change maker to make again")
+				continue
+			}
+			logger.Info(ctx, "updating PR that is behind its base")
+			errs = append(errs, p.updateBehind(ctx, repo, pr))
+		}
+	}
+	return multierr.Combine(errs...)
+}
+
+func (p *PrCreator) madeByAutobot(pr ghapp.GraphQLPRQueryNode) bool {
+	return p.authoredByAutobot(pr.Author.Bot.ID, pr.Author.User.ID)
+}
+
+func (p *PrCreator) authoredByAutobot(botID githubv4.ID, userID githubv4.ID) bool {
+	if p.PRMaker == nil {
+		return true
+	}
+	return p.PRMaker.ID == botID || p.PRMaker.ID == userID
+}
+
+func (p *PrCreator) updateBehind(ctx context.Context, repo checkout.RepoConfig, pr ghapp.GraphQLPRQueryNode) error {
+	if p.Plan != nil {
+		return p.planf("%s/%s#%d: would update branch with %s", repo.RemoteOwner(), repo.RemoteName(), pr.Number, pr.BaseRef.Name)
+	}
+	if _, err := p.Client.UpdatePullRequestBranch(ctx, repo.RemoteOwner(), repo.RemoteName(), githubv4.UpdatePullRequestBranchInput{
+		PullRequestID:   pr.ID,
+		ExpectedHeadOid: &pr.HeadRef.Target.Oid,
+	}); err != nil {
+		return fmt.Errorf("unable to update branch of #%d: %w", pr.Number, err)
+	}
+	return nil
+}
+
+func (p *PrCreator) closeObsolete(ctx context.Context, repo checkout.RepoConfig, pr ghapp.GraphQLPRQueryNode, changeMaker string) error {
+	if p.Plan != nil {
+		return p.planf("%s/%s#%d: would close: conflicts and %s no longer makes it", repo.RemoteOwner(), repo.RemoteName(), pr.Number, changeMaker)
+	}
+	if p.Declined != nil {
+		if err := p.Declined.Ignore(repo.RemoteOwner(), repo.RemoteName(), int(pr.Number)); err != nil {
+			return fmt.Errorf("unable to remember #%d is not declined: %w", pr.Number, err)
+		}
+	}
+	if _, err := p.Client.AddComment(ctx, repo.RemoteOwner(), repo.RemoteName(), githubv4.AddCommentInput{
+		SubjectID: pr.ID,
+		Body:      githubv4.String(fmt.Sprintf("Closing: this PR conflicts with %s and change maker %s no longer makes this change", pr.BaseRef.Name, changeMaker)),
+	}); err != nil {
+		return fmt.Errorf("unable to comment on #%d: %w", pr.Number, err)
+	}
+	if _, err := p.Client.ClosePullRequest(ctx, repo.RemoteOwner(), repo.RemoteName(), githubv4.ClosePullRequestInput{
+		PullRequestID: pr.ID,
+	}); err != nil {
+		return fmt.Errorf("unable to close #%d: %w", pr.Number, err)
+	}
+	if err := p.Client.DeleteBranch(ctx, repo.RemoteOwner(), repo.RemoteName(), string(pr.HeadRefName)); err != nil {
+		return fmt.Errorf("unable to delete branch of #%d: %w", pr.Number, err)
+	}
+	return nil
+}
+
+func (p *PrCreator) planf(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(p.Plan, format+"\n", args...); err != nil {
+		return fmt.Errorf("unable to write plan: %w", err)
+	}
+	return nil
+}
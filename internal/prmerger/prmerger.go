@@ -3,11 +3,15 @@ package prmerger
 import (
 	"context"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/gate"
 	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/metrics"
 	"github.com/cresta/zapctx"
 	"github.com/shurcooL/githubv4"
 	"go.uber.org/zap"
@@ -17,75 +21,125 @@ type PRMerger struct {
 	Client        ghapp.GithubAPI
 	Logger        *zapctx.Logger
 	AutobotConfig *autobotcfg.AutobotConfig
+	// MarkerSigner, if set, means only PRs with a validly signed auto-merge marker are merged
+	MarkerSigner *marker.Signer
+	// Plan, if set, turns on plan mode: what would be merged, and why, is written here and nothing is merged
+	Plan io.Writer
+	// Now defaults to time.Now
+	Now func() time.Time
+}
+
+func (p *PRMerger) now() time.Time {
+	if p.Now == nil {
+		return time.Now()
+	}
+	return p.Now()
+}
+
+// closed returns why PRs of the repository cfg is for may not be merged now, or empty if they may
+func (p *PRMerger) closed(cfg *autobotcfg.AutobotPerRepoConfig) string {
+	var global *autobotcfg.Schedule
+	if p.AutobotConfig != nil {
+		global = p.AutobotConfig.Schedule
+	}
+	return cfg.Closed(global, p.now())
 }
 
 func (p *PRMerger) Execute(ctx context.Context) error {
 	p.Logger.Debug(ctx, "+PRMerger.Execute")
 	defer p.Logger.Debug(ctx, "-PRMerger.Execute")
-	for _, r := range p.AutobotConfig.Repos {
-		repoCfg, err := ghapp.FetchMasterConfigFile(ctx, p.Client, r)
-		if err != nil {
-			return fmt.Errorf("uanble to fetch repo content for %s: %w", r, err)
-		}
-		if !repoCfg.AllowAutoMerge {
-			p.Logger.Debug(ctx, "not allowed to auto merge")
-			continue
-		}
-		prs, err := p.Client.EveryOpenPullRequest(ctx, r.Owner, r.Name)
-		if err != nil {
-			return fmt.Errorf("cannot list every pr: %w", err)
-		}
-		for _, pr := range prs.Repository.PullRequests.Nodes {
-			if err := p.processPr(ctx, pr); err != nil {
-				return fmt.Errorf("unable to process pr: %w", err)
-			}
+	for _, r := range p.AutobotConfig.AllRepos() {
+		if err := p.executeRepo(ctx, r, ghapp.PRSelector{}); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (p *PRMerger) processPr(ctx context.Context, pr ghapp.GraphQLPRQueryNode) error {
-	return p.processPrIter(ctx, pr, 0)
+// ExecutePullRequests processes only the pull requests of owner/name that match sel
+func (p *PRMerger) ExecutePullRequests(ctx context.Context, owner string, name string, sel ghapp.PRSelector) error {
+	p.Logger.Debug(ctx, "+PRMerger.ExecutePullRequests")
+	defer p.Logger.Debug(ctx, "-PRMerger.ExecutePullRequests")
+	r := p.AutobotConfig.FindRepo(owner, name)
+	if r == nil {
+		p.Logger.Debug(ctx, "ignoring unknown repository", zap.String("owner", owner), zap.String("name", name))
+		return nil
+	}
+	return p.executeRepo(ctx, *r, sel)
 }
 
-func (p *PRMerger) processPrIter(ctx context.Context, pr ghapp.GraphQLPRQueryNode, itr int) error {
-	// Will merge a PR if all these are true
-	//   * "gitops-autobot: auto-merge=true" contained in body on line by itself (spaces trimmed)
-	//   * Not a draft
-	//   * All checks have passed
-	//   * PR is mergeable
-	logger := p.Logger.With(zap.Int32("pr", int32(pr.Number)))
-	logger.Debug(ctx, "processing pr", zap.Any("pr", pr))
-	if !p.prAskingForAutoMerge(string(pr.Body)) {
-		logger.Debug(ctx, "pr not asking for review")
-		return nil
+func (p *PRMerger) executeRepo(ctx context.Context, r autobotcfg.RepoConfig, sel ghapp.PRSelector) error {
+	repoCfg, err := ghapp.FetchMasterConfigFile(ctx, p.Client, r)
+	if err != nil {
+		return fmt.Errorf("uanble to fetch repo content for %s: %w", r, err)
 	}
-	if pr.Merged {
-		logger.Debug(ctx, "already merged!")
+	if !repoCfg.AllowAutoMerge {
+		p.Logger.Debug(ctx, "not allowed to auto merge")
+		if p.Plan != nil {
+			p.planf(ctx, "%s/%s: auto merge is not allowed", r.Owner, r.Name)
+		}
 		return nil
 	}
-	if pr.IsDraft {
-		logger.Debug(ctx, "ignoring draft PR")
-		return nil
+	prs, err := p.Client.EveryOpenPullRequest(ctx, r.Owner, r.Name, ghapp.PRFilterFromConfig(p.AutobotConfig))
+	if err != nil {
+		return fmt.Errorf("cannot list every pr: %w", err)
 	}
-	if pr.Mergeable != githubv4.MergeableStateMergeable {
-		logger.Info(ctx, "cannot merge with state not clean", zap.String("state", string(pr.Mergeable)))
+	if frozenBy := ghapp.LabelledPR(prs.Repository.PullRequests.Nodes, repoCfg.FreezeLabelName()); frozenBy != nil {
+		reason := fmt.Sprintf("frozen by the %s label on #%d", repoCfg.FreezeLabelName(), frozenBy.Number)
+		p.Logger.Info(ctx, "not merging frozen repository", zap.String("repo", r.String()), zap.String("reason", reason))
+		if p.Plan != nil {
+			p.planf(ctx, "%s/%s: would not merge: %s", r.Owner, r.Name, reason)
+			return nil
+		}
+		if !repoCfg.NativeMerge() {
+			return nil
+		}
+		for _, pr := range prs.Repository.PullRequests.Nodes {
+			if !sel.Matches(pr) {
+				continue
+			}
+			if err := p.disableAutoMerge(ctx, pr); err != nil {
+				return fmt.Errorf("unable to stop frozen pr: %w", err)
+			}
+		}
 		return nil
 	}
-	if pr.HeadRef.Target.Commit.StatusCheckRollup.State != githubv4.StatusStateSuccess {
-		logger.Debug(ctx, "status state not success", zap.String("state", string(pr.HeadRef.Target.Commit.StatusCheckRollup.State)))
-		return nil
+	for _, pr := range prs.Repository.PullRequests.Nodes {
+		if !sel.Matches(pr) {
+			continue
+		}
+		if err := p.processPr(ctx, pr, repoCfg); err != nil {
+			return fmt.Errorf("unable to process pr: %w", err)
+		}
 	}
-	if pr.ReviewDecision == githubv4.PullRequestReviewDecisionChangesRequested {
-		logger.Debug(ctx, "unable to auto merge PR with changes requested")
+	return nil
+}
+
+func (p *PRMerger) processPr(ctx context.Context, pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) error {
+	logger := p.Logger.With(zap.Int32("pr", int32(pr.Number)))
+	logger.Debug(ctx, "processing pr", zap.Any("pr", pr))
+	merge, reason := p.MergeDecision(pr, cfg)
+	logger.Debug(ctx, "merge decision", zap.Bool("merge", merge), zap.String("reason", reason))
+	if cfg.NativeMerge() {
+		return p.processNative(ctx, pr, cfg, merge, reason)
+	}
+	if p.Plan != nil {
+		if merge {
+			p.planf(ctx, "%s/%s#%d: would merge: %s", pr.Repository.Owner.Login, pr.Repository.Name, pr.Number, reason)
+		} else {
+			p.planf(ctx, "%s/%s#%d: would not merge: %s", pr.Repository.Owner.Login, pr.Repository.Name, pr.Number, reason)
+		}
 		return nil
 	}
-	if pr.ReviewDecision == githubv4.PullRequestReviewDecisionReviewRequired {
-		logger.Debug(ctx, "unable to auto merge PR with a required reviewer left")
+	if !merge {
+		metrics.Skipped(string(pr.Repository.Owner.Login)+"/"+string(pr.Repository.Name), metrics.ActionMerge, reason)
 		return nil
 	}
+	return p.mergeIter(ctx, pr, cfg, 0)
+}
 
-	method := githubv4.PullRequestMergeMethodSquash
+func (p *PRMerger) mergeIter(ctx context.Context, pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig, itr int) error {
+	method := pr.MergeMethod(cfg)
 	if _, err := p.Client.MergePullRequest(ctx, string(pr.Repository.Owner.Login), string(pr.Repository.Name), string(pr.BaseRef.Name), githubv4.MergePullRequestInput{
 		PullRequestID:   pr.ID,
 		ExpectedHeadOid: &pr.HeadRef.Target.Oid,
@@ -96,21 +150,207 @@ func (p *PRMerger) processPrIter(ctx context.Context, pr ghapp.GraphQLPRQueryNod
 			// https://github.community/t/merging-via-rest-api-returns-405-base-branch-was-modified-review-and-try-the-merge-again/13787
 			select {
 			case <-time.After(time.Second * 5):
-				return p.processPrIter(ctx, pr, itr+1)
+				return p.mergeIter(ctx, pr, cfg, itr+1)
 			case <-ctx.Done():
 				return ctx.Err()
 			}
 		}
 		return fmt.Errorf("unable to do create a merge: %w", err)
 	}
+	metrics.PullRequests.WithLabelValues(string(pr.Repository.Owner.Login)+"/"+string(pr.Repository.Name), metrics.ActionMerge).Inc()
 	return nil
 }
 
-func (p *PRMerger) prAskingForAutoMerge(msg string) bool {
-	for _, line := range strings.Split(msg, "\n") {
-		if strings.TrimSpace(line) == "gitops-autobot: auto-merge=true" {
-			return true
+// processNative leaves merging pr to GitHub.  A ready PR goes into the merge queue if its base branch requires one, and
+// is merged right away otherwise, as GitHub refuses auto merge on PRs that could merge already.  Any other PR asking
+// for merge gets auto merge enabled, which GitHub acts on, through the merge queue if there is one, once it is ready.
+func (p *PRMerger) processNative(ctx context.Context, pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig, ready bool, reason string) error {
+	owner, name := string(pr.Repository.Owner.Login), string(pr.Repository.Name)
+	repo := owner + "/" + name
+	if requested, why := gate.Decide(p.requestGates(pr, cfg), ""); !requested {
+		if p.Plan != nil {
+			p.planf(ctx, "%s#%d: would not merge: %s", repo, pr.Number, why)
+			return nil
+		}
+		metrics.Skipped(repo, metrics.ActionAutoMerge, why)
+		// Auto merge enabled earlier would otherwise still merge a PR that stopped asking for it, such as one whose
+		// signed marker no longer matches after a push.  Humans may enable auto merge on PRs that never asked us.
+		if marker.HasMarker(string(pr.Body)) || pr.HasLabel(cfg.HoldLabelName()) || p.closed(cfg) != "" {
+			return p.disableAutoMerge(ctx, pr)
+		}
+		return nil
+	}
+	state, ready, reason, err := p.nativeState(ctx, pr, ready, reason)
+	if err != nil {
+		return err
+	}
+	s := state.Repository.PullRequest
+	queued := bool(s.IsMergeQueueEnabled)
+	switch {
+	case bool(s.IsInMergeQueue):
+		p.Logger.Debug(ctx, "already in the merge queue", zap.Int32("pr", int32(pr.Number)))
+		return nil
+	case s.AutoMergeRequest != nil && !queued:
+		p.Logger.Debug(ctx, "auto merge already enabled", zap.Int32("pr", int32(pr.Number)))
+		return nil
+	case ready && queued:
+		if p.Plan != nil {
+			p.planf(ctx, "%s#%d: would add to the merge queue: %s", repo, pr.Number, reason)
+			return nil
 		}
+		if _, err := p.Client.EnqueuePullRequest(ctx, owner, name, ghapp.EnqueuePullRequestInput{
+			PullRequestID:   pr.ID,
+			ExpectedHeadOid: &pr.HeadRef.Target.Oid,
+		}); err != nil {
+			return fmt.Errorf("unable to add to the merge queue: %w", err)
+		}
+		metrics.PullRequests.WithLabelValues(repo, metrics.ActionEnqueue).Inc()
+		return nil
+	case ready:
+		if p.Plan != nil {
+			p.planf(ctx, "%s#%d: would merge: %s", repo, pr.Number, reason)
+			return nil
+		}
+		return p.mergeIter(ctx, pr, cfg, 0)
+	case s.AutoMergeRequest != nil:
+		// GitHub adds the PR to the merge queue once it is ready
+		return nil
+	}
+	method := pr.MergeMethod(cfg)
+	if p.Plan != nil {
+		p.planf(ctx, "%s#%d: would enable auto merge (%s): waiting for %s", repo, pr.Number, method, reason)
+		return nil
+	}
+	if _, err := p.Client.EnablePullRequestAutoMerge(ctx, owner, name, githubv4.EnablePullRequestAutoMergeInput{
+		PullRequestID: pr.ID,
+		MergeMethod:   &method,
+	}); err != nil {
+		return fmt.Errorf("unable to enable auto merge: %w", err)
+	}
+	metrics.PullRequests.WithLabelValues(repo, metrics.ActionAutoMerge).Inc()
+	return nil
+}
+
+// nativeState fetches how GitHub is going to merge pr.  If its base branch has a merge queue, ready and reason are
+// decided again, as the merge queue tests PRs against the latest base, so they need not be up to date.
+func (p *PRMerger) nativeState(ctx context.Context, pr ghapp.GraphQLPRQueryNode, ready bool, reason string) (*ghapp.GraphQLPRMergeStateQuery, bool, string, error) {
+	state, err := p.Client.PullRequestMergeState(ctx, string(pr.Repository.Owner.Login), string(pr.Repository.Name), int(pr.Number))
+	if err != nil {
+		return nil, false, "", fmt.Errorf("unable to get merge state: %w", err)
+	}
+	if state.Repository.PullRequest.IsMergeQueueEnabled {
+		ready, reason = gate.Decide(p.readyGates(pr, true), "mergeable and all checks passed")
+	}
+	return state, ready, reason, nil
+}
+
+// NativeMergeDecision returns if pr is going to be merged, and why, in repositories that leave merging to GitHub.  It
+// is what processNative does, which asks GitHub if pr is in the merge queue or has auto merge enabled.
+func (p *PRMerger) NativeMergeDecision(ctx context.Context, pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) (bool, string, error) {
+	if requested, why := gate.Decide(p.requestGates(pr, cfg), ""); !requested {
+		return false, why, nil
+	}
+	ready, reason := p.MergeDecision(pr, cfg)
+	state, ready, reason, err := p.nativeState(ctx, pr, ready, reason)
+	if err != nil {
+		return false, "", err
+	}
+	s := state.Repository.PullRequest
+	switch {
+	case bool(s.IsInMergeQueue):
+		return true, "in the merge queue", nil
+	case s.AutoMergeRequest != nil:
+		return true, "auto merge enabled: waiting for GitHub to merge it", nil
+	case ready && bool(s.IsMergeQueueEnabled):
+		return true, "adding to the merge queue: " + reason, nil
+	case ready:
+		return true, reason, nil
+	}
+	return true, "enabling auto merge: waiting for " + reason, nil
+}
+
+// disableAutoMerge turns off auto merge of pr if it is on, so GitHub does not merge a PR that is held, frozen or no
+// longer asking for merge
+func (p *PRMerger) disableAutoMerge(ctx context.Context, pr ghapp.GraphQLPRQueryNode) error {
+	owner, name := string(pr.Repository.Owner.Login), string(pr.Repository.Name)
+	state, err := p.Client.PullRequestMergeState(ctx, owner, name, int(pr.Number))
+	if err != nil {
+		return fmt.Errorf("unable to get merge state: %w", err)
+	}
+	if state.Repository.PullRequest.AutoMergeRequest == nil {
+		return nil
+	}
+	p.Logger.Info(ctx, "disabling auto merge of pr no longer to be merged", zap.Int32("pr", int32(pr.Number)))
+	if _, err := p.Client.DisablePullRequestAutoMerge(ctx, owner, name, githubv4.DisablePullRequestAutoMergeInput{
+		PullRequestID: pr.ID,
+	}); err != nil {
+		return fmt.Errorf("unable to disable auto merge: %w", err)
+	}
+	return nil
+}
+
+// MergeDecision returns if pr should be merged, and why.  If not, the reason is the first condition that failed.
+func (p *PRMerger) MergeDecision(pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) (bool, string) {
+	return gate.Decide(p.MergeGates(pr, cfg), "asking for merge, mergeable and all checks passed")
+}
+
+// MergeGates returns every condition pr has to meet to be merged, in the order they are checked
+func (p *PRMerger) MergeGates(pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) []gate.Gate {
+	// Will merge a PR if all these are true
+	//   * The repository allows auto merge
+	//   * Not on hold
+	//   * Not frozen, and inside the schedule
+	//   * "gitops-autobot: auto-merge=true" contained in body on line by itself (spaces trimmed), or a signed marker
+	//     for the head commit if markers are signed
+	//   * Not a draft
+	//   * PR is mergeable and up to date with its base
+	//   * All checks have passed
+	//   * No changes requested and no required reviewer left
+	return append(p.requestGates(pr, cfg), p.readyGates(pr, false)...)
+}
+
+// requestGates are the gates saying pr should be merged at all
+func (p *PRMerger) requestGates(pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) []gate.Gate {
+	return []gate.Gate{
+		gate.AutoMergeAllowed(cfg),
+		gate.NotOnHold(cfg, pr.HasLabel),
+		gate.Schedule(p.closed(cfg)),
+		gate.AskingForMerge(p.prAskingForAutoMerge(pr), "PR"),
+		gate.Check("not merged", !bool(pr.Merged), "already merged"),
+		gate.NotADraft(bool(pr.IsDraft), "PR"),
+	}
+}
+
+// readyGates are the gates saying GitHub would let pr merge now.  A merge queue does not need pr to be up to date.
+func (p *PRMerger) readyGates(pr ghapp.GraphQLPRQueryNode, mergeQueue bool) []gate.Gate {
+	rollup := pr.HeadRef.Target.Commit.StatusCheckRollup.State
+	reviewReason := ""
+	switch pr.ReviewDecision {
+	case githubv4.PullRequestReviewDecisionChangesRequested:
+		reviewReason = "unable to auto merge PR with changes requested"
+	case githubv4.PullRequestReviewDecisionReviewRequired:
+		reviewReason = "unable to auto merge PR with a required reviewer left"
+	}
+	ret := []gate.Gate{
+		gate.Check("mergeable", pr.Mergeable == githubv4.MergeableStateMergeable, fmt.Sprintf("cannot merge with state not clean (%s)", pr.Mergeable)),
+	}
+	if !mergeQueue {
+		ret = append(ret, gate.Check("up to date", pr.MergeStateStatus != ghapp.MergeStateStatusBehind, "branch is behind its base: waiting for it to be updated"))
+	}
+	return append(ret,
+		gate.Check("rollup state", rollup == githubv4.StatusStateSuccess, fmt.Sprintf("status state not success (%s)", rollup)),
+		gate.Check("review decision", reviewReason == "", reviewReason),
+	)
+}
+
+func (p *PRMerger) planf(ctx context.Context, format string, args ...interface{}) {
+	_, err := fmt.Fprintf(p.Plan, format+"\n", args...)
+	p.Logger.IfErr(err).Warn(ctx, "unable to write plan")
+}
+
+func (p *PRMerger) prAskingForAutoMerge(pr ghapp.GraphQLPRQueryNode) bool {
+	if p.MarkerSigner != nil {
+		return p.MarkerSigner.HasVerifiedAction(string(pr.Body), string(pr.Repository.Owner.Login)+"/"+string(pr.Repository.Name), string(pr.HeadRefName), string(pr.HeadRef.Target.Oid), marker.ActionAutoMerge)
 	}
-	return false
+	return marker.HasRequestedAction(string(pr.Body), marker.ActionAutoMerge)
 }
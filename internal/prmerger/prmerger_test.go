@@ -7,13 +7,17 @@ import (
 	http2 "net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
 	"github.com/cresta/gitops-autobot/internal/cache"
 	"github.com/cresta/gitops-autobot/internal/ghapp"
 	"github.com/cresta/gitops-autobot/internal/ghapp/cachedgithub"
+	"github.com/cresta/gitops-autobot/internal/ghapp/fakegithub"
 	"github.com/cresta/gitops-autobot/internal/ghapp/githubdirect"
+	"github.com/cresta/gitops-autobot/internal/marker"
 	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/shurcooL/githubv4"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
@@ -58,3 +62,200 @@ func TestPRMerger_Execute(t *testing.T) {
 	}
 	require.NoError(t, pr.Execute(ctx))
 }
+
+func TestPRMerger_Plan(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	p := PRMerger{
+		Logger: testhelp.ZapTestingLogger(t),
+		Plan:   &out,
+	}
+	var pr ghapp.GraphQLPRQueryNode
+	pr.Number = 12
+	pr.Repository.Owner.Login = "cresta"
+	pr.Repository.Name = "gitops"
+	pr.Body = "gitops-autobot: auto-merge=true"
+	pr.Mergeable = githubv4.MergeableStateMergeable
+	pr.HeadRef.Target.Commit.StatusCheckRollup.State = githubv4.StatusStatePending
+	repoCfg := &autobotcfg.AutobotPerRepoConfig{AllowAutoMerge: true}
+	require.NoError(t, p.processPr(ctx, pr, repoCfg))
+	require.Equal(t, "cresta/gitops#12: would not merge: status state not success (PENDING)\n", out.String())
+
+	out.Reset()
+	pr.HeadRef.Target.Commit.StatusCheckRollup.State = githubv4.StatusStateSuccess
+	require.NoError(t, p.processPr(ctx, pr, repoCfg))
+	require.Equal(t, "cresta/gitops#12: would merge: asking for merge, mergeable and all checks passed\n", out.String())
+}
+
+const nativeRepoConfig = `allowAutoMerge: true
+mergeMode: native
+mergeMethod: rebase
+changeMakers:
+  - name: helm
+    mergeMethod: merge
+`
+
+// nativeMerger is a merger of a fake repository with one autobot PR from the helm change maker
+func nativeMerger(t *testing.T, mergeQueue bool) (*fakegithub.GitHub, *PRMerger) {
+	ctx := context.Background()
+	gh := fakegithub.New(t.TempDir())
+	require.NoError(t, gh.AddRepository(fakegithub.Repository{
+		Owner:         "cresta",
+		Name:          "gitops",
+		Files:         map[string]string{".gitops-autobot": nativeRepoConfig},
+		RequireReview: true,
+		MergeQueue:    mergeQueue,
+	}))
+	_, err := gh.Commit("cresta", "gitops", "autobot-helm", map[string]string{"values.yaml": "version=2\n"}, "Upgrade")
+	require.NoError(t, err)
+	_, err = gh.Client("autobot").CreatePullRequest(ctx, "cresta", "gitops", githubv4.CreatePullRequestInput{
+		BaseRefName: "master",
+		HeadRefName: "autobot-helm",
+		Title:       "Upgrade",
+		Body:        githubv4.NewString(githubv4.String("gitops-autobot: auto-merge=true\n" + marker.ChangeMakerLine("helm"))),
+	})
+	require.NoError(t, err)
+	return gh, &PRMerger{
+		Client: gh.Client("reviewer"),
+		Logger: testhelp.ZapTestingLogger(t),
+		AutobotConfig: &autobotcfg.AutobotConfig{
+			Repos: []autobotcfg.RepoConfig{{Owner: "cresta", Name: "gitops", Branch: "master"}},
+		},
+	}
+}
+
+func approve(t *testing.T, gh *fakegithub.GitHub) {
+	event := githubv4.PullRequestReviewEventApprove
+	_, err := gh.Client("reviewer").AcceptPullRequest(context.Background(), "cresta", "gitops", githubv4.AddPullRequestReviewInput{
+		PullRequestID: gh.PullRequests("cresta", "gitops")[0].ID,
+		Event:         &event,
+	})
+	require.NoError(t, err)
+}
+
+func TestPRMerger_NativeAutoMerge(t *testing.T) {
+	ctx := context.Background()
+	gh, p := nativeMerger(t, false)
+	require.NoError(t, p.Execute(ctx))
+	pr := gh.PullRequests("cresta", "gitops")[0]
+	require.Equal(t, githubv4.PullRequestStateOpen, pr.State)
+	require.Equal(t, githubv4.PullRequestMergeMethodMerge, pr.AutoMergeMethod, "the method of the change maker wins")
+	require.NoError(t, p.Execute(ctx), "auto merge is only enabled once")
+
+	// Hold turns auto merge off again
+	require.NoError(t, p.Client.AddLabel(ctx, "cresta", "gitops", pr.Number, "autobot-hold"))
+	require.NoError(t, p.Execute(ctx))
+	require.Empty(t, gh.PullRequests("cresta", "gitops")[0].AutoMergeMethod)
+	require.NoError(t, p.Client.RemoveLabel(ctx, "cresta", "gitops", pr.Number, "autobot-hold"))
+	require.NoError(t, p.Execute(ctx))
+
+	approve(t, gh)
+	merged, err := gh.ProcessAutoMerges("cresta", "gitops")
+	require.NoError(t, err)
+	require.Equal(t, []int{pr.Number}, merged)
+	pr = gh.PullRequests("cresta", "gitops")[0]
+	require.Equal(t, githubv4.PullRequestStateMerged, pr.State)
+	require.Equal(t, githubv4.PullRequestMergeMethodMerge, pr.MergeMethod)
+}
+
+func TestPRMerger_NativePushAfterAutoMerge(t *testing.T) {
+	ctx := context.Background()
+	gh, p := nativeMerger(t, false)
+	signer := &marker.Signer{Key: []byte("sekret")}
+	p.MarkerSigner = signer
+	prs, err := p.Client.EveryOpenPullRequest(ctx, "cresta", "gitops", ghapp.PRFilter{})
+	require.NoError(t, err)
+	pr := prs.Repository.PullRequests.Nodes[0]
+	_, err = gh.Client("autobot").UpdatePullRequest(ctx, "cresta", "gitops", githubv4.UpdatePullRequestInput{
+		PullRequestID: pr.ID,
+		Body: githubv4.NewString(githubv4.String(marker.ChangeMakerLine("helm") + "\n" + signer.Sign(marker.Marker{
+			Repository: "cresta/gitops",
+			Branch:     "autobot-helm",
+			HeadOID:    string(pr.HeadRef.Target.Oid),
+			Actions:    []string{marker.ActionAutoMerge},
+		}))),
+	})
+	require.NoError(t, err)
+	// A human PR with auto merge of its own, which never asked autobot for anything
+	_, err = gh.Commit("cresta", "gitops", "human-change", map[string]string{"other.yaml": "a\n"}, "Change")
+	require.NoError(t, err)
+	human := gh.Client("human")
+	_, err = human.CreatePullRequest(ctx, "cresta", "gitops", githubv4.CreatePullRequestInput{
+		BaseRefName: "master",
+		HeadRefName: "human-change",
+		Title:       "Change",
+	})
+	require.NoError(t, err)
+	_, err = human.EnablePullRequestAutoMerge(ctx, "cresta", "gitops", githubv4.EnablePullRequestAutoMergeInput{
+		PullRequestID: gh.PullRequests("cresta", "gitops")[1].ID,
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Execute(ctx))
+	require.NotEmpty(t, gh.PullRequests("cresta", "gitops")[0].AutoMergeMethod)
+
+	// The signed marker no longer matches the head, so GitHub must not merge the push
+	_, err = gh.Commit("cresta", "gitops", "autobot-helm", map[string]string{"values.yaml": "version=3\n"}, "Human push")
+	require.NoError(t, err)
+	require.NoError(t, p.Execute(ctx))
+	require.Empty(t, gh.PullRequests("cresta", "gitops")[0].AutoMergeMethod)
+	require.NotEmpty(t, gh.PullRequests("cresta", "gitops")[1].AutoMergeMethod, "auto merge humans enabled is left alone")
+}
+
+func TestPRMerger_NativeReady(t *testing.T) {
+	ctx := context.Background()
+	gh, p := nativeMerger(t, false)
+	approve(t, gh)
+	require.NoError(t, p.Execute(ctx))
+	pr := gh.PullRequests("cresta", "gitops")[0]
+	require.Equal(t, githubv4.PullRequestStateMerged, pr.State, "GitHub refuses auto merge on PRs that can merge already")
+	require.Equal(t, githubv4.PullRequestMergeMethodMerge, pr.MergeMethod)
+}
+
+func TestPRMerger_NativeMergeQueue(t *testing.T) {
+	ctx := context.Background()
+	gh, p := nativeMerger(t, true)
+	require.NoError(t, p.Execute(ctx))
+	pr := gh.PullRequests("cresta", "gitops")[0]
+	require.False(t, pr.InMergeQueue, "not approved yet")
+	require.NotEmpty(t, pr.AutoMergeMethod)
+
+	gh, p = nativeMerger(t, true)
+	approve(t, gh)
+	require.NoError(t, p.Execute(ctx))
+	pr = gh.PullRequests("cresta", "gitops")[0]
+	require.True(t, pr.InMergeQueue)
+	require.Empty(t, pr.AutoMergeMethod)
+	require.NoError(t, p.Execute(ctx), "already in the queue")
+	merged, err := gh.ProcessAutoMerges("cresta", "gitops")
+	require.NoError(t, err)
+	require.Equal(t, []int{pr.Number}, merged)
+}
+
+func TestPRMerger_NativeFreeze(t *testing.T) {
+	ctx := context.Background()
+	gh, p := nativeMerger(t, false)
+	require.NoError(t, p.Execute(ctx))
+	pr := gh.PullRequests("cresta", "gitops")[0]
+	require.NotEmpty(t, pr.AutoMergeMethod)
+
+	// Labelling any PR freezes the whole repository, which stops auto merge already enabled
+	require.NoError(t, p.Client.AddLabel(ctx, "cresta", "gitops", pr.Number, "autobot-freeze"))
+	require.NoError(t, p.Execute(ctx))
+	require.Empty(t, gh.PullRequests("cresta", "gitops")[0].AutoMergeMethod)
+	require.NoError(t, p.Client.RemoveLabel(ctx, "cresta", "gitops", pr.Number, "autobot-freeze"))
+
+	// So does being outside the schedule
+	_, err := gh.Commit("cresta", "gitops", "master", map[string]string{
+		".gitops-autobot": nativeRepoConfig + "schedule:\n  windows:\n    - days: [mon]\n      start: \"09:00\"\n      end: \"10:00\"\n",
+	}, "Only merge on monday mornings")
+	require.NoError(t, err)
+	p.Now = func() time.Time { return time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC) }
+	require.NoError(t, p.Execute(ctx))
+	require.NotEmpty(t, gh.PullRequests("cresta", "gitops")[0].AutoMergeMethod)
+	p.Now = func() time.Time { return time.Date(2026, 10, 19, 10, 30, 0, 0, time.UTC) }
+	require.NoError(t, p.Execute(ctx))
+	require.Empty(t, gh.PullRequests("cresta", "gitops")[0].AutoMergeMethod)
+	merge, reason := p.MergeDecision(ghapp.GraphQLPRQueryNode{}, &autobotcfg.AutobotPerRepoConfig{AllowAutoMerge: true, Freeze: true})
+	require.False(t, merge)
+	require.Equal(t, "repository is frozen", reason)
+}
@@ -3,11 +3,14 @@ package prreviewer
 import (
 	"context"
 	"fmt"
-	"strings"
+	"io"
 	"time"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/gate"
 	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/gitops-autobot/internal/metrics"
 	"github.com/cresta/zapctx"
 	"github.com/shurcooL/githubv4"
 	"go.uber.org/zap"
@@ -18,75 +21,103 @@ type PrReviewer struct {
 	Logger        *zapctx.Logger
 	AutobotConfig *autobotcfg.AutobotConfig
 	PRMaker       *ghapp.UserInfo
+	// MarkerSigner, if set, means only PRs with a validly signed auto-approve marker are approved
+	MarkerSigner *marker.Signer
+	// Plan, if set, turns on plan mode: what would be approved, and why, is written here and nothing is approved
+	Plan io.Writer
+	// Now defaults to time.Now
+	Now func() time.Time
+
+	// heads is when each PR head was first seen, which the delay window counts from
+	heads gate.HeadClock
+}
+
+func (p *PrReviewer) now() time.Time {
+	if p.Now == nil {
+		return time.Now()
+	}
+	return p.Now()
 }
 
 func (p *PrReviewer) Execute(ctx context.Context) error {
 	p.Logger.Debug(ctx, "+PrReviewer.Execute")
 	defer p.Logger.Debug(ctx, "-PrReviewer.Execute")
-	for _, r := range p.AutobotConfig.Repos {
-		repoCfg, err := ghapp.FetchMasterConfigFile(ctx, p.Client, r)
-		if err != nil {
-			return fmt.Errorf("uanble to fetch repo content for %s: %w", r, err)
-		}
-		if !repoCfg.AllowAutoReview {
-			p.Logger.Debug(ctx, "not allowed to auto review")
-			continue
-		}
-		prs, err := p.Client.EveryOpenPullRequest(ctx, r.Owner, r.Name)
-		if err != nil {
-			return fmt.Errorf("cannot list every pr: %w", err)
-		}
-		for _, pr := range prs.Repository.PullRequests.Nodes {
-			if err := p.processPr(ctx, pr, repoCfg); err != nil {
-				return fmt.Errorf("unable to process pr: %w", err)
-			}
+	for _, r := range p.AutobotConfig.AllRepos() {
+		if err := p.executeRepo(ctx, r, ghapp.PRSelector{}); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (p *PrReviewer) processPr(ctx context.Context, pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) error {
-	logger := p.Logger.With(zap.Int32("pr", int32(pr.Number)))
-	logger.Debug(ctx, "processing pr", zap.Any("pr", pr))
-	// Will accept a PR if all the following are true
-	//   * "gitops-autobot: auto-approve=true" contained in body on line by itself (spaces trimmed)
-	//   * Not a draft
-	//   * Enough time since creation has passed
-	//   * All checks have passed
-	//   * Author is allowed for auto approve
-	//     * PR creator author is always allowed
-	//     * Users are allowed if autobot allows user auto approve for this repository
-	if !p.prAskingForAutoApproval(string(pr.Body)) {
-		logger.Debug(ctx, "pr not asking for review")
+// ExecutePullRequests processes only the pull requests of owner/name that match sel
+func (p *PrReviewer) ExecutePullRequests(ctx context.Context, owner string, name string, sel ghapp.PRSelector) error {
+	p.Logger.Debug(ctx, "+PrReviewer.ExecutePullRequests")
+	defer p.Logger.Debug(ctx, "-PrReviewer.ExecutePullRequests")
+	r := p.AutobotConfig.FindRepo(owner, name)
+	if r == nil {
+		p.Logger.Debug(ctx, "ignoring unknown repository", zap.String("owner", owner), zap.String("name", name))
 		return nil
 	}
-	if p.PRMaker.ID != pr.Author.Bot.ID && p.PRMaker.ID != pr.Author.User.ID {
-		if !cfg.AllowUsersToTriggerAccept {
-			if p.PRMaker == nil {
-				logger.Debug(ctx, "not allowing users to accept reviews")
-				return nil
-			}
-		}
-		if pr.IsCrossRepository {
-			logger.Debug(ctx, "auto approve not allowed for cross repository PRs")
-			return nil
-		}
+	return p.executeRepo(ctx, *r, sel)
+}
+
+func (p *PrReviewer) executeRepo(ctx context.Context, r autobotcfg.RepoConfig, sel ghapp.PRSelector) error {
+	repoCfg, err := ghapp.FetchMasterConfigFile(ctx, p.Client, r)
+	if err != nil {
+		return fmt.Errorf("uanble to fetch repo content for %s: %w", r, err)
 	}
-	if pr.IsDraft {
-		logger.Debug(ctx, "ignoring draft PR")
+	if !repoCfg.AllowAutoReview {
+		p.Logger.Debug(ctx, "not allowed to auto review")
+		if p.Plan != nil {
+			p.planf(ctx, "%s/%s: auto review is not allowed", r.Owner, r.Name)
+		}
 		return nil
 	}
-	if time.Since(pr.UpdatedAt.Time) < p.AutobotConfig.DelayForAutoApproval {
-		logger.Debug(ctx, "ignoring pr too recently made", zap.Duration("time_left", (p.AutobotConfig.DelayForAutoApproval-time.Since(pr.UpdatedAt.Time)).Round(time.Second)))
-		return nil
+	prs, err := p.Client.EveryOpenPullRequest(ctx, r.Owner, r.Name, ghapp.PRFilterFromConfig(p.AutobotConfig))
+	if err != nil {
+		return fmt.Errorf("cannot list every pr: %w", err)
 	}
-	if pr.HeadRef.Target.Commit.StatusCheckRollup.State != githubv4.StatusStateSuccess {
-		logger.Debug(ctx, "status state not success", zap.String("state", string(pr.HeadRef.Target.Commit.StatusCheckRollup.State)))
+	open := make(map[string]bool, len(prs.Repository.PullRequests.Nodes))
+	for _, pr := range prs.Repository.PullRequests.Nodes {
+		open[headKey(pr)] = true
+	}
+	p.heads.Retain(r.Owner+"/"+r.Name+"#", open)
+	if frozenBy := ghapp.LabelledPR(prs.Repository.PullRequests.Nodes, repoCfg.FreezeLabelName()); frozenBy != nil {
+		reason := fmt.Sprintf("frozen by the %s label on #%d", repoCfg.FreezeLabelName(), frozenBy.Number)
+		p.Logger.Info(ctx, "not reviewing frozen repository", zap.String("repo", r.String()), zap.String("reason", reason))
+		if p.Plan != nil {
+			p.planf(ctx, "%s/%s: would not approve: %s", r.Owner, r.Name, reason)
+		}
 		return nil
 	}
+	for _, pr := range prs.Repository.PullRequests.Nodes {
+		if !sel.Matches(pr) {
+			continue
+		}
+		if err := p.processPr(ctx, pr, repoCfg); err != nil {
+			return fmt.Errorf("unable to process pr: %w", err)
+		}
+	}
+	return nil
+}
 
-	if pr.ViewerLatestReview.Commit.Oid == pr.HeadRef.Target.Oid {
-		logger.Debug(ctx, "already reviewed this PR")
+func (p *PrReviewer) processPr(ctx context.Context, pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) error {
+	logger := p.Logger.With(zap.Int32("pr", int32(pr.Number)))
+	logger.Debug(ctx, "processing pr", zap.Any("pr", pr))
+	approve, reason := p.ApprovalDecision(pr, cfg)
+	logger.Debug(ctx, "approval decision", zap.Bool("approve", approve), zap.String("reason", reason))
+	if p.Plan != nil {
+		if approve {
+			p.planf(ctx, "%s/%s#%d: would approve: %s", pr.Repository.Owner.Login, pr.Repository.Name, pr.Number, reason)
+		} else {
+			p.planf(ctx, "%s/%s#%d: would not approve: %s", pr.Repository.Owner.Login, pr.Repository.Name, pr.Number, reason)
+		}
+		return nil
+	}
+	repo := string(pr.Repository.Owner.Login) + "/" + string(pr.Repository.Name)
+	if !approve {
+		metrics.Skipped(repo, metrics.ActionApprove, reason)
 		return nil
 	}
 
@@ -100,15 +131,63 @@ func (p *PrReviewer) processPr(ctx context.Context, pr ghapp.GraphQLPRQueryNode,
 	}); err != nil {
 		return fmt.Errorf("uanble to add PR review: %w", err)
 	}
+	metrics.PullRequests.WithLabelValues(repo, metrics.ActionApprove).Inc()
 
 	return nil
 }
 
-func (p *PrReviewer) prAskingForAutoApproval(msg string) bool {
-	for _, line := range strings.Split(msg, "\n") {
-		if strings.TrimSpace(line) == "gitops-autobot: auto-approve=true" {
-			return true
-		}
+// ApprovalDecision returns if pr should be approved, and why.  If not, the reason is the first condition that failed.
+func (p *PrReviewer) ApprovalDecision(pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) (bool, string) {
+	return gate.Decide(p.ApprovalGates(pr, cfg), "asking for approval and all checks passed")
+}
+
+// ApprovalGates returns every condition pr has to meet to be approved, in the order they are checked
+func (p *PrReviewer) ApprovalGates(pr ghapp.GraphQLPRQueryNode, cfg *autobotcfg.AutobotPerRepoConfig) []gate.Gate {
+	// Will accept a PR if all the following are true
+	//   * The repository allows auto review
+	//   * Not on hold
+	//   * Not frozen, and inside the schedule
+	//   * "gitops-autobot: auto-approve=true" contained in body on line by itself (spaces trimmed), or a signed marker
+	//     for the head commit if markers are signed
+	//   * Author is allowed for auto approve
+	//     * PR creator author is always allowed
+	//     * Users are allowed if autobot allows user auto approve for this repository
+	//   * Not a draft
+	//   * Enough time since the head commit was first seen has passed
+	//   * All checks have passed
+	//   * Not already reviewed at the head commit
+	now := p.now()
+	rollup := pr.HeadRef.Target.Commit.StatusCheckRollup.State
+	return []gate.Gate{
+		gate.AutoReviewAllowed(cfg),
+		gate.NotOnHold(cfg, pr.HasLabel),
+		gate.Schedule(cfg.Closed(p.AutobotConfig.Schedule, now)),
+		gate.AskingForApproval(p.prAskingForAutoApproval(pr), "PR"),
+		gate.AuthorAllowance(cfg, p.madeByAutobot(pr), bool(pr.IsCrossRepository), "PR"),
+		gate.NotADraft(bool(pr.IsDraft), "PR"),
+		gate.DelayWindow(p.AutobotConfig.DelayForAutoApproval, p.heads.Since(headKey(pr), string(pr.HeadRef.Target.Oid), now), now, "PR"),
+		gate.Check("rollup state", rollup == githubv4.StatusStateSuccess, fmt.Sprintf("status state not success (%s)", rollup)),
+		gate.Check("not yet reviewed", pr.ViewerLatestReview.Commit.Oid != pr.HeadRef.Target.Oid, "already reviewed this PR"),
+	}
+}
+
+// headKey is pr, as kept by the HeadClock of the reviewer
+func headKey(pr ghapp.GraphQLPRQueryNode) string {
+	return fmt.Sprintf("%s/%s#%d", pr.Repository.Owner.Login, pr.Repository.Name, pr.Number)
+}
+
+func (p *PrReviewer) madeByAutobot(pr ghapp.GraphQLPRQueryNode) bool {
+	return p.PRMaker != nil && (p.PRMaker.ID == pr.Author.Bot.ID || p.PRMaker.ID == pr.Author.User.ID)
+}
+
+func (p *PrReviewer) planf(ctx context.Context, format string, args ...interface{}) {
+	_, err := fmt.Fprintf(p.Plan, format+"\n", args...)
+	p.Logger.IfErr(err).Warn(ctx, "unable to write plan")
+}
+
+func (p *PrReviewer) prAskingForAutoApproval(pr ghapp.GraphQLPRQueryNode) bool {
+	if p.MarkerSigner != nil {
+		return p.MarkerSigner.HasVerifiedAction(string(pr.Body), string(pr.Repository.Owner.Login)+"/"+string(pr.Repository.Name), string(pr.HeadRefName), string(pr.HeadRef.Target.Oid), marker.ActionAutoApprove)
 	}
-	return false
+	return marker.HasRequestedAction(string(pr.Body), marker.ActionAutoApprove)
 }
@@ -7,13 +7,16 @@ import (
 	http2 "net/http"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/cresta/gitops-autobot/internal/autobotcfg"
 	"github.com/cresta/gitops-autobot/internal/cache"
 	"github.com/cresta/gitops-autobot/internal/ghapp"
 	"github.com/cresta/gitops-autobot/internal/ghapp/cachedgithub"
+	"github.com/cresta/gitops-autobot/internal/ghapp/fakegithub"
 	"github.com/cresta/gitops-autobot/internal/ghapp/githubdirect"
 	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/shurcooL/githubv4"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 )
@@ -64,3 +67,49 @@ func TestPrReviewer_Execute(t *testing.T) {
 	}
 	require.NoError(t, pr.Execute(ctx))
 }
+
+func TestPrReviewer_DelayIgnoresCommitDate(t *testing.T) {
+	ctx := context.Background()
+	gh := fakegithub.New(t.TempDir())
+	require.NoError(t, gh.AddRepository(fakegithub.Repository{
+		Owner:         "cresta",
+		Name:          "gitops",
+		Files:         map[string]string{".gitops-autobot": "allowAutoReview: true\nallowUsersToTriggerAccept: true\n"},
+		RequireReview: true,
+	}))
+	// A user pushes a commit dated long ago, to get past the delay
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	gh.Now = func() time.Time { return now.Add(-time.Hour * 24 * 365) }
+	_, err := gh.Commit("cresta", "gitops", "backdated", map[string]string{"values.yaml": "version=2\n"}, "Upgrade")
+	require.NoError(t, err)
+	gh.Now = func() time.Time { return now }
+	_, err = gh.Client("jack").CreatePullRequest(ctx, "cresta", "gitops", githubv4.CreatePullRequestInput{
+		BaseRefName: "master",
+		HeadRefName: "backdated",
+		Title:       "Upgrade",
+		Body:        githubv4.NewString("gitops-autobot: auto-approve=true"),
+	})
+	require.NoError(t, err)
+	reviewer := gh.Client("reviewer")
+	var plan bytes.Buffer
+	p := &PrReviewer{
+		Client: reviewer,
+		Logger: testhelp.ZapTestingLogger(t),
+		AutobotConfig: &autobotcfg.AutobotConfig{
+			Repos:                []autobotcfg.RepoConfig{{Owner: "cresta", Name: "gitops", Branch: "master"}},
+			DelayForAutoApproval: time.Hour,
+		},
+		Plan: &plan,
+		Now:  gh.Now,
+	}
+	require.NoError(t, p.Execute(ctx))
+	require.Equal(t, "cresta/gitops#1: would not approve: ignoring PR too recently made (1h0m0s left)\n", plan.String())
+
+	// The delay counts from when the head was first seen
+	now = now.Add(time.Hour)
+	p.Plan = nil
+	require.NoError(t, p.Execute(ctx))
+	prs, err := reviewer.EveryOpenPullRequest(ctx, "cresta", "gitops", ghapp.PRFilter{})
+	require.NoError(t, err)
+	require.Equal(t, githubv4.PullRequestReviewDecisionApproved, prs.Repository.PullRequests.Nodes[0].ReviewDecision)
+}
@@ -0,0 +1,258 @@
+package slashcmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/declined"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/metrics"
+	"github.com/cresta/zapctx"
+	"github.com/shurcooL/githubv4"
+	"go.uber.org/zap"
+)
+
+const prefix = "/autobot"
+
+const (
+	VerbApprove  = "approve"
+	VerbMerge    = "merge"
+	VerbRebase   = "rebase"
+	VerbHold     = "hold"
+	VerbUnhold   = "unhold"
+	VerbRecreate = "recreate"
+	VerbUnignore = "unignore"
+)
+
+var allVerbs = []string{VerbApprove, VerbMerge, VerbRebase, VerbHold, VerbUnhold, VerbRecreate, VerbUnignore}
+
+// Command is a "/autobot <verb>" comment left on a pull request
+type Command struct {
+	Owner     string
+	Name      string
+	Number    int
+	Commenter string
+	Verb      string
+}
+
+// Parse finds the first "/autobot <verb>" line of a comment body
+func Parse(body string) (string, bool) {
+	for _, line := range strings.Split(body, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != prefix {
+			continue
+		}
+		return strings.ToLower(fields[1]), true
+	}
+	return "", false
+}
+
+var permissionRank = map[string]int{
+	"none":  0,
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// PermissionAtLeast is true if the repository permission have is at least want
+func PermissionAtLeast(have string, want string) bool {
+	haveRank, exists := permissionRank[strings.ToLower(have)]
+	if !exists {
+		return false
+	}
+	wantRank, exists := permissionRank[strings.ToLower(want)]
+	if !exists {
+		// Fail closed on typos in the config
+		wantRank = permissionRank["admin"]
+	}
+	return haveRank >= wantRank
+}
+
+// Runner carries out slash commands, but only on pull requests that autobot created
+type Runner struct {
+	Client        ghapp.GithubAPI
+	AutobotConfig *autobotcfg.AutobotConfig
+	PRMaker       *ghapp.UserInfo
+	Logger        *zapctx.Logger
+	// TriggerRepo is called after "recreate" closes a PR, so the branch is made again
+	TriggerRepo func(owner string, name string, branch string)
+	// Declined is where PRs humans closed without merging are remembered.  "unignore" on such a PR forgets it.
+	Declined *declined.Store
+}
+
+func (r *Runner) Execute(ctx context.Context, cmd Command) error {
+	r.Logger.Debug(ctx, "+Runner.Execute")
+	defer r.Logger.Debug(ctx, "-Runner.Execute")
+	logger := r.Logger.With(zap.String("verb", cmd.Verb), zap.Int("pr", cmd.Number), zap.String("commenter", cmd.Commenter))
+	repo := r.AutobotConfig.FindRepo(cmd.Owner, cmd.Name)
+	if repo == nil {
+		logger.Debug(ctx, "ignoring command on unknown repository")
+		return nil
+	}
+	repoCfg, err := ghapp.FetchMasterConfigFile(ctx, r.Client, *repo)
+	if err != nil {
+		return fmt.Errorf("unable to fetch repo content for %s: %w", repo, err)
+	}
+	if repoCfg.SlashCommands == nil {
+		logger.Debug(ctx, "slash commands not enabled")
+		return nil
+	}
+	var pr *ghapp.GraphQLPRQueryNode
+	var subjectID githubv4.ID
+	if cmd.Verb == VerbUnignore {
+		// Declined PRs are closed, so they are found in what was remembered when they closed
+		var record *declined.Record
+		if r.Declined != nil {
+			record = r.Declined.Get(repo.Owner, repo.Name, cmd.Number)
+		}
+		if record == nil {
+			logger.Debug(ctx, "pr was not declined")
+			return nil
+		}
+		subjectID = record.ID
+	} else {
+		prs, err := r.Client.EveryOpenPullRequest(ctx, repo.Owner, repo.Name, ghapp.PRFilterFromConfig(r.AutobotConfig))
+		if err != nil {
+			return fmt.Errorf("cannot list every pr: %w", err)
+		}
+		for idx := range prs.Repository.PullRequests.Nodes {
+			if (ghapp.PRSelector{Number: cmd.Number}).Matches(prs.Repository.PullRequests.Nodes[idx]) {
+				pr = &prs.Repository.PullRequests.Nodes[idx]
+			}
+		}
+		if pr == nil {
+			logger.Debug(ctx, "pr is not open")
+			return nil
+		}
+		if r.PRMaker == nil || (r.PRMaker.ID != pr.Author.Bot.ID && r.PRMaker.ID != pr.Author.User.ID) {
+			logger.Debug(ctx, "ignoring command on pr autobot did not make")
+			return nil
+		}
+		subjectID = pr.ID
+	}
+	reply, err := r.run(ctx, cmd, *repo, repoCfg, pr)
+	if err != nil {
+		logger.IfErr(err).Warn(ctx, "unable to run command")
+		reply = fmt.Sprintf("@%s unable to %s: %s", cmd.Commenter, cmd.Verb, err.Error())
+	}
+	if _, err := r.Client.AddComment(ctx, repo.Owner, repo.Name, githubv4.AddCommentInput{
+		SubjectID: subjectID,
+		Body:      githubv4.String(reply),
+	}); err != nil {
+		return fmt.Errorf("unable to reply to command: %w", err)
+	}
+	return nil
+}
+
+// run performs the command, returning the reply to acknowledge it with.  pr is the open PR, or nil for "unignore".
+func (r *Runner) run(ctx context.Context, cmd Command, repo autobotcfg.RepoConfig, repoCfg *autobotcfg.AutobotPerRepoConfig, pr *ghapp.GraphQLPRQueryNode) (string, error) {
+	if !isKnownVerb(cmd.Verb) {
+		return fmt.Sprintf("@%s unknown command %q.  Known commands are: %s", cmd.Commenter, cmd.Verb, strings.Join(allVerbs, ", ")), nil
+	}
+	if !repoCfg.SlashCommands.Allows(cmd.Verb) {
+		return fmt.Sprintf("@%s the %s command is not enabled for this repository", cmd.Commenter, cmd.Verb), nil
+	}
+	permission, err := r.Client.RepositoryPermission(ctx, repo.Owner, repo.Name, cmd.Commenter)
+	if err != nil {
+		return "", fmt.Errorf("unable to check permission: %w", err)
+	}
+	if required := repoCfg.SlashCommands.RequiredPermission(); !PermissionAtLeast(permission, required) {
+		return fmt.Sprintf("@%s you need %s permission on this repository to %s", cmd.Commenter, required, cmd.Verb), nil
+	}
+	switch cmd.Verb {
+	case VerbApprove:
+		event := githubv4.PullRequestReviewEventApprove
+		body := githubv4.String(fmt.Sprintf("approved on behalf of @%s", cmd.Commenter))
+		if _, err := r.Client.AcceptPullRequest(ctx, repo.Owner, repo.Name, githubv4.AddPullRequestReviewInput{
+			PullRequestID: pr.ID,
+			CommitOID:     &pr.HeadRef.Target.Oid,
+			Body:          &body,
+			Event:         &event,
+		}); err != nil {
+			return "", fmt.Errorf("unable to add PR review: %w", err)
+		}
+		metrics.PullRequests.WithLabelValues(repo.Owner+"/"+repo.Name, metrics.ActionApprove).Inc()
+		return fmt.Sprintf("@%s approved", cmd.Commenter), nil
+	case VerbMerge:
+		method := pr.MergeMethod(repoCfg)
+		if _, err := r.Client.MergePullRequest(ctx, repo.Owner, repo.Name, string(pr.BaseRef.Name), githubv4.MergePullRequestInput{
+			PullRequestID:   pr.ID,
+			ExpectedHeadOid: &pr.HeadRef.Target.Oid,
+			MergeMethod:     &method,
+		}); err != nil {
+			return "", fmt.Errorf("unable to merge: %w", err)
+		}
+		metrics.PullRequests.WithLabelValues(repo.Owner+"/"+repo.Name, metrics.ActionMerge).Inc()
+		return fmt.Sprintf("@%s merged", cmd.Commenter), nil
+	case VerbRebase:
+		if _, err := r.Client.UpdatePullRequestBranch(ctx, repo.Owner, repo.Name, githubv4.UpdatePullRequestBranchInput{
+			PullRequestID:   pr.ID,
+			ExpectedHeadOid: &pr.HeadRef.Target.Oid,
+		}); err != nil {
+			return "", fmt.Errorf("unable to update branch: %w", err)
+		}
+		return fmt.Sprintf("@%s updated the branch with %s", cmd.Commenter, pr.BaseRef.Name), nil
+	case VerbHold:
+		if err := r.Client.AddLabel(ctx, repo.Owner, repo.Name, cmd.Number, repoCfg.HoldLabelName()); err != nil {
+			return "", fmt.Errorf("unable to add hold label: %w", err)
+		}
+		return fmt.Sprintf("@%s on hold: autobot will not approve or merge this PR until `/autobot unhold`", cmd.Commenter), nil
+	case VerbUnhold:
+		if err := r.Client.RemoveLabel(ctx, repo.Owner, repo.Name, cmd.Number, repoCfg.HoldLabelName()); err != nil {
+			return "", fmt.Errorf("unable to remove hold label: %w", err)
+		}
+		return fmt.Sprintf("@%s no longer on hold", cmd.Commenter), nil
+	case VerbRecreate:
+		if r.Declined != nil {
+			if err := r.Declined.Ignore(repo.Owner, repo.Name, cmd.Number); err != nil {
+				return "", fmt.Errorf("unable to remember PR is not declined: %w", err)
+			}
+		}
+		if _, err := r.Client.ClosePullRequest(ctx, repo.Owner, repo.Name, githubv4.ClosePullRequestInput{
+			PullRequestID: pr.ID,
+		}); err != nil {
+			return "", fmt.Errorf("unable to close PR: %w", err)
+		}
+		if err := r.Client.DeleteBranch(ctx, repo.Owner, repo.Name, string(pr.HeadRefName)); err != nil {
+			return "", fmt.Errorf("unable to delete branch: %w", err)
+		}
+		if r.TriggerRepo != nil {
+			r.TriggerRepo(repo.Owner, repo.Name, repo.Branch)
+		}
+		return fmt.Sprintf("@%s closed this PR: a new one will be created from %s", cmd.Commenter, repo.Branch), nil
+	case VerbUnignore:
+		record, err := r.Declined.Forget(repo.Owner, repo.Name, cmd.Number)
+		if err != nil {
+			return "", fmt.Errorf("unable to forget declined changes: %w", err)
+		}
+		if record == nil {
+			return fmt.Sprintf("@%s autobot did not remember this PR as declined", cmd.Commenter), nil
+		}
+		// The change is only proposed again once its old branch is gone
+		exists, err := r.Client.DoesBranchExist(ctx, repo.Owner, repo.Name, record.Branch)
+		if err != nil {
+			return "", fmt.Errorf("unable to check for branch: %w", err)
+		}
+		if exists {
+			if err := r.Client.DeleteBranch(ctx, repo.Owner, repo.Name, record.Branch); err != nil {
+				return "", fmt.Errorf("unable to delete branch: %w", err)
+			}
+		}
+		if r.TriggerRepo != nil {
+			r.TriggerRepo(repo.Owner, repo.Name, repo.Branch)
+		}
+		return fmt.Sprintf("@%s autobot may propose the changes of this PR again", cmd.Commenter), nil
+	}
+	return "", fmt.Errorf("unhandled verb %s", cmd.Verb)
+}
+
+func isKnownVerb(verb string) bool {
+	for _, v := range allVerbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
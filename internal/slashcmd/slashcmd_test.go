@@ -0,0 +1,164 @@
+package slashcmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/autobotcfg"
+	"github.com/cresta/gitops-autobot/internal/declined"
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/marker"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/shurcooL/githubv4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	verb, ok := Parse("thanks!\n  /autobot   Merge now\n/autobot hold")
+	require.True(t, ok)
+	require.Equal(t, VerbMerge, verb)
+	_, ok = Parse("/autobot")
+	require.False(t, ok)
+	_, ok = Parse("please /autobot merge")
+	require.False(t, ok)
+}
+
+func TestPermissionAtLeast(t *testing.T) {
+	require.True(t, PermissionAtLeast("admin", "write"))
+	require.True(t, PermissionAtLeast("write", "write"))
+	require.False(t, PermissionAtLeast("read", "write"))
+	require.False(t, PermissionAtLeast("none", "read"))
+	require.False(t, PermissionAtLeast("write", "wrtie"))
+}
+
+// fakeClient implements only what the runner uses
+type fakeClient struct {
+	ghapp.GithubAPI
+	config      string
+	permissions map[string]string
+	prs         ghapp.GraphQLPRQuery
+	comments    []string
+	labels      []string
+}
+
+func (f *fakeClient) GetContents(_ context.Context, _ string, _ string, _ string) (string, error) {
+	return f.config, nil
+}
+
+func (f *fakeClient) EveryOpenPullRequest(_ context.Context, _ string, _ string, _ ghapp.PRFilter) (*ghapp.GraphQLPRQuery, error) {
+	return &f.prs, nil
+}
+
+func (f *fakeClient) RepositoryPermission(_ context.Context, _ string, _ string, login string) (string, error) {
+	return f.permissions[login], nil
+}
+
+func (f *fakeClient) AddComment(_ context.Context, _ string, _ string, in githubv4.AddCommentInput) (*ghapp.AddCommentOutput, error) {
+	f.comments = append(f.comments, string(in.Body))
+	return &ghapp.AddCommentOutput{}, nil
+}
+
+func (f *fakeClient) AddLabel(_ context.Context, _ string, _ string, _ int, label string) error {
+	f.labels = append(f.labels, label)
+	return nil
+}
+
+func TestRunner_Execute(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeClient{
+		config: "slashCommands:\n  commands: [hold, unhold]\nholdLabel: wait\n",
+		permissions: map[string]string{
+			"jack": "write",
+			"jill": "read",
+		},
+	}
+	var botPR ghapp.GraphQLPRQueryNode
+	botPR.Number = 3
+	botPR.Author.Bot.ID = "bot"
+	var userPR ghapp.GraphQLPRQueryNode
+	userPR.Number = 4
+	userPR.Author.User.ID = "jack"
+	client.prs.Repository.PullRequests.Nodes = []ghapp.GraphQLPRQueryNode{botPR, userPR}
+	r := Runner{
+		Client: client,
+		AutobotConfig: &autobotcfg.AutobotConfig{
+			Repos: []autobotcfg.RepoConfig{{Owner: "cresta", Name: "gitops", Branch: "master"}},
+		},
+		PRMaker: &ghapp.UserInfo{ID: "bot"},
+		Logger:  testhelp.ZapTestingLogger(t),
+	}
+	cmd := func(number int, commenter string, verb string) Command {
+		return Command{Owner: "cresta", Name: "gitops", Number: number, Commenter: commenter, Verb: verb}
+	}
+
+	require.NoError(t, r.Execute(ctx, cmd(3, "jack", VerbHold)))
+	require.Equal(t, []string{"wait"}, client.labels)
+	require.Len(t, client.comments, 1)
+	require.Contains(t, client.comments[0], "on hold")
+
+	require.NoError(t, r.Execute(ctx, cmd(3, "jill", VerbHold)))
+	require.Contains(t, client.comments[1], "you need write permission")
+	require.NoError(t, r.Execute(ctx, cmd(3, "jack", VerbMerge)))
+	require.Contains(t, client.comments[2], "not enabled")
+	require.NoError(t, r.Execute(ctx, cmd(3, "jack", "explode")))
+	require.Contains(t, client.comments[3], "unknown command")
+	require.Equal(t, []string{"wait"}, client.labels)
+
+	// Not our PR, not an open PR and not our repository are all ignored without a reply
+	require.NoError(t, r.Execute(ctx, cmd(4, "jack", VerbHold)))
+	require.NoError(t, r.Execute(ctx, cmd(5, "jack", VerbHold)))
+	require.NoError(t, r.Execute(ctx, Command{Owner: "cresta", Name: "other", Number: 3, Commenter: "jack", Verb: VerbHold}))
+	require.Len(t, client.comments, 4)
+}
+
+func (f *fakeClient) DoesBranchExist(_ context.Context, _ string, _ string, ref string) (bool, error) {
+	return ref == "filechange_values.yaml", nil
+}
+
+func (f *fakeClient) DeleteBranch(_ context.Context, _ string, _ string, ref string) error {
+	f.labels = append(f.labels, "deleted "+ref)
+	return nil
+}
+
+func TestRunner_ExecuteUnignore(t *testing.T) {
+	ctx := context.Background()
+	client := &fakeClient{
+		config:      "slashCommands: {}\n",
+		permissions: map[string]string{"jack": "write"},
+	}
+	store, err := declined.Load("")
+	require.NoError(t, err)
+	change := marker.ChangeID{File: "values.yaml", Name: "nginx", Version: "3.0.0"}
+	_, err = store.Add("cresta", "gitops", declined.Record{
+		Number:      7,
+		ID:          "PR_7",
+		Branch:      "filechange_values.yaml",
+		ChangeMaker: "helm",
+		Changes:     []marker.ChangeID{change},
+	})
+	require.NoError(t, err)
+	var triggered []string
+	r := Runner{
+		Client: client,
+		AutobotConfig: &autobotcfg.AutobotConfig{
+			Repos: []autobotcfg.RepoConfig{{Owner: "cresta", Name: "gitops", Branch: "master"}},
+		},
+		PRMaker: &ghapp.UserInfo{ID: "bot"},
+		Logger:  testhelp.ZapTestingLogger(t),
+		TriggerRepo: func(owner string, name string, branch string) {
+			triggered = append(triggered, owner+"/"+name+"@"+branch)
+		},
+		Declined: store,
+	}
+	require.True(t, store.For("cresta", "gitops", "helm").IsDeclined(change))
+	require.NoError(t, r.Execute(ctx, Command{Owner: "cresta", Name: "gitops", Number: 7, Commenter: "jack", Verb: VerbUnignore}))
+	require.False(t, store.For("cresta", "gitops", "helm").IsDeclined(change))
+	require.Equal(t, []string{"deleted filechange_values.yaml"}, client.labels)
+	require.Equal(t, []string{"cresta/gitops@master"}, triggered)
+	require.Len(t, client.comments, 1)
+	require.Contains(t, client.comments[0], "may propose the changes of this PR again")
+
+	// PRs that were never declined are ignored without a reply
+	require.NoError(t, r.Execute(ctx, Command{Owner: "cresta", Name: "gitops", Number: 8, Commenter: "jack", Verb: VerbUnignore}))
+	require.Len(t, client.comments, 1)
+}
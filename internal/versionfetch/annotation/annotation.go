@@ -0,0 +1,46 @@
+package annotation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-logfmt/logfmt"
+)
+
+const Prefix = "# gitops-autobot:"
+
+// Parse extracts the logfmt encoded keys of a "# gitops-autobot:" comment.  The second return value is false if the
+// line does not contain an autobot comment.
+func Parse(line string) (map[string]string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if len(trimmed) == 0 {
+		return nil, false
+	}
+	gitopsStart := strings.LastIndex(trimmed, Prefix)
+	if gitopsStart == -1 {
+		return nil, false
+	}
+	trimmed = strings.TrimSpace(trimmed[gitopsStart+len(Prefix):])
+	dec := logfmt.NewDecoder(strings.NewReader(trimmed))
+	keys := make(map[string]string)
+	for dec.ScanRecord() {
+		for dec.ScanKeyval() {
+			keys[string(dec.Key())] = string(dec.Value())
+		}
+	}
+	return keys, true
+}
+
+// OptionalBool returns nil if key is not set, otherwise the parsed value of key
+func OptionalBool(keys map[string]string, key string) (*bool, error) {
+	str, exists := keys[key]
+	if !exists {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flag %s: %w", key, err)
+	}
+	return &parsed, nil
+}
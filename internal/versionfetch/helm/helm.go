@@ -8,7 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"path"
 	"strings"
 	"time"
 
@@ -16,9 +16,13 @@ import (
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/cresta/gitops-autobot/internal/cache"
+	"github.com/cresta/gitops-autobot/internal/metrics"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/annotation"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/registry"
 	"github.com/cresta/zapctx"
-	"github.com/go-logfmt/logfmt"
 	"github.com/goccy/go-yaml"
+	"go.uber.org/zap"
+	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/repo"
 )
 
@@ -35,6 +39,9 @@ type LineHelmChange struct {
 	UpgradeInfo              UpgradeInfo
 	CurrentVersionLine       string
 	CurrentVersionLineNumber int
+	// CurrentVersionOffset is where the version starts inside CurrentVersionLine.  If set, only the version itself is
+	// replaced so quotes and trailing comments are kept.
+	CurrentVersionOffset int
 }
 
 func (c *LineHelmChange) isValid() bool {
@@ -44,8 +51,6 @@ func (c *LineHelmChange) isValid() bool {
 		c.UpgradeInfo.VersionConstraint != "" && c.UpgradeInfo.ChartName != "" && c.UpgradeInfo.Repository != ""
 }
 
-const autobotPrefix = "# gitops-autobot:"
-
 func GroupChangesByRepo(changes []*LineHelmChange) map[string][]*LineHelmChange {
 	ret := make(map[string][]*LineHelmChange)
 	for _, change := range changes {
@@ -57,23 +62,10 @@ func GroupChangesByRepo(changes []*LineHelmChange) map[string][]*LineHelmChange
 func ParseHelmReleaseYAML(lines []string) ([]*LineHelmChange, error) {
 	ret := make([]*LineHelmChange, 0, 3) // most files will have only a few changes.
 	for idx, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if len(trimmed) == 0 {
-			continue
-		}
-		gitopsStart := strings.LastIndex(trimmed, autobotPrefix)
-		if gitopsStart == -1 {
+		keys, isAnnotation := annotation.Parse(line)
+		if !isAnnotation {
 			continue
 		}
-		trimmed = trimmed[gitopsStart+len(autobotPrefix):]
-		trimmed = strings.TrimSpace(trimmed)
-		dec := logfmt.NewDecoder(strings.NewReader(trimmed))
-		keys := make(map[string]string)
-		for dec.ScanRecord() {
-			for dec.ScanKeyval() {
-				keys[string(dec.Key())] = string(dec.Value())
-			}
-		}
 		if keys["changer"] != "helm" {
 			continue
 		}
@@ -115,20 +107,16 @@ func ParseHelmReleaseYAML(lines []string) ([]*LineHelmChange, error) {
 		if version, exists := keys["currentVersion"]; exists {
 			thisChange.UpgradeInfo.CurrentVersion = version
 		}
-		if autoMergeStr, exists := keys["autoMerge"]; exists {
-			parsed, err := strconv.ParseBool(autoMergeStr)
-			if err != nil {
-				return nil, fmt.Errorf("invalid flag %s: %w", "autoMerge", err)
-			}
-			thisChange.UpgradeInfo.AutoMerge = &parsed
+		autoMerge, err := annotation.OptionalBool(keys, "autoMerge")
+		if err != nil {
+			return nil, err
 		}
-		if autoAcceptStr, exists := keys["autoAccept"]; exists {
-			parsed, err := strconv.ParseBool(autoAcceptStr)
-			if err != nil {
-				return nil, fmt.Errorf("invalid flag %s: %w", "autoAccept", err)
-			}
-			thisChange.UpgradeInfo.AutoApprove = &parsed
+		thisChange.UpgradeInfo.AutoMerge = autoMerge
+		autoApprove, err := annotation.OptionalBool(keys, "autoAccept")
+		if err != nil {
+			return nil, err
 		}
+		thisChange.UpgradeInfo.AutoApprove = autoApprove
 
 		if _, err := semver.NewConstraint(thisChange.UpgradeInfo.VersionConstraint); err != nil {
 			return nil, fmt.Errorf("invalid version constraint %s: %w", thisChange.UpgradeInfo.VersionConstraint, err)
@@ -167,13 +155,28 @@ func (r *RepoInfoLoader) LoadIndexFile(ctx context.Context, repoURL string) (*re
 	}
 	var ret repo.IndexFile
 	if err := r.Cache.GetOrSet(ctx, []byte("helm_index:"+repoURL), time.Minute*5, &ret, func(ctx context.Context) (interface{}, error) {
-		return loader.LoadIndexFile(ctx, repoURL)
+		start := time.Now()
+		index, err := loader.LoadIndexFile(ctx, repoURL)
+		metrics.HelmIndexFetchDuration.WithLabelValues(u.Scheme, metrics.Result(err)).Observe(time.Since(start).Seconds())
+		return index, err
 	}); err != nil {
 		return nil, fmt.Errorf("unable to load or get from cache: %w", err)
 	}
 	return &ret, nil
 }
 
+// LoadChartIndexFile is LoadIndexFile for a single chart.  OCI registries have one repository per chart, so for oci://
+// URLs the chart name is appended to the repository URL.
+func (r *RepoInfoLoader) LoadChartIndexFile(ctx context.Context, repoURL string, chartName string) (*repo.IndexFile, error) {
+	if strings.HasPrefix(repoURL, "oci://") {
+		repoURL = strings.TrimSuffix(repoURL, "/")
+		if path.Base(repoURL) != chartName {
+			repoURL += "/" + chartName
+		}
+	}
+	return r.LoadIndexFile(ctx, repoURL)
+}
+
 func yamlIndent(line string) int {
 	return len(line) - len(strings.TrimLeft(line, " -"))
 }
@@ -239,8 +242,50 @@ func (h *S3Loader) LoadIndexFile(ctx context.Context, urlStr string) (*repo.Inde
 	return ret, nil
 }
 
+// OCILoader lists the tags of a chart pushed to an OCI registry and synthesizes an index file from them.  OCI
+// repositories are per chart, so the URL is expected to end with the chart name (see RepoInfoLoader.LoadChartIndexFile).
+type OCILoader struct {
+	Logger   *zapctx.Logger
+	Registry *registry.Client
+}
+
+func (o *OCILoader) LoadIndexFile(ctx context.Context, urlStr string) (*repo.IndexFile, error) {
+	parsedURL, err := url.Parse(strings.TrimSuffix(urlStr, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse URL for OCI: %w", err)
+	}
+	repository := strings.TrimPrefix(parsedURL.Path, "/")
+	if repository == "" {
+		return nil, fmt.Errorf("OCI url %s has no chart repository", urlStr)
+	}
+	tags, err := o.Registry.ListTags(ctx, "https://"+parsedURL.Host, repository)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tags for %s: %w", urlStr, err)
+	}
+	chartName := path.Base(repository)
+	ret := repo.NewIndexFile()
+	for _, tag := range tags {
+		// OCI tags cannot contain "+", so helm pushes build metadata with "_" instead
+		version := strings.ReplaceAll(tag, "_", "+")
+		if _, err := semver.NewVersion(version); err != nil {
+			continue
+		}
+		ret.Entries[chartName] = append(ret.Entries[chartName], &repo.ChartVersion{
+			Metadata: &chart.Metadata{
+				APIVersion: chart.APIVersionV2,
+				Name:       chartName,
+				Version:    version,
+			},
+			URLs: []string{"oci://" + parsedURL.Host + "/" + repository + ":" + tag},
+		})
+	}
+	ret.SortEntries()
+	return ret, nil
+}
+
 var _ IndexLoader = &HTTPLoader{}
 var _ IndexLoader = &S3Loader{}
+var _ IndexLoader = &OCILoader{}
 
 func LoadFromReader(ctx context.Context, reader io.Reader, logger *zapctx.Logger) (*repo.IndexFile, error) {
 	f, err := ioutil.TempFile("", "helm_load_from_reader")
@@ -278,7 +323,9 @@ type VersionChange struct {
 	LineNumber   int
 }
 
-func (c *ChangeParser) LoadVersions(_ context.Context, change *LineHelmChange, index *repo.IndexFile) (*VersionChange, error) {
+// LoadVersions picks the highest version of the chart that satisfies the version constraint.  Versions declined returns
+// true for are skipped, so a later version is still picked.  declined may be nil.
+func (c *ChangeParser) LoadVersions(ctx context.Context, change *LineHelmChange, index *repo.IndexFile, declined func(version string) bool) (*VersionChange, error) {
 	constraint, err := semver.NewConstraint(change.UpgradeInfo.VersionConstraint)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse constraint %s: %w", change.UpgradeInfo.VersionConstraint, err)
@@ -300,6 +347,10 @@ func (c *ChangeParser) LoadVersions(_ context.Context, change *LineHelmChange, i
 		if !constraint.Check(thisVersion) {
 			continue
 		}
+		if thisVersion.GreaterThan(highestVersion) && declined != nil && declined(thisVersion.String()) {
+			c.Logger.Debug(ctx, "skipping declined version", zap.String("chart", change.UpgradeInfo.ChartName), zap.String("version", thisVersion.String()))
+			continue
+		}
 		if thisVersion.GreaterThan(highestVersion) {
 			highestVersion = thisVersion
 		}
@@ -307,6 +358,19 @@ func (c *ChangeParser) LoadVersions(_ context.Context, change *LineHelmChange, i
 	if highestVersion == currentVersion {
 		return nil, nil
 	}
+	if change.CurrentVersionOffset != 0 {
+		line := change.CurrentVersionLine
+		end := change.CurrentVersionOffset + len(change.UpgradeInfo.CurrentVersion)
+		if end > len(line) || line[change.CurrentVersionOffset:end] != change.UpgradeInfo.CurrentVersion {
+			return nil, fmt.Errorf("unable to find version %s in line %s", change.UpgradeInfo.CurrentVersion, line)
+		}
+		return &VersionChange{
+			PreviousLine: line,
+			NewLine:      line[:change.CurrentVersionOffset] + highestVersion.String() + line[end:],
+			LineNumber:   change.CurrentVersionLineNumber,
+			NewVersion:   highestVersion.String(),
+		}, nil
+	}
 	parts := strings.SplitN(change.CurrentVersionLine, ":", 2)
 	if len(parts) != 2 {
 		return nil, fmt.Errorf("invalid current line %s", change.CurrentVersionLine)
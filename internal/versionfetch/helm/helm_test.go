@@ -1,10 +1,19 @@
 package helm
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/cresta/gitops-autobot/internal/cache"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/registry"
+	"github.com/cresta/zapctx/testhelp/testhelp"
 	"github.com/stretchr/testify/require"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
 )
 
 const testHelmReleaseFlux = `apiVersion: helm.fluxcd.io/v1
@@ -44,3 +53,180 @@ func TestParse(t *testing.T) {
 		CurrentVersionLineNumber: 11,
 	}, *ret[0])
 }
+
+func TestOCILoader(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.Equal(t, "/v2/charts/gitdb/tags/list", request.URL.Path)
+		require.NoError(t, json.NewEncoder(writer).Encode(map[string]interface{}{
+			"name": "charts/gitdb",
+			"tags": []string{"0.1.25", "0.1.26_build.1", "1.0.0", "latest"},
+		}))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	logger := testhelp.ZapTestingLogger(t)
+	loader := &RepoInfoLoader{
+		Logger: logger,
+		Cache:  &cache.InMemoryCache{},
+		LoadersByScheme: map[string]IndexLoader{
+			"oci": &OCILoader{
+				Logger: logger,
+				Registry: &registry.Client{
+					Client: srv.Client(),
+					Logger: logger,
+					Cache:  &cache.InMemoryCache{},
+				},
+			},
+		},
+	}
+	repoURL := "oci://" + srv.Listener.Addr().String() + "/charts"
+	idx, err := loader.LoadChartIndexFile(ctx, repoURL, "gitdb")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(idx.Entries["gitdb"]))
+
+	change, err := (&ChangeParser{Logger: logger}).LoadVersions(ctx, &LineHelmChange{
+		UpgradeInfo: UpgradeInfo{
+			Repository:        repoURL,
+			ChartName:         "gitdb",
+			CurrentVersion:    "0.1.25",
+			VersionConstraint: "0.x.x",
+		},
+		CurrentVersionLine:       "    version: 0.1.25",
+		CurrentVersionLineNumber: 11,
+	}, idx, nil)
+	require.NoError(t, err)
+	require.Equal(t, "0.1.26+build.1", change.NewVersion)
+}
+
+const testHelmRepository = `apiVersion: source.toolkit.fluxcd.io/v1beta2
+kind: HelmRepository
+metadata:
+  name: cresta
+  namespace: flux-system
+spec:
+  url: https://cresta.github.io/gitdb/`
+
+const testManifests = `---
+apiVersion: helm.toolkit.fluxcd.io/v2beta1
+kind: HelmRelease
+metadata:
+  name: gitdb
+  namespace: gitdb
+spec:
+  # gitops-autobot: changer=helm versionConstraint=0.x.x autoMerge=true
+  interval: 5m
+  chart:
+    spec:
+      sourceRef:
+        namespace: flux-system
+        kind: HelmRepository
+        name: cresta
+      version: "0.1.25" # pinned
+      chart: gitdb
+---
+apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: gitdb
+spec:
+  project: default
+  source:
+    targetRevision: 0.1.20
+    chart: gitdb
+    # gitops-autobot: changer=helm versionConstraint=0.1.x
+    repoURL: https://cresta.github.io/gitdb/
+`
+
+func TestParseHelmManifests(t *testing.T) {
+	repos := FindHelmRepositories(strings.Split(testHelmRepository, "\n"))
+	require.Equal(t, HelmRepositories{"flux-system/cresta": "https://cresta.github.io/gitdb/"}, repos)
+	lines := strings.Split(testManifests, "\n")
+	ret, err := ParseHelmManifests(lines, repos)
+	require.NoError(t, err)
+	require.Equal(t, []int{7, 27}, ret.AnnotationLines)
+	require.Equal(t, 2, len(ret.Changes))
+	autoMerge := true
+	require.Equal(t, LineHelmChange{
+		UpgradeInfo: UpgradeInfo{
+			Repository:        "https://cresta.github.io/gitdb/",
+			ChartName:         "gitdb",
+			CurrentVersion:    "0.1.25",
+			VersionConstraint: "0.x.x",
+			AutoMerge:         &autoMerge,
+		},
+		CurrentVersionLine:       `      version: "0.1.25" # pinned`,
+		CurrentVersionLineNumber: 15,
+		CurrentVersionOffset:     16,
+	}, *ret.Changes[0])
+	require.Equal(t, "0.1.20", ret.Changes[1].UpgradeInfo.CurrentVersion)
+	require.Equal(t, "0.1.x", ret.Changes[1].UpgradeInfo.VersionConstraint)
+	require.Equal(t, 25, ret.Changes[1].CurrentVersionLineNumber)
+
+	change, err := (&ChangeParser{}).LoadVersions(context.Background(), ret.Changes[0], &repo.IndexFile{
+		Entries: map[string]repo.ChartVersions{
+			"gitdb": {
+				{Metadata: &chart.Metadata{Version: "0.1.26"}},
+				{Metadata: &chart.Metadata{Version: "1.0.0"}},
+			},
+		},
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, `      version: "0.1.26" # pinned`, change.NewLine)
+}
+
+func TestParseHelmManifests_SourceRefWithoutNamespace(t *testing.T) {
+	// kustomize usually sets the namespace of the HelmRepository, so it is not in the file
+	repos := FindHelmRepositories(strings.Split(strings.Replace(testHelmRepository, "  namespace: flux-system\n", "", 1), "\n"))
+	require.Equal(t, HelmRepositories{"/cresta": "https://cresta.github.io/gitdb/"}, repos)
+	ret, err := ParseHelmManifests(strings.Split(testManifests, "\n"), repos)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(ret.Changes))
+	require.Equal(t, "https://cresta.github.io/gitdb/", ret.Changes[0].UpgradeInfo.Repository)
+	require.Empty(t, ret.UnresolvedSourceRefs)
+
+	ret, err = ParseHelmManifests(strings.Split(testManifests, "\n"), HelmRepositories{"flux-system/other": "https://example.com/"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(ret.Changes))
+	require.Equal(t, []string{"flux-system/cresta"}, ret.UnresolvedSourceRefs)
+
+	ambiguous := HelmRepositories{"a/cresta": "https://a.example.com/", "b/cresta": "https://b.example.com/"}
+	require.Equal(t, "", ambiguous.Lookup("flux-system", "cresta"))
+	require.Equal(t, "https://b.example.com/", ambiguous.Lookup("b", "cresta"))
+}
+
+func TestChangeParser_LoadVersionsDeclined(t *testing.T) {
+	change := &LineHelmChange{
+		UpgradeInfo: UpgradeInfo{
+			Repository:        "https://cresta.github.io/gitdb/",
+			ChartName:         "gitdb",
+			CurrentVersion:    "2.0.0",
+			VersionConstraint: ">= 2.0.0",
+		},
+		CurrentVersionLine:       "    version: 2.0.0",
+		CurrentVersionLineNumber: 11,
+	}
+	index := &repo.IndexFile{
+		Entries: map[string]repo.ChartVersions{
+			"gitdb": {
+				{Metadata: &chart.Metadata{Version: "2.5.0"}},
+				{Metadata: &chart.Metadata{Version: "3.0.0"}},
+			},
+		},
+	}
+	declined := map[string]bool{"3.0.0": true}
+	parser := &ChangeParser{Logger: testhelp.ZapTestingLogger(t)}
+	ctx := context.Background()
+	ret, err := parser.LoadVersions(ctx, change, index, func(version string) bool { return declined[version] })
+	require.NoError(t, err)
+	require.Equal(t, "2.5.0", ret.NewVersion)
+
+	declined["2.5.0"] = true
+	ret, err = parser.LoadVersions(ctx, change, index, func(version string) bool { return declined[version] })
+	require.NoError(t, err)
+	require.Nil(t, ret)
+
+	index.Entries["gitdb"] = append(index.Entries["gitdb"], &repo.ChartVersion{Metadata: &chart.Metadata{Version: "3.0.1"}})
+	ret, err = parser.LoadVersions(ctx, change, index, func(version string) bool { return declined[version] })
+	require.NoError(t, err)
+	require.Equal(t, "3.0.1", ret.NewVersion, "versions after a declined one are still proposed")
+}
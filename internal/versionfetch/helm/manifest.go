@@ -0,0 +1,290 @@
+package helm
+
+import (
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/annotation"
+	"gopkg.in/yaml.v3"
+)
+
+// HelmRepositories maps "namespace/name" of Flux HelmRepository objects to their URL
+type HelmRepositories map[string]string
+
+func helmRepositoryKey(namespace string, name string) string {
+	return namespace + "/" + name
+}
+
+// Lookup finds the URL of the HelmRepository namespace/name.  HelmRepository objects often get their namespace from
+// kustomize rather than their own metadata, so if there is no exact match a single HelmRepository called name in any
+// namespace is used instead.
+func (h HelmRepositories) Lookup(namespace string, name string) string {
+	if repoURL, exists := h[helmRepositoryKey(namespace, name)]; exists {
+		return repoURL
+	}
+	found := ""
+	for key, repoURL := range h {
+		if !strings.HasSuffix(key, "/"+name) || strings.Count(key, "/") != 1 {
+			continue
+		}
+		if found != "" && found != repoURL {
+			// Ambiguous: we cannot tell which namespace was meant
+			return ""
+		}
+		found = repoURL
+	}
+	return found
+}
+
+// ManifestParseResult are the chart references found in Flux HelmRelease and Argo CD Application documents
+type ManifestParseResult struct {
+	Changes []*LineHelmChange
+	// AnnotationLines are the line numbers of every autobot comment inside a recognized document.  These should not be
+	// given to ParseHelmReleaseYAML as well.
+	AnnotationLines []int
+	// UnresolvedSourceRefs are the "namespace/name" sourceRefs of annotated HelmReleases that match no HelmRepository
+	UnresolvedSourceRefs []string
+}
+
+type manifestDocument struct {
+	startLine int
+	lines     []string
+	root      *yaml.Node
+}
+
+// splitDocuments breaks a multi document YAML file on its "---" separators.  Documents that are not valid YAML
+// mappings are dropped.
+func splitDocuments(lines []string) []manifestDocument {
+	var ret []manifestDocument
+	start := 0
+	for idx := 0; idx <= len(lines); idx++ {
+		if idx < len(lines) && !isDocumentSeparator(lines[idx]) {
+			continue
+		}
+		docLines := lines[start:idx]
+		var root yaml.Node
+		if err := yaml.Unmarshal([]byte(strings.Join(docLines, "\n")), &root); err == nil && len(root.Content) == 1 && root.Content[0].Kind == yaml.MappingNode {
+			ret = append(ret, manifestDocument{
+				startLine: start,
+				lines:     docLines,
+				root:      root.Content[0],
+			})
+		}
+		start = idx + 1
+	}
+	return ret
+}
+
+func isDocumentSeparator(line string) bool {
+	return strings.TrimRight(line, " \t\r") == "---" || strings.HasPrefix(line, "--- ")
+}
+
+// mappingValue walks a path of keys through nested mappings
+func mappingValue(node *yaml.Node, path ...string) *yaml.Node {
+	for _, key := range path {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			if node.Content[idx].Value == key {
+				next = node.Content[idx+1]
+				break
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+func scalarValue(node *yaml.Node, path ...string) string {
+	n := mappingValue(node, path...)
+	if n == nil || n.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return n.Value
+}
+
+func (d *manifestDocument) apiGroup() string {
+	return strings.SplitN(scalarValue(d.root, "apiVersion"), "/", 2)[0]
+}
+
+func (d *manifestDocument) kind() string {
+	return scalarValue(d.root, "kind")
+}
+
+// FindHelmRepositories returns the Flux HelmRepository objects defined in the file
+func FindHelmRepositories(lines []string) HelmRepositories {
+	ret := make(HelmRepositories)
+	for _, doc := range splitDocuments(lines) {
+		if doc.apiGroup() != "source.toolkit.fluxcd.io" || doc.kind() != "HelmRepository" {
+			continue
+		}
+		name := scalarValue(doc.root, "metadata", "name")
+		repoURL := scalarValue(doc.root, "spec", "url")
+		if name == "" || repoURL == "" {
+			continue
+		}
+		ret[helmRepositoryKey(scalarValue(doc.root, "metadata", "namespace"), name)] = repoURL
+	}
+	return ret
+}
+
+type chartReference struct {
+	// sourceRef is the HelmRepository a Flux HelmRelease refers to
+	sourceRef   string
+	repository  string
+	chartName   string
+	versionNode *yaml.Node
+}
+
+// ParseHelmManifests understands Flux HelmRelease (helm.toolkit.fluxcd.io) and Argo CD Application documents.  A
+// document is only considered if it contains a "# gitops-autobot: changer=helm" comment, which carries the same keys
+// as for ParseHelmReleaseYAML.  Flux sourceRefs are resolved using repos.
+func ParseHelmManifests(lines []string, repos HelmRepositories) (*ManifestParseResult, error) {
+	var ret ManifestParseResult
+	for _, doc := range splitDocuments(lines) {
+		var refs []chartReference
+		switch {
+		case doc.apiGroup() == "helm.toolkit.fluxcd.io" && doc.kind() == "HelmRelease":
+			refs = fluxChartReferences(&doc, repos)
+		case doc.apiGroup() == "argoproj.io" && doc.kind() == "Application":
+			refs = argoChartReferences(&doc)
+		default:
+			continue
+		}
+		annotationLines, annotations := documentAnnotations(&doc)
+		if len(annotationLines) == 0 {
+			continue
+		}
+		ret.AnnotationLines = append(ret.AnnotationLines, annotationLines...)
+		for _, ref := range refs {
+			if ref.sourceRef != "" && ref.repository == "" {
+				ret.UnresolvedSourceRefs = append(ret.UnresolvedSourceRefs, ref.sourceRef)
+			}
+			change, err := ref.toChange(&doc, annotationLines, annotations)
+			if err != nil {
+				return nil, err
+			}
+			if change != nil {
+				ret.Changes = append(ret.Changes, change)
+			}
+		}
+	}
+	return &ret, nil
+}
+
+func fluxChartReferences(doc *manifestDocument, repos HelmRepositories) []chartReference {
+	chartSpec := mappingValue(doc.root, "spec", "chart", "spec")
+	sourceKind := scalarValue(chartSpec, "sourceRef", "kind")
+	if sourceKind != "" && sourceKind != "HelmRepository" {
+		return nil
+	}
+	namespace := scalarValue(chartSpec, "sourceRef", "namespace")
+	if namespace == "" {
+		namespace = scalarValue(doc.root, "metadata", "namespace")
+	}
+	name := scalarValue(chartSpec, "sourceRef", "name")
+	return []chartReference{
+		{
+			sourceRef:   helmRepositoryKey(namespace, name),
+			repository:  repos.Lookup(namespace, name),
+			chartName:   scalarValue(chartSpec, "chart"),
+			versionNode: mappingValue(chartSpec, "version"),
+		},
+	}
+}
+
+func argoChartReferences(doc *manifestDocument) []chartReference {
+	sources := make([]*yaml.Node, 0, 1)
+	if source := mappingValue(doc.root, "spec", "source"); source != nil {
+		sources = append(sources, source)
+	}
+	if multiSource := mappingValue(doc.root, "spec", "sources"); multiSource != nil && multiSource.Kind == yaml.SequenceNode {
+		sources = append(sources, multiSource.Content...)
+	}
+	ret := make([]chartReference, 0, len(sources))
+	for _, source := range sources {
+		ret = append(ret, chartReference{
+			repository:  scalarValue(source, "repoURL"),
+			chartName:   scalarValue(source, "chart"),
+			versionNode: mappingValue(source, "targetRevision"),
+		})
+	}
+	return ret
+}
+
+// documentAnnotations returns the (file relative) line numbers of each helm autobot comment in the document
+func documentAnnotations(doc *manifestDocument) ([]int, []map[string]string) {
+	var lineNumbers []int
+	var annotations []map[string]string
+	for idx, line := range doc.lines {
+		keys, isAnnotation := annotation.Parse(line)
+		if !isAnnotation || keys["changer"] != "helm" {
+			continue
+		}
+		lineNumbers = append(lineNumbers, doc.startLine+idx)
+		annotations = append(annotations, keys)
+	}
+	return lineNumbers, annotations
+}
+
+func (c *chartReference) toChange(doc *manifestDocument, annotationLines []int, annotations []map[string]string) (*LineHelmChange, error) {
+	if c.versionNode == nil || c.versionNode.Kind != yaml.ScalarNode || c.chartName == "" || c.repository == "" {
+		return nil, nil
+	}
+	lineNumber := doc.startLine + c.versionNode.Line - 1
+	// The closest annotation before the version wins, so multiple sources can be configured differently
+	keys := annotations[0]
+	for idx, annotationLine := range annotationLines {
+		if annotationLine < lineNumber {
+			keys = annotations[idx]
+		}
+	}
+	line := doc.lines[c.versionNode.Line-1]
+	offset := byteOffset(line, c.versionNode.Column-1)
+	if c.versionNode.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		offset++
+	}
+	if offset <= 0 || offset+len(c.versionNode.Value) > len(line) || line[offset:offset+len(c.versionNode.Value)] != c.versionNode.Value {
+		// Escaped or multi line scalars are not something we can safely rewrite in place
+		return nil, nil
+	}
+	change := LineHelmChange{
+		UpgradeInfo: UpgradeInfo{
+			Repository:        c.repository,
+			ChartName:         c.chartName,
+			CurrentVersion:    c.versionNode.Value,
+			VersionConstraint: keys["versionConstraint"],
+		},
+		CurrentVersionLine:       line,
+		CurrentVersionLineNumber: lineNumber,
+		CurrentVersionOffset:     offset,
+	}
+	var err error
+	if change.UpgradeInfo.AutoMerge, err = annotation.OptionalBool(keys, "autoMerge"); err != nil {
+		return nil, err
+	}
+	if change.UpgradeInfo.AutoApprove, err = annotation.OptionalBool(keys, "autoAccept"); err != nil {
+		return nil, err
+	}
+	// Version ranges (Flux allows "1.x") are not pinned versions, so there is nothing for us to bump
+	if _, err := semver.NewVersion(change.UpgradeInfo.CurrentVersion); err != nil {
+		return nil, nil
+	}
+	if !change.isValid() {
+		return nil, nil
+	}
+	return &change, nil
+}
+
+// byteOffset converts a rune column into a byte offset of line
+func byteOffset(line string, runeColumn int) int {
+	for byteIdx := range line {
+		if runeColumn == 0 {
+			return byteIdx
+		}
+		runeColumn--
+	}
+	return len(line)
+}
@@ -0,0 +1,192 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/annotation"
+	"github.com/cresta/gitops-autobot/internal/versionfetch/registry"
+	"github.com/goccy/go-yaml"
+)
+
+type UpgradeInfo struct {
+	RegistryURL       string
+	Repository        string
+	CurrentTag        string
+	VersionConstraint string
+	AutoMerge         *bool
+	AutoApprove       *bool
+}
+
+type LineImageChange struct {
+	UpgradeInfo           UpgradeInfo
+	CurrentTagLine        string
+	CurrentTagLineNumber  int
+	currentTagValueOffset int
+}
+
+func (c *LineImageChange) isValid() bool {
+	return c.CurrentTagLine != "" && c.CurrentTagLineNumber != 0 && c.UpgradeInfo.CurrentTag != "" &&
+		c.UpgradeInfo.VersionConstraint != "" && c.UpgradeInfo.Repository != "" && c.UpgradeInfo.RegistryURL != ""
+}
+
+// ParseImageYAML finds lines annotated with "# gitops-autobot: changer=image" and looks in the next 3 lines (at the same
+// indent) for either a full reference (image: ghcr.io/org/repo:1.2.3) or a split repository: and tag: pair
+func ParseImageYAML(lines []string) ([]*LineImageChange, error) {
+	ret := make([]*LineImageChange, 0, 3)
+	for idx, line := range lines {
+		keys, isAnnotation := annotation.Parse(line)
+		if !isAnnotation {
+			continue
+		}
+		if keys["changer"] != "image" {
+			continue
+		}
+		lineIndent := yamlIndent(line)
+		var thisChange LineImageChange
+		var repository string
+		for idx2 := idx + 1; idx2 <= idx+3 && idx2 < len(lines); idx2++ {
+			if yamlIndent(lines[idx2]) != lineIndent {
+				continue
+			}
+			v := make(map[string]string)
+			if err := yaml.Unmarshal([]byte(strings.TrimLeft(lines[idx2], " -")), &v); err != nil {
+				continue
+			}
+			if imageStr, exists := v["image"]; exists {
+				ref, err := registry.ParseReference(imageStr)
+				if err != nil || ref.Tag == "" {
+					continue
+				}
+				thisChange.UpgradeInfo.RegistryURL = ref.RegistryURL
+				thisChange.UpgradeInfo.Repository = ref.Repository
+				thisChange.UpgradeInfo.CurrentTag = ref.Tag
+				thisChange.CurrentTagLine = lines[idx2]
+				thisChange.CurrentTagLineNumber = idx2
+				thisChange.currentTagValueOffset = strings.LastIndex(lines[idx2], ":"+ref.Tag) + 1
+			}
+			if repoStr, exists := v["repository"]; exists {
+				repository = repoStr
+			}
+			if tag, exists := v["tag"]; exists {
+				thisChange.UpgradeInfo.CurrentTag = tag
+				thisChange.CurrentTagLine = lines[idx2]
+				thisChange.CurrentTagLineNumber = idx2
+				colon := strings.Index(lines[idx2], ":")
+				thisChange.currentTagValueOffset = colon + 1 + strings.Index(lines[idx2][colon+1:], tag)
+			}
+		}
+		if repoStr, exists := keys["repository"]; exists {
+			repository = repoStr
+		}
+		if repository != "" {
+			ref, err := registry.ParseReference(repository)
+			if err != nil {
+				return nil, fmt.Errorf("invalid repository %s: %w", repository, err)
+			}
+			thisChange.UpgradeInfo.RegistryURL = ref.RegistryURL
+			thisChange.UpgradeInfo.Repository = ref.Repository
+		}
+		if registryURL, exists := keys["registry"]; exists {
+			thisChange.UpgradeInfo.RegistryURL = strings.TrimSuffix(registryURL, "/")
+		}
+		if constraint, exists := keys["versionConstraint"]; exists {
+			thisChange.UpgradeInfo.VersionConstraint = constraint
+		}
+		autoMerge, err := annotation.OptionalBool(keys, "autoMerge")
+		if err != nil {
+			return nil, err
+		}
+		thisChange.UpgradeInfo.AutoMerge = autoMerge
+		autoApprove, err := annotation.OptionalBool(keys, "autoAccept")
+		if err != nil {
+			return nil, err
+		}
+		thisChange.UpgradeInfo.AutoApprove = autoApprove
+
+		if _, err := semver.NewConstraint(thisChange.UpgradeInfo.VersionConstraint); err != nil {
+			return nil, fmt.Errorf("invalid version constraint %s: %w", thisChange.UpgradeInfo.VersionConstraint, err)
+		}
+		if !thisChange.isValid() {
+			continue
+		}
+		if _, err := semver.NewVersion(thisChange.UpgradeInfo.CurrentTag); err != nil {
+			return nil, fmt.Errorf("invalid version tag %s: %w", thisChange.UpgradeInfo.CurrentTag, err)
+		}
+		ret = append(ret, &thisChange)
+	}
+	return ret, nil
+}
+
+func yamlIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " -"))
+}
+
+type TagLister interface {
+	ListTags(ctx context.Context, registryURL string, repository string) ([]string, error)
+}
+
+var _ TagLister = &registry.Client{}
+
+type ChangeParser struct {
+	Tags TagLister
+}
+
+type VersionChange struct {
+	PreviousLine string
+	NewLine      string
+	NewTag       string
+	LineNumber   int
+}
+
+// LoadVersions picks the highest tag of the image that satisfies the version constraint.  Tags that are not semantic
+// versions (latest, sha-abcdef, etc) are ignored.
+// LoadVersions finds the highest tag of the image of change that meets its constraint.  Tags declined returns true for
+// are skipped, if it is set.
+func (c *ChangeParser) LoadVersions(ctx context.Context, change *LineImageChange, declined func(tag string) bool) (*VersionChange, error) {
+	constraint, err := semver.NewConstraint(change.UpgradeInfo.VersionConstraint)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse constraint %s: %w", change.UpgradeInfo.VersionConstraint, err)
+	}
+	currentVersion, err := semver.NewVersion(change.UpgradeInfo.CurrentTag)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse current tag: %w", err)
+	}
+	tags, err := c.Tags.ListTags(ctx, change.UpgradeInfo.RegistryURL, change.UpgradeInfo.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tags: %w", err)
+	}
+	highestVersion := currentVersion
+	for _, t := range tags {
+		thisVersion, err := semver.NewVersion(t)
+		if err != nil {
+			continue
+		}
+		if !constraint.Check(thisVersion) {
+			continue
+		}
+		if thisVersion.GreaterThan(highestVersion) && declined != nil && declined(t) {
+			continue
+		}
+		if thisVersion.GreaterThan(highestVersion) {
+			highestVersion = thisVersion
+		}
+	}
+	if highestVersion == currentVersion {
+		return nil, nil
+	}
+	line := change.CurrentTagLine
+	start := change.currentTagValueOffset
+	end := start + len(change.UpgradeInfo.CurrentTag)
+	if start <= 0 || end > len(line) || line[start:end] != change.UpgradeInfo.CurrentTag {
+		return nil, fmt.Errorf("unable to find tag %s in line %s", change.UpgradeInfo.CurrentTag, line)
+	}
+	return &VersionChange{
+		PreviousLine: line,
+		NewLine:      line[:start] + highestVersion.Original() + line[end:],
+		NewTag:       highestVersion.Original(),
+		LineNumber:   change.CurrentTagLineNumber,
+	}, nil
+}
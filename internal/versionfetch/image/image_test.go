@@ -0,0 +1,40 @@
+package image
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testImageValues = `replicaCount: 1
+image:
+  # gitops-autobot: changer=image versionConstraint=1.x.x autoMerge=true
+  repository: ghcr.io/cresta/gitdb
+  tag: "1.2.3"
+sidecar:
+  # gitops-autobot: changer=image versionConstraint=~2.0
+  image: redis:2.0.1 # keep pinned to 2.0
+`
+
+func TestParseImageYAML(t *testing.T) {
+	ret, err := ParseImageYAML(strings.Split(testImageValues, "\n"))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(ret))
+	autoMerge := true
+	require.Equal(t, UpgradeInfo{
+		RegistryURL:       "https://ghcr.io",
+		Repository:        "cresta/gitdb",
+		CurrentTag:        "1.2.3",
+		VersionConstraint: "1.x.x",
+		AutoMerge:         &autoMerge,
+	}, ret[0].UpgradeInfo)
+	require.Equal(t, 4, ret[0].CurrentTagLineNumber)
+	require.Equal(t, UpgradeInfo{
+		RegistryURL:       "https://registry-1.docker.io",
+		Repository:        "library/redis",
+		CurrentTag:        "2.0.1",
+		VersionConstraint: "~2.0",
+	}, ret[1].UpgradeInfo)
+	require.Equal(t, 7, ret[1].CurrentTagLineNumber)
+}
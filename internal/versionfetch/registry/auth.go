@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// challenge is a parsed WWW-Authenticate header, like
+// Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:cresta/gitdb:pull"
+type challenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+func parseChallenge(header string) (challenge, error) {
+	header = strings.TrimSpace(header)
+	spaceIdx := strings.Index(header, " ")
+	if spaceIdx == -1 {
+		return challenge{Scheme: strings.ToLower(header)}, nil
+	}
+	ret := challenge{
+		Scheme: strings.ToLower(header[:spaceIdx]),
+		Params: make(map[string]string),
+	}
+	rest := header[spaceIdx+1:]
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		eqIdx := strings.Index(rest, "=")
+		if eqIdx == -1 {
+			return challenge{}, fmt.Errorf("invalid challenge parameter in %s", header)
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eqIdx]))
+		rest = rest[eqIdx+1:]
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			endIdx := strings.Index(rest[1:], `"`)
+			if endIdx == -1 {
+				return challenge{}, fmt.Errorf("unterminated quote in challenge %s", header)
+			}
+			val = rest[1 : endIdx+1]
+			rest = rest[endIdx+2:]
+		} else {
+			endIdx := strings.Index(rest, ",")
+			if endIdx == -1 {
+				endIdx = len(rest)
+			}
+			val = strings.TrimSpace(rest[:endIdx])
+			rest = rest[endIdx:]
+		}
+		ret.Params[key] = val
+	}
+	return ret, nil
+}
+
+type cachedToken struct {
+	token    string
+	expireAt time.Time
+}
+
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+func (t *tokenCache) get(key string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tok, exists := t.tokens[key]; exists && tok.expireAt.After(time.Now()) {
+		return tok.token
+	}
+	return ""
+}
+
+func (t *tokenCache) set(key string, token string, ttl time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens == nil {
+		t.tokens = make(map[string]cachedToken)
+	}
+	t.tokens[key] = cachedToken{
+		token:    token,
+		expireAt: time.Now().Add(ttl),
+	}
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// authorizationFor negotiates an Authorization header value for a request to reqURL that was rejected with the
+// WWW-Authenticate header challengeHeader
+func (c *Client) authorizationFor(ctx context.Context, reqURL string, challengeHeader string) (string, error) {
+	parsedURL, err := url.Parse(reqURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse url %s: %w", reqURL, err)
+	}
+	creds, hasCreds := c.Credentials[parsedURL.Host]
+	ch, err := parseChallenge(challengeHeader)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse challenge: %w", err)
+	}
+	switch ch.Scheme {
+	case "basic":
+		if !hasCreds {
+			return "", fmt.Errorf("registry %s requires basic auth, but no credentials are configured", parsedURL.Host)
+		}
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(creds.Username, creds.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported auth challenge %s", challengeHeader)
+	}
+	realm := ch.Params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge missing realm: %s", challengeHeader)
+	}
+	cacheKey := strings.Join([]string{realm, ch.Params["service"], ch.Params["scope"]}, "|")
+	if tok := c.tokens.get(cacheKey); tok != "" {
+		return "Bearer " + tok, nil
+	}
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse realm %s: %w", realm, err)
+	}
+	q := tokenURL.Query()
+	if service := ch.Params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	if scope := ch.Params["scope"]; scope != "" {
+		q.Set("scope", scope)
+	}
+	tokenURL.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to construct token request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	if hasCreds {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch token from %s: %w", realm, err)
+	}
+	defer func() {
+		c.Logger.IfErr(resp.Body.Close()).Warn(ctx, "unable to close http response body")
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("non 200 status code from token endpoint: %d", resp.StatusCode)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("unable to decode token response: %w", err)
+	}
+	tok := tr.Token
+	if tok == "" {
+		tok = tr.AccessToken
+	}
+	if tok == "" {
+		return "", fmt.Errorf("token endpoint %s returned no token", realm)
+	}
+	ttl := time.Duration(tr.ExpiresIn) * time.Second
+	if ttl <= 0 {
+		// The distribution spec says to assume 60 seconds when expires_in is not given
+		ttl = time.Minute
+	}
+	// Leave some slack so we don't use a token right as it expires
+	c.tokens.set(cacheKey, tok, ttl*9/10)
+	return "Bearer " + tok, nil
+}
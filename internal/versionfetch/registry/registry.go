@@ -0,0 +1,200 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cresta/gitops-autobot/internal/cache"
+	"github.com/cresta/zapctx"
+)
+
+const dockerHubRegistry = "https://registry-1.docker.io"
+
+// Reference is a parsed container image reference of the form [host/]repository[:tag]
+type Reference struct {
+	// RegistryURL is the base URL of the registry, including scheme
+	RegistryURL string
+	Repository  string
+	Tag         string
+}
+
+func (r Reference) String() string {
+	return fmt.Sprintf("%s/%s:%s", r.RegistryURL, r.Repository, r.Tag)
+}
+
+// ParseReference splits an image reference like ghcr.io/cresta/gitops-autobot:1.2.3 into its registry, repository and
+// tag.  References without a registry host are assumed to live on Docker Hub.
+func ParseReference(ref string) (Reference, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return Reference{}, fmt.Errorf("empty image reference")
+	}
+	if digestIdx := strings.Index(ref, "@"); digestIdx != -1 {
+		return Reference{}, fmt.Errorf("digest references are not supported: %s", ref)
+	}
+	var ret Reference
+	if lastSlash, lastColon := strings.LastIndex(ref, "/"), strings.LastIndex(ref, ":"); lastColon > lastSlash {
+		ret.Tag = ref[lastColon+1:]
+		ref = ref[:lastColon]
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ret.RegistryURL = "https://" + parts[0]
+		ret.Repository = parts[1]
+	} else {
+		ret.RegistryURL = dockerHubRegistry
+		ret.Repository = ref
+	}
+	if ret.RegistryURL == "https://docker.io" || ret.RegistryURL == "https://index.docker.io" {
+		ret.RegistryURL = dockerHubRegistry
+	}
+	if ret.RegistryURL == dockerHubRegistry && !strings.Contains(ret.Repository, "/") {
+		ret.Repository = "library/" + ret.Repository
+	}
+	return ret, nil
+}
+
+// Client talks to registries that implement the Docker Registry HTTP API v2 (which OCI distribution registries also do)
+type Client struct {
+	Client *http.Client
+	Logger *zapctx.Logger
+	Cache  cache.Cache
+	// Credentials are optional logins, keyed by registry host (ghcr.io, 123.dkr.ecr.us-west-2.amazonaws.com, etc)
+	Credentials map[string]BasicCredentials
+	// PlainHTTP are the registry hosts (localhost:5000, etc) that are reached over plain HTTP rather than HTTPS
+	PlainHTTP map[string]bool
+	tokens    tokenCache
+}
+
+type BasicCredentials struct {
+	Username string
+	Password string
+}
+
+type tagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// ListTags returns every tag of repository inside the registry at registryURL, following pagination links
+func (c *Client) ListTags(ctx context.Context, registryURL string, repository string) ([]string, error) {
+	registryURL = c.baseURL(strings.TrimSuffix(registryURL, "/"))
+	var ret []string
+	if err := c.Cache.GetOrSet(ctx, []byte("registry_tags:"+registryURL+"/"+repository), time.Minute*5, &ret, func(ctx context.Context) (interface{}, error) {
+		return c.listTagsNoCache(ctx, registryURL, repository)
+	}); err != nil {
+		return nil, fmt.Errorf("unable to load or get from cache: %w", err)
+	}
+	return ret, nil
+}
+
+// baseURL is registryURL over plain HTTP if its host is one of PlainHTTP.  Registry URLs made from image references
+// and OCI chart URLs always start with https://.
+func (c *Client) baseURL(registryURL string) string {
+	if host := strings.TrimPrefix(registryURL, "https://"); host != registryURL && c.PlainHTTP[host] {
+		return "http://" + host
+	}
+	return registryURL
+}
+
+func (c *Client) listTagsNoCache(ctx context.Context, registryURL string, repository string) ([]string, error) {
+	ret := make([]string, 0)
+	nextURL := registryURL + "/v2/" + repository + "/tags/list"
+	for nextURL != "" {
+		var page tagList
+		link, err := c.getJSON(ctx, nextURL, &page)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list tags for %s: %w", repository, err)
+		}
+		ret = append(ret, page.Tags...)
+		nextURL, err = resolveNextLink(nextURL, link)
+		if err != nil {
+			return nil, fmt.Errorf("unable to follow pagination link: %w", err)
+		}
+	}
+	return ret, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, reqURL string, into interface{}) (string, error) {
+	resp, err := c.get(ctx, reqURL, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challengeHeader := resp.Header.Get("WWW-Authenticate")
+		c.Logger.IfErr(resp.Body.Close()).Warn(ctx, "unable to close http response body")
+		authHeader, err := c.authorizationFor(ctx, reqURL, challengeHeader)
+		if err != nil {
+			return "", fmt.Errorf("unable to authenticate to registry: %w", err)
+		}
+		resp, err = c.get(ctx, reqURL, authHeader)
+		if err != nil {
+			return "", err
+		}
+	}
+	defer func() {
+		c.Logger.IfErr(resp.Body.Close()).Warn(ctx, "unable to close http response body")
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("non 200 status code: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(into); err != nil {
+		return "", fmt.Errorf("unable to decode response body: %w", err)
+	}
+	return resp.Header.Get("Link"), nil
+}
+
+func (c *Client) get(ctx context.Context, reqURL string, authHeader string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct request object: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch URL %s: %w", reqURL, err)
+	}
+	return resp, nil
+}
+
+// resolveNextLink parses a header like `</v2/foo/tags/list?n=100&last=bar>; rel="next"` relative to currentURL
+func resolveNextLink(currentURL string, linkHeader string) (string, error) {
+	if linkHeader == "" {
+		return "", nil
+	}
+	for _, link := range strings.Split(linkHeader, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		isNext := false
+		for _, param := range parts[1:] {
+			if strings.ReplaceAll(strings.TrimSpace(param), " ", "") == `rel="next"` {
+				isNext = true
+			}
+		}
+		if !isNext {
+			continue
+		}
+		target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		base, err := url.Parse(currentURL)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse url %s: %w", currentURL, err)
+		}
+		ref, err := url.Parse(target)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse link %s: %w", target, err)
+		}
+		return base.ResolveReference(ref).String(), nil
+	}
+	return "", nil
+}
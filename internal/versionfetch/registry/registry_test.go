@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/cache"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReference(t *testing.T) {
+	for ref, expected := range map[string]Reference{
+		"redis:6.2":                      {RegistryURL: "https://registry-1.docker.io", Repository: "library/redis", Tag: "6.2"},
+		"bitnami/redis":                  {RegistryURL: "https://registry-1.docker.io", Repository: "bitnami/redis"},
+		"ghcr.io/cresta/gitdb:v1.0.0":    {RegistryURL: "https://ghcr.io", Repository: "cresta/gitdb", Tag: "v1.0.0"},
+		"localhost:5000/team/app:1.2.3":  {RegistryURL: "https://localhost:5000", Repository: "team/app", Tag: "1.2.3"},
+		"docker.io/library/nginx:1.21.6": {RegistryURL: "https://registry-1.docker.io", Repository: "library/nginx", Tag: "1.21.6"},
+	} {
+		ret, err := ParseReference(ref)
+		require.NoError(t, err)
+		require.Equal(t, expected, ret, ref)
+	}
+}
+
+func TestClient_ListTagsBearerChallenge(t *testing.T) {
+	tokenRequests := 0
+	mux := http.NewServeMux()
+	var srv *httptest.Server
+	mux.HandleFunc("/token", func(writer http.ResponseWriter, request *http.Request) {
+		tokenRequests++
+		user, pass, ok := request.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "robot", user)
+		require.Equal(t, "hunter2", pass)
+		require.Equal(t, "test-registry", request.URL.Query().Get("service"))
+		require.Equal(t, "repository:charts/gitdb:pull", request.URL.Query().Get("scope"))
+		require.NoError(t, json.NewEncoder(writer).Encode(map[string]interface{}{
+			"token":      "sekret",
+			"expires_in": 300,
+		}))
+	})
+	mux.HandleFunc("/v2/charts/gitdb/tags/list", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Bearer sekret" {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="test-registry",scope="repository:charts/gitdb:pull"`)
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.NoError(t, json.NewEncoder(writer).Encode(map[string]interface{}{
+			"name": "charts/gitdb",
+			"tags": []string{"0.1.0", "0.2.0"},
+		}))
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+	c := &Client{
+		Client: srv.Client(),
+		Logger: testhelp.ZapTestingLogger(t),
+		Cache:  &cache.InMemoryCache{},
+		Credentials: map[string]BasicCredentials{
+			srv.Listener.Addr().String(): {Username: "robot", Password: "hunter2"},
+		},
+	}
+	ctx := context.Background()
+	tags, err := c.listTagsNoCache(ctx, srv.URL, "charts/gitdb")
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.1.0", "0.2.0"}, tags)
+	_, err = c.listTagsNoCache(ctx, srv.URL, "charts/gitdb")
+	require.NoError(t, err)
+	require.Equal(t, 1, tokenRequests, "token should be reused")
+}
+
+func TestClient_ListTagsPlainHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		require.Equal(t, "/v2/team/app/tags/list", request.URL.Path)
+		require.NoError(t, json.NewEncoder(writer).Encode(map[string]interface{}{
+			"name": "team/app",
+			"tags": []string{"1.2.3"},
+		}))
+	}))
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+	c := &Client{
+		Client:    srv.Client(),
+		Logger:    testhelp.ZapTestingLogger(t),
+		Cache:     &cache.InMemoryCache{},
+		PlainHTTP: map[string]bool{host: true},
+	}
+	ref, err := ParseReference(host + "/team/app:1.2.3")
+	require.NoError(t, err)
+	tags, err := c.ListTags(context.Background(), ref.RegistryURL, ref.Repository)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.2.3"}, tags)
+}
@@ -0,0 +1,170 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/slashcmd"
+	"github.com/cresta/zapctx"
+	"github.com/google/go-github/v29/github"
+	"go.uber.org/zap"
+)
+
+// maxPayloadSize is larger than any payload GitHub will send (they cap deliveries at 25MB)
+const maxPayloadSize = 25 << 20
+
+// Scheduler is told about work that a webhook made necessary.  GitopsBot implements it.
+type Scheduler interface {
+	TriggerRepo(owner string, name string, branch string)
+	TriggerPullRequests(owner string, name string, sel ghapp.PRSelector)
+	TriggerCommand(cmd slashcmd.Command)
+}
+
+// Handler receives GitHub webhook deliveries and schedules targeted work for them
+type Handler struct {
+	Secret    []byte
+	Scheduler Scheduler
+	Logger    *zapctx.Logger
+}
+
+func (h *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	payload, err := ioutil.ReadAll(io.LimitReader(request.Body, maxPayloadSize))
+	if err != nil {
+		h.Logger.IfErr(err).Warn(ctx, "unable to read webhook body")
+		http.Error(writer, "unable to read body", http.StatusBadRequest)
+		return
+	}
+	if err := VerifySignature(request.Header.Get("X-Hub-Signature-256"), payload, h.Secret); err != nil {
+		h.Logger.IfErr(err).Warn(ctx, "rejecting webhook")
+		http.Error(writer, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	eventType := github.WebHookType(request)
+	event, err := github.ParseWebHook(eventType, payload)
+	if err != nil {
+		// Events we do not know about are not an error: GitHub sends whatever the app is subscribed to
+		h.Logger.Debug(ctx, "unable to parse webhook", zap.String("event", eventType), zap.Error(err))
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	logger := h.Logger.With(zap.String("event", eventType), zap.String("delivery", github.DeliveryID(request)))
+	if h.schedule(event) {
+		logger.Debug(ctx, "scheduled work for webhook")
+		writer.WriteHeader(http.StatusAccepted)
+		return
+	}
+	logger.Debug(ctx, "nothing to do for webhook")
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// VerifySignature checks that header is the "sha256=<hex>" HMAC of payload with secret
+func VerifySignature(header string, payload []byte, secret []byte) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("no webhook secret configured")
+	}
+	if !strings.HasPrefix(header, "sha256=") {
+		return fmt.Errorf("missing or unsupported signature header")
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil {
+		return fmt.Errorf("unable to decode signature: %w", err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	if _, err := mac.Write(payload); err != nil {
+		return fmt.Errorf("unable to compute signature: %w", err)
+	}
+	if !hmac.Equal(expected, mac.Sum(nil)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// schedule turns a parsed event into work, returning true if there was any
+func (h *Handler) schedule(event interface{}) bool {
+	switch e := event.(type) {
+	case *github.PushEvent:
+		if !strings.HasPrefix(e.GetRef(), "refs/heads/") || e.GetDeleted() {
+			return false
+		}
+		repo := e.GetRepo()
+		h.Scheduler.TriggerRepo(repo.GetOwner().GetLogin(), repo.GetName(), strings.TrimPrefix(e.GetRef(), "refs/heads/"))
+		return true
+	case *github.PullRequestEvent:
+		switch e.GetAction() {
+		case "opened", "reopened", "synchronize", "edited", "ready_for_review", "labeled", "unlabeled":
+		default:
+			return false
+		}
+		return h.triggerPR(e.GetRepo(), e.GetNumber())
+	case *github.PullRequestReviewEvent:
+		if e.GetAction() != "submitted" {
+			return false
+		}
+		return h.triggerPR(e.GetRepo(), e.GetPullRequest().GetNumber())
+	case *github.CheckSuiteEvent:
+		if e.GetAction() != "completed" {
+			return false
+		}
+		prs := e.GetCheckSuite().PullRequests
+		for _, pr := range prs {
+			h.triggerPR(e.GetRepo(), pr.GetNumber())
+		}
+		if len(prs) == 0 {
+			// Suites of forks do not list pull requests, but still share the head commit
+			return h.triggerCommit(e.GetRepo(), e.GetCheckSuite().GetHeadSHA())
+		}
+		return true
+	case *github.IssueCommentEvent:
+		if e.GetAction() != "created" || !e.GetIssue().IsPullRequest() {
+			return false
+		}
+		verb, ok := slashcmd.Parse(e.GetComment().GetBody())
+		if !ok {
+			return false
+		}
+		h.Scheduler.TriggerCommand(slashcmd.Command{
+			Owner:     e.GetRepo().GetOwner().GetLogin(),
+			Name:      e.GetRepo().GetName(),
+			Number:    e.GetIssue().GetNumber(),
+			Commenter: e.GetComment().GetUser().GetLogin(),
+			Verb:      verb,
+		})
+		return true
+	case *github.StatusEvent:
+		if e.GetState() == "pending" {
+			return false
+		}
+		return h.triggerCommit(e.GetRepo(), e.GetSHA())
+	}
+	return false
+}
+
+func (h *Handler) triggerPR(repo *github.Repository, number int) bool {
+	if repo == nil || number == 0 {
+		return false
+	}
+	h.Scheduler.TriggerPullRequests(repo.GetOwner().GetLogin(), repo.GetName(), ghapp.PRSelector{
+		Number: number,
+	})
+	return true
+}
+
+func (h *Handler) triggerCommit(repo *github.Repository, sha string) bool {
+	if repo == nil || sha == "" {
+		return false
+	}
+	h.Scheduler.TriggerPullRequests(repo.GetOwner().GetLogin(), repo.GetName(), ghapp.PRSelector{
+		HeadOID: sha,
+	})
+	return true
+}
+
+var _ http.Handler = &Handler{}
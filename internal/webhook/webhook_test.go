@@ -0,0 +1,101 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cresta/gitops-autobot/internal/ghapp"
+	"github.com/cresta/gitops-autobot/internal/slashcmd"
+	"github.com/cresta/zapctx/testhelp/testhelp"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingScheduler struct {
+	repos    []string
+	prs      []string
+	commands []slashcmd.Command
+}
+
+func (r *recordingScheduler) TriggerCommand(cmd slashcmd.Command) {
+	r.commands = append(r.commands, cmd)
+}
+
+func (r *recordingScheduler) TriggerRepo(owner string, name string, branch string) {
+	r.repos = append(r.repos, owner+"/"+name+":"+branch)
+}
+
+func (r *recordingScheduler) TriggerPullRequests(owner string, name string, sel ghapp.PRSelector) {
+	if sel.HeadOID != "" {
+		r.prs = append(r.prs, owner+"/"+name+"@"+sel.HeadOID)
+		return
+	}
+	r.prs = append(r.prs, owner+"/"+name+"#"+strconv.Itoa(sel.Number))
+}
+
+func sign(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(payload))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliver(t *testing.T, h *Handler, event string, payload string, signature string) int {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(payload))
+	req.Header.Set("X-GitHub-Event", event)
+	req.Header.Set("X-Hub-Signature-256", signature)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+const testRepo = `"repository": {"name": "gitops", "owner": {"login": "cresta"}}`
+
+func TestHandler(t *testing.T) {
+	sched := &recordingScheduler{}
+	h := &Handler{
+		Secret:    []byte("hunter2"),
+		Scheduler: sched,
+		Logger:    testhelp.ZapTestingLogger(t),
+	}
+	send := func(event string, payload string) int {
+		return deliver(t, h, event, payload, sign("hunter2", payload))
+	}
+
+	push := `{"ref": "refs/heads/master", ` + testRepo + `}`
+	require.Equal(t, http.StatusUnauthorized, deliver(t, h, "push", push, sign("wrong", push)))
+	require.Equal(t, http.StatusUnauthorized, deliver(t, h, "push", push, ""))
+	require.Empty(t, sched.repos)
+
+	require.Equal(t, http.StatusAccepted, send("push", push))
+	require.Equal(t, http.StatusNoContent, send("push", `{"ref": "refs/tags/v1", `+testRepo+`}`))
+	require.Equal(t, []string{"cresta/gitops:master"}, sched.repos)
+
+	require.Equal(t, http.StatusAccepted, send("pull_request", `{"action": "synchronize", "number": 3, `+testRepo+`}`))
+	require.Equal(t, http.StatusNoContent, send("pull_request", `{"action": "closed", "number": 3, `+testRepo+`}`))
+	require.Equal(t, http.StatusAccepted, send("pull_request_review", `{"action": "submitted", "pull_request": {"number": 4}, `+testRepo+`}`))
+	require.Equal(t, http.StatusAccepted, send("check_suite", `{"action": "completed", "check_suite": {"head_sha": "abc", "pull_requests": [{"number": 5}]}, `+testRepo+`}`))
+	require.Equal(t, http.StatusAccepted, send("check_suite", `{"action": "completed", "check_suite": {"head_sha": "abc"}, `+testRepo+`}`))
+	require.Equal(t, http.StatusNoContent, send("status", `{"state": "pending", "sha": "def", `+testRepo+`}`))
+	require.Equal(t, http.StatusAccepted, send("status", `{"state": "success", "sha": "def", `+testRepo+`}`))
+	require.Equal(t, http.StatusNoContent, send("unknown_event", `{}`))
+	require.Equal(t, []string{"cresta/gitops#3", "cresta/gitops#4", "cresta/gitops#5", "cresta/gitops@abc", "cresta/gitops@def"}, sched.prs)
+
+	comment := `{"action": "created", "issue": {"number": 7, "pull_request": {"url": "x"}}, "comment": {"body": "lgtm\n/autobot Hold\n", "user": {"login": "jack"}}, ` + testRepo + `}`
+	require.Equal(t, http.StatusAccepted, send("issue_comment", comment))
+	require.Equal(t, http.StatusNoContent, send("issue_comment", `{"action": "created", "issue": {"number": 8}, "comment": {"body": "/autobot hold"}, `+testRepo+`}`))
+	require.Equal(t, http.StatusNoContent, send("issue_comment", `{"action": "created", "issue": {"number": 9, "pull_request": {"url": "x"}}, "comment": {"body": "hold please"}, `+testRepo+`}`))
+	require.Equal(t, []slashcmd.Command{{Owner: "cresta", Name: "gitops", Number: 7, Commenter: "jack", Verb: "hold"}}, sched.commands)
+}
+
+func TestVerifySignature(t *testing.T) {
+	require.NoError(t, VerifySignature(sign("s", "body"), []byte("body"), []byte("s")))
+	require.Error(t, VerifySignature(sign("s", "body"), []byte("body2"), []byte("s")))
+	require.Error(t, VerifySignature(sign("s", "body"), []byte("body"), nil))
+	require.Error(t, VerifySignature("sha1=abc", []byte("body"), []byte("s")))
+	require.Error(t, VerifySignature("sha256=zz", []byte("body"), []byte("s")))
+}